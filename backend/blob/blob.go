@@ -0,0 +1,54 @@
+// Package blob lưu nội dung các tệp người dùng tải lên, tách biệt với metadata trong store.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrNotFound được trả về khi key không tồn tại
+	ErrNotFound = errors.New("không tìm thấy tệp")
+	// ErrInvalidKey được trả về khi key rỗng hoặc có thể thoát ra ngoài vùng lưu trữ
+	ErrInvalidKey = errors.New("key của tệp không hợp lệ")
+)
+
+// Store định nghĩa các thao tác lưu trữ nội dung tệp mà mọi backend phải hỗ trợ.
+// Key là đường dẫn tương đối gồm các phần phân cách bởi "/", ví dụ "attachments/<id>".
+type Store interface {
+	// Put ghi đúng size byte đọc từ r vào key, ghi đè nếu key đã tồn tại.
+	// Người đọc không bao giờ thấy một tệp ghi dở.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open mở tệp để đọc. Object hỗ trợ Seek để phục vụ request Range mà không đọc lại từ đầu.
+	// Trả về ErrNotFound nếu key không tồn tại.
+	Open(ctx context.Context, key string) (Object, error)
+	// Delete xóa tệp, không lỗi nếu key không tồn tại
+	Delete(ctx context.Context, key string) error
+}
+
+// Object là nội dung một tệp đang mở
+type Object interface {
+	io.ReadSeekCloser
+	// Size là kích thước tệp tính bằng byte
+	Size() int64
+}
+
+// validKey chấp nhận key gồm các phần khác rỗng chỉ có chữ, số, '.', '-' và '_', không có phần "." hay ".."
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
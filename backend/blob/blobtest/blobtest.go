@@ -0,0 +1,152 @@
+// Package blobtest cung cấp bộ kiểm thử dùng chung cho mọi backend của package blob.
+//
+// LocalStore được kiểm tra với một thư mục tạm; S3Store được kiểm tra với FakeS3 hoặc một dịch vụ
+// tương thích S3 chạy cục bộ như MinIO, ví dụ:
+//
+//	blobtest.RunStoreTests(t, func(t *testing.T) blob.Store {
+//		s, err := blob.NewS3Store(blob.S3Config{Endpoint: "http://localhost:9000", Bucket: "test", ...})
+//		...
+//	})
+package blobtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"webchat/blob"
+)
+
+// ctx dùng cho mọi thao tác trong bộ kiểm thử
+var ctx = context.Background()
+
+// RunStoreTests chạy các kiểm thử hành vi của blob.Store. newStore phải trả về store rỗng
+// hoặc ít nhất không chứa các key bắt đầu bằng "blobtest/".
+func RunStoreTests(t *testing.T, newStore func(t *testing.T) blob.Store) {
+	t.Run("PutAndOpen", func(t *testing.T) {
+		s := newStore(t)
+		content := []byte("xin chào, đây là nội dung tệp")
+		if err := s.Put(ctx, "blobtest/put/file.txt", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		obj, err := s.Open(ctx, "blobtest/put/file.txt")
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer obj.Close()
+		if obj.Size() != int64(len(content)) {
+			t.Errorf("Size = %d, want %d", obj.Size(), len(content))
+		}
+		got, err := io.ReadAll(obj)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("content = %q, want %q", got, content)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		s := newStore(t)
+		for _, content := range []string{"phiên bản đầu tiên dài hơn", "bản mới"} {
+			if err := s.Put(ctx, "blobtest/overwrite", strings.NewReader(content), int64(len(content)), ""); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if got := readAll(t, s, "blobtest/overwrite"); got != "bản mới" {
+			t.Errorf("content after overwrite = %q, want %q", got, "bản mới")
+		}
+	})
+
+	t.Run("ShortReader", func(t *testing.T) {
+		s := newStore(t)
+		// Nội dung ngắn hơn size không được để lại tệp ghi dở
+		if err := s.Put(ctx, "blobtest/short", strings.NewReader("abc"), 10, ""); err == nil {
+			t.Errorf("Put with short reader succeeded, want error")
+		}
+		if _, err := s.Open(ctx, "blobtest/short"); !errors.Is(err, blob.ErrNotFound) {
+			t.Errorf("Open after failed Put = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		s := newStore(t)
+		content := "0123456789abcdefghij"
+		if err := s.Put(ctx, "blobtest/seek", strings.NewReader(content), int64(len(content)), ""); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		obj, err := s.Open(ctx, "blobtest/seek")
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer obj.Close()
+
+		// Cách http.ServeContent đọc một request Range: tìm kích thước, rồi đọc từng đoạn
+		if end, err := obj.Seek(0, io.SeekEnd); err != nil || end != int64(len(content)) {
+			t.Fatalf("Seek(0, SeekEnd) = %d, %v, want %d", end, err, len(content))
+		}
+		for _, r := range []struct {
+			offset, length int64
+		}{{10, 5}, {2, 3}, {15, 5}} {
+			if _, err := obj.Seek(r.offset, io.SeekStart); err != nil {
+				t.Fatalf("Seek(%d): %v", r.offset, err)
+			}
+			buf := make([]byte, r.length)
+			if _, err := io.ReadFull(obj, buf); err != nil {
+				t.Fatalf("ReadFull at %d: %v", r.offset, err)
+			}
+			if want := content[r.offset : r.offset+r.length]; string(buf) != want {
+				t.Errorf("read at %d = %q, want %q", r.offset, buf, want)
+			}
+		}
+		if n, err := obj.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Read at end = %d, %v, want 0, EOF", n, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put(ctx, "blobtest/delete", strings.NewReader("x"), 1, ""); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := s.Delete(ctx, "blobtest/delete"); err != nil {
+				t.Fatalf("Delete #%d: %v", i+1, err)
+			}
+		}
+		if _, err := s.Open(ctx, "blobtest/delete"); !errors.Is(err, blob.ErrNotFound) {
+			t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		s := newStore(t)
+		for _, key := range []string{"", "../escape", "blobtest/../../escape", "/absolute", "blobtest//double", "blobtest/space name"} {
+			if err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); !errors.Is(err, blob.ErrInvalidKey) {
+				t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+			}
+			if _, err := s.Open(ctx, key); !errors.Is(err, blob.ErrInvalidKey) {
+				t.Errorf("Open(%q) = %v, want ErrInvalidKey", key, err)
+			}
+		}
+	})
+}
+
+func readAll(t *testing.T, s blob.Store, key string) string {
+	t.Helper()
+	obj, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", key, err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("ReadAll(%q): %v", key, err)
+	}
+	return string(data)
+}
@@ -0,0 +1,119 @@
+package blobtest
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeS3 là một server S3 tối giản lưu object trong bộ nhớ, dùng thay cho MinIO khi kiểm thử S3Store:
+//
+//	server := httptest.NewServer(blobtest.NewFakeS3("test", "access-key"))
+//	defer server.Close()
+//	s, err := blob.NewS3Store(blob.S3Config{Endpoint: server.URL, Bucket: "test", PathStyle: true, ...})
+//
+// FakeS3 chỉ hỗ trợ URL dạng path-style, các thao tác PUT, GET (kể cả Range "bytes=N-" và "bytes=N-M"),
+// HEAD và DELETE trên object. Chữ ký không được tính lại, chỉ kiểm tra request có header chữ ký
+// AWS Signature Version 4 với đúng access key.
+type FakeS3 struct {
+	bucket      string
+	accessKeyID string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewFakeS3 tạo server giả lập một bucket rỗng
+func NewFakeS3(bucket, accessKeyID string) *FakeS3 {
+	return &FakeS3{
+		bucket:      bucket,
+		accessKeyID: accessKeyID,
+		objects:     make(map[string][]byte),
+	}
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+f.accessKeyID+"/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok || key == "" {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		// S3 từ chối nội dung ngắn hơn Content-Length và không tạo object
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, exists := f.objects[key]
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		start, end, ok := parseRange(r.Header.Get("Range"), int64(len(data)))
+		if !ok {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+		status := http.StatusOK
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+
+				strconv.FormatInt(end-1, 10)+"/"+strconv.Itoa(len(data)))
+			status = http.StatusPartialContent
+		}
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data[start:end])
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseRange đọc header Range dạng "bytes=N-" hoặc "bytes=N-M", trả về khoảng [start, end)
+func parseRange(header string, size int64) (start, end int64, ok bool) {
+	if header == "" {
+		return 0, size, true
+	}
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if last != "" {
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || lastByte < start {
+			return 0, 0, false
+		}
+		if lastByte+1 < size {
+			end = lastByte + 1
+		}
+	}
+	return start, end, true
+}
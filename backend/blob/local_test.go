@@ -0,0 +1,18 @@
+package blob_test
+
+import (
+	"testing"
+
+	"webchat/blob"
+	"webchat/blob/blobtest"
+)
+
+func TestLocalStore(t *testing.T) {
+	blobtest.RunStoreTests(t, func(t *testing.T) blob.Store {
+		s, err := blob.NewLocalStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewLocalStore: %v", err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,28 @@
+package blob_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"webchat/blob"
+	"webchat/blob/blobtest"
+)
+
+func TestS3Store(t *testing.T) {
+	blobtest.RunStoreTests(t, func(t *testing.T) blob.Store {
+		server := httptest.NewServer(blobtest.NewFakeS3("test", "access-key"))
+		t.Cleanup(server.Close)
+
+		s, err := blob.NewS3Store(blob.S3Config{
+			Endpoint:        server.URL,
+			Bucket:          "test",
+			AccessKeyID:     "access-key",
+			SecretAccessKey: "secret-key",
+			PathStyle:       true,
+		})
+		if err != nil {
+			t.Fatalf("NewS3Store: %v", err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,107 @@
+// Command migrate hiển thị và áp dụng các migration của backend lưu trữ.
+//
+// Cách dùng:
+//
+//	go run ./cmd/migrate status   # liệt kê migration đã áp dụng và đang chờ
+//	go run ./cmd/migrate up       # áp dụng các migration đang chờ
+//
+// Backend được chọn giống như server: DB_DRIVER=sqlite dùng SQLITE_PATH,
+// ngược lại kết nối MongoDB qua MONGODB_URI.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"webchat/store"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrator là phần chung của các store hỗ trợ migration
+type migrator interface {
+	Migrate() error
+	MigrationStatus() ([]store.MigrationStatus, error)
+}
+
+func main() {
+	if len(os.Args) != 2 || (os.Args[1] != "status" && os.Args[1] != "up") {
+		fmt.Fprintln(os.Stderr, "usage: migrate status|up")
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using default environment variables")
+	}
+
+	m, closeFn, err := openMigrator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeFn()
+
+	if os.Args[1] == "up" {
+		if err := m.Migrate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	statuses, err := m.MigrationStatus()
+	if err != nil {
+		log.Fatal(err)
+	}
+	printStatus(statuses)
+}
+
+func openMigrator() (migrator, func(), error) {
+	if os.Getenv("DB_DRIVER") == "sqlite" {
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "data/webchat.db"
+		}
+
+		db, err := store.OpenSQLiteDB(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store.NewSQLStore(db), func() { db.Close() }, nil
+	}
+
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017/webchat"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, nil, fmt.Errorf("could not connect to MongoDB: %w", err)
+	}
+
+	closeFn := func() { client.Disconnect(context.Background()) }
+	return store.NewMongoStore(client.Database("webchat")), closeFn, nil
+}
+
+func printStatus(statuses []store.MigrationStatus) {
+	pending := 0
+	for _, s := range statuses {
+		if s.Applied {
+			fmt.Printf("  [x] %3d %-30s applied %s\n", s.Version, s.Name, s.AppliedAt.Local().Format(time.RFC3339))
+		} else {
+			pending++
+			fmt.Printf("  [ ] %3d %-30s pending\n", s.Version, s.Name)
+		}
+	}
+	fmt.Printf("%d migration(s), %d pending\n", len(statuses), pending)
+}
@@ -26,11 +26,21 @@ type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
 	Name     string `json:"name" binding:"required"`
+	Device   string `json:"device" binding:"max=100"` // tên thiết bị hiển thị trong danh sách phiên, không bắt buộc
 }
 
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
+	Device   string `json:"device" binding:"max=100"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -40,13 +50,13 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	user, err := h.userService.CreateUser(req.Email, req.Password, req.Name)
+	user, err := h.userService.CreateUser(c.Request.Context(), req.Email, req.Password, req.Name)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	tokens, err := h.authService.GenerateTokenPair(user.ID)
+	tokens, err := h.authService.GenerateTokenPair(c.Request.Context(), user.ID, clientInfo(c, req.Device))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Lỗi tạo token"})
 		return
@@ -68,7 +78,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	log.Printf("Login attempt with email: %s", req.Email)
 
-	user, err := h.userService.GetUserByEmail(req.Email)
+	user, err := h.userService.GetUserByEmail(c.Request.Context(), req.Email)
 	if err != nil {
 		log.Printf("Login error - User not found: %s, error: %v", req.Email, err)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Email hoặc mật khẩu không đúng"})
@@ -81,7 +91,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	tokens, err := h.authService.GenerateTokenPair(user.ID)
+	tokens, err := h.authService.GenerateTokenPair(c.Request.Context(), user.ID, clientInfo(c, req.Device))
 	if err != nil {
 		log.Printf("Login error - Failed to generate tokens: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Lỗi tạo token", "details": err.Error()})
@@ -96,20 +106,34 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	})
 }
 
+// RefreshToken đổi refresh token lấy cặp token mới. Refresh token được gửi trong body
+// ({"refreshToken": ...}) hoặc trong header Authorization như trước đây.
 func (h *AuthHandler) RefreshToken(c *gin.Context) {
-	auth := c.GetHeader("Authorization")
-	if auth == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token không được cung cấp"})
-		return
+	var req RefreshTokenRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+			return
+		}
 	}
 
-	parts := strings.Split(auth, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token không hợp lệ"})
-		return
+	refreshToken := req.RefreshToken
+	if refreshToken == "" {
+		auth := c.GetHeader("Authorization")
+		if auth == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token không được cung cấp"})
+			return
+		}
+
+		parts := strings.Split(auth, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token không hợp lệ"})
+			return
+		}
+		refreshToken = parts[1]
 	}
 
-	tokens, err := h.authService.RefreshTokens(parts[1])
+	tokens, err := h.authService.RefreshTokens(c.Request.Context(), refreshToken, c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token không hợp lệ hoặc đã hết hạn"})
 		return
@@ -117,3 +141,27 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 
 	c.JSON(http.StatusOK, tokens)
 }
+
+// Logout thu hồi token của phiên hiện tại và đóng kết nối WebSocket của người dùng
+func (h *AuthHandler) Logout(c *gin.Context) {
+	// Body không bắt buộc: không có refresh token thì chỉ thu hồi access token
+	var req LogoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+			return
+		}
+	}
+
+	claims := c.MustGet("tokenClaims").(*services.TokenClaims)
+	if err := h.authService.Logout(c.Request.Context(), claims, req.RefreshToken); err != nil {
+		log.Printf("Logout error - Failed to revoke tokens: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Không thể đăng xuất"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Đăng xuất thành công",
+	})
+}
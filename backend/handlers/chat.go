@@ -1,10 +1,10 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
-	"time"
 
+	"webchat/models"
 	"webchat/services"
 
 	"github.com/gin-gonic/gin"
@@ -34,14 +34,68 @@ type CreateGroupConversationRequest struct {
 }
 
 type SendMessageRequest struct {
+	Content     string   `json:"content"`     // có thể bỏ trống khi tin nhắn có tệp đính kèm
+	ReplyTo     string   `json:"reply_to"`    // ID tin nhắn được trả lời, không bắt buộc
+	Attachments []string `json:"attachments"` // ID các tệp đã tải lên qua /files/upload
+	Kind        string   `json:"kind"`        // "text" (mặc định) hoặc "voice"
+}
+
+type EditMessageRequest struct {
 	Content string `json:"content" binding:"required"`
 }
 
+type DeleteMessageRequest struct {
+	Scope string `form:"scope"` // "me" (mặc định) hoặc "everyone"
+}
+
 type GetMessagesRequest struct {
 	Before string `form:"before"`
+	After  string `form:"after"`
+	Around string `form:"around"`
 	Limit  int64  `form:"limit,default=50"`
 }
 
+// pageRequest chuyển tham số truy vấn thành yêu cầu phân trang; ok = false khi dùng
+// nhiều hơn một trong before, after và around vì chúng loại trừ lẫn nhau
+func (r GetMessagesRequest) pageRequest() (req services.MessagePageRequest, ok bool) {
+	modes := 0
+	for _, cursor := range []string{r.Before, r.After, r.Around} {
+		if cursor != "" {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return services.MessagePageRequest{}, false
+	}
+	return services.MessagePageRequest{
+		Before: r.Before,
+		After:  r.After,
+		Around: r.Around,
+		Limit:  r.Limit,
+	}, true
+}
+
+// parseObjectIDs chuyển danh sách ID dạng hex sang ObjectID, ok = false nếu có ID không hợp lệ
+func parseObjectIDs(values []string) (ids []primitive.ObjectID, ok bool) {
+	ids = make([]primitive.ObjectID, 0, len(values))
+	for _, value := range values {
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+type GetConversationsRequest struct {
+	Cursor string `form:"cursor"`
+	Type   string `form:"type"`
+	Unread bool   `form:"unread"`
+	Name   string `form:"name"`
+	Limit  int64  `form:"limit,default=20"`
+}
+
 func (h *ChatHandler) CreatePersonalConversation(c *gin.Context) {
 	var req CreatePersonalConversationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -52,19 +106,23 @@ func (h *ChatHandler) CreatePersonalConversation(c *gin.Context) {
 	userID := c.MustGet("userID").(primitive.ObjectID)
 
 	// Kiểm tra người dùng tồn tại
-	_, err := h.userService.GetUserByID(req.UserID)
+	_, err := h.userService.GetUserByID(c.Request.Context(), req.UserID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Không tìm thấy người dùng"})
 		return
 	}
 
-	conv, err := h.chatService.CreatePersonalConversation(userID, req.UserID)
+	conv, err := h.chatService.CreatePersonalConversation(c.Request.Context(), userID, req.UserID)
+	if errors.Is(err, services.ErrUserBlocked) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, conv)
+	h.respondConversation(c, userID, conv)
 }
 
 func (h *ChatHandler) CreateGroupConversation(c *gin.Context) {
@@ -76,13 +134,24 @@ func (h *ChatHandler) CreateGroupConversation(c *gin.Context) {
 
 	userID := c.MustGet("userID").(primitive.ObjectID)
 
-	conv, err := h.chatService.CreateGroupConversation(req.Name, req.Image, userID, req.Participants)
+	conv, err := h.chatService.CreateGroupConversation(c.Request.Context(), req.Name, req.Image, userID, req.Participants)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.respondConversation(c, userID, conv)
+}
+
+// respondConversation trả về cuộc hội thoại kèm thông tin thành viên
+func (h *ChatHandler) respondConversation(c *gin.Context, userID primitive.ObjectID, conv *models.Conversation) {
+	response, err := h.chatService.ConversationResponse(c.Request.Context(), userID, conv)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, conv)
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *ChatHandler) SendMessage(c *gin.Context) {
@@ -99,9 +168,32 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 		return
 	}
 
-	msg, err := h.chatService.SendMessage(userID, convID, req.Content)
+	var replyToID primitive.ObjectID
+	if req.ReplyTo != "" {
+		if replyToID, err = primitive.ObjectIDFromHex(req.ReplyTo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn được trả lời không hợp lệ"})
+			return
+		}
+	}
+
+	attachmentIDs, ok := parseObjectIDs(req.Attachments)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tệp đính kèm không hợp lệ"})
+		return
+	}
+
+	msg, err := h.chatService.SendMessage(c.Request.Context(), userID, convID, req.Content, replyToID, attachmentIDs, models.MessageKind(req.Kind))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, services.ErrInvalidReplyTo), errors.Is(err, services.ErrEmptyMessage),
+			errors.Is(err, services.ErrInvalidAttachment), errors.Is(err, services.ErrTooManyAttachments),
+			errors.Is(err, services.ErrInvalidMessageKind), errors.Is(err, services.ErrInvalidVoiceMessage):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrUserBlocked):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -121,22 +213,95 @@ func (h *ChatHandler) GetMessages(c *gin.Context) {
 		return
 	}
 
-	before := time.Now()
-	if req.Before != "" {
-		before, err = time.Parse(time.RFC3339, req.Before)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Thời gian không hợp lệ"})
-			return
-		}
+	pageReq, ok := req.pageRequest()
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chỉ được dùng một trong before, after hoặc around"})
+		return
 	}
 
-	messages, err := h.chatService.GetMessages(convID, req.Limit, before)
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	page, err := h.chatService.GetMessages(c.Request.Context(), userID, convID, pageReq)
+	if errors.Is(err, services.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, messages)
+	c.JSON(http.StatusOK, page)
+}
+
+// EditMessage sửa nội dung tin nhắn của người gửi
+func (h *ChatHandler) EditMessage(c *gin.Context) {
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	msgID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	msg, err := h.chatService.EditMessage(c.Request.Context(), userID, msgID, req.Content)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotMessageSender), errors.Is(err, services.ErrEditWindowExpired),
+			errors.Is(err, services.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrVoiceMessageNotEditable), errors.Is(err, services.ErrEmptyMessage),
+			errors.Is(err, services.ErrMessageTooLong):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// DeleteMessage xóa tin nhắn ở phía người dùng hoặc thu hồi với mọi người
+func (h *ChatHandler) DeleteMessage(c *gin.Context) {
+	var req DeleteMessageRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = string(services.DeleteForMe)
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	msgID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	err = h.chatService.DeleteMessage(c.Request.Context(), userID, msgID, services.DeleteScope(req.Scope))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidDeleteScope):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrDeleteForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
 
 func (h *ChatHandler) MarkMessageAsRead(c *gin.Context) {
@@ -147,9 +312,16 @@ func (h *ChatHandler) MarkMessageAsRead(c *gin.Context) {
 		return
 	}
 
-	err = h.chatService.MarkMessageAsRead(msgID, userID)
+	err = h.chatService.MarkMessageAsRead(c.Request.Context(), msgID, userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, services.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -181,9 +353,16 @@ func (h *ChatHandler) BatchMarkMessagesAsRead(c *gin.Context) {
 	}
 
 	// Gọi service để đánh dấu hàng loạt
-	err := h.chatService.BatchMarkMessagesAsRead(messageIDs, userID)
+	err := h.chatService.BatchMarkMessagesAsRead(c.Request.Context(), messageIDs, userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, services.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -192,26 +371,35 @@ func (h *ChatHandler) BatchMarkMessagesAsRead(c *gin.Context) {
 
 // GetConversations lấy danh sách cuộc hội thoại của người dùng
 func (h *ChatHandler) GetConversations(c *gin.Context) {
-	userID := c.MustGet("userID").(primitive.ObjectID)
+	var req GetConversationsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
 
-	// Mặc định lấy 20 cuộc hội thoại gần nhất
-	limit := 20
-	if limitParam := c.Query("limit"); limitParam != "" {
-		// Nếu có tham số limit, convert sang số nguyên
-		_, err := fmt.Sscanf(limitParam, "%d", &limit)
-		if err != nil || limit <= 0 {
-			limit = 20
-		}
-		if limit > 50 {
-			limit = 50 // Giới hạn tối đa 50 cuộc hội thoại
-		}
+	convType := models.ConversationType(req.Type)
+	if convType != "" && convType != models.ConversationTypePersonal && convType != models.ConversationTypeGroup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Loại cuộc hội thoại không hợp lệ"})
+		return
 	}
 
-	conversations, err := h.chatService.GetConversations(userID, int64(limit))
+	userID := c.MustGet("userID").(primitive.ObjectID)
+
+	page, err := h.chatService.GetConversations(c.Request.Context(), userID, services.ConversationListRequest{
+		Cursor:     req.Cursor,
+		Type:       convType,
+		UnreadOnly: req.Unread,
+		NamePrefix: req.Name,
+		Limit:      req.Limit,
+	})
+	if errors.Is(err, services.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, conversations)
+	c.JSON(http.StatusOK, page)
 }
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// transferTimeout thay cho ReadTimeout/WriteTimeout 15s của server khi nhận hoặc gửi nội dung tệp lớn
+	transferTimeout = 10 * time.Minute
+	// multipartOverhead là phần dư cho boundary và header của multipart ngoài nội dung tệp
+	multipartOverhead = 64 << 10
+)
+
+type FileHandler struct {
+	fileService *services.FileService
+}
+
+func NewFileHandler(fileService *services.FileService) *FileHandler {
+	return &FileHandler{
+		fileService: fileService,
+	}
+}
+
+// Upload nhận tệp trong trường "file" của form multipart và trả về thông tin tệp để gắn vào tin nhắn
+func (h *FileHandler) Upload(c *gin.Context) {
+	// Không hỗ trợ gia hạn deadline (ví dụ khi chạy sau một ResponseWriter khác) thì giữ timeout của server
+	_ = http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(transferTimeout))
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.fileService.MaxSize()+multipartOverhead)
+
+	// Đọc trực tiếp từ multipart thay vì ParseMultipartForm để nội dung tệp chỉ được ghi ra đĩa một lần
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Yêu cầu phải có dạng multipart/form-data"})
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Thiếu tệp trong trường file"})
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondFileError(c, err)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		userID := c.MustGet("userID").(primitive.ObjectID)
+		attachment, err := h.fileService.UploadFile(c.Request.Context(), userID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			respondFileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, attachment.ToResponse())
+		return
+	}
+}
+
+// Download trả nội dung tệp cho người có quyền xem, hỗ trợ Range (để trình phát âm thanh, video tua được),
+// If-Range, If-None-Match và If-Modified-Since
+func (h *FileHandler) Download(c *gin.Context) {
+	id, ok := parseFileID(c)
+	if !ok {
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	attachment, object, err := h.fileService.OpenAttachment(c.Request.Context(), userID, id)
+	if err != nil {
+		respondFileError(c, err)
+		return
+	}
+	defer object.Close()
+
+	serveObject(c, object, attachment.ContentType, services.ContentDisposition(attachment), `"`+attachment.ID.Hex()+`"`, attachment.CreatedAt)
+}
+
+// Thumbnail trả ảnh thu nhỏ của tệp ảnh cho người có quyền xem tệp gốc
+func (h *FileHandler) Thumbnail(c *gin.Context) {
+	id, ok := parseFileID(c)
+	if !ok {
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	attachment, object, err := h.fileService.OpenThumbnail(c.Request.Context(), userID, id)
+	if err != nil {
+		respondFileError(c, err)
+		return
+	}
+	defer object.Close()
+
+	serveObject(c, object, attachment.ThumbnailType, "inline", `"`+attachment.ID.Hex()+`-thumbnail"`, attachment.CreatedAt)
+}
+
+func parseFileID(c *gin.Context) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tệp không hợp lệ"})
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
+
+// serveObject gửi nội dung object kèm các header bảo vệ chung cho mọi tệp người dùng tải lên.
+// Nội dung tệp không thay đổi sau khi tải lên nên etag chỉ cần dựa vào ID; http.ServeContent dùng nó
+// để trả 304 và để trả 206 cho request Range kèm If-Range.
+func serveObject(c *gin.Context, object io.ReadSeeker, contentType, disposition, etag string, modTime time.Time) {
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(transferTimeout))
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", disposition)
+	// Trình duyệt không được đoán lại loại tệp hay chạy script trong tệp được mở trực tiếp
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+	// Quyền xem có thể thay đổi nên trình duyệt phải hỏi lại server, nhận 304 nếu tệp không đổi
+	header.Set("Cache-Control", "private, no-cache")
+	header.Set("ETag", etag)
+
+	http.ServeContent(c.Writer, c.Request, "", modTime, object)
+}
+
+// respondFileError chuyển lỗi khi tải tệp lên hoặc về thành mã HTTP tương ứng
+func respondFileError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, services.ErrFileTooLarge), errors.As(err, &maxBytesErr):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": services.ErrFileTooLarge.Error()})
+	case errors.Is(err, services.ErrFileTypeNotAllowed):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrEmptyFile), errors.Is(err, services.ErrInvalidImage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAttachmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newObjectServer(t *testing.T, content []byte, etag string, modTime time.Time) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/object", func(c *gin.Context) {
+		serveObject(c, bytes.NewReader(content), "audio/ogg", `inline; filename="voice.ogg"`, etag, modTime)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServeObjectRange(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	const etag = `"65f0c0ffee0000000000abcd"`
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := newObjectServer(t, content, etag, modTime)
+
+	for _, tc := range []struct {
+		name         string
+		header       map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{
+			name:   "full content",
+			status: http.StatusOK,
+			body:   string(content),
+		},
+		{
+			name:         "range",
+			header:       map[string]string{"Range": "bytes=2-5"},
+			status:       http.StatusPartialContent,
+			body:         "2345",
+			contentRange: "bytes 2-5/20",
+		},
+		{
+			name:         "open-ended range",
+			header:       map[string]string{"Range": "bytes=15-"},
+			status:       http.StatusPartialContent,
+			body:         "fghij",
+			contentRange: "bytes 15-19/20",
+		},
+		{
+			name:         "suffix range",
+			header:       map[string]string{"Range": "bytes=-3"},
+			status:       http.StatusPartialContent,
+			body:         "hij",
+			contentRange: "bytes 17-19/20",
+		},
+		{
+			name:         "if-range matches",
+			header:       map[string]string{"Range": "bytes=0-0", "If-Range": etag},
+			status:       http.StatusPartialContent,
+			body:         "0",
+			contentRange: "bytes 0-0/20",
+		},
+		{
+			// Tệp đã khác bản client đang giữ thì trả toàn bộ nội dung
+			name:   "if-range does not match",
+			header: map[string]string{"Range": "bytes=0-0", "If-Range": `"other"`},
+			status: http.StatusOK,
+			body:   string(content),
+		},
+		{
+			name:         "unsatisfiable range",
+			header:       map[string]string{"Range": "bytes=50-60"},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:   "if-none-match",
+			header: map[string]string{"If-None-Match": etag},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "if-modified-since",
+			header: map[string]string{"If-Modified-Since": modTime.Add(time.Hour).Format(http.TimeFormat)},
+			status: http.StatusNotModified,
+		},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/object", nil)
+		if err != nil {
+			t.Fatalf("%s: NewRequest: %v", tc.name, err)
+		}
+		for key, value := range tc.header {
+			req.Header.Set(key, value)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: request: %v", tc.name, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: read body: %v", tc.name, err)
+		}
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+		if tc.status != http.StatusRequestedRangeNotSatisfiable && string(body) != tc.body {
+			t.Errorf("%s: body = %q, want %q", tc.name, body, tc.body)
+		}
+		if got := resp.Header.Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tc.name, got, tc.contentRange)
+		}
+		if tc.status == http.StatusOK || tc.status == http.StatusPartialContent {
+			if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("%s: Accept-Ranges = %q, want bytes", tc.name, got)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "audio/ogg" {
+				t.Errorf("%s: Content-Type = %q, want audio/ogg", tc.name, got)
+			}
+		}
+		if got := resp.Header.Get("ETag"); got != etag {
+			t.Errorf("%s: ETag = %q, want %q", tc.name, got, etag)
+		}
+	}
+}
+
+func TestServeObjectSecurityHeaders(t *testing.T) {
+	server := newObjectServer(t, []byte("<script>alert(1)</script>"), `"x"`, time.Now())
+	resp, err := server.Client().Get(server.URL + "/object")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+
+	for key, want := range map[string]string{
+		"Content-Type":            "audio/ogg",
+		"Content-Disposition":     `inline; filename="voice.ogg"`,
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Cache-Control":           "private, no-cache",
+	} {
+		if got := resp.Header.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
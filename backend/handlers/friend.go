@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxBatchFriendRequests giới hạn số lời mời được xử lý trong một yêu cầu hàng loạt
+const maxBatchFriendRequests = 50
+
+type FriendHandler struct {
+	friendService *services.FriendService
+}
+
+func NewFriendHandler(friendService *services.FriendService) *FriendHandler {
+	return &FriendHandler{
+		friendService: friendService,
+	}
+}
+
+type SendFriendRequestRequest struct {
+	UserID string `json:"userId" binding:"required"`
+}
+
+type BatchFriendRequestsRequest struct {
+	RequestIDs []string `json:"requestIds" binding:"required"`
+	Action     string   `json:"action" binding:"required"` // accept hoặc reject
+}
+
+// respondFriendError chuyển lỗi của các thao tác bạn bè thành mã HTTP tương ứng
+func respondFriendError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrFriendRequestNotFound),
+		errors.Is(err, services.ErrNotFriends):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrFriendRequestExists), errors.Is(err, services.ErrAlreadyFriends):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCannotFriendSelf), errors.Is(err, services.ErrInvalidFriendAction):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUserBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetFriends lấy danh sách bạn bè
+func (h *FriendHandler) GetFriends(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+
+	friends, err := h.friendService.ListFriends(c.Request.Context(), userID)
+	if err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"friends": friends})
+}
+
+// GetFriendRequests lấy các lời mời kết bạn đang chờ đã nhận và đã gửi
+func (h *FriendHandler) GetFriendRequests(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+
+	requests, err := h.friendService.ListFriendRequests(c.Request.Context(), userID)
+	if err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// SendFriendRequest gửi lời mời kết bạn, hoặc chấp nhận ngay nếu người kia đã gửi lời mời trước đó
+func (h *FriendHandler) SendFriendRequest(c *gin.Context) {
+	var req SendFriendRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	recipientID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID người dùng không hợp lệ"})
+		return
+	}
+
+	request, friend, err := h.friendService.SendFriendRequest(c.Request.Context(), userID, recipientID)
+	if err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	if friend != nil {
+		c.JSON(http.StatusOK, gin.H{"success": true, "request": request, "friend": friend})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"success": true, "request": request})
+}
+
+// AcceptFriendRequest chấp nhận lời mời kết bạn đã nhận
+func (h *FriendHandler) AcceptFriendRequest(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	requestID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID lời mời không hợp lệ"})
+		return
+	}
+
+	friend, err := h.friendService.AcceptFriendRequest(c.Request.Context(), userID, requestID)
+	if err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "requestId": requestID, "friend": friend})
+}
+
+// RejectFriendRequest từ chối lời mời kết bạn đã nhận
+func (h *FriendHandler) RejectFriendRequest(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	requestID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID lời mời không hợp lệ"})
+		return
+	}
+
+	if err := h.friendService.RejectFriendRequest(c.Request.Context(), userID, requestID); err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "requestId": requestID})
+}
+
+// BatchProcessFriendRequests chấp nhận hoặc từ chối nhiều lời mời kết bạn
+func (h *FriendHandler) BatchProcessFriendRequests(c *gin.Context) {
+	var req BatchFriendRequestsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+	if len(req.RequestIDs) > maxBatchFriendRequests {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quá nhiều lời mời trong một yêu cầu"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	requestIDs := make([]primitive.ObjectID, 0, len(req.RequestIDs))
+	for _, idStr := range req.RequestIDs {
+		requestID, err := primitive.ObjectIDFromHex(idStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ID lời mời không hợp lệ"})
+			return
+		}
+		requestIDs = append(requestIDs, requestID)
+	}
+
+	results, err := h.friendService.ProcessFriendRequests(c.Request.Context(), userID, requestIDs, req.Action)
+	if err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "results": results})
+}
+
+// RemoveFriend hủy kết bạn
+func (h *FriendHandler) RemoveFriend(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	friendID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID người dùng không hợp lệ"})
+		return
+	}
+
+	if err := h.friendService.RemoveFriend(c.Request.Context(), userID, friendID); err != nil {
+		respondFriendError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "friendId": friendID})
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ToggleReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required"`
+}
+
+// respondReactionError chuyển lỗi của các thao tác reaction thành mã HTTP tương ứng
+func respondReactionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidEmoji), errors.Is(err, services.ErrTooManyReactions):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotParticipant):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ToggleReaction thả emoji vào tin nhắn, hoặc gỡ nếu người dùng đã thả emoji đó
+func (h *ChatHandler) ToggleReaction(c *gin.Context) {
+	var req ToggleReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	msgID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	msg, err := h.chatService.ToggleReaction(c.Request.Context(), userID, msgID, req.Emoji)
+	if err != nil {
+		respondReactionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// ListReactions liệt kê những người đã thả từng emoji vào tin nhắn
+func (h *ChatHandler) ListReactions(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	msgID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	reactions, err := h.chatService.ListReactions(c.Request.Context(), userID, msgID)
+	if err != nil {
+		respondReactionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reactions": reactions})
+}
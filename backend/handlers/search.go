@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SearchMessagesRequest struct {
+	Query          string `form:"q"`
+	ConversationID string `form:"conversation_id"`
+	SenderID       string `form:"sender_id"`
+	Since          string `form:"since"` // RFC3339 hoặc YYYY-MM-DD (từ đầu ngày, giờ UTC)
+	Until          string `form:"until"` // RFC3339 (không gồm thời điểm này) hoặc YYYY-MM-DD (gồm cả ngày đó, giờ UTC)
+	HasAttachment  bool   `form:"has_attachment"`
+	Cursor         string `form:"cursor"`
+	Limit          int64  `form:"limit,default=20"`
+}
+
+// parseSearchTime đọc thời điểm dạng RFC3339 hoặc một ngày YYYY-MM-DD.
+// Với ngày, endOfDay = true trả về đầu ngày hôm sau để mốc until gồm trọn ngày đó.
+func parseSearchTime(value string, endOfDay bool) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, true
+}
+
+// SearchMessages tìm tin nhắn theo từ khóa trong các cuộc hội thoại người dùng tham gia
+func (h *ChatHandler) SearchMessages(c *gin.Context) {
+	var req SearchMessagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	searchReq := services.MessageSearchRequest{
+		Query:         req.Query,
+		HasAttachment: req.HasAttachment,
+		Cursor:        req.Cursor,
+		Limit:         req.Limit,
+	}
+	var err error
+	if req.ConversationID != "" {
+		if searchReq.ConversationID, err = primitive.ObjectIDFromHex(req.ConversationID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ID cuộc hội thoại không hợp lệ"})
+			return
+		}
+	}
+	if req.SenderID != "" {
+		if searchReq.SenderID, err = primitive.ObjectIDFromHex(req.SenderID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ID người gửi không hợp lệ"})
+			return
+		}
+	}
+	var ok bool
+	if searchReq.Since, ok = parseSearchTime(req.Since, false); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Thời gian since không hợp lệ"})
+		return
+	}
+	if searchReq.Until, ok = parseSearchTime(req.Until, true); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Thời gian until không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	page, err := h.chatService.SearchMessages(c.Request.Context(), userID, searchReq)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmptySearchQuery), errors.Is(err, services.ErrSearchQueryTooLong),
+			errors.Is(err, services.ErrInvalidCursor):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// clientInfo lấy thông tin thiết bị của yêu cầu đăng nhập
+func clientInfo(c *gin.Context, device string) services.ClientInfo {
+	return services.ClientInfo{
+		Device:    device,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+}
+
+// GetSessions lấy danh sách phiên đăng nhập của người dùng
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	claims := c.MustGet("tokenClaims").(*services.TokenClaims)
+
+	sessions, err := h.authService.ListSessions(c.Request.Context(), claims.UserID, claims.FamilyID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Không thể lấy danh sách phiên đăng nhập"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession đăng xuất một phiên đăng nhập, kể cả phiên hiện tại
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID phiên đăng nhập không hợp lệ"})
+		return
+	}
+
+	if err := h.authService.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Error revoking session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Không thể đăng xuất phiên đăng nhập"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "sessionId": sessionID})
+}
+
+// RevokeOtherSessions đăng xuất mọi thiết bị khác, giữ lại phiên hiện tại
+func (h *AuthHandler) RevokeOtherSessions(c *gin.Context) {
+	claims := c.MustGet("tokenClaims").(*services.TokenClaims)
+
+	revoked, err := h.authService.RevokeOtherSessions(c.Request.Context(), claims.UserID, claims.FamilyID)
+	if err != nil {
+		log.Printf("Error revoking other sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Không thể đăng xuất các thiết bị khác"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "revoked": revoked})
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SendThreadReplyRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+type ThreadNotificationsRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// respondThreadError chuyển lỗi của các thao tác trên thread thành mã HTTP tương ứng
+func respondThreadError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidThreadRoot), errors.Is(err, services.ErrInvalidCursor):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotParticipant), errors.Is(err, services.ErrUserBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// SendThreadReply gửi tin trả lời trong thread của tin nhắn
+func (h *ChatHandler) SendThreadReply(c *gin.Context) {
+	var req SendThreadReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	rootID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	msg, err := h.chatService.SendThreadReply(c.Request.Context(), userID, rootID, req.Content)
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// GetThreadMessages lấy tin nhắn gốc và một trang tin trả lời trong thread
+func (h *ChatHandler) GetThreadMessages(c *gin.Context) {
+	var req GetMessagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	rootID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	pageReq, ok := req.pageRequest()
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chỉ được dùng một trong before, after hoặc around"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	page, err := h.chatService.GetThreadMessages(c.Request.Context(), userID, rootID, pageReq)
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// FollowThread theo dõi thread của tin nhắn
+func (h *ChatHandler) FollowThread(c *gin.Context) {
+	h.setThreadFollow(c, true)
+}
+
+// UnfollowThread bỏ theo dõi thread của tin nhắn
+func (h *ChatHandler) UnfollowThread(c *gin.Context) {
+	h.setThreadFollow(c, false)
+}
+
+func (h *ChatHandler) setThreadFollow(c *gin.Context, follow bool) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	rootID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	if err := h.chatService.FollowThread(c.Request.Context(), userID, rootID, follow); err != nil {
+		respondThreadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// MarkThreadRead đánh dấu đã đọc mọi tin trả lời trong thread
+func (h *ChatHandler) MarkThreadRead(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	rootID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	if err := h.chatService.MarkThreadRead(c.Request.Context(), userID, rootID); err != nil {
+		respondThreadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SetThreadNotifications bật hoặc tắt việc nhận mọi tin trả lời trong thread của cuộc hội thoại
+func (h *ChatHandler) SetThreadNotifications(c *gin.Context) {
+	var req ThreadNotificationsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dữ liệu không hợp lệ"})
+		return
+	}
+
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	convID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID cuộc hội thoại không hợp lệ"})
+		return
+	}
+
+	if err := h.chatService.SetThreadNotifications(c.Request.Context(), userID, convID, *req.Enabled); err != nil {
+		respondThreadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 
@@ -25,11 +26,17 @@ type UpdateProfileRequest struct {
 	Avatar string `json:"avatar"`
 }
 
+type SearchUsersRequest struct {
+	Query  string `form:"q"`
+	Cursor string `form:"cursor"`
+	Limit  int64  `form:"limit,default=20"`
+}
+
 // GetProfile lấy thông tin cá nhân của người dùng
 func (h *UserHandler) GetProfile(c *gin.Context) {
 	userID := c.MustGet("userID").(primitive.ObjectID)
 
-	user, err := h.userService.GetUserByID(userID)
+	user, err := h.userService.GetUserByID(c.Request.Context(), userID)
 	if err != nil {
 		log.Printf("Error getting user profile: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -59,7 +66,7 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 	// Nếu tên không được cung cấp hoặc rỗng, lấy tên hiện tại
 	name := req.Name
 	if name == "" {
-		user, err := h.userService.GetUserByID(userID)
+		user, err := h.userService.GetUserByID(c.Request.Context(), userID)
 		if err != nil {
 			log.Printf("Error getting user for profile update: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -71,7 +78,7 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 		name = user.Name
 	}
 
-	updatedUser, err := h.userService.UpdateUser(userID, name, req.Avatar)
+	updatedUser, err := h.userService.UpdateUser(c.Request.Context(), userID, name, req.Avatar)
 	if err != nil {
 		log.Printf("Error updating user profile: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -83,3 +90,123 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 
 	c.JSON(http.StatusOK, updatedUser.ToResponse())
 }
+
+// SearchUsers tìm người dùng theo tên hoặc email
+func (h *UserHandler) SearchUsers(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+
+	var req SearchUsersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Dữ liệu không hợp lệ",
+			"code":  "INVALID_REQUEST",
+		})
+		return
+	}
+
+	page, err := h.userService.SearchUsers(c.Request.Context(), userID, req.Query, req.Cursor, req.Limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmptySearchQuery), errors.Is(err, services.ErrSearchQueryTooLong),
+			errors.Is(err, services.ErrInvalidCursor):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+				"code":  "INVALID_REQUEST",
+			})
+		default:
+			log.Printf("Error searching users: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Không thể tìm kiếm người dùng",
+				"code":  "SEARCH_FAILED",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetBlockedUsers lấy danh sách người dùng đã bị chặn
+func (h *UserHandler) GetBlockedUsers(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+
+	blocked, err := h.userService.ListBlockedUsers(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing blocked users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Không thể lấy danh sách chặn",
+			"code":  "BLOCK_LIST_FAILED",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocked": blocked})
+}
+
+// BlockUser chặn một người dùng
+func (h *UserHandler) BlockUser(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	blockedID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "ID người dùng không hợp lệ",
+			"code":  "INVALID_REQUEST",
+		})
+		return
+	}
+
+	if err := h.userService.BlockUser(c.Request.Context(), userID, blockedID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrCannotBlockSelf):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+				"code":  "INVALID_REQUEST",
+			})
+		case errors.Is(err, services.ErrUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+				"code":  "USER_NOT_FOUND",
+			})
+		default:
+			log.Printf("Error blocking user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Không thể chặn người dùng",
+				"code":  "BLOCK_FAILED",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "user_id": blockedID})
+}
+
+// UnblockUser bỏ chặn một người dùng
+func (h *UserHandler) UnblockUser(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	blockedID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "ID người dùng không hợp lệ",
+			"code":  "INVALID_REQUEST",
+		})
+		return
+	}
+
+	if err := h.userService.UnblockUser(c.Request.Context(), userID, blockedID); err != nil {
+		if errors.Is(err, services.ErrUserNotBlocked) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+				"code":  "NOT_BLOCKED",
+			})
+			return
+		}
+		log.Printf("Error unblocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Không thể bỏ chặn người dùng",
+			"code":  "UNBLOCK_FAILED",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "user_id": blockedID})
+}
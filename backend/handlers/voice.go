@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"webchat/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MarkMessagePlayed đánh dấu người dùng đã nghe tin nhắn thoại
+func (h *ChatHandler) MarkMessagePlayed(c *gin.Context) {
+	userID := c.MustGet("userID").(primitive.ObjectID)
+	msgID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID tin nhắn không hợp lệ"})
+		return
+	}
+
+	msg, err := h.chatService.MarkVoicePlayed(c.Request.Context(), userID, msgID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotVoiceMessage):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotParticipant):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"time"
+	"webchat/models"
+	"webchat/services"
 	"webchat/types"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +17,9 @@ import (
 // WebSocketHandler extends the basic functionality from types.WebSocketHandler
 type WebSocketHandler struct {
 	*types.WebSocketHandler
+	chatService   *services.ChatService   // Sẽ được set sau khi khởi tạo để tránh circular dependency
+	friendService *services.FriendService // Tương tự chatService
+	userService   *services.UserService   // Dùng để ẩn trạng thái online và đang gõ với người có quan hệ chặn
 }
 
 // NewWebSocketHandler creates a new WebSocket handler
@@ -23,9 +29,25 @@ func NewWebSocketHandler() *WebSocketHandler {
 	}
 }
 
+// SetChatService thiết lập chatService sau khi khởi tạo để tránh circular dependency
+func (h *WebSocketHandler) SetChatService(chatService *services.ChatService) {
+	h.chatService = chatService
+}
+
+// SetFriendService thiết lập friendService để báo trạng thái online cho bạn bè
+func (h *WebSocketHandler) SetFriendService(friendService *services.FriendService) {
+	h.friendService = friendService
+}
+
+// SetUserService thiết lập userService để kiểm tra danh sách chặn
+func (h *WebSocketHandler) SetUserService(userService *services.UserService) {
+	h.userService = userService
+}
+
 // HandleConnection handles a new WebSocket connection
 func (h *WebSocketHandler) HandleConnection(c *gin.Context) {
 	userID := c.MustGet("userID").(primitive.ObjectID)
+	claims := c.MustGet("tokenClaims").(*services.TokenClaims)
 
 	conn, err := h.Upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -33,40 +55,48 @@ func (h *WebSocketHandler) HandleConnection(c *gin.Context) {
 		return
 	}
 
-	h.Mutex.Lock()
-	h.Clients[userID] = conn
-	h.Mutex.Unlock()
+	// Mỗi tab hoặc thiết bị là một kết nối riêng, gắn với phiên của token để đóng đúng kết nối khi phiên bị thu hồi
+	client := types.NewClient(userID, claims.FamilyID, conn)
 
-	// Broadcast trạng thái online
-	h.broadcastUserStatus(userID, true)
+	// Broadcast trạng thái online khi đây là kết nối đầu tiên của người dùng
+	if h.AddClient(client) {
+		h.broadcastUserStatus(userID, true)
+		h.notifyFriends(userID, true)
+	}
 
 	// Khởi động heartbeat
-	go h.handleHeartbeat(userID, conn)
+	go h.handleHeartbeat(client)
+
+	// Context của request HTTP kết thúc ngay khi handler trả về, nên mỗi kết nối
+	// có context riêng, bị hủy khi kết nối đóng để dừng các thao tác database đang chạy
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// Xử lý tin nhắn
-	go h.handleMessages(userID, conn)
+	go h.handleMessages(ctx, cancel, client)
 }
 
-func (h *WebSocketHandler) handleHeartbeat(userID primitive.ObjectID, conn *websocket.Conn) {
+func (h *WebSocketHandler) handleHeartbeat(client *types.Client) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				h.handleDisconnect(userID)
+			if err := client.WriteMessage(websocket.PingMessage, nil); err != nil {
+				h.handleDisconnect(client)
 				return
 			}
 		}
 	}
 }
 
-func (h *WebSocketHandler) handleMessages(userID primitive.ObjectID, conn *websocket.Conn) {
-	defer h.handleDisconnect(userID)
+func (h *WebSocketHandler) handleMessages(ctx context.Context, cancel context.CancelFunc, client *types.Client) {
+	defer h.handleDisconnect(client)
+	defer cancel()
 
+	userID := client.UserID
 	for {
-		_, message, err := conn.ReadMessage()
+		_, message, err := client.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Lỗi websocket: %v", err)
@@ -82,29 +112,34 @@ func (h *WebSocketHandler) handleMessages(userID primitive.ObjectID, conn *webso
 
 		switch wsMessage.Type {
 		case types.EventTypeMessage:
-			h.handleNewMessage(userID, wsMessage.Payload)
+			h.handleNewMessage(ctx, client, wsMessage.Payload)
 		case types.EventTypeTyping:
 			h.handleTypingStatus(userID, wsMessage.Payload)
 		case types.EventTypeRead:
-			h.handleMessageRead(userID, wsMessage.Payload)
+			h.handleMessageRead(ctx, client, wsMessage.Payload)
+		case types.EventTypeMessagePlayed:
+			h.handleMessagePlayed(ctx, client, wsMessage.Payload)
 		}
 	}
 }
 
-func (h *WebSocketHandler) handleDisconnect(userID primitive.ObjectID) {
-	h.Mutex.Lock()
-	if conn, ok := h.Clients[userID]; ok {
-		conn.Close()
-		delete(h.Clients, userID)
-		delete(h.Typing, userID)
+func (h *WebSocketHandler) handleDisconnect(client *types.Client) {
+	// Người dùng chỉ offline khi kết nối cuối cùng của họ đóng
+	if !h.RemoveClient(client) {
+		return
 	}
-	h.Mutex.Unlock()
 
 	// Broadcast trạng thái offline
-	h.broadcastUserStatus(userID, false)
+	h.broadcastUserStatus(client.UserID, false)
+	h.notifyFriends(client.UserID, false)
 }
 
 func (h *WebSocketHandler) broadcastUserStatus(userID primitive.ObjectID, isOnline bool) {
+	peers, ok := h.blockPeers(userID)
+	if !ok {
+		return
+	}
+
 	message := types.WebSocketMessage{
 		Type: types.EventTypeOnline,
 		Payload: map[string]interface{}{
@@ -113,30 +148,110 @@ func (h *WebSocketHandler) broadcastUserStatus(userID primitive.ObjectID, isOnli
 		},
 	}
 
-	h.broadcastToAll(message)
+	h.broadcastToAll(message, peers...)
+}
+
+// blockPeers trả về những người có quan hệ chặn với userID, họ không nhận được trạng thái online
+// và đang gõ của userID. ok là false nếu không lấy được danh sách chặn, khi đó không nên gửi sự kiện.
+func (h *WebSocketHandler) blockPeers(userID primitive.ObjectID) ([]primitive.ObjectID, bool) {
+	if h.userService == nil {
+		return nil, true
+	}
+	peers, err := h.userService.BlockPeerIDs(context.Background(), userID)
+	if err != nil {
+		log.Printf("Lỗi lấy danh sách chặn: %v", err)
+		return nil, false
+	}
+	return peers, true
+}
+
+// notifyFriends gửi sự kiện friend_status tới bạn bè đang online của userID
+func (h *WebSocketHandler) notifyFriends(userID primitive.ObjectID, isOnline bool) {
+	if h.friendService == nil {
+		return
+	}
+	h.friendService.NotifyFriendStatus(context.Background(), userID, isOnline)
 }
 
-func (h *WebSocketHandler) broadcastToAll(message types.WebSocketMessage) {
+// broadcastToAll gửi message tới mọi người dùng đang online, trừ những người trong except
+func (h *WebSocketHandler) broadcastToAll(message types.WebSocketMessage, except ...primitive.ObjectID) {
 	payload, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Lỗi marshal message: %v", err)
 		return
 	}
 
+	skip := make(map[primitive.ObjectID]bool, len(except))
+	for _, userID := range except {
+		skip[userID] = true
+	}
+
 	h.Mutex.RLock()
 	defer h.Mutex.RUnlock()
 
-	for _, conn := range h.Clients {
-		if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
-			log.Printf("Lỗi gửi message: %v", err)
+	for userID, clients := range h.Clients {
+		if skip[userID] {
+			continue
+		}
+		for client := range clients {
+			if err := client.WriteMessage(websocket.TextMessage, payload); err != nil {
+				log.Printf("Lỗi gửi message: %v", err)
+			}
+		}
+	}
+}
+
+// handleNewMessage gửi tin nhắn qua ChatService với payload {conversation_id, content, reply_to, attachments}
+func (h *WebSocketHandler) handleNewMessage(ctx context.Context, client *types.Client, payload interface{}) {
+	data, ok := payload.(map[string]interface{})
+	if !ok || h.chatService == nil {
+		return
+	}
+
+	convIDStr, _ := data["conversation_id"].(string)
+	conversationID, err := primitive.ObjectIDFromHex(convIDStr)
+	if err != nil {
+		h.sendError(client, "ID cuộc hội thoại không hợp lệ")
+		return
+	}
+	content, _ := data["content"].(string)
+	kind, _ := data["kind"].(string)
+
+	var replyToID primitive.ObjectID
+	if replyToStr, _ := data["reply_to"].(string); replyToStr != "" {
+		if replyToID, err = primitive.ObjectIDFromHex(replyToStr); err != nil {
+			h.sendError(client, "ID tin nhắn được trả lời không hợp lệ")
+			return
+		}
+	}
+
+	rawAttachments, _ := data["attachments"].([]interface{})
+	attachmentIDs := make([]primitive.ObjectID, 0, len(rawAttachments))
+	for _, raw := range rawAttachments {
+		idStr, _ := raw.(string)
+		attachmentID, err := primitive.ObjectIDFromHex(idStr)
+		if err != nil {
+			h.sendError(client, "ID tệp đính kèm không hợp lệ")
+			return
 		}
+		attachmentIDs = append(attachmentIDs, attachmentID)
+	}
+
+	// Mọi kết nối của người gửi, kể cả kết nối này, nhận tin nhắn đã lưu qua sự kiện message trong outbox
+	if _, err := h.chatService.SendMessage(ctx, client.UserID, conversationID, content, replyToID, attachmentIDs, models.MessageKind(kind)); err != nil {
+		log.Printf("Lỗi gửi tin nhắn qua websocket: %v", err)
+		h.sendError(client, err.Error())
 	}
 }
 
-// Custom implementations of message handling
-func (h *WebSocketHandler) handleNewMessage(userID primitive.ObjectID, payload interface{}) {
-	// Implementation logic should be updated to reflect your business requirements
-	log.Printf("New message from user %s: %v", userID.Hex(), payload)
+// sendError gửi thông báo lỗi qua WebSocket cho kết nối đã gửi yêu cầu, không cho các tab khác của người dùng
+func (h *WebSocketHandler) sendError(client *types.Client, message string) {
+	client.Send(types.WebSocketMessage{
+		Type: types.EventTypeError,
+		Payload: map[string]interface{}{
+			"error": message,
+		},
+	})
 }
 
 func (h *WebSocketHandler) handleTypingStatus(userID primitive.ObjectID, payload interface{}) {
@@ -164,7 +279,11 @@ func (h *WebSocketHandler) handleTypingStatus(userID primitive.ObjectID, payload
 			h.Typing[userID][conversationID] = isTyping
 			h.Mutex.Unlock()
 
-			// Broadcast typing status to other users
+			// Broadcast typing status to other users, except those with a block in either direction
+			peers, ok := h.blockPeers(userID)
+			if !ok {
+				return
+			}
 			message := types.WebSocketMessage{
 				Type: types.EventTypeTyping,
 				Payload: map[string]interface{}{
@@ -173,12 +292,49 @@ func (h *WebSocketHandler) handleTypingStatus(userID primitive.ObjectID, payload
 					"is_typing":       isTyping,
 				},
 			}
-			h.broadcastToAll(message)
+			h.broadcastToAll(message, peers...)
+		}
+	}
+}
+
+// handleMessageRead đánh dấu đã đọc với payload {message_ids: [...]}
+func (h *WebSocketHandler) handleMessageRead(ctx context.Context, client *types.Client, payload interface{}) {
+	data, ok := payload.(map[string]interface{})
+	if !ok || h.chatService == nil {
+		return
+	}
+
+	rawIDs, _ := data["message_ids"].([]interface{})
+	messageIDs := make([]primitive.ObjectID, 0, len(rawIDs))
+	for _, raw := range rawIDs {
+		idStr, _ := raw.(string)
+		if msgID, err := primitive.ObjectIDFromHex(idStr); err == nil {
+			messageIDs = append(messageIDs, msgID)
 		}
 	}
+
+	if err := h.chatService.BatchMarkMessagesAsRead(ctx, messageIDs, client.UserID); err != nil {
+		log.Printf("Lỗi đánh dấu đã đọc qua websocket: %v", err)
+		h.sendError(client, err.Error())
+	}
 }
 
-func (h *WebSocketHandler) handleMessageRead(userID primitive.ObjectID, payload interface{}) {
-	// Implementation logic for marking messages as read
-	log.Printf("Message read by user %s: %v", userID.Hex(), payload)
+// handleMessagePlayed đánh dấu người dùng đã nghe tin nhắn thoại
+func (h *WebSocketHandler) handleMessagePlayed(ctx context.Context, client *types.Client, payload interface{}) {
+	data, ok := payload.(map[string]interface{})
+	if !ok || h.chatService == nil {
+		return
+	}
+
+	idStr, _ := data["message_id"].(string)
+	messageID, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		h.sendError(client, "ID tin nhắn không hợp lệ")
+		return
+	}
+
+	if _, err := h.chatService.MarkVoicePlayed(ctx, client.UserID, messageID); err != nil {
+		log.Printf("Lỗi đánh dấu đã nghe qua websocket: %v", err)
+		h.sendError(client, err.Error())
+	}
 }
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webchat/models"
+	"webchat/services"
+	"webchat/store"
+	"webchat/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newWebSocketServer chạy WebSocketHandler trên memory store. Người dùng của kết nối lấy từ query user
+// thay cho middleware xác thực.
+func newWebSocketServer(t *testing.T) (*httptest.Server, *WebSocketHandler, *services.ChatService, *store.MemoryStore) {
+	t.Helper()
+	memoryStore := store.NewMemoryStore()
+	timeouts := services.DefaultTimeouts()
+	wsHandler := NewWebSocketHandler()
+
+	authService := services.NewAuthService("test-secret", memoryStore, wsHandler.WebSocketHandler, timeouts)
+	userService := services.NewUserService(memoryStore, authService, timeouts)
+	authService.SetUserService(userService)
+	outbox := services.NewOutboxDispatcher(memoryStore, wsHandler.WebSocketHandler, time.Hour, timeouts)
+	outbox.Start()
+	t.Cleanup(outbox.Stop)
+	chatService := services.NewChatService(memoryStore, userService, nil, wsHandler.WebSocketHandler, outbox, services.DefaultMessagePolicy(), timeouts)
+	wsHandler.SetChatService(chatService)
+	wsHandler.SetUserService(userService)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ws", func(c *gin.Context) {
+		userID, err := primitive.ObjectIDFromHex(c.Query("user"))
+		if err != nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		c.Set("userID", userID)
+		c.Set("tokenClaims", &services.TokenClaims{UserID: userID, FamilyID: primitive.NewObjectID()})
+	}, wsHandler.HandleConnection)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, wsHandler, chatService, memoryStore
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, userID primitive.ObjectID) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?user=" + userID.Hex()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitForConnections chờ handler đăng ký đủ n kết nối của userID
+func waitForConnections(t *testing.T, h *WebSocketHandler, userID primitive.ObjectID, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.Mutex.RLock()
+		count := len(h.Clients[userID])
+		h.Mutex.RUnlock()
+		if count == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("user %s did not reach %d connections", userID.Hex(), n)
+}
+
+// readEvents đọc mọi sự kiện nhận được trong khoảng wait
+func readEvents(t *testing.T, conn *websocket.Conn, wait time.Duration) []types.WebSocketMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	var events []types.WebSocketMessage
+	for {
+		var event types.WebSocketMessage
+		if err := conn.ReadJSON(&event); err != nil {
+			return events
+		}
+		events = append(events, event)
+	}
+}
+
+func countEvents(events []types.WebSocketMessage, eventType string) int {
+	count := 0
+	for _, event := range events {
+		if event.Type == eventType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWebSocketMessageReachesEachConnectionOnce(t *testing.T) {
+	ctx := context.Background()
+	server, wsHandler, chatService, memoryStore := newWebSocketServer(t)
+
+	sender := &models.User{ID: primitive.NewObjectID(), Email: "sender@example.com", Name: "Sender"}
+	recipient := &models.User{ID: primitive.NewObjectID(), Email: "recipient@example.com", Name: "Recipient"}
+	for _, user := range []*models.User{sender, recipient} {
+		if err := memoryStore.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	conv, err := chatService.CreatePersonalConversation(ctx, sender.ID, recipient.ID)
+	if err != nil {
+		t.Fatalf("CreatePersonalConversation: %v", err)
+	}
+
+	origin := dialWebSocket(t, server, sender.ID)
+	other := dialWebSocket(t, server, sender.ID)
+	waitForConnections(t, wsHandler, sender.ID, 2)
+
+	if err := origin.WriteJSON(map[string]interface{}{
+		"type": types.EventTypeMessage,
+		"payload": map[string]interface{}{
+			"conversation_id": conv.ID.Hex(),
+			"content":         "xin chào",
+		},
+	}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	for name, conn := range map[string]*websocket.Conn{"origin": origin, "other": other} {
+		events := readEvents(t, conn, 500*time.Millisecond)
+		if got := countEvents(events, types.EventTypeMessage); got != 1 {
+			t.Errorf("%s connection got %d message events, want 1", name, got)
+		}
+		if got := countEvents(events, types.EventTypeError); got != 0 {
+			t.Errorf("%s connection got %d error events, want 0", name, got)
+		}
+	}
+}
+
+func TestWebSocketErrorReachesOnlyOrigin(t *testing.T) {
+	server, wsHandler, _, _ := newWebSocketServer(t)
+	userID := primitive.NewObjectID()
+
+	origin := dialWebSocket(t, server, userID)
+	other := dialWebSocket(t, server, userID)
+	waitForConnections(t, wsHandler, userID, 2)
+
+	if err := origin.WriteJSON(map[string]interface{}{
+		"type":    types.EventTypeMessage,
+		"payload": map[string]interface{}{"conversation_id": "invalid", "content": "xin chào"},
+	}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		conn *websocket.Conn
+		want int
+	}{
+		{name: "origin", conn: origin, want: 1},
+		{name: "other", conn: other, want: 0},
+	} {
+		events := readEvents(t, tc.conn, 300*time.Millisecond)
+		if got := countEvents(events, types.EventTypeError); got != tc.want {
+			t.Errorf("%s connection got %d error events, want %d", tc.name, got, tc.want)
+		}
+	}
+}
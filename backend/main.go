@@ -6,12 +6,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"webchat/blob"
 	"webchat/handlers"
 	"webchat/middleware"
 	"webchat/services"
+	"webchat/store"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -44,12 +47,17 @@ func main() {
 	var mongoClient *mongo.Client
 	useMock := os.Getenv("USE_MOCK_DB")
 
+	// DB_DRIVER=sqlite dùng file SQLite thay cho MongoDB và mock database
+	dbDriver := os.Getenv("DB_DRIVER")
+
 	// Sử dụng mock database mặc định nếu không có biến môi trường
 	if useMock == "" {
 		useMock = "true" // Sử dụng mock database mặc định
 	}
 
-	if useMock == "true" {
+	if dbDriver == "sqlite" {
+		db = nil
+	} else if useMock == "true" {
 		log.Println("Using mock database for development")
 		db = nil
 	} else {
@@ -84,19 +92,6 @@ func main() {
 		}
 	}
 
-	// Xử lý đóng kết nối MongoDB khi tắt server
-	if mongoClient != nil {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			log.Println("Closing MongoDB connection...")
-			mongoClient.Disconnect(context.Background())
-			log.Println("Application shutting down...")
-			os.Exit(0)
-		}()
-	}
-
 	// Khởi tạo các service
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
@@ -104,18 +99,98 @@ func main() {
 		log.Println("Warning: Using default JWT secret key. Set JWT_SECRET environment variable for production.")
 	}
 
-	authService := services.NewAuthService(jwtSecret)
-	userService := services.NewUserService(db, authService)
+	// Chọn backend lưu trữ: MongoDB nếu đã kết nối, ngược lại dùng bộ nhớ
+	var userStore store.UserStore
+	var chatStore store.ChatStore
+	var memoryStore *store.MemoryStore
+	var sqlStore *store.SQLStore
+	if dbDriver == "sqlite" {
+		sqlitePath := os.Getenv("SQLITE_PATH")
+		if sqlitePath == "" {
+			sqlitePath = "data/webchat.db"
+		}
+
+		var err error
+		sqlStore, err = store.OpenSQLiteStore(sqlitePath)
+		if err != nil {
+			log.Fatal("Could not open SQLite database: ", err)
+		}
+		log.Println("Using SQLite database at", sqlitePath)
+		userStore, chatStore = sqlStore, sqlStore
+	} else if db != nil {
+		mongoStore := store.NewMongoStore(db)
+		// Gửi tin nhắn dùng transaction, chỉ có trên replica set hoặc sharded cluster
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		supported, err := mongoStore.DetectTransactions(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Could not detect MongoDB transaction support:", err)
+		}
+		// Không có transaction thì các bước ghi của một thao tác có thể chỉ hoàn tất một phần,
+		// nên chỉ chạy như vậy khi được cho phép rõ ràng qua MONGODB_ALLOW_NO_TRANSACTIONS=true
+		if !supported {
+			if os.Getenv("MONGODB_ALLOW_NO_TRANSACTIONS") != "true" {
+				log.Fatal("MongoDB does not support transactions (not a replica set or sharded cluster). " +
+					"Use a replica set, or set MONGODB_ALLOW_NO_TRANSACTIONS=true to run without atomic writes")
+			}
+			log.Println("Warning: MongoDB is not a replica set, writes are not atomic and a failure can leave partial updates")
+		}
+		// Tạo index và áp dụng các migration còn thiếu trước khi nhận request
+		if err := mongoStore.Migrate(); err != nil {
+			log.Fatal("MongoDB migration failed: ", err)
+		}
+		userStore, chatStore = mongoStore, mongoStore
+	} else {
+		log.Println("Using in-memory store")
+		memoryStore = store.NewMemoryStore()
+		enableMemorySnapshots(memoryStore)
+		userStore, chatStore = memoryStore, memoryStore
+	}
+
+	// Giới hạn thời gian cho mỗi thao tác database, có thể chỉnh qua DB_READ_TIMEOUT/DB_WRITE_TIMEOUT
+	timeouts := services.DefaultTimeouts()
+	timeouts.Read = durationEnv("DB_READ_TIMEOUT", timeouts.Read)
+	timeouts.Write = durationEnv("DB_WRITE_TIMEOUT", timeouts.Write)
+
+	wsHandler := handlers.NewWebSocketHandler()
+
+	authService := services.NewAuthService(jwtSecret, userStore, wsHandler.WebSocketHandler, timeouts)
+	// Token đã thu hồi chỉ cần giữ tới khi hết hạn, TOKEN_CLEANUP_INTERVAL là chu kỳ dọn dẹp
+	authService.StartTokenCleanup(durationEnv("TOKEN_CLEANUP_INTERVAL", time.Hour))
+	userService := services.NewUserService(userStore, authService, timeouts)
 	// Thiết lập userService cho authService để tránh circular dependency
 	authService.SetUserService(userService)
 
-	wsHandler := handlers.NewWebSocketHandler()
-	chatService := services.NewChatService(db, wsHandler.WebSocketHandler)
+	if memoryStore != nil {
+		seedDemoUser(userService)
+	}
+
+	// Dispatcher gửi các sự kiện trong outbox, OUTBOX_POLL_INTERVAL là chu kỳ quét dự phòng
+	outbox := services.NewOutboxDispatcher(chatStore, wsHandler.WebSocketHandler,
+		durationEnv("OUTBOX_POLL_INTERVAL", time.Second), timeouts)
+	outbox.Start()
+
+	// MESSAGE_EDIT_WINDOW là thời gian sau khi gửi mà người gửi còn được sửa tin nhắn
+	messagePolicy := services.DefaultMessagePolicy()
+	messagePolicy.EditWindow = durationEnv("MESSAGE_EDIT_WINDOW", messagePolicy.EditWindow)
+
+	// FILE_MAX_SIZE là kích thước tối đa (byte) của một tệp tải lên
+	uploadPolicy := services.DefaultUploadPolicy()
+	uploadPolicy.MaxSize = sizeEnv("FILE_MAX_SIZE", uploadPolicy.MaxSize)
+	fileService := services.NewFileService(newBlobStore(), chatStore, uploadPolicy, timeouts)
+
+	chatService := services.NewChatService(chatStore, userService, fileService, wsHandler.WebSocketHandler, outbox, messagePolicy, timeouts)
+	wsHandler.SetChatService(chatService)
+	friendService := services.NewFriendService(chatStore, userService, wsHandler.WebSocketHandler, outbox, timeouts)
+	wsHandler.SetFriendService(friendService)
+	wsHandler.SetUserService(userService)
 
 	// Khởi tạo các handler
 	authHandler := handlers.NewAuthHandler(userService, authService)
 	chatHandler := handlers.NewChatHandler(chatService, userService)
 	userHandler := handlers.NewUserHandler(userService)
+	fileHandler := handlers.NewFileHandler(fileService)
+	friendHandler := handlers.NewFriendHandler(friendService)
 
 	// Khởi tạo middleware
 	authMiddleware := middleware.NewAuthMiddleware(authService)
@@ -145,7 +220,7 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{
 			"status":  "ok",
 			"message": "API is working",
-			"mock":    useMock == "true",
+			"mock":    memoryStore != nil,
 			"env":     ginMode,
 			"version": "1.0.0",
 		})
@@ -157,7 +232,7 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{
 			"status":  "ok",
 			"message": "API is working",
-			"mock":    useMock == "true",
+			"mock":    memoryStore != nil,
 			"env":     ginMode,
 			"version": "1.0.0",
 		})
@@ -173,6 +248,7 @@ func main() {
 	api.POST("/auth/register", authHandler.Register)
 	api.POST("/auth/login", authHandler.Login)
 	api.POST("/auth/refresh", authHandler.RefreshToken)
+	api.POST("/auth/logout", authMiddleware.RequireAuth(), authHandler.Logout)
 
 	// WebSocket endpoint - sử dụng WebSocketAuth thay vì RequireAuth
 	api.GET("/ws", authMiddleware.WebSocketAuth(), wsHandler.HandleConnection)
@@ -184,14 +260,55 @@ func main() {
 		// User endpoints
 		protected.GET("/users/profile", userHandler.GetProfile)
 		protected.PUT("/users/profile", userHandler.UpdateProfile)
+		protected.GET("/users/search", userHandler.SearchUsers)
+		protected.GET("/users/blocked", userHandler.GetBlockedUsers)
+		protected.POST("/users/:id/block", userHandler.BlockUser)
+		protected.DELETE("/users/:id/block", userHandler.UnblockUser)
+
+		// Session endpoints
+		protected.GET("/sessions", authHandler.GetSessions)
+		protected.DELETE("/sessions", authHandler.RevokeOtherSessions) // đăng xuất mọi thiết bị khác
+		protected.DELETE("/sessions/:id", authHandler.RevokeSession)
 
 		// Chat endpoints
 		protected.POST("/conversations/personal", chatHandler.CreatePersonalConversation)
 		protected.POST("/conversations/group", chatHandler.CreateGroupConversation)
 		protected.GET("/conversations/:id/messages", chatHandler.GetMessages)
 		protected.POST("/conversations/:id/messages", chatHandler.SendMessage)
+		protected.PATCH("/messages/:id", chatHandler.EditMessage)
+		protected.DELETE("/messages/:id", chatHandler.DeleteMessage)
 		protected.PUT("/messages/:id/read", chatHandler.MarkMessageAsRead)
+		protected.PUT("/messages/:id/played", chatHandler.MarkMessagePlayed)
 		protected.PUT("/messages/batch-read", chatHandler.BatchMarkMessagesAsRead)
+		protected.GET("/messages/:id/reactions", chatHandler.ListReactions)
+		protected.POST("/messages/:id/reactions", chatHandler.ToggleReaction)
+		protected.GET("/messages/:id/thread", chatHandler.GetThreadMessages)
+		protected.POST("/messages/:id/thread", chatHandler.SendThreadReply)
+		protected.PUT("/messages/:id/thread/follow", chatHandler.FollowThread)
+		protected.DELETE("/messages/:id/thread/follow", chatHandler.UnfollowThread)
+		protected.PUT("/messages/:id/thread/read", chatHandler.MarkThreadRead)
+		protected.PUT("/conversations/:id/thread-notifications", chatHandler.SetThreadNotifications)
+
+		// File endpoints
+		protected.POST("/files/upload", fileHandler.Upload)
+		protected.GET("/files/:id", fileHandler.Download)
+		protected.GET("/files/:id/thumbnail", fileHandler.Thumbnail)
+
+		// Friend endpoints
+		protected.GET("/friends", friendHandler.GetFriends)
+		protected.DELETE("/friends/:id", friendHandler.RemoveFriend)
+		protected.GET("/friends/requests", friendHandler.GetFriendRequests)
+		protected.POST("/friends/requests", friendHandler.SendFriendRequest)
+		protected.PUT("/friends/requests/batch", friendHandler.BatchProcessFriendRequests)
+		protected.PUT("/friends/requests/:id/accept", friendHandler.AcceptFriendRequest)
+		protected.PUT("/friends/requests/:id/reject", friendHandler.RejectFriendRequest)
+		// services/user.api.js của frontend gửi POST cho hai thao tác trên
+		protected.POST("/friends/requests/:id/accept", friendHandler.AcceptFriendRequest)
+		protected.POST("/friends/requests/:id/reject", friendHandler.RejectFriendRequest)
+
+		// Search endpoints
+		protected.GET("/search/messages", chatHandler.SearchMessages)
+
 		// Thêm route để lấy danh sách cuộc hội thoại
 		protected.GET("/conversations", chatHandler.GetConversations)
 	}
@@ -225,17 +342,130 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Đóng kết nối MongoDB nếu có
+	// Shutdown server: dừng nhận request mới và chờ các request đang chạy kết thúc
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Server forced to shutdown:", err)
+	}
+
+	// Dừng dispatcher trước khi đóng store, sự kiện chưa gửi sẽ được gửi ở lần chạy sau
+	outbox.Stop()
+	authService.Stop()
+
+	// Ghi snapshot cuối cùng của mock database
+	if memoryStore != nil {
+		if err := memoryStore.Close(); err != nil {
+			log.Println("Error saving memory store snapshot:", err)
+		}
+	}
+
+	// Đóng kết nối SQLite nếu có
+	if sqlStore != nil {
+		if err := sqlStore.Close(); err != nil {
+			log.Println("Error closing SQLite database:", err)
+		}
+	}
+
+	// Đóng kết nối MongoDB sau cùng, khi không còn request hay dispatcher nào dùng nó
 	if mongoClient != nil {
 		if err := mongoClient.Disconnect(ctx); err != nil {
-			log.Fatal("Error disconnecting from MongoDB:", err)
+			log.Println("Error disconnecting from MongoDB:", err)
 		}
 	}
 
-	// Shutdown server
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+	log.Println("Server exited properly")
+}
+
+// enableMemorySnapshots nạp và ghi định kỳ snapshot của mock database ra file
+// để dữ liệu không bị mất khi khởi động lại. Đặt MOCK_DB_SNAPSHOT=off để tắt.
+func enableMemorySnapshots(memoryStore *store.MemoryStore) {
+	path := os.Getenv("MOCK_DB_SNAPSHOT")
+	if path == "" {
+		path = "data/mock_db.bson"
+	}
+	if path == "off" {
+		return
 	}
 
-	log.Println("Server exited properly")
+	interval := durationEnv("MOCK_DB_SNAPSHOT_INTERVAL", 30*time.Second)
+
+	if err := memoryStore.EnableSnapshots(path, interval); err != nil {
+		log.Fatal("Could not load memory store snapshot: ", err)
+	}
+	log.Printf("Memory store snapshots enabled: %s every %s", path, interval)
+}
+
+// newBlobStore chọn nơi lưu nội dung tệp tải lên: BLOB_STORE=s3 dùng dịch vụ tương thích S3
+// (AWS S3, MinIO...) cấu hình qua các biến S3_*, mặc định lưu trên đĩa trong UPLOAD_DIR
+func newBlobStore() blob.Store {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		s3Store, err := blob.NewS3Store(blob.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+		})
+		if err != nil {
+			log.Fatal("Invalid S3 configuration: ", err)
+		}
+		log.Printf("Storing uploaded files in S3 bucket %s", os.Getenv("S3_BUCKET"))
+		return s3Store
+	}
+
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = "data/uploads"
+	}
+	localStore, err := blob.NewLocalStore(uploadDir)
+	if err != nil {
+		log.Fatal("Could not open upload directory: ", err)
+	}
+	log.Println("Storing uploaded files in", uploadDir)
+	return localStore
+}
+
+// sizeEnv đọc biến môi trường dạng số byte dương, dùng giá trị mặc định nếu không hợp lệ
+func sizeEnv(name string, defaultValue int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// durationEnv đọc biến môi trường dạng duration (ví dụ "5s", "1m"), dùng giá trị mặc định nếu không hợp lệ
+func durationEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// seedDemoUser tạo tài khoản demo mặc định để test với mock database
+func seedDemoUser(userService *services.UserService) {
+	ctx := context.Background()
+	if _, err := userService.GetUserByEmail(ctx, "demo@example.com"); err == nil {
+		return
+	}
+
+	demoUser, err := userService.CreateUser(ctx, "demo@example.com", "123456", "Người dùng Demo")
+	if err != nil {
+		log.Printf("Could not create demo user: %v", err)
+		return
+	}
+	log.Printf("Created demo user: %s with password: 123456", demoUser.Email)
 }
@@ -0,0 +1,138 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// WaveformLength là số cột của dạng sóng trả về cho client
+	WaveformLength = 64
+	// WaveformMax là giá trị của cột cao nhất
+	WaveformMax = 100
+
+	// opusRate là tần số mẫu của mốc thời gian trong Ogg Opus và WebM Opus, không phụ thuộc tần số gốc
+	opusRate = 48000
+)
+
+// ErrUnsupportedAudio được trả về khi không đọc được thời lượng của tệp âm thanh:
+// định dạng hoặc codec chưa được hỗ trợ, hoặc tệp bị hỏng
+var ErrUnsupportedAudio = errors.New("không đọc được thông tin của tệp âm thanh")
+
+// Audio là thông tin đọc được từ tệp âm thanh
+type Audio struct {
+	// ContentType là loại nội dung chính xác hơn kết quả của http.DetectContentType,
+	// ví dụ audio/ogg thay cho application/ogg để trình duyệt phát trực tiếp
+	ContentType string
+	Duration    time.Duration
+	// Waveform có WaveformLength giá trị từ 0 tới WaveformMax, chia đều theo thời gian
+	Waveform []int
+}
+
+// IsAudio cho biết ProcessAudio có thể đọc loại nội dung này hay không
+func IsAudio(contentType string) bool {
+	switch contentType {
+	case "audio/wave", "application/ogg", "video/webm":
+		return true
+	}
+	return false
+}
+
+// ProcessAudio đọc thời lượng và dạng sóng của tệp âm thanh.
+// Với WAV (PCM), dạng sóng là biên độ đỉnh của từng đoạn. Với Opus trong Ogg hoặc WebM và Vorbis trong Ogg,
+// dạng sóng được ước lượng từ lượng dữ liệu nén theo thời gian vì thư viện chuẩn không có bộ giải mã:
+// bộ mã hóa dùng nhiều byte hơn cho đoạn có tiếng và rất ít byte cho đoạn im lặng.
+func ProcessAudio(r io.ReaderAt, size int64, contentType string) (*Audio, error) {
+	switch contentType {
+	case "audio/wave":
+		return processWAV(r, size)
+	case "application/ogg":
+		return processOgg(r, size)
+	case "video/webm":
+		return processWebM(r, size)
+	}
+	return nil, ErrUnsupportedAudio
+}
+
+// span là một đoạn dữ liệu nén và khoảng thời gian nó mã hóa
+type span struct {
+	start, end time.Duration
+	bytes      int
+}
+
+// bitrateWaveform chia tổng thời lượng thành WaveformLength cột, mỗi cột là lượng dữ liệu nén trung bình
+// trong khoảng thời gian của cột. Dữ liệu của một đoạn được chia đều trên khoảng thời gian của đoạn đó.
+func bitrateWaveform(spans []span, total time.Duration) []int {
+	values := make([]float64, WaveformLength)
+	if total <= 0 {
+		return normalizeWaveform(values)
+	}
+	column := float64(total) / WaveformLength
+	for _, s := range spans {
+		if s.end <= s.start {
+			continue
+		}
+		density := float64(s.bytes) / float64(s.end-s.start)
+		first := int(float64(s.start) / column)
+		last := min(WaveformLength-1, int(float64(s.end)/column))
+		for i := max(first, 0); i <= last; i++ {
+			from := math.Max(float64(s.start), float64(i)*column)
+			to := math.Min(float64(s.end), float64(i+1)*column)
+			if to > from {
+				values[i] += density * (to - from)
+			}
+		}
+	}
+	return normalizeWaveform(values)
+}
+
+// normalizeWaveform đưa các giá trị về thang 0..WaveformMax theo giá trị lớn nhất,
+// để bản ghi âm nhỏ vẫn có dạng sóng dễ nhìn
+func normalizeWaveform(values []float64) []int {
+	peak := 0.0
+	for _, v := range values {
+		peak = math.Max(peak, v)
+	}
+	waveform := make([]int, len(values))
+	if peak == 0 {
+		return waveform
+	}
+	for i, v := range values {
+		waveform[i] = int(math.Round(v / peak * WaveformMax))
+	}
+	return waveform
+}
+
+// opusPacketDuration tính thời lượng của một gói Opus từ byte TOC (RFC 6716, mục 3.1), 0 nếu gói không hợp lệ
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+
+	// Thời lượng một frame, tính theo đơn vị 1/400 giây (2,5ms)
+	var frame int
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60ms
+		frame = []int{4, 8, 16, 24}[config%4]
+	case config < 16: // Hybrid: 10, 20ms
+		frame = []int{4, 8}[config%2]
+	default: // CELT: 2,5, 5, 10, 20ms
+		frame = []int{1, 2, 4, 8}[config%4]
+	}
+
+	frames := 1
+	switch toc & 0x3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return time.Duration(frame*frames) * time.Second / 400
+}
@@ -0,0 +1,555 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// wavFile tạo tệp WAV với chunk fmt cho trước, các chunk phụ đặt trước data và dữ liệu mẫu
+func wavFile(format, channels, sampleRate, bits int, data []byte, extra ...[]byte) []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], uint16(format))
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(sampleRate))
+	blockAlign := channels * bits / 8
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], uint16(bits))
+	if format == wavFormatExtensible {
+		// cbSize, valid bits, channel mask rồi SubFormat GUID bắt đầu bằng mã PCM
+		ext := make([]byte, 24)
+		binary.LittleEndian.PutUint16(ext[0:], 22)
+		binary.LittleEndian.PutUint16(ext[2:], uint16(bits))
+		binary.LittleEndian.PutUint16(ext[8:], wavFormatPCM)
+		fmtChunk = append(fmtChunk, ext...)
+	}
+
+	body := []byte("WAVE")
+	body = append(body, riffChunk("fmt ", fmtChunk)...)
+	for _, chunk := range extra {
+		body = append(body, chunk...)
+	}
+	body = append(body, riffChunk("data", data)...)
+	return riffChunk("RIFF", body)
+}
+
+// riffChunk tạo một chunk RIFF, đệm một byte nếu kích thước lẻ
+func riffChunk(id string, data []byte) []byte {
+	chunk := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// pcm16 tạo frames mẫu 16 bit cho mỗi kênh, im lặng ở nửa đầu và biên độ amplitude ở nửa sau
+func pcm16(frames, channels int, amplitude int16) []byte {
+	data := make([]byte, 0, frames*channels*2)
+	for i := 0; i < frames; i++ {
+		sample := int16(0)
+		if i >= frames/2 {
+			sample = amplitude
+			if i%2 == 1 {
+				sample = -amplitude
+			}
+		}
+		for c := 0; c < channels; c++ {
+			data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+		}
+	}
+	return data
+}
+
+// halfSilent kiểm tra dạng sóng im lặng ở nửa đầu và gần WaveformMax ở nửa sau. Cột giữa và cột cuối
+// được bỏ qua vì pre-skip của Opus làm dữ liệu lệch một chút so với ranh giới cột.
+func halfSilent(t *testing.T, name string, waveform []int) {
+	t.Helper()
+	if len(waveform) != WaveformLength {
+		t.Fatalf("%s: waveform length = %d, want %d", name, len(waveform), WaveformLength)
+	}
+	for i, v := range waveform {
+		if i < WaveformLength/2-1 && v > 10 {
+			t.Errorf("%s: waveform[%d] = %d in the quiet half", name, i, v)
+		}
+		if i > WaveformLength/2 && i < WaveformLength-1 && v < WaveformMax*9/10 {
+			t.Errorf("%s: waveform[%d] = %d in the loud half", name, i, v)
+		}
+	}
+}
+
+func TestProcessWAV(t *testing.T) {
+	pcm8 := make([]byte, 4000)
+	for i := range pcm8 {
+		pcm8[i] = 128
+		if i >= len(pcm8)/2 {
+			pcm8[i] = 255
+		}
+	}
+	pcm24 := make([]byte, 0, 3*8000)
+	for i := 0; i < 8000; i++ {
+		sample := int32(0)
+		if i >= 4000 {
+			sample = -1 << 22
+		}
+		pcm24 = append(pcm24, byte(sample), byte(sample>>8), byte(sample>>16))
+	}
+	float32s := make([]byte, 0, 4*2*16000)
+	for i := 0; i < 2*16000; i++ {
+		sample := float32(0)
+		if i >= 16000 {
+			sample = 0.5
+		}
+		float32s = binary.LittleEndian.AppendUint32(float32s, math.Float32bits(sample))
+	}
+	truncated := wavFile(wavFormatPCM, 1, 8000, 16, pcm16(16000, 1, 1000))
+	binary.LittleEndian.PutUint32(truncated[len(truncated)-len(pcm16(16000, 1, 1000))-4:], 0x7fffffff)
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		duration time.Duration
+	}{
+		{"16-bit mono", wavFile(wavFormatPCM, 1, 8000, 16, pcm16(16000, 1, 1000)), 2 * time.Second},
+		{"16-bit stereo", wavFile(wavFormatPCM, 2, 44100, 16, pcm16(22050, 2, 20000)), 500 * time.Millisecond},
+		{"8-bit", wavFile(wavFormatPCM, 1, 4000, 8, pcm8), time.Second},
+		{"24-bit", wavFile(wavFormatPCM, 1, 16000, 24, pcm24), 500 * time.Millisecond},
+		{"float", wavFile(wavFormatFloat, 2, 16000, 32, float32s), time.Second},
+		{"extensible", wavFile(wavFormatExtensible, 1, 8000, 16, pcm16(8000, 1, 1000)), time.Second},
+		// Chunk LIST có kích thước lẻ được đệm một byte trước chunk data
+		{"odd chunk before data", wavFile(wavFormatPCM, 1, 8000, 16, pcm16(8000, 1, 1000), riffChunk("LIST", []byte("INFOx"))), time.Second},
+		// Bản ghi dở khai báo data dài hơn phần thực có trong tệp
+		{"truncated data", truncated, 2 * time.Second},
+	} {
+		audio, err := ProcessAudio(bytes.NewReader(tc.data), int64(len(tc.data)), "audio/wave")
+		if err != nil {
+			t.Errorf("%s: ProcessAudio: %v", tc.name, err)
+			continue
+		}
+		if audio.ContentType != "audio/wave" {
+			t.Errorf("%s: content type = %q", tc.name, audio.ContentType)
+		}
+		if audio.Duration != tc.duration {
+			t.Errorf("%s: duration = %v, want %v", tc.name, audio.Duration, tc.duration)
+		}
+		halfSilent(t, tc.name, audio.Waveform)
+	}
+}
+
+func TestProcessWAVSilence(t *testing.T) {
+	data := wavFile(wavFormatPCM, 1, 8000, 16, make([]byte, 1600))
+	audio, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "audio/wave")
+	if err != nil {
+		t.Fatalf("ProcessAudio: %v", err)
+	}
+	if audio.Duration != 100*time.Millisecond {
+		t.Errorf("duration = %v, want 100ms", audio.Duration)
+	}
+	if len(audio.Waveform) != WaveformLength {
+		t.Fatalf("waveform length = %d, want %d", len(audio.Waveform), WaveformLength)
+	}
+	for i, v := range audio.Waveform {
+		if v != 0 {
+			t.Errorf("waveform[%d] = %d, want 0 for silence", i, v)
+		}
+	}
+}
+
+func TestProcessWAVUnsupported(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"not riff":      []byte("RIFX\x00\x00\x00\x00WAVE"),
+		"no data chunk": wavFile(wavFormatPCM, 1, 8000, 16, nil),
+		"no fmt chunk":  append([]byte("RIFF\x00\x00\x00\x00WAVE"), riffChunk("data", make([]byte, 100))...),
+		"adpcm":         wavFile(2, 1, 8000, 4, make([]byte, 100)),
+		"12-bit":        wavFile(wavFormatPCM, 1, 8000, 12, make([]byte, 100)),
+		"zero rate":     wavFile(wavFormatPCM, 1, 0, 16, make([]byte, 100)),
+		"partial frame": wavFile(wavFormatPCM, 2, 8000, 16, make([]byte, 3)),
+		"short fmt":     append([]byte("RIFF\x00\x00\x00\x00WAVE"), riffChunk("fmt ", make([]byte, 8))...),
+	} {
+		if _, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "audio/wave"); err != ErrUnsupportedAudio {
+			t.Errorf("%s: error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// oggCRC tính checksum của trang Ogg (CRC-32 đa thức 0x04c11db7, không đảo bit)
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// oggStream ghép các gói thành trang Ogg giống bộ mux thật: header mỗi gói một trang, gói âm thanh
+// được xếp tới tối đa maxSegments segment mỗi trang và gói dài có thể nằm vắt qua hai trang.
+// granules[i] là granule position sau gói âm thanh thứ i.
+func oggStream(serial uint32, headers, packets [][]byte, granules []int64, maxSegments int) []byte {
+	var out []byte
+	sequence := uint32(0)
+	writePage := func(headerType byte, granule int64, lacing, data []byte) {
+		page := []byte("OggS\x00")
+		page = append(page, headerType)
+		page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+		page = binary.LittleEndian.AppendUint32(page, serial)
+		page = binary.LittleEndian.AppendUint32(page, sequence)
+		page = append(page, 0, 0, 0, 0, byte(len(lacing)))
+		page = append(append(page, lacing...), data...)
+		binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+		out = append(out, page...)
+		sequence++
+	}
+
+	for i, header := range headers {
+		headerType := byte(0)
+		if i == 0 {
+			headerType = 0x02 // bắt đầu luồng
+		}
+		writePage(headerType, 0, packetLacing(len(header)), header)
+	}
+
+	var lacing, data []byte
+	granule := int64(-1)
+	continued := false
+	flush := func(last bool) {
+		headerType := byte(0)
+		if continued {
+			headerType |= 0x01
+		}
+		if last {
+			headerType |= 0x04
+		}
+		writePage(headerType, granule, lacing, data)
+		lacing, data, granule = nil, nil, -1
+	}
+	for i, packet := range packets {
+		segments := packetLacing(len(packet))
+		for len(segments) > 0 {
+			if len(lacing) == maxSegments {
+				flush(false)
+				continued = true
+			}
+			n := min(len(segments), maxSegments-len(lacing))
+			size := 0
+			for _, s := range segments[:n] {
+				size += int(s)
+			}
+			lacing = append(lacing, segments[:n]...)
+			data = append(data, packet[:size]...)
+			segments, packet = segments[n:], packet[size:]
+		}
+		continued = false
+		granule = granules[i]
+	}
+	flush(true)
+	return out
+}
+
+// packetLacing trả về bảng lacing của một gói dài size byte
+func packetLacing(size int) []byte {
+	lacing := bytes.Repeat([]byte{255}, size/255)
+	return append(lacing, byte(size%255))
+}
+
+// opusPackets tạo count gói CELT 20ms; nửa đầu rất ngắn như đoạn im lặng, nửa sau dài như đoạn có tiếng
+func opusPackets(count int) [][]byte {
+	packets := make([][]byte, count)
+	for i := range packets {
+		size := 3
+		if i >= count/2 {
+			size = 300
+		}
+		packets[i] = make([]byte, size)
+		packets[i][0] = 31 << 3 // CELT fullband 20ms, một frame
+	}
+	return packets
+}
+
+func opusHead(preSkip int) []byte {
+	head := []byte("OpusHead\x01\x01\x00\x00\x80\xbb\x00\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint16(head[10:], uint16(preSkip))
+	return head
+}
+
+// oggOpusFile tạo tệp Ogg Opus dài count*20ms với pre-skip 312 mẫu
+func oggOpusFile(count, maxSegments int) []byte {
+	const preSkip = 312
+	granules := make([]int64, count)
+	for i := range granules {
+		granules[i] = preSkip + int64(i+1)*960
+	}
+	headers := [][]byte{opusHead(preSkip), []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00")}
+	return oggStream(0x1234, headers, opusPackets(count), granules, maxSegments)
+}
+
+func TestProcessOggOpus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		duration time.Duration
+	}{
+		{"one packet per page", oggOpusFile(100, 2), 2 * time.Second},
+		// Gói 300 byte cần 2 segment nên bị chia qua hai trang khi mỗi trang chỉ có 3 segment
+		{"packets across pages", oggOpusFile(100, 3), 2 * time.Second},
+		{"many packets per page", oggOpusFile(250, 255), 5 * time.Second},
+	} {
+		audio, err := ProcessAudio(bytes.NewReader(tc.data), int64(len(tc.data)), "application/ogg")
+		if err != nil {
+			t.Errorf("%s: ProcessAudio: %v", tc.name, err)
+			continue
+		}
+		if audio.ContentType != "audio/ogg" {
+			t.Errorf("%s: content type = %q, want audio/ogg", tc.name, audio.ContentType)
+		}
+		if audio.Duration != tc.duration {
+			t.Errorf("%s: duration = %v, want %v", tc.name, audio.Duration, tc.duration)
+		}
+		halfSilent(t, tc.name, audio.Waveform)
+	}
+}
+
+func TestProcessOggVorbis(t *testing.T) {
+	ident := make([]byte, 30)
+	copy(ident, "\x01vorbis")
+	binary.LittleEndian.PutUint32(ident[12:], 8000)
+	headers := [][]byte{ident, []byte("\x03vorbis"), []byte("\x05vorbis")}
+	packets := make([][]byte, 20)
+	granules := make([]int64, 20)
+	for i := range packets {
+		packets[i] = make([]byte, 10)
+		if i >= 10 {
+			packets[i] = make([]byte, 400)
+		}
+		granules[i] = int64(i+1) * 400
+	}
+	data := oggStream(7, headers, packets, granules, 2)
+
+	audio, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "application/ogg")
+	if err != nil {
+		t.Fatalf("ProcessAudio: %v", err)
+	}
+	if audio.Duration != time.Second {
+		t.Errorf("duration = %v, want 1s", audio.Duration)
+	}
+	halfSilent(t, "vorbis", audio.Waveform)
+}
+
+func TestProcessOggUnsupported(t *testing.T) {
+	valid := oggOpusFile(10, 255)
+	for name, data := range map[string][]byte{
+		"not ogg":       []byte("RIFF\x00\x00\x00\x00WAVE"),
+		"unknown codec": oggStream(1, [][]byte{[]byte("\x80theora")}, nil, nil, 255),
+		"headers only":  oggStream(1, [][]byte{opusHead(0), []byte("OpusTags")}, nil, nil, 255),
+		"truncated":     valid[:len(valid)-10],
+	} {
+		if _, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "application/ogg"); err != ErrUnsupportedAudio {
+			t.Errorf("%s: error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// ebmlElement tạo phần tử EBML với kích thước được mã hóa 8 byte như nhiều bộ mux vẫn làm
+func ebmlElement(id uint32, body ...[]byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+	out = binary.BigEndian.AppendUint64(out, uint64(len(data))|0x01<<56)
+	return append(out, data...)
+}
+
+// ebmlUnknownSize tạo phần tử có kích thước không xác định như Segment và Cluster của MediaRecorder
+func ebmlUnknownSize(id uint32, body ...[]byte) []byte {
+	element := ebmlElement(id)
+	out := append(element[:len(element)-8], 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+// simpleBlock tạo SimpleBlock của track 1 với mốc thời gian tương đối so với cluster
+func simpleBlock(relative int16, packet []byte) []byte {
+	block := binary.BigEndian.AppendUint16([]byte{0x81}, uint16(relative))
+	return ebmlElement(ebmlSimpleBlock, append(append(block, 0x80), packet...))
+}
+
+// webmFile tạo tệp WebM giống MediaRecorder: count gói Opus 20ms, mỗi cluster chứa 50 gói (1 giây)
+func webmFile(trackType uint64, codecID string, count int) []byte {
+	tracks := ebmlElement(ebmlTracks, ebmlElement(ebmlTrackEntry,
+		ebmlUint(ebmlTrackNumber, 1),
+		ebmlUint(ebmlTrackType, trackType),
+		ebmlElement(ebmlCodecID, []byte(codecID)),
+	))
+	body := [][]byte{
+		ebmlElement(ebmlInfo, ebmlUint(ebmlTimecodeScale, uint64(time.Millisecond))),
+		tracks,
+	}
+	packets := opusPackets(count)
+	for first := 0; first < count; first += 50 {
+		cluster := [][]byte{ebmlUint(ebmlTimecode, uint64(first*20))}
+		for i := first; i < min(count, first+50); i++ {
+			block := simpleBlock(int16((i-first)*20), packets[i])
+			if i%2 == 1 {
+				// Một số bộ mux dùng BlockGroup thay cho SimpleBlock
+				block = ebmlElement(ebmlBlockGroup, append([]byte{ebmlBlock}, block[1:]...))
+			}
+			cluster = append(cluster, block)
+		}
+		body = append(body, ebmlUnknownSize(ebmlCluster, cluster...))
+	}
+	header := ebmlElement(0x1a45dfa3, ebmlElement(0x4282, []byte("webm")))
+	return append(header, ebmlUnknownSize(ebmlSegment, body...)...)
+}
+
+func TestProcessWebMOpus(t *testing.T) {
+	for _, tc := range []struct {
+		count    int
+		duration time.Duration
+	}{
+		{100, 2 * time.Second},
+		{151, 3020 * time.Millisecond},
+	} {
+		data := webmFile(webmTrackTypeAudio, "A_OPUS", tc.count)
+		audio, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "video/webm")
+		if err != nil {
+			t.Errorf("%d packets: ProcessAudio: %v", tc.count, err)
+			continue
+		}
+		if audio.ContentType != "audio/webm" {
+			t.Errorf("%d packets: content type = %q, want audio/webm", tc.count, audio.ContentType)
+		}
+		if audio.Duration != tc.duration {
+			t.Errorf("%d packets: duration = %v, want %v", tc.count, audio.Duration, tc.duration)
+		}
+		halfSilent(t, "webm", audio.Waveform)
+	}
+}
+
+func TestProcessWebMUnsupported(t *testing.T) {
+	valid := webmFile(webmTrackTypeAudio, "A_OPUS", 10)
+	for name, data := range map[string][]byte{
+		"video track": webmFile(1, "V_VP8", 10),
+		"vorbis":      webmFile(webmTrackTypeAudio, "A_VORBIS", 10),
+		"no blocks":   webmFile(webmTrackTypeAudio, "A_OPUS", 0),
+		"truncated":   valid[:len(valid)-100],
+		"not ebml":    []byte("OggS\x00\x02"),
+	} {
+		if _, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), "video/webm"); err != ErrUnsupportedAudio {
+			t.Errorf("%s: error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	for _, tc := range []struct {
+		packet []byte
+		want   time.Duration
+	}{
+		{nil, 0},
+		{[]byte{0 << 3}, 10 * time.Millisecond},          // SILK 10ms
+		{[]byte{3 << 3}, 60 * time.Millisecond},          // SILK 60ms
+		{[]byte{13 << 3}, 20 * time.Millisecond},         // Hybrid 20ms
+		{[]byte{16 << 3}, 2500 * time.Microsecond},       // CELT 2,5ms
+		{[]byte{31<<3 | 1}, 40 * time.Millisecond},       // hai frame cùng kích thước
+		{[]byte{31<<3 | 2}, 40 * time.Millisecond},       // hai frame khác kích thước
+		{[]byte{31<<3 | 3, 0x83}, 60 * time.Millisecond}, // ba frame, có padding
+		{[]byte{31<<3 | 3}, 0},                           // thiếu byte đếm frame
+	} {
+		if got := opusPacketDuration(tc.packet); got != tc.want {
+			t.Errorf("opusPacketDuration(% x) = %v, want %v", tc.packet, got, tc.want)
+		}
+	}
+}
+
+func TestBitrateWaveform(t *testing.T) {
+	// Một đoạn duy nhất phủ đều toàn bộ thời lượng cho dạng sóng phẳng
+	flat := bitrateWaveform([]span{{start: 0, end: time.Second, bytes: 640}}, time.Second)
+	for i, v := range flat {
+		if v != WaveformMax {
+			t.Fatalf("flat waveform[%d] = %d, want %d", i, v, WaveformMax)
+		}
+	}
+
+	// Đoạn bắt đầu trước mốc 0 (pre-skip) hoặc có thời lượng 0 không làm lệch chỉ số
+	waveform := bitrateWaveform([]span{
+		{start: -10 * time.Millisecond, end: 10 * time.Millisecond, bytes: 100},
+		{start: 500 * time.Millisecond, end: 500 * time.Millisecond, bytes: 1000},
+	}, time.Second)
+	if len(waveform) != WaveformLength || waveform[0] != WaveformMax {
+		t.Errorf("waveform = %v, want only the first column set", waveform)
+	}
+	for i, v := range waveform[1:] {
+		if v != 0 {
+			t.Errorf("waveform[%d] = %d, want 0", i+1, v)
+		}
+	}
+
+	if got := bitrateWaveform(nil, 0); len(got) != WaveformLength {
+		t.Errorf("empty waveform length = %d, want %d", len(got), WaveformLength)
+	}
+}
+
+// checkAudio kiểm tra các bất biến của kết quả ProcessAudio với dữ liệu bất kỳ
+func checkAudio(t *testing.T, data []byte, contentType string) {
+	audio, err := ProcessAudio(bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		return
+	}
+	if audio.Duration <= 0 {
+		t.Fatalf("duration = %v, want > 0", audio.Duration)
+	}
+	if len(audio.Waveform) != WaveformLength {
+		t.Fatalf("waveform length = %d, want %d", len(audio.Waveform), WaveformLength)
+	}
+	for i, v := range audio.Waveform {
+		if v < 0 || v > WaveformMax {
+			t.Fatalf("waveform[%d] = %d out of range", i, v)
+		}
+	}
+}
+
+func FuzzProcessWAV(f *testing.F) {
+	f.Add(wavFile(wavFormatPCM, 1, 8000, 16, pcm16(800, 1, 1000)))
+	f.Add(wavFile(wavFormatExtensible, 2, 8000, 24, make([]byte, 600), riffChunk("LIST", []byte("odd"))))
+	f.Add(wavFile(wavFormatFloat, 1, 8000, 32, make([]byte, 400)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAudio(t, data, "audio/wave")
+	})
+}
+
+func FuzzProcessOgg(f *testing.F) {
+	f.Add(oggOpusFile(10, 3))
+	f.Add(oggOpusFile(10, 255))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAudio(t, data, "application/ogg")
+	})
+}
+
+func FuzzProcessWebM(f *testing.F) {
+	f.Add(webmFile(webmTrackTypeAudio, "A_OPUS", 10))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAudio(t, data, "video/webm")
+	})
+}
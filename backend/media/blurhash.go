@@ -0,0 +1,115 @@
+package media
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhash mã hóa img theo thuật toán BlurHash (https://blurha.sh): vài hệ số DCT tần số thấp của ảnh,
+// đủ để client dựng lại một ảnh mờ cùng tông màu chỉ từ chuỗi khoảng 20-30 ký tự.
+// Số thành phần theo chiều dài hơn của ảnh là 4, chiều còn lại là 3.
+func blurhash(img *image.RGBA) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	componentsX, componentsY := 4, 3
+	if height > width {
+		componentsX, componentsY = 3, 4
+	}
+
+	// Phần trong suốt được phủ lên nền trắng như khi hiển thị trên giao diện sáng
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			background := 255 - int(img.Pix[i+3])
+			for c := 0; c < 3; c++ {
+				linear[y*width+x][c] = srgbToLinear(int(img.Pix[i+c]) + background)
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	encodeBase83(&hash, (componentsX-1)+(componentsY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		encodeBase83(&hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(&hash, 0, 1)
+	}
+
+	encodeBase83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		value := 0
+		for _, component := range factor {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(component/maximumValue, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		encodeBase83(&hash, value, 2)
+	}
+	return hash.String()
+}
+
+func encodeBase83(b *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		divisor := 1
+		for k := 0; k < i; k++ {
+			divisor *= 83
+		}
+		b.WriteByte(base83Alphabet[value/divisor%83])
+	}
+}
+
+func srgbToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
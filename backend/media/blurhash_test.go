@@ -0,0 +1,39 @@
+package media
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func solidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBlurhash(t *testing.T) {
+	// Nửa trái đen, nửa phải trắng
+	split := solidImage(32, 16, color.White)
+	draw.Draw(split, image.Rect(0, 0, 16, 16), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	// Giá trị mong đợi khớp với bộ mã hóa tham chiếu của BlurHash. Thuật toán lấy mẫu cos(πix/w)
+	// tại mép trái mỗi pixel nên ảnh một màu vẫn có thành phần AC nhỏ khác 0.
+	for _, tc := range []struct {
+		name string
+		img  *image.RGBA
+		want string
+	}{
+		{"red landscape", solidImage(32, 16, color.RGBA{255, 0, 0, 255}), "LKTI:j,YfQ,Y|co1fQo1fQfQfQfQ"},
+		{"black portrait", solidImage(16, 32, color.Black), "T00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"white square", solidImage(8, 8, color.White), "LfTSUA~qfQ~q~qt7fQt7fQfQfQfQ"},
+		// Pixel trong suốt hoàn toàn được phủ lên nền trắng
+		{"transparent", solidImage(8, 8, color.Transparent), "LfTSUA~qfQ~q~qt7fQt7fQfQfQfQ"},
+		{"black and white halves", split, "L~Lqe900Rj-;t7WBayoffQfQfQfQ"},
+	} {
+		if got := blurhash(tc.img); got != tc.want {
+			t.Errorf("%s: blurhash = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package media đọc thông tin từ nội dung tệp ảnh và âm thanh người dùng tải lên
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	// Đăng ký bộ giải mã GIF cho image.Decode
+	_ "image/gif"
+)
+
+const (
+	// ThumbnailSize là cạnh dài tối đa của ảnh thu nhỏ, tính theo pixel
+	ThumbnailSize = 320
+	// maxDecodePixels giới hạn số pixel được giải mã để ảnh nén rất nhỏ nhưng kích thước khổng lồ
+	// không chiếm hết bộ nhớ. Ảnh lớn hơn vẫn được nhận nhưng không có ảnh thu nhỏ.
+	maxDecodePixels = 50_000_000
+	// placeholderSize là cạnh dài của ảnh dùng để tính blurhash, đủ cho vài thành phần tần số thấp
+	placeholderSize = 32
+	// thumbnailQuality là chất lượng JPEG của ảnh thu nhỏ không có phần trong suốt
+	thumbnailQuality = 80
+)
+
+// ErrInvalidImage được trả về khi nội dung không giải mã được dù có chữ ký của định dạng ảnh
+var ErrInvalidImage = errors.New("ảnh bị hỏng hoặc không đúng định dạng")
+
+// Image là kết quả xử lý một tệp ảnh
+type Image struct {
+	// Data là nội dung ảnh đã bỏ metadata, được lưu thay cho tệp gốc
+	Data []byte
+	// Width và Height là kích thước khi hiển thị, đã tính cả hướng xoay trong EXIF
+	Width  int
+	Height int
+
+	// Thumbnail là ảnh thu nhỏ đã xoay đúng hướng, nil nếu ảnh quá lớn để giải mã
+	Thumbnail       []byte
+	ThumbnailType   string
+	ThumbnailWidth  int
+	ThumbnailHeight int
+	// Blurhash là chuỗi ngắn mô tả màu sắc của ảnh để client vẽ ảnh mờ trong lúc chờ tải
+	Blurhash string
+}
+
+// IsImage cho biết ProcessImage có xử lý được loại nội dung này hay không.
+// Chỉ các định dạng có bộ giải mã trong thư viện chuẩn được hỗ trợ.
+func IsImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ProcessImage bỏ metadata (EXIF, XMP, chú thích...) khỏi ảnh, đọc kích thước và tạo ảnh thu nhỏ cùng blurhash.
+// Với JPEG, hướng xoay EXIF được giữ lại trong một khối EXIF tối giản để ảnh gốc vẫn hiển thị đúng chiều.
+func ProcessImage(data []byte, contentType string) (*Image, error) {
+	orientation := 1
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		data, orientation, err = stripJPEG(data)
+	case "image/png":
+		data, err = stripPNG(data)
+	case "image/gif":
+		// GIF không có EXIF; khối mở rộng chú thích hiếm khi chứa thông tin cá nhân nên được giữ nguyên
+	default:
+		return nil, ErrInvalidImage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	result := &Image{Data: data, Width: config.Width, Height: config.Height}
+	if swapsAxes(orientation) {
+		result.Width, result.Height = config.Height, config.Width
+	}
+	if int64(config.Width)*int64(config.Height) > maxDecodePixels {
+		return result, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	width, height := fit(config.Width, config.Height, ThumbnailSize)
+	thumbnail := orient(resize(src, width, height), orientation)
+
+	var buf bytes.Buffer
+	if thumbnail.Opaque() {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality})
+		result.ThumbnailType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, thumbnail)
+		result.ThumbnailType = "image/png"
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Thumbnail = buf.Bytes()
+	result.ThumbnailWidth = thumbnail.Bounds().Dx()
+	result.ThumbnailHeight = thumbnail.Bounds().Dy()
+
+	width, height = fit(result.ThumbnailWidth, result.ThumbnailHeight, placeholderSize)
+	result.Blurhash = blurhash(resize(thumbnail, width, height))
+	return result, nil
+}
+
+// fit thu nhỏ kích thước width x height để cạnh dài không vượt quá limit, giữ nguyên tỉ lệ
+func fit(width, height, limit int) (int, int) {
+	if width <= limit && height <= limit {
+		return width, height
+	}
+	if width >= height {
+		return limit, max(1, (height*limit+width/2)/width)
+	}
+	return max(1, (width*limit+height/2)/height), limit
+}
+
+// resize thu nhỏ src về width x height bằng cách lấy trung bình các pixel nguồn phủ lên mỗi pixel đích.
+// Ảnh nhỏ hơn kích thước đích được giữ nguyên tỉ lệ 1:1 vì fit không bao giờ yêu cầu phóng to.
+func resize(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	at := pixelReader(src)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := at(sx, sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// pixelReader trả về hàm đọc màu premultiplied 16 bit của một pixel. Các kiểu ảnh do bộ giải mã chuẩn
+// tạo ra được đọc trực tiếp từ bộ đệm, tránh cấp phát color.Color cho từng pixel của ảnh lớn.
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(x, y)], img.Cb[img.COffset(x, y)], img.Cr[img.COffset(x, y)])
+			return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			return uint32(img.Pix[i]) * 0x101, uint32(img.Pix[i+1]) * 0x101, uint32(img.Pix[i+2]) * 0x101, uint32(img.Pix[i+3]) * 0x101
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			a := uint32(img.Pix[i+3])
+			return uint32(img.Pix[i]) * a * 0x101 / 0xff, uint32(img.Pix[i+1]) * a * 0x101 / 0xff, uint32(img.Pix[i+2]) * a * 0x101 / 0xff, a * 0x101
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)]) * 0x101
+			return v, v, v, 0xffff
+		}
+	case *image.Paletted:
+		palette := make([][4]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			palette[i][0], palette[i][1], palette[i][2], palette[i][3] = c.RGBA()
+		}
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			index := int(img.Pix[img.PixOffset(x, y)])
+			if index >= len(palette) {
+				return 0, 0, 0, 0
+			}
+			c := palette[index]
+			return c[0], c[1], c[2], c[3]
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		return src.At(x, y).RGBA()
+	}
+}
+
+// swapsAxes cho biết hướng xoay EXIF có đổi chiều rộng và chiều cao khi hiển thị hay không
+func swapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orient xoay hoặc lật img theo giá trị Orientation của EXIF (1-8) để ảnh hiển thị đúng chiều
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	dstWidth, dstHeight := width, height
+	if swapsAxes(orientation) {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // lật ngang
+				sx, sy = width-1-x, y
+			case 3: // xoay 180°
+				sx, sy = width-1-x, height-1-y
+			case 4: // lật dọc
+				sx, sy = x, height-1-y
+			case 5: // đối xứng qua đường chéo chính
+				sx, sy = y, x
+			case 6: // xoay 90° theo chiều kim đồng hồ
+				sx, sy = y, height-1-x
+			case 7: // đối xứng qua đường chéo phụ
+				sx, sy = width-1-y, height-1-x
+			case 8: // xoay 90° ngược chiều kim đồng hồ
+				sx, sy = width-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
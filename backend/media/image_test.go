@@ -0,0 +1,266 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// orientedJPEG tạo ảnh JPEG width x height có khối EXIF với hướng xoay cho trước
+func orientedJPEG(t testing.TB, width, height, orientation int) []byte {
+	t.Helper()
+	return testJPEG(t, width, height, orientationSegment(orientation))
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		result, err := ProcessImage(orientedJPEG(t, 640, 320, orientation), "image/jpeg")
+		if err != nil {
+			t.Fatalf("orientation %d: ProcessImage: %v", orientation, err)
+		}
+
+		width, height, thumbWidth, thumbHeight := 640, 320, 320, 160
+		if orientation >= 5 {
+			width, height, thumbWidth, thumbHeight = height, width, thumbHeight, thumbWidth
+		}
+		if result.Width != width || result.Height != height {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", orientation, result.Width, result.Height, width, height)
+		}
+		if result.ThumbnailWidth != thumbWidth || result.ThumbnailHeight != thumbHeight {
+			t.Errorf("orientation %d: thumbnail size = %dx%d, want %dx%d",
+				orientation, result.ThumbnailWidth, result.ThumbnailHeight, thumbWidth, thumbHeight)
+		}
+		if result.ThumbnailType != "image/jpeg" {
+			t.Errorf("orientation %d: thumbnail type = %q, want image/jpeg", orientation, result.ThumbnailType)
+		}
+		thumbnail, err := jpeg.DecodeConfig(bytes.NewReader(result.Thumbnail))
+		if err != nil {
+			t.Fatalf("orientation %d: decode thumbnail: %v", orientation, err)
+		}
+		if thumbnail.Width != thumbWidth || thumbnail.Height != thumbHeight {
+			t.Errorf("orientation %d: encoded thumbnail = %dx%d, want %dx%d",
+				orientation, thumbnail.Width, thumbnail.Height, thumbWidth, thumbHeight)
+		}
+
+		// Ảnh gốc giữ hướng xoay, ảnh thu nhỏ đã xoay sẵn nên không cần
+		_, kept, err := stripJPEG(result.Data)
+		if err != nil {
+			t.Fatalf("orientation %d: stored data is not a valid JPEG: %v", orientation, err)
+		}
+		if kept != orientation {
+			t.Errorf("orientation %d: stored data orientation = %d", orientation, kept)
+		}
+		if len(result.Blurhash) != 28 {
+			t.Errorf("orientation %d: blurhash %q has length %d, want 28", orientation, result.Blurhash, len(result.Blurhash))
+		}
+	}
+}
+
+func TestProcessImageSmall(t *testing.T) {
+	result, err := ProcessImage(orientedJPEG(t, 40, 20, 6), "image/jpeg")
+	if err != nil {
+		t.Fatalf("ProcessImage: %v", err)
+	}
+	if result.Width != 20 || result.Height != 40 {
+		t.Errorf("size = %dx%d, want 20x40", result.Width, result.Height)
+	}
+	// Ảnh nhỏ hơn ThumbnailSize không bị phóng to
+	if result.ThumbnailWidth != 20 || result.ThumbnailHeight != 40 {
+		t.Errorf("thumbnail size = %dx%d, want 20x40", result.ThumbnailWidth, result.ThumbnailHeight)
+	}
+}
+
+func TestProcessImageTransparentPNG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 400))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+
+	result, err := ProcessImage(buf.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("ProcessImage: %v", err)
+	}
+	if result.Width != 100 || result.Height != 400 {
+		t.Errorf("size = %dx%d, want 100x400", result.Width, result.Height)
+	}
+	if result.ThumbnailType != "image/png" {
+		t.Errorf("thumbnail type = %q, want image/png", result.ThumbnailType)
+	}
+	if result.ThumbnailWidth != 80 || result.ThumbnailHeight != 320 {
+		t.Errorf("thumbnail size = %dx%d, want 80x320", result.ThumbnailWidth, result.ThumbnailHeight)
+	}
+	thumbnail, err := png.Decode(bytes.NewReader(result.Thumbnail))
+	if err != nil {
+		t.Fatalf("decode thumbnail: %v", err)
+	}
+	if _, _, _, a := thumbnail.At(0, 0).RGBA(); a == 0xffff {
+		t.Error("thumbnail lost its transparency")
+	}
+}
+
+func TestProcessImageGIF(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 50, 30), []color.Color{color.Black, color.White})
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("gif.Encode: %v", err)
+	}
+
+	result, err := ProcessImage(buf.Bytes(), "image/gif")
+	if err != nil {
+		t.Fatalf("ProcessImage: %v", err)
+	}
+	if !bytes.Equal(result.Data, buf.Bytes()) {
+		t.Error("GIF data was modified")
+	}
+	if result.Width != 50 || result.Height != 30 || result.ThumbnailWidth != 50 || result.ThumbnailHeight != 30 {
+		t.Errorf("size = %dx%d, thumbnail %dx%d, want 50x30", result.Width, result.Height, result.ThumbnailWidth, result.ThumbnailHeight)
+	}
+}
+
+func TestProcessImageTooLargeToDecode(t *testing.T) {
+	// Chỉ cần IHDR để đọc kích thước; ảnh vượt maxDecodePixels không được giải mã
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 10000)
+	binary.BigEndian.PutUint32(ihdr[4:], 6000)
+	ihdr[8], ihdr[9] = 8, 2
+	data := append(append([]byte{}, pngSignature...), pngChunk("IHDR", ihdr)...)
+	data = append(data, pngChunk("IEND", nil)...)
+
+	result, err := ProcessImage(data, "image/png")
+	if err != nil {
+		t.Fatalf("ProcessImage: %v", err)
+	}
+	if result.Width != 10000 || result.Height != 6000 {
+		t.Errorf("size = %dx%d, want 10000x6000", result.Width, result.Height)
+	}
+	if result.Thumbnail != nil || result.Blurhash != "" {
+		t.Error("image over maxDecodePixels has a thumbnail")
+	}
+}
+
+func TestProcessImageInvalid(t *testing.T) {
+	jpegData := testJPEG(t, 8, 8)
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		contentType string
+	}{
+		{"unsupported type", jpegData, "image/webp"},
+		{"png declared as jpeg", testPNG(t, 8, 8), "image/jpeg"},
+		{"jpeg declared as png", jpegData, "image/png"},
+		{"corrupt gif", []byte("GIF89a\x00"), "image/gif"},
+	} {
+		if _, err := ProcessImage(tc.data, tc.contentType); err != ErrInvalidImage {
+			t.Errorf("%s: error = %v, want ErrInvalidImage", tc.name, err)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	for _, tc := range []struct {
+		width, height, limit int
+		wantW, wantH         int
+	}{
+		{100, 50, 320, 100, 50},
+		{320, 320, 320, 320, 320},
+		{640, 320, 320, 320, 160},
+		{320, 640, 320, 160, 320},
+		{1000, 333, 320, 320, 107},
+		{5000, 1, 320, 320, 1},
+		{1, 5000, 32, 1, 32},
+	} {
+		if w, h := fit(tc.width, tc.height, tc.limit); w != tc.wantW || h != tc.wantH {
+			t.Errorf("fit(%d, %d, %d) = %dx%d, want %dx%d", tc.width, tc.height, tc.limit, w, h, tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	const width, height = 3, 2
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	topLeft, topRight := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}
+	img.SetRGBA(0, 0, topLeft)
+	img.SetRGBA(width-1, 0, topRight)
+
+	// Vị trí hiển thị của góc trên trái và góc trên phải ảnh gốc theo định nghĩa Orientation của EXIF
+	for _, tc := range []struct {
+		orientation       int
+		topLeft, topRight image.Point
+		swapped           bool
+	}{
+		{1, image.Pt(0, 0), image.Pt(2, 0), false},
+		{2, image.Pt(2, 0), image.Pt(0, 0), false},
+		{3, image.Pt(2, 1), image.Pt(0, 1), false},
+		{4, image.Pt(0, 1), image.Pt(2, 1), false},
+		{5, image.Pt(0, 0), image.Pt(0, 2), true},
+		{6, image.Pt(1, 0), image.Pt(1, 2), true},
+		{7, image.Pt(1, 2), image.Pt(1, 0), true},
+		{8, image.Pt(0, 2), image.Pt(0, 0), true},
+	} {
+		dst := orient(img, tc.orientation)
+		wantSize := image.Pt(width, height)
+		if tc.swapped {
+			wantSize = image.Pt(height, width)
+		}
+		if size := dst.Bounds().Size(); size != wantSize {
+			t.Errorf("orientation %d: size = %v, want %v", tc.orientation, size, wantSize)
+			continue
+		}
+		if got := dst.RGBAAt(tc.topLeft.X, tc.topLeft.Y); got != topLeft {
+			t.Errorf("orientation %d: pixel at %v = %v, want top-left %v", tc.orientation, tc.topLeft, got, topLeft)
+		}
+		if got := dst.RGBAAt(tc.topRight.X, tc.topRight.Y); got != topRight {
+			t.Errorf("orientation %d: pixel at %v = %v, want top-right %v", tc.orientation, tc.topRight, got, topRight)
+		}
+	}
+}
+
+func FuzzProcessImage(f *testing.F) {
+	f.Add(orientedJPEG(f, 16, 8, 6), "image/jpeg")
+	f.Add(testJPEG(f, 8, 8, jpegSegment(jpegCOM, []byte("comment"))), "image/jpeg")
+	f.Add(testPNG(f, 8, 4, pngChunk("tEXt", []byte("k\x00v"))), "image/png")
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), []color.Color{color.Black}), nil); err != nil {
+		f.Fatalf("gif.Encode: %v", err)
+	}
+	f.Add(buf.Bytes(), "image/gif")
+
+	f.Fuzz(func(t *testing.T, data []byte, contentType string) {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err == nil && int64(config.Width)*int64(config.Height) > 1<<20 {
+			// Tránh giải mã ảnh khổng lồ làm chậm fuzzer
+			return
+		}
+
+		result, err := ProcessImage(data, contentType)
+		if err != nil {
+			return
+		}
+		if result.Width <= 0 || result.Height <= 0 {
+			t.Fatalf("invalid size %dx%d", result.Width, result.Height)
+		}
+		if result.Thumbnail == nil {
+			return
+		}
+		if result.ThumbnailWidth > ThumbnailSize || result.ThumbnailHeight > ThumbnailSize ||
+			result.ThumbnailWidth <= 0 || result.ThumbnailHeight <= 0 {
+			t.Fatalf("invalid thumbnail size %dx%d", result.ThumbnailWidth, result.ThumbnailHeight)
+		}
+		if (result.Width > result.Height) != (result.ThumbnailWidth > result.ThumbnailHeight) && result.Width != result.Height {
+			t.Fatalf("thumbnail %dx%d does not match orientation of %dx%d",
+				result.ThumbnailWidth, result.ThumbnailHeight, result.Width, result.Height)
+		}
+		if _, _, err := image.DecodeConfig(bytes.NewReader(result.Data)); err != nil {
+			t.Fatalf("stripped data does not decode: %v", err)
+		}
+	})
+}
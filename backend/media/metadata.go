@@ -0,0 +1,193 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegSOS  = 0xda
+	jpegAPP0 = 0xe0
+	jpegAPP1 = 0xe1 // EXIF và XMP
+	jpegAPP2 = 0xe2 // ICC profile hoặc Multi-Picture Format
+	jpegAPPD = 0xed // Photoshop IRB, thường chứa IPTC
+	jpegCOM  = 0xfe
+
+	exifOrientationTag = 0x0112
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader   = []byte("Exif\x00\x00")
+	mpfHeader    = []byte("MPF\x00")
+)
+
+// stripJPEG bỏ các segment metadata (EXIF, XMP, IPTC, chú thích, ảnh phụ của Multi-Picture Format)
+// và mọi dữ liệu sau marker EOI mà không mã hóa lại ảnh. Hướng xoay EXIF được trả về và ghi lại
+// vào một khối EXIF chỉ chứa Orientation.
+func stripJPEG(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, 0, ErrInvalidImage
+	}
+
+	orientation := 1
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xff, jpegSOI)
+	var kept [][]byte
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, 0, ErrInvalidImage
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Byte đệm trước marker
+			pos++
+			continue
+		}
+		if marker == jpegSOS {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, ErrInvalidImage
+		}
+		segment, payload := data[pos:end], data[pos+4:end]
+
+		switch {
+		case marker == jpegAPP1:
+			if bytes.HasPrefix(payload, exifHeader) {
+				if value := exifOrientation(payload[len(exifHeader):]); value != 0 {
+					orientation = value
+				}
+			}
+		case marker == jpegAPP2 && bytes.HasPrefix(payload, mpfHeader), marker == jpegAPPD, marker == jpegCOM:
+		default:
+			kept = append(kept, segment)
+		}
+		pos = end
+	}
+
+	// Khối EXIF phải đứng sau JFIF (APP0) nếu có
+	if len(kept) > 0 && kept[0][1] == jpegAPP0 {
+		out = append(out, kept[0]...)
+		kept = kept[1:]
+	}
+	if orientation != 1 {
+		out = append(out, orientationSegment(orientation)...)
+	}
+	for _, segment := range kept {
+		out = append(out, segment...)
+	}
+
+	// Từ SOS trở đi là dữ liệu ảnh, chỉ cần tìm EOI để cắt bỏ phần thừa phía sau. Trong dữ liệu nén,
+	// 0xff được theo sau bởi 0x00 (byte 0xff thật), marker RSTn hoặc một segment có độ dài
+	// (SOS, DHT... giữa các lượt quét của ảnh progressive) cần bỏ qua nguyên khối.
+	scan := pos
+	for i := pos; i+1 < len(data); {
+		if data[i] != 0xff {
+			i++
+			continue
+		}
+		switch marker := data[i+1]; {
+		case marker == jpegEOI:
+			return append(append(out, data[scan:i]...), 0xff, jpegEOI), orientation, nil
+		case marker == 0x00, marker == 0xff, marker >= 0xd0 && marker <= 0xd7:
+			i += 2
+		default:
+			if i+4 > len(data) {
+				return nil, 0, ErrInvalidImage
+			}
+			i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		}
+	}
+	return nil, 0, ErrInvalidImage
+}
+
+// exifOrientation đọc thẻ Orientation trong IFD0 của khối EXIF (định dạng TIFF), trả về 0 nếu không có
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation có kiểu SHORT (3), giá trị nằm ngay trong 2 byte đầu của trường value
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationSegment tạo segment APP1 chứa khối EXIF chỉ có một thẻ Orientation
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, // big-endian
+		0x00, 0x00, 0x00, 0x08, // IFD0 ngay sau header
+		0x00, 0x01, // một thẻ
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // Orientation, SHORT, 1 giá trị
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // không có IFD tiếp theo
+	}
+	segment := []byte{0xff, jpegAPP1, 0x00, 0x00}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+// stripPNG bỏ các chunk metadata (EXIF, văn bản, thời điểm chỉnh sửa) và dữ liệu sau IEND.
+// Các chunk ảnh hưởng tới cách hiển thị như gAMA, iCCP, pHYs được giữ nguyên.
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrInvalidImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	pos := len(pngSignature)
+	for {
+		if pos+12 > len(data) {
+			return nil, ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, ErrInvalidImage
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		if chunkType == "IEND" {
+			return out, nil
+		}
+		pos = end
+	}
+}
@@ -0,0 +1,253 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// jpegSegment tạo một segment JPEG có độ dài với marker và payload cho trước
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(payload)))
+	return append(segment, payload...)
+}
+
+// exifTIFF tạo khối TIFF có IFD0 gồm thẻ Make chứa maker và, nếu orientation khác 0, thẻ Orientation
+func exifTIFF(order binary.ByteOrder, orientation int, maker string) []byte {
+	count := 1
+	if orientation != 0 {
+		count = 2
+	}
+	tiff := make([]byte, 8)
+	if order == binary.LittleEndian {
+		copy(tiff, "II*\x00")
+	} else {
+		copy(tiff, "MM\x00*")
+	}
+	order.PutUint32(tiff[4:], 8)
+
+	ifd := make([]byte, 2+12*count+4)
+	order.PutUint16(ifd, uint16(count))
+	makeOffset := 8 + len(ifd)
+	entry := ifd[2:]
+	order.PutUint16(entry[0:], 0x010f) // Make, ASCII
+	order.PutUint16(entry[2:], 2)
+	order.PutUint32(entry[4:], uint32(len(maker)+1))
+	order.PutUint32(entry[8:], uint32(makeOffset))
+	if orientation != 0 {
+		entry = ifd[14:]
+		order.PutUint16(entry[0:], exifOrientationTag)
+		order.PutUint16(entry[2:], 3)
+		order.PutUint32(entry[4:], 1)
+		order.PutUint16(entry[8:], uint16(orientation))
+	}
+
+	tiff = append(tiff, ifd...)
+	return append(append(tiff, maker...), 0)
+}
+
+// testImage tạo ảnh RGBA có màu thay đổi theo vị trí để ảnh thu nhỏ không bị đồng màu
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	return img
+}
+
+// testJPEG mã hóa ảnh width x height và chèn các segment cho trước ngay sau SOI
+func testJPEG(t testing.TB, width, height int, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(width, height), nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+// pngChunk tạo một chunk PNG có CRC hợp lệ
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPNG mã hóa ảnh width x height và chèn các chunk cho trước ngay sau IHDR
+func testPNG(t testing.TB, width, height int, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(width, height)); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	data := buf.Bytes()
+	ihdrEnd := len(pngSignature) + 12 + 13
+	out := append([]byte{}, data[:ihdrEnd]...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := testJPEG(t, 40, 20,
+		jpegSegment(jpegAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")),
+		jpegSegment(jpegAPP1, append(append([]byte{}, exifHeader...), exifTIFF(binary.LittleEndian, 6, "GPS-SECRET")...)),
+		jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>XMP-SECRET</x:xmpmeta>")),
+		jpegSegment(jpegAPP2, []byte("MPF\x00MPF-SECRET")),
+		jpegSegment(jpegAPPD, []byte("Photoshop 3.0\x00IPTC-SECRET")),
+		jpegSegment(jpegCOM, []byte("COMMENT-SECRET")),
+	)
+	data = append(data, "TRAILING-SECRET"...)
+
+	stripped, orientation, err := stripJPEG(data)
+	if err != nil {
+		t.Fatalf("stripJPEG: %v", err)
+	}
+	if orientation != 6 {
+		t.Errorf("orientation = %d, want 6", orientation)
+	}
+	for _, secret := range []string{"GPS-SECRET", "XMP-SECRET", "xap/1.0", "MPF-SECRET", "IPTC-SECRET", "COMMENT-SECRET", "TRAILING-SECRET"} {
+		if bytes.Contains(stripped, []byte(secret)) {
+			t.Errorf("stripped JPEG still contains %q", secret)
+		}
+	}
+	if !bytes.HasSuffix(stripped, []byte{0xff, jpegEOI}) {
+		t.Error("stripped JPEG does not end with EOI")
+	}
+
+	// JFIF vẫn đứng đầu, ngay sau đó là khối EXIF tối giản chỉ giữ Orientation
+	jfifEnd := 2 + 2 + 16
+	if !bytes.Equal(stripped[2:4], []byte{0xff, jpegAPP0}) {
+		t.Fatalf("first segment marker = % x, want ff e0", stripped[2:4])
+	}
+	if want := orientationSegment(6); !bytes.HasPrefix(stripped[jfifEnd:], want) {
+		t.Errorf("segment after JFIF = % x, want orientation segment % x", stripped[jfifEnd:jfifEnd+len(want)], want)
+	}
+	if got := exifOrientation(orientationSegment(6)[4+len(exifHeader):]); got != 6 {
+		t.Errorf("exifOrientation(orientationSegment(6)) = %d, want 6", got)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("DecodeConfig stripped JPEG: %v", err)
+	}
+	if config.Width != 40 || config.Height != 20 {
+		t.Errorf("stripped JPEG size = %dx%d, want 40x20", config.Width, config.Height)
+	}
+}
+
+func TestStripJPEGWithoutOrientation(t *testing.T) {
+	data := testJPEG(t, 8, 8, jpegSegment(jpegAPP1, append(append([]byte{}, exifHeader...), exifTIFF(binary.BigEndian, 0, "GPS-SECRET")...)))
+
+	stripped, orientation, err := stripJPEG(data)
+	if err != nil {
+		t.Fatalf("stripJPEG: %v", err)
+	}
+	if orientation != 1 {
+		t.Errorf("orientation = %d, want 1", orientation)
+	}
+	if bytes.Contains(stripped, exifHeader) {
+		t.Error("stripped JPEG has an EXIF block although the orientation is the default")
+	}
+}
+
+func TestStripJPEGInvalid(t *testing.T) {
+	valid := testJPEG(t, 8, 8)
+	for name, data := range map[string][]byte{
+		"empty":            nil,
+		"not jpeg":         []byte("GIF89a"),
+		"truncated header": valid[:20],
+		"missing EOI":      valid[:len(valid)-2],
+		"segment overflow": append([]byte{0xff, jpegSOI}, 0xff, jpegCOM, 0xff, 0xff, 'x'),
+	} {
+		if _, _, err := stripJPEG(data); err != ErrInvalidImage {
+			t.Errorf("%s: stripJPEG error = %v, want ErrInvalidImage", name, err)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	wrongType := exifTIFF(binary.BigEndian, 6, "x")
+	binary.BigEndian.PutUint16(wrongType[8+2+12+2:], 4) // Orientation có kiểu LONG thay vì SHORT
+
+	for _, tc := range []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little endian", exifTIFF(binary.LittleEndian, 3, "x"), 3},
+		{"big endian", exifTIFF(binary.BigEndian, 8, "x"), 8},
+		{"no orientation", exifTIFF(binary.BigEndian, 0, "x"), 0},
+		{"out of range", exifTIFF(binary.BigEndian, 9, "x"), 0},
+		{"wrong type", wrongType, 0},
+		{"bad byte order", append([]byte("XX\x00*"), exifTIFF(binary.BigEndian, 6, "x")[4:]...), 0},
+		{"truncated IFD", exifTIFF(binary.LittleEndian, 6, "x")[:20], 0},
+		{"too short", []byte("II*"), 0},
+	} {
+		if got := exifOrientation(tc.tiff); got != tc.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	pHYs := pngChunk("pHYs", []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1})
+	data := testPNG(t, 30, 10,
+		pHYs,
+		pngChunk("tEXt", []byte("Comment\x00TEXT-SECRET")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00XMP-SECRET")),
+		pngChunk("eXIf", exifTIFF(binary.BigEndian, 6, "GPS-SECRET")),
+		pngChunk("tIME", []byte{0x07, 0xe8, 1, 1, 12, 0, 0}),
+	)
+	data = append(data, "TRAILING-SECRET"...)
+
+	stripped, err := stripPNG(data)
+	if err != nil {
+		t.Fatalf("stripPNG: %v", err)
+	}
+	for _, secret := range []string{"TEXT-SECRET", "XMP-SECRET", "GPS-SECRET", "tIME", "TRAILING-SECRET"} {
+		if bytes.Contains(stripped, []byte(secret)) {
+			t.Errorf("stripped PNG still contains %q", secret)
+		}
+	}
+	if !bytes.Contains(stripped, pHYs) {
+		t.Error("stripped PNG lost its pHYs chunk")
+	}
+
+	img, err := png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("png.Decode stripped PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 30 || size.Y != 10 {
+		t.Errorf("stripped PNG size = %v, want 30x10", size)
+	}
+}
+
+func TestStripPNGInvalid(t *testing.T) {
+	valid := testPNG(t, 4, 4)
+	for name, data := range map[string][]byte{
+		"empty":          nil,
+		"not png":        []byte("\xff\xd8\xff"),
+		"missing IEND":   valid[:len(valid)-12],
+		"chunk overflow": append(append([]byte{}, pngSignature...), 0x7f, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T', 0, 0, 0, 0),
+	} {
+		if _, err := stripPNG(data); err != ErrInvalidImage {
+			t.Errorf("%s: stripPNG error = %v, want ErrInvalidImage", name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const oggPageHeaderSize = 27
+
+// oggPage là một trang Ogg: các gói (packet) có thể bắt đầu ở trang trước và kéo dài sang trang sau
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte // bảng lacing, giá trị 255 nghĩa là gói còn tiếp tục ở segment sau
+	data     []byte
+}
+
+// readOggPage đọc trang tiếp theo, trả về io.EOF khi hết tệp
+func readOggPage(r *bufio.Reader) (*oggPage, error) {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, ErrUnsupportedAudio
+	}
+	if string(header[:4]) != "OggS" || header[4] != 0 {
+		return nil, ErrUnsupportedAudio
+	}
+
+	page := &oggPage{
+		granule:  int64(binary.LittleEndian.Uint64(header[6:])),
+		serial:   binary.LittleEndian.Uint32(header[14:]),
+		segments: make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, page.segments); err != nil {
+		return nil, ErrUnsupportedAudio
+	}
+	size := 0
+	for _, lacing := range page.segments {
+		size += int(lacing)
+	}
+	page.data = make([]byte, size)
+	if _, err := io.ReadFull(r, page.data); err != nil {
+		return nil, ErrUnsupportedAudio
+	}
+	return page, nil
+}
+
+// processOgg đọc luồng logic đầu tiên của tệp Ogg nếu đó là Opus hoặc Vorbis.
+// Thời lượng lấy từ granule position của trang cuối; dạng sóng được ước lượng theo từng gói Opus
+// hoặc theo từng trang Vorbis (thời lượng gói Vorbis chỉ biết được khi giải mã setup header).
+func processOgg(r io.ReaderAt, size int64) (*Audio, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r, 0, size))
+
+	first, err := readOggPage(reader)
+	if err != nil {
+		return nil, ErrUnsupportedAudio
+	}
+	var opus bool
+	var rate, preSkip int64
+	switch {
+	case bytes.HasPrefix(first.data, []byte("OpusHead")) && len(first.data) >= 19:
+		opus, rate = true, opusRate
+		preSkip = int64(binary.LittleEndian.Uint16(first.data[10:]))
+	case bytes.HasPrefix(first.data, []byte("\x01vorbis")) && len(first.data) >= 30:
+		rate = int64(binary.LittleEndian.Uint32(first.data[12:]))
+	default:
+		return nil, ErrUnsupportedAudio
+	}
+	if rate <= 0 {
+		return nil, ErrUnsupportedAudio
+	}
+	toDuration := func(samples int64) time.Duration {
+		return time.Duration(samples * int64(time.Second) / rate)
+	}
+
+	var spans []span
+	var lastGranule, pageStart int64
+	var pendingBytes int
+	var packet []byte // gói đang đọc dở, chỉ giữ vài byte đầu cần cho TOC của Opus
+	var packetSize int
+	var elapsed time.Duration
+	// headers đếm ngược số gói header còn lại: Vorbis có 3, Opus có 2 (OpusHead, OpusTags)
+	headers := -3
+	if opus {
+		headers = -2
+	}
+
+	for page := first; ; {
+		if page.serial == first.serial {
+			start := 0
+			for _, lacing := range page.segments {
+				end := start + int(lacing)
+				if len(packet) < 2 {
+					packet = append(packet, page.data[start:min(end, start+2-len(packet))]...)
+				}
+				packetSize += int(lacing)
+				start = end
+				if lacing == 255 {
+					continue
+				}
+
+				// Kết thúc một gói
+				if headers < 0 {
+					headers++
+				} else if opus {
+					duration := opusPacketDuration(packet)
+					spans = append(spans, span{start: elapsed, end: elapsed + duration, bytes: packetSize})
+					elapsed += duration
+				} else {
+					pendingBytes += packetSize
+				}
+				packet, packetSize = packet[:0], 0
+			}
+
+			// granule -1 nghĩa là không có gói nào kết thúc trong trang
+			if page.granule >= 0 && headers >= 0 {
+				if !opus && page.granule > pageStart {
+					spans = append(spans, span{start: toDuration(pageStart), end: toDuration(page.granule), bytes: pendingBytes})
+					pendingBytes, pageStart = 0, page.granule
+				}
+				lastGranule = page.granule
+			}
+		}
+
+		page, err = readOggPage(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	duration := toDuration(lastGranule - preSkip)
+	if duration <= 0 {
+		return nil, ErrUnsupportedAudio
+	}
+	if opus {
+		// Gói đầu tiên bắt đầu từ trước mốc 0 một khoảng pre-skip
+		skip := toDuration(preSkip)
+		for i := range spans {
+			spans[i].start -= skip
+			spans[i].end -= skip
+		}
+	}
+	return &Audio{
+		ContentType: "audio/ogg",
+		Duration:    duration,
+		Waveform:    bitrateWaveform(spans, duration),
+	}, nil
+}
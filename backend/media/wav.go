@@ -0,0 +1,122 @@
+package media
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+// processWAV đọc header RIFF/WAVE và tính biên độ đỉnh của từng cột dạng sóng từ dữ liệu PCM
+func processWAV(r io.ReaderAt, size int64) (*Audio, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return nil, ErrUnsupportedAudio
+	}
+
+	var format, channels, bits, blockAlign int
+	var sampleRate int64
+	var dataOffset, dataSize int64
+	for offset := int64(12); offset+8 <= size; {
+		chunk := make([]byte, 8)
+		if _, err := r.ReadAt(chunk, offset); err != nil {
+			return nil, ErrUnsupportedAudio
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		body := offset + 8
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, ErrUnsupportedAudio
+			}
+			fmtChunk := make([]byte, min(chunkSize, 40))
+			if _, err := r.ReadAt(fmtChunk, body); err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+			format = int(binary.LittleEndian.Uint16(fmtChunk))
+			channels = int(binary.LittleEndian.Uint16(fmtChunk[2:]))
+			sampleRate = int64(binary.LittleEndian.Uint32(fmtChunk[4:]))
+			blockAlign = int(binary.LittleEndian.Uint16(fmtChunk[12:]))
+			bits = int(binary.LittleEndian.Uint16(fmtChunk[14:]))
+			// WAVE_FORMAT_EXTENSIBLE ghi định dạng thật ở 2 byte đầu của SubFormat GUID
+			if format == wavFormatExtensible && len(fmtChunk) >= 26 {
+				format = int(binary.LittleEndian.Uint16(fmtChunk[24:]))
+			}
+		case "data":
+			// Bản ghi đang ghi dở có thể khai báo kích thước lớn hơn phần thực có trong tệp
+			dataOffset, dataSize = body, min(chunkSize, size-body)
+		}
+		if dataSize > 0 && channels > 0 {
+			break
+		}
+		// Chunk có kích thước lẻ được đệm thêm một byte
+		offset = body + chunkSize + chunkSize%2
+	}
+
+	sampleBytes := bits / 8
+	if dataSize <= 0 || channels <= 0 || sampleRate <= 0 || bits%8 != 0 || blockAlign < channels*sampleBytes ||
+		!((format == wavFormatPCM && sampleBytes >= 1 && sampleBytes <= 4) || (format == wavFormatFloat && sampleBytes == 4)) {
+		return nil, ErrUnsupportedAudio
+	}
+
+	frames := dataSize / int64(blockAlign)
+	audio := &Audio{
+		ContentType: "audio/wave",
+		Duration:    time.Duration(frames * int64(time.Second) / sampleRate),
+	}
+	// Chunk data ngắn hơn một frame không có mẫu nào để phát
+	if audio.Duration <= 0 {
+		return nil, ErrUnsupportedAudio
+	}
+
+	peaks := make([]float64, WaveformLength)
+	for i := range peaks {
+		first := frames * int64(i) / WaveformLength
+		last := frames * int64(i+1) / WaveformLength
+		if last <= first {
+			continue
+		}
+		data := make([]byte, (last-first)*int64(blockAlign))
+		if _, err := r.ReadAt(data, dataOffset+first*int64(blockAlign)); err != nil && err != io.EOF {
+			return nil, err
+		}
+		for frame := 0; frame+blockAlign <= len(data); frame += blockAlign {
+			for channel := 0; channel < channels; channel++ {
+				sample := data[frame+channel*sampleBytes : frame+(channel+1)*sampleBytes]
+				peaks[i] = math.Max(peaks[i], math.Abs(pcmSample(sample, format)))
+			}
+		}
+	}
+	audio.Waveform = normalizeWaveform(peaks)
+	return audio, nil
+}
+
+// pcmSample đổi một mẫu little-endian về khoảng [-1, 1]
+func pcmSample(sample []byte, format int) float64 {
+	if format == wavFormatFloat {
+		v := float64(math.Float32frombits(binary.LittleEndian.Uint32(sample)))
+		if math.IsNaN(v) {
+			return 0
+		}
+		return math.Max(-1, math.Min(1, v))
+	}
+	switch len(sample) {
+	case 1:
+		// Mẫu 8 bit là số không dấu, 128 là mức im lặng
+		return (float64(sample[0]) - 128) / 128
+	case 2:
+		return float64(int16(binary.LittleEndian.Uint16(sample))) / (1 << 15)
+	case 3:
+		v := int32(sample[0]) | int32(sample[1])<<8 | int32(int8(sample[2]))<<16
+		return float64(v) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(sample))) / (1 << 31)
+	}
+}
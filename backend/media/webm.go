@@ -0,0 +1,231 @@
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// ID của các phần tử EBML cần đọc trong tệp WebM
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549a966
+	ebmlTimecodeScale = 0x2ad7b1
+	ebmlTracks        = 0x1654ae6b
+	ebmlTrackEntry    = 0xae
+	ebmlTrackNumber   = 0xd7
+	ebmlTrackType     = 0x83
+	ebmlCodecID       = 0x86
+	ebmlCluster       = 0x1f43b675
+	ebmlTimecode      = 0xe7
+	ebmlBlockGroup    = 0xa0
+	ebmlBlock         = 0xa1
+	ebmlSimpleBlock   = 0xa3
+
+	webmTrackTypeAudio = 2
+	// maxEBMLValueSize giới hạn kích thước các giá trị số và chuỗi được đọc vào bộ nhớ
+	maxEBMLValueSize = 1 << 10
+)
+
+type webmTrack struct {
+	number    uint64
+	trackType uint64
+	codecID   string
+}
+
+// processWebM đọc tệp WebM chỉ có một track âm thanh Opus, như tệp MediaRecorder của trình duyệt tạo ra.
+// MediaRecorder không ghi thời lượng vào Segment Info nên thời lượng được tính từ mốc thời gian của block cuối.
+func processWebM(r io.ReaderAt, size int64) (*Audio, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r, 0, size))
+
+	timecodeScale := uint64(time.Millisecond)
+	var tracks []*webmTrack
+	var audioTrack *webmTrack
+	var clusterTimecode uint64
+	var spans []span
+	var end time.Duration
+
+	for {
+		id, size, err := readEBMLElement(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, ErrUnsupportedAudio
+		}
+
+		switch id {
+		case ebmlSegment, ebmlInfo, ebmlTracks, ebmlCluster, ebmlBlockGroup:
+			// Phần tử chứa phần tử con: đọc tiếp vào bên trong. MediaRecorder ghi Segment và Cluster
+			// với kích thước "không xác định" nên không thể nhảy qua chúng theo kích thước.
+			if id == ebmlCluster {
+				audioTrack, err = webmAudioTrack(tracks)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case ebmlTrackEntry:
+			tracks = append(tracks, &webmTrack{})
+		case ebmlTimecodeScale, ebmlTrackNumber, ebmlTrackType, ebmlTimecode:
+			value, err := readEBMLUint(reader, size)
+			if err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+			switch {
+			case id == ebmlTimecodeScale:
+				timecodeScale = value
+			case id == ebmlTimecode:
+				clusterTimecode = value
+			case len(tracks) == 0:
+			case id == ebmlTrackNumber:
+				tracks[len(tracks)-1].number = value
+			case id == ebmlTrackType:
+				tracks[len(tracks)-1].trackType = value
+			}
+		case ebmlCodecID:
+			value, err := readEBMLBytes(reader, size)
+			if err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+			if len(tracks) > 0 {
+				tracks[len(tracks)-1].codecID = string(value)
+			}
+		case ebmlSimpleBlock, ebmlBlock:
+			if audioTrack == nil || size < 4 || size == unknownEBMLSize {
+				return nil, ErrUnsupportedAudio
+			}
+			block, err := readEBMLBytes(reader, min(size, 16))
+			if err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+			if _, err := reader.Discard(int(size - min(size, 16))); err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+			track, n := readVint(block)
+			if n == 0 || track != audioTrack.number || len(block) < n+4 {
+				continue
+			}
+			relative := int64(int16(binary.BigEndian.Uint16(block[n:])))
+			// Block có lacing chứa nhiều gói, hiếm gặp với Opus nên chỉ tính vào thời lượng
+			laced := block[n+2]&0x06 != 0
+			start := time.Duration((int64(clusterTimecode) + relative) * int64(timecodeScale))
+			if laced {
+				end = max(end, start)
+				continue
+			}
+			duration := opusPacketDuration(block[n+3:])
+			spans = append(spans, span{start: start, end: start + duration, bytes: int(size) - n - 3})
+			end = max(end, start+duration)
+		default:
+			if size == unknownEBMLSize {
+				return nil, ErrUnsupportedAudio
+			}
+			if _, err := reader.Discard(int(size)); err != nil {
+				return nil, ErrUnsupportedAudio
+			}
+		}
+	}
+
+	if audioTrack == nil || end <= 0 {
+		return nil, ErrUnsupportedAudio
+	}
+	return &Audio{
+		ContentType: "audio/webm",
+		Duration:    end,
+		Waveform:    bitrateWaveform(spans, end),
+	}, nil
+}
+
+// webmAudioTrack trả về track Opus duy nhất, lỗi nếu tệp có track video hoặc codec khác
+func webmAudioTrack(tracks []*webmTrack) (*webmTrack, error) {
+	if len(tracks) != 1 || tracks[0].trackType != webmTrackTypeAudio || tracks[0].codecID != "A_OPUS" {
+		return nil, ErrUnsupportedAudio
+	}
+	return tracks[0], nil
+}
+
+// unknownEBMLSize đánh dấu phần tử có kích thước không xác định (mọi bit giá trị đều là 1)
+const unknownEBMLSize = -1
+
+// readEBMLElement đọc ID và kích thước của phần tử tiếp theo
+func readEBMLElement(r *bufio.Reader) (id uint32, size int64, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, 0, io.EOF
+	}
+	length := bits.LeadingZeros8(first[0]) + 1
+	if length > 4 {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	idBytes := make([]byte, length)
+	if _, err := io.ReadFull(r, idBytes); err != nil {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	for _, b := range idBytes {
+		id = id<<8 | uint32(b)
+	}
+
+	first, err = r.Peek(1)
+	if err != nil {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	length = bits.LeadingZeros8(first[0]) + 1
+	if length > 8 {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	sizeBytes := make([]byte, length)
+	if _, err := io.ReadFull(r, sizeBytes); err != nil {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	value, _ := readVint(sizeBytes)
+	if value == 1<<(7*length)-1 {
+		return id, unknownEBMLSize, nil
+	}
+	if value > 1<<62 {
+		return 0, 0, ErrUnsupportedAudio
+	}
+	return id, int64(value), nil
+}
+
+// readVint đọc số nguyên độ dài thay đổi của EBML (đã bỏ bit đánh dấu độ dài), n = 0 nếu không hợp lệ
+func readVint(data []byte) (value uint64, n int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	n = bits.LeadingZeros8(data[0]) + 1
+	if len(data) < n {
+		return 0, 0
+	}
+	value = uint64(data[0]) & (0xff >> n)
+	for _, b := range data[1:n] {
+		value = value<<8 | uint64(b)
+	}
+	return value, n
+}
+
+func readEBMLBytes(r *bufio.Reader, size int64) ([]byte, error) {
+	if size < 0 || size > maxEBMLValueSize {
+		return nil, ErrUnsupportedAudio
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func readEBMLUint(r *bufio.Reader, size int64) (uint64, error) {
+	if size > 8 {
+		return 0, ErrUnsupportedAudio
+	}
+	data, err := readEBMLBytes(r, size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -103,7 +104,7 @@ func (m *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 			return
 		}
 
-		claims, err := m.authService.ValidateToken(parts[1])
+		claims, err := m.authService.ValidateToken(c.Request.Context(), parts[1])
 		if err != nil {
 			log.Printf("Token validation failed: %v for path: %s", err, c.Request.URL.Path)
 
@@ -112,6 +113,11 @@ func (m *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 					"error": "Phiên đăng nhập đã hết hạn, vui lòng đăng nhập lại",
 					"code":  "TOKEN_EXPIRED",
 				})
+			} else if errors.Is(err, services.ErrTokenRevoked) {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "Phiên đăng nhập đã kết thúc, vui lòng đăng nhập lại",
+					"code":  "TOKEN_REVOKED",
+				})
 			} else {
 				c.JSON(http.StatusUnauthorized, gin.H{
 					"error": "Token không hợp lệ hoặc đã hết hạn",
@@ -123,8 +129,11 @@ func (m *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 			return
 		}
 
-		// Lưu ID người dùng vào context để các handler có thể sử dụng
+		m.authService.RecordSessionActivity(c.Request.Context(), claims, c.ClientIP())
+
+		// Lưu ID người dùng và claims của token vào context để các handler có thể sử dụng
 		c.Set("userID", claims.UserID)
+		c.Set("tokenClaims", claims)
 		c.Next()
 	}
 }
@@ -144,7 +153,7 @@ func (m *AuthMiddleware) WebSocketAuth() gin.HandlerFunc {
 			return
 		}
 
-		claims, err := m.authService.ValidateToken(token)
+		claims, err := m.authService.ValidateToken(c.Request.Context(), token)
 		if err != nil {
 			log.Printf("WebSocket token validation failed: %v from IP: %s", err, c.ClientIP())
 
@@ -153,6 +162,11 @@ func (m *AuthMiddleware) WebSocketAuth() gin.HandlerFunc {
 					"error": "Phiên đăng nhập đã hết hạn, vui lòng đăng nhập lại",
 					"code":  "TOKEN_EXPIRED",
 				})
+			} else if errors.Is(err, services.ErrTokenRevoked) {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "Phiên đăng nhập đã kết thúc, vui lòng đăng nhập lại",
+					"code":  "TOKEN_REVOKED",
+				})
 			} else {
 				c.JSON(http.StatusUnauthorized, gin.H{
 					"error": "Token không hợp lệ hoặc đã hết hạn",
@@ -164,7 +178,10 @@ func (m *AuthMiddleware) WebSocketAuth() gin.HandlerFunc {
 			return
 		}
 
+		m.authService.RecordSessionActivity(c.Request.Context(), claims, c.ClientIP())
+
 		c.Set("userID", claims.UserID)
+		c.Set("tokenClaims", claims)
 		c.Next()
 	}
 }
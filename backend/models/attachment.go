@@ -0,0 +1,121 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Attachment là một tệp người dùng đã tải lên. Tệp chưa gắn vào tin nhắn nào chỉ người tải lên
+// truy cập được; sau khi gắn, mọi thành viên của cuộc hội thoại còn nhìn thấy tin nhắn đều tải được.
+type Attachment struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UploaderID     primitive.ObjectID `bson:"uploader_id" json:"uploader_id"`
+	ConversationID primitive.ObjectID `bson:"conversation_id,omitempty" json:"conversation_id,omitempty"`
+	MessageID      primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	Key            string             `bson:"key" json:"-"` // vị trí nội dung tệp trong blob store
+	Filename       string             `bson:"filename" json:"filename"`
+	ContentType    string             `bson:"content_type" json:"content_type"` // xác định từ nội dung tệp, không tin vào client
+	Size           int64              `bson:"size" json:"size"`
+	Image          *ImageInfo         `bson:"image,omitempty" json:"image,omitempty"` // nil nếu không phải ảnh hoặc không đọc được
+	ThumbnailKey   string             `bson:"thumbnail_key,omitempty" json:"-"`       // vị trí ảnh thu nhỏ trong blob store
+	ThumbnailType  string             `bson:"thumbnail_content_type,omitempty" json:"-"`
+	Audio          *AudioInfo         `bson:"audio,omitempty" json:"audio,omitempty"` // nil nếu không phải âm thanh hoặc không đọc được
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// ImageInfo là kích thước và ảnh xem trước của tệp ảnh, giúp client dựng khung ảnh trước khi tải ảnh gốc
+type ImageInfo struct {
+	Width           int    `bson:"width" json:"width"`
+	Height          int    `bson:"height" json:"height"`
+	ThumbnailWidth  int    `bson:"thumbnail_width,omitempty" json:"thumbnail_width,omitempty"` // 0 nếu ảnh quá lớn để tạo ảnh thu nhỏ
+	ThumbnailHeight int    `bson:"thumbnail_height,omitempty" json:"thumbnail_height,omitempty"`
+	Blurhash        string `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+}
+
+// AudioInfo là thời lượng và dạng sóng của tệp âm thanh, đủ để client vẽ trình phát trước khi tải tệp
+type AudioInfo struct {
+	DurationMs int64 `bson:"duration_ms" json:"duration_ms"`
+	// Waveform là độ cao các cột dạng sóng từ 0 tới 100, chia đều theo thời gian
+	Waveform []int `bson:"waveform,omitempty" json:"waveform,omitempty"`
+}
+
+// HasThumbnail cho biết ảnh có ảnh thu nhỏ hay không
+func (i *ImageInfo) HasThumbnail() bool {
+	return i.ThumbnailWidth > 0
+}
+
+// IsAttached cho biết tệp đã được gắn vào một tin nhắn hay chưa
+func (a *Attachment) IsAttached() bool {
+	return !a.MessageID.IsZero()
+}
+
+// Ref tạo bản tham chiếu tới tệp để lưu cùng tin nhắn
+func (a *Attachment) Ref() AttachmentRef {
+	return AttachmentRef{
+		ID:          a.ID,
+		Filename:    a.Filename,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		Image:       a.Image,
+		Audio:       a.Audio,
+	}
+}
+
+func (a *Attachment) ToResponse() *AttachmentResponse {
+	return a.Ref().ToResponse()
+}
+
+// AttachmentRef là thông tin tệp đính kèm được lưu kèm tin nhắn để hiển thị mà không cần tra bản ghi tệp
+type AttachmentRef struct {
+	ID          primitive.ObjectID `bson:"id" json:"id"`
+	Filename    string             `bson:"filename" json:"filename"`
+	ContentType string             `bson:"content_type" json:"content_type"`
+	Size        int64              `bson:"size" json:"size"`
+	Image       *ImageInfo         `bson:"image,omitempty" json:"image,omitempty"`
+	Audio       *AudioInfo         `bson:"audio,omitempty" json:"audio,omitempty"`
+}
+
+type AttachmentResponse struct {
+	ID          primitive.ObjectID `json:"id"`
+	Filename    string             `json:"filename"`
+	ContentType string             `json:"content_type"`
+	Size        int64              `json:"size"`
+	URL         string             `json:"url"` // đường dẫn tải tệp, cần xác thực như các API khác
+	Image       *ImageResponse     `json:"image,omitempty"`
+	Audio       *AudioInfo         `json:"audio,omitempty"`
+}
+
+type ImageResponse struct {
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	Blurhash        string `json:"blurhash,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+func (r AttachmentRef) ToResponse() *AttachmentResponse {
+	url := "/api/files/" + r.ID.Hex()
+	response := &AttachmentResponse{
+		ID:          r.ID,
+		Filename:    r.Filename,
+		ContentType: r.ContentType,
+		Size:        r.Size,
+		URL:         url,
+		Audio:       r.Audio,
+	}
+	if r.Image != nil {
+		response.Image = &ImageResponse{
+			Width:    r.Image.Width,
+			Height:   r.Image.Height,
+			Blurhash: r.Image.Blurhash,
+		}
+		if r.Image.HasThumbnail() {
+			response.Image.ThumbnailURL = url + "/thumbnail"
+			response.Image.ThumbnailWidth = r.Image.ThumbnailWidth
+			response.Image.ThumbnailHeight = r.Image.ThumbnailHeight
+		}
+	}
+	return response
+}
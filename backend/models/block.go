@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserBlock ghi nhận việc BlockerID chặn BlockedID. Quan hệ chặn có một chiều,
+// nhưng các hạn chế về nhắn tin và trạng thái online được áp dụng cho cả hai phía.
+type UserBlock struct {
+	BlockerID primitive.ObjectID `bson:"blocker_id" json:"blocker_id"`
+	BlockedID primitive.ObjectID `bson:"blocked_id" json:"blocked_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
@@ -21,10 +21,24 @@ type Conversation struct {
 	Participants []primitive.ObjectID `bson:"participants" json:"participants"`
 	Admins       []primitive.ObjectID `bson:"admins,omitempty" json:"admins,omitempty"`
 	LastMessage  *Message             `bson:"last_message,omitempty" json:"last_message,omitempty"`
+	// UnreadCounts đếm số tin nhắn chưa đọc của từng thành viên, khóa là ID hex của thành viên.
+	// Không trả về client vì chứa số liệu của người khác, dùng UnreadCountFor.
+	UnreadCounts map[string]int64 `bson:"unread_counts,omitempty" json:"-"`
+	// ThreadOptIns là các thành viên chọn nhận mọi tin trả lời trong thread của cuộc hội thoại,
+	// kể cả thread họ không theo dõi
+	ThreadOptIns []primitive.ObjectID `bson:"thread_opt_ins,omitempty" json:"-"`
 	CreatedAt    time.Time            `bson:"created_at" json:"created_at"`
 	UpdatedAt    time.Time            `bson:"updated_at" json:"updated_at"`
 }
 
+// UnreadCountFor trả về số tin nhắn chưa đọc của một thành viên
+func (c *Conversation) UnreadCountFor(userID primitive.ObjectID) int64 {
+	if count := c.UnreadCounts[userID.Hex()]; count > 0 {
+		return count
+	}
+	return 0
+}
+
 type ConversationResponse struct {
 	ID           primitive.ObjectID `json:"id"`
 	Type         ConversationType   `json:"type"`
@@ -33,7 +47,9 @@ type ConversationResponse struct {
 	Participants []*UserResponse    `json:"participants"`
 	Admins       []*UserResponse    `json:"admins,omitempty"`
 	LastMessage  *MessageResponse   `json:"last_message,omitempty"`
+	UnreadCount  int64              `json:"unread_count"`
 	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
 }
 
 func (c *Conversation) ToResponse(participants []*User, lastMessage *MessageResponse) *ConversationResponse {
@@ -63,5 +79,6 @@ func (c *Conversation) ToResponse(participants []*User, lastMessage *MessageResp
 		Admins:       adminResponses,
 		LastMessage:  lastMessage,
 		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
 	}
 }
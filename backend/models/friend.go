@@ -0,0 +1,47 @@
+package models
+
+import (
+	"bytes"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type FriendRequestStatus string
+
+const (
+	FriendRequestPending  FriendRequestStatus = "pending"
+	FriendRequestAccepted FriendRequestStatus = "accepted"
+	// FriendRequestRejected và FriendRequestRemoved chỉ xuất hiện trong sự kiện và phản hồi:
+	// lời mời bị từ chối và quan hệ bạn bè bị hủy đều bị xóa để hai người có thể kết bạn lại sau
+	FriendRequestRejected FriendRequestStatus = "rejected"
+	FriendRequestRemoved  FriendRequestStatus = "removed"
+)
+
+// FriendRequest là lời mời kết bạn giữa hai người dùng; lời mời đã được chấp nhận chính là quan hệ bạn bè.
+// Mỗi cặp người dùng có nhiều nhất một bản ghi, bất kể ai là người gửi.
+type FriendRequest struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	SenderID    primitive.ObjectID  `bson:"sender_id" json:"sender_id"`
+	RecipientID primitive.ObjectID  `bson:"recipient_id" json:"recipient_id"`
+	PairKey     string              `bson:"pair_key" json:"-"` // FriendPairKey của hai người, unique trong store
+	Status      FriendRequestStatus `bson:"status" json:"status"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"` // thời điểm chấp nhận với quan hệ bạn bè
+}
+
+// FriendPairKey trả về khóa của cặp người dùng, giống nhau với cả hai thứ tự tham số
+func FriendPairKey(userID1, userID2 primitive.ObjectID) string {
+	if bytes.Compare(userID1[:], userID2[:]) > 0 {
+		userID1, userID2 = userID2, userID1
+	}
+	return userID1.Hex() + ":" + userID2.Hex()
+}
+
+// OtherUser trả về người còn lại trong lời mời so với userID
+func (r *FriendRequest) OtherUser(userID primitive.ObjectID) primitive.ObjectID {
+	if r.SenderID == userID {
+		return r.RecipientID
+	}
+	return r.SenderID
+}
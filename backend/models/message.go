@@ -7,12 +7,16 @@ import (
 )
 
 type MessageType string
+type MessageKind string
 type MessageStatus string
 
 const (
 	MessageTypePersonal MessageType = "personal"
 	MessageTypeGroup    MessageType = "group"
 
+	MessageKindText  MessageKind = "text"
+	MessageKindVoice MessageKind = "voice" // tin nhắn thoại: đúng một tệp âm thanh, không có nội dung chữ
+
 	MessageStatusSent      MessageStatus = "sent"
 	MessageStatusDelivered MessageStatus = "delivered"
 	MessageStatusRead      MessageStatus = "read"
@@ -24,36 +28,219 @@ type Message struct {
 	ConversationID primitive.ObjectID   `bson:"conversation_id" json:"conversation_id"`
 	GroupID        primitive.ObjectID   `bson:"group_id,omitempty" json:"group_id,omitempty"`
 	SenderID       primitive.ObjectID   `bson:"sender_id" json:"sender_id"`
+	Kind           MessageKind          `bson:"kind,omitempty" json:"kind,omitempty"` // rỗng ở tin nhắn cũ, tương đương MessageKindText
 	Content        string               `bson:"content" json:"content"`
 	Status         MessageStatus        `bson:"status" json:"status"`
 	ReadBy         []primitive.ObjectID `bson:"read_by" json:"read_by"`
-	IsDeleted      bool                 `bson:"is_deleted" json:"is_deleted"`
-	CreatedAt      time.Time            `bson:"created_at" json:"created_at"`
-	UpdatedAt      time.Time            `bson:"updated_at" json:"updated_at"`
+	PlayedBy       []primitive.ObjectID `bson:"played_by,omitempty" json:"-"` // những người đã nghe tin nhắn thoại, độc lập với ReadBy
+	IsDeleted      bool                 `bson:"is_deleted" json:"is_deleted"` // đã thu hồi với mọi người, chỉ còn lại tombstone
+	DeletedAt      *time.Time           `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy      primitive.ObjectID   `bson:"deleted_by,omitempty" json:"-"`                // người gửi hoặc quản trị viên nhóm đã thu hồi
+	HiddenFor      []primitive.ObjectID `bson:"hidden_for,omitempty" json:"-"`                // những người đã xóa tin nhắn ở phía mình
+	ReplyToID      primitive.ObjectID   `bson:"reply_to,omitempty" json:"reply_to,omitempty"` // tin nhắn được trích dẫn, cùng cuộc hội thoại
+	// UnreadExempt là những thành viên đã chặn người gửi lúc tin nhắn được gửi. Tin nhắn bị ẩn với họ nên
+	// không được tính vào số tin chưa đọc; tách khỏi ReadBy để người gửi không thấy họ đã đọc.
+	UnreadExempt []primitive.ObjectID `bson:"unread_exempt,omitempty" json:"-"`
+	// ThreadRootID là tin nhắn gốc nếu đây là tin trả lời trong thread.
+	// Tin trả lời trong thread không xuất hiện trên dòng thời gian chính của cuộc hội thoại.
+	ThreadRootID primitive.ObjectID `bson:"thread_root_id,omitempty" json:"thread_root_id,omitempty"`
+	// Các trường thread của tin nhắn gốc
+	ThreadReplyCount  int64                `bson:"thread_reply_count,omitempty" json:"thread_reply_count"`
+	ThreadLastReplyAt *time.Time           `bson:"thread_last_reply_at,omitempty" json:"thread_last_reply_at,omitempty"`
+	ThreadFollowers   []primitive.ObjectID `bson:"thread_followers,omitempty" json:"-"`
+	// ThreadUnreadCounts đếm số tin trả lời chưa đọc của từng người theo dõi, khóa là ID hex
+	ThreadUnreadCounts map[string]int64 `bson:"thread_unread_counts,omitempty" json:"-"`
+	EditedAt           *time.Time       `bson:"edited_at,omitempty" json:"edited_at,omitempty"` // nil nếu chưa từng được sửa
+	EditHistory        []MessageEdit    `bson:"edit_history,omitempty" json:"edit_history,omitempty"`
+	Reactions          []Reaction       `bson:"reactions,omitempty" json:"-"` // theo thứ tự thả, mỗi người một lần cho mỗi emoji
+	Attachments        []AttachmentRef  `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	CreatedAt          time.Time        `bson:"created_at" json:"created_at"`
+	UpdatedAt          time.Time        `bson:"updated_at" json:"updated_at"`
+}
+
+// IsVoice cho biết đây có phải tin nhắn thoại hay không
+func (m *Message) IsVoice() bool {
+	return m.Kind == MessageKindVoice
+}
+
+// IsHiddenFor cho biết userID đã xóa tin nhắn ở phía mình hay chưa
+func (m *Message) IsHiddenFor(userID primitive.ObjectID) bool {
+	for _, id := range m.HiddenFor {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsThreadReply cho biết tin nhắn là tin trả lời trong thread hay thuộc dòng thời gian chính
+func (m *Message) IsThreadReply() bool {
+	return !m.ThreadRootID.IsZero()
+}
+
+// IsFollowingThread cho biết userID có theo dõi thread của tin nhắn gốc này không
+func (m *Message) IsFollowingThread(userID primitive.ObjectID) bool {
+	for _, id := range m.ThreadFollowers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasReaction cho biết userID đã thả emoji vào tin nhắn chưa
+func (m *Message) HasReaction(userID primitive.ObjectID, emoji string) bool {
+	for _, reaction := range m.Reactions {
+		if reaction.UserID == userID && reaction.Emoji == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// ReactionSummaries gộp các reaction theo emoji, theo thứ tự emoji được thả lần đầu.
+// ReactedByMe chỉ được đặt khi viewer khác rỗng.
+func (m *Message) ReactionSummaries(viewer primitive.ObjectID) []ReactionSummary {
+	summaries := []ReactionSummary{}
+	index := make(map[string]int)
+	for _, reaction := range m.Reactions {
+		i, ok := index[reaction.Emoji]
+		if !ok {
+			i = len(summaries)
+			index[reaction.Emoji] = i
+			summaries = append(summaries, ReactionSummary{Emoji: reaction.Emoji})
+		}
+		summaries[i].Count++
+		if !viewer.IsZero() && reaction.UserID == viewer {
+			summaries[i].ReactedByMe = true
+		}
+	}
+	return summaries
+}
+
+// ThreadUnreadCountFor trả về số tin trả lời trong thread mà userID chưa đọc
+func (m *Message) ThreadUnreadCountFor(userID primitive.ObjectID) int64 {
+	if count := m.ThreadUnreadCounts[userID.Hex()]; count > 0 {
+		return count
+	}
+	return 0
+}
+
+// MessageEdit là một phiên bản cũ của nội dung tin nhắn, theo thứ tự từ cũ tới mới
+type MessageEdit struct {
+	Content    string    `bson:"content" json:"content"`
+	ReplacedAt time.Time `bson:"replaced_at" json:"replaced_at"` // thời điểm nội dung này bị thay bằng nội dung mới
+}
+
+// Reaction là một emoji người dùng thả vào tin nhắn
+type Reaction struct {
+	Emoji     string             `bson:"emoji" json:"emoji"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// ReactionSummary là số người đã thả một emoji vào tin nhắn
+type ReactionSummary struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
 }
 
 type MessageResponse struct {
-	ID             primitive.ObjectID `json:"id"`
-	Type           MessageType        `json:"type"`
-	ConversationID primitive.ObjectID `json:"conversation_id"`
-	GroupID        primitive.ObjectID `json:"group_id,omitempty"`
-	Sender         *UserResponse      `json:"sender"`
-	Content        string             `json:"content"`
-	Status         MessageStatus      `json:"status"`
-	ReadCount      int                `json:"read_count"`
-	CreatedAt      time.Time          `json:"created_at"`
+	ID             primitive.ObjectID   `json:"id"`
+	Type           MessageType          `json:"type"`
+	ConversationID primitive.ObjectID   `json:"conversation_id"`
+	GroupID        primitive.ObjectID   `json:"group_id,omitempty"`
+	Sender         *UserResponse        `json:"sender"`
+	Kind           MessageKind          `json:"kind"`
+	Content        string               `json:"content"`
+	Status         MessageStatus        `json:"status"`
+	ReadBy         []primitive.ObjectID `json:"read_by"`
+	ReadCount      int                  `json:"read_count"`
+	PlayedBy       []primitive.ObjectID `json:"played_by,omitempty"` // chỉ có ở tin nhắn thoại
+	Edited         bool                 `json:"edited"`
+	EditedAt       *time.Time           `json:"edited_at,omitempty"`
+	Deleted        bool                 `json:"deleted"` // tombstone: nội dung đã bị thu hồi
+	DeletedAt      *time.Time           `json:"deleted_at,omitempty"`
+	ReplyTo        *MessagePreview      `json:"reply_to,omitempty"`
+	ThreadRootID   *primitive.ObjectID  `json:"thread_root_id,omitempty"`
+	// Thống kê thread, chỉ có ở tin nhắn gốc
+	ThreadReplyCount  int64                 `json:"thread_reply_count"`
+	ThreadLastReplyAt *time.Time            `json:"thread_last_reply_at,omitempty"`
+	Reactions         []ReactionSummary     `json:"reactions"`
+	Attachments       []*AttachmentResponse `json:"attachments,omitempty"`
+	CreatedAt         time.Time             `json:"created_at"`
 }
 
 func (m *Message) ToResponse(sender *User) *MessageResponse {
-	return &MessageResponse{
-		ID:             m.ID,
-		Type:           m.Type,
-		ConversationID: m.ConversationID,
-		GroupID:        m.GroupID,
-		Sender:         sender.ToResponse(),
-		Content:        m.Content,
-		Status:         m.Status,
-		ReadCount:      len(m.ReadBy),
-		CreatedAt:      m.CreatedAt,
+	response := &MessageResponse{
+		ID:                m.ID,
+		Type:              m.Type,
+		ConversationID:    m.ConversationID,
+		GroupID:           m.GroupID,
+		Sender:            sender.ToResponse(),
+		Kind:              MessageKindText,
+		Content:           m.Content,
+		Status:            m.Status,
+		ReadBy:            m.ReadBy,
+		ReadCount:         len(m.ReadBy),
+		Edited:            m.EditedAt != nil,
+		EditedAt:          m.EditedAt,
+		Deleted:           m.IsDeleted,
+		DeletedAt:         m.DeletedAt,
+		ThreadReplyCount:  m.ThreadReplyCount,
+		ThreadLastReplyAt: m.ThreadLastReplyAt,
+		Reactions:         m.ReactionSummaries(primitive.NilObjectID),
+		CreatedAt:         m.CreatedAt,
+	}
+	if m.IsVoice() {
+		response.Kind = MessageKindVoice
+		response.PlayedBy = append([]primitive.ObjectID{}, m.PlayedBy...)
+	}
+	if m.IsThreadReply() {
+		rootID := m.ThreadRootID
+		response.ThreadRootID = &rootID
+	}
+	for _, attachment := range m.Attachments {
+		response.Attachments = append(response.Attachments, attachment.ToResponse())
+	}
+	return response
+}
+
+// replyPreviewLength là số ký tự tối đa của nội dung trong bản xem trước tin nhắn được trích dẫn
+const replyPreviewLength = 100
+
+// MessagePreview là bản rút gọn của tin nhắn được trích dẫn.
+// Bản xem trước được tạo từ trạng thái hiện tại của tin nhắn gốc nên phản ánh cả việc sửa và thu hồi.
+type MessagePreview struct {
+	ID         primitive.ObjectID `json:"id"`
+	SenderID   primitive.ObjectID `json:"sender_id"`
+	SenderName string             `json:"sender_name"`
+	Content    string             `json:"content"` // rỗng nếu tin nhắn gốc đã bị thu hồi
+	Edited     bool               `json:"edited"`
+	Deleted    bool               `json:"deleted"`
+}
+
+// ToPreview tạo bản xem trước của tin nhắn, nội dung dài được cắt ngắn
+func (m *Message) ToPreview(sender *User) *MessagePreview {
+	preview := &MessagePreview{
+		ID:         m.ID,
+		SenderID:   m.SenderID,
+		SenderName: sender.Name,
+		Edited:     m.EditedAt != nil,
+		Deleted:    m.IsDeleted,
+	}
+	if !m.IsDeleted {
+		preview.Content = truncateRunes(m.Content, replyPreviewLength)
+	}
+	return preview
+}
+
+// truncateRunes cắt s còn tối đa n ký tự, thêm dấu "…" nếu bị cắt
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
 	}
+	return string(runes[:n]) + "…"
 }
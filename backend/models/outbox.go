@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OutboxEvent là một sự kiện WebSocket được ghi cùng transaction với dữ liệu gây ra nó.
+// Dispatcher đọc các sự kiện còn chờ, gửi tới người nhận rồi xóa khỏi outbox.
+type OutboxEvent struct {
+	ID         primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	Type       string               `bson:"type" json:"type"`
+	Recipients []primitive.ObjectID `bson:"recipients" json:"recipients"`
+	Payload    []byte               `bson:"payload" json:"payload"` // payload đã mã hóa JSON
+	CreatedAt  time.Time            `bson:"created_at" json:"created_at"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session là một phiên đăng nhập trên một thiết bị. ID của phiên trùng với ID của TokenFamily
+// được tạo ra từ lần đăng nhập đó, nên thu hồi phiên là thu hồi family.
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Device     string             `bson:"device" json:"device"`
+	UserAgent  string             `bson:"user_agent" json:"user_agent"`
+	IP         string             `bson:"ip" json:"ip"` // IP của lần dùng gần nhất
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt time.Time          `bson:"last_used_at" json:"last_used_at"`
+}
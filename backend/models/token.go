@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RevokedToken là một JWT đã bị thu hồi trước khi hết hạn, ví dụ khi người dùng đăng xuất.
+// Bản ghi chỉ cần giữ tới ExpiresAt: sau thời điểm đó token bị từ chối vì đã hết hạn.
+type RevokedToken struct {
+	ID        string    `bson:"_id" json:"id"` // claim jti của token
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// TokenFamily là chuỗi refresh token sinh ra từ một lần đăng nhập. Mỗi refresh token chỉ dùng được một lần:
+// khi làm mới, CurrentTokenID chuyển sang token mới. Token cũ hơn được dùng lại là dấu hiệu token bị đánh cắp,
+// khi đó cả family bị thu hồi.
+type TokenFamily struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
+	CurrentTokenID string             `bson:"current_token_id" json:"-"` // jti của refresh token mới nhất
+	RevokedAt      *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"` // lần làm mới gần nhất
+	ExpiresAt      time.Time          `bson:"expires_at" json:"expires_at"` // thời điểm refresh token mới nhất hết hạn
+}
+
+// IsRevoked kiểm tra family đã bị thu hồi hay chưa
+func (f *TokenFamily) IsRevoked() bool {
+	return f.RevokedAt != nil
+}
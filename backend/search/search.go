@@ -0,0 +1,84 @@
+// Package search tách văn bản thành từ khóa để tìm kiếm tin nhắn không phân biệt hoa thường và dấu.
+// Mọi backend lưu trữ dùng chung cách tách từ này nên cùng một truy vấn cho cùng kết quả.
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxTermLength giới hạn độ dài một từ khóa (tính theo byte), phần dài hơn bị cắt bỏ
+const maxTermLength = 64
+
+// Token là một từ trong văn bản gốc và từ khóa đã chuẩn hóa của nó
+type Token struct {
+	Term       string
+	Start, End int // vị trí byte của từ trong văn bản gốc
+}
+
+// Tokens tách văn bản thành các từ: chuỗi liên tiếp các chữ cái, chữ số và dấu kết hợp.
+// Mọi ký tự khác (khoảng trắng, dấu câu, emoji...) là ký tự phân cách.
+func Tokens(text string) []Token {
+	var tokens []Token
+	start := -1
+	for i, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = appendToken(tokens, text, start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = appendToken(tokens, text, start, len(text))
+	}
+	return tokens
+}
+
+func appendToken(tokens []Token, text string, start, end int) []Token {
+	if term := Normalize(text[start:end]); term != "" {
+		tokens = append(tokens, Token{Term: term, Start: start, End: end})
+	}
+	return tokens
+}
+
+// Terms trả về các từ khóa khác nhau của văn bản theo thứ tự xuất hiện lần đầu
+func Terms(text string) []string {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, token := range Tokens(text) {
+		if !seen[token.Term] {
+			seen[token.Term] = true
+			terms = append(terms, token.Term)
+		}
+	}
+	return terms
+}
+
+// Normalize đưa một từ về dạng chữ thường, bỏ dấu: "Chào" và "chao" cho cùng một từ khóa.
+// "đ" được giữ nguyên vì là một chữ cái riêng, giống text index của MongoDB.
+func Normalize(word string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(word) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if b.Len()+utf8.RuneLen(r) > maxTermLength {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
@@ -1,25 +1,60 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	// ErrTokenRevoked được trả về khi token đã bị thu hồi, ví dụ sau khi đăng xuất
+	ErrTokenRevoked = errors.New("token đã bị thu hồi")
+	// ErrRefreshTokenReused được trả về khi refresh token đã được dùng để làm mới trước đó.
+	// Đây là dấu hiệu token bị đánh cắp nên cả family của token bị thu hồi.
+	ErrRefreshTokenReused = errors.New("refresh token đã được sử dụng")
+)
+
+// Giá trị của claim token_type. Access token và refresh token dùng chung secret
+// nên claim này ngăn việc dùng token loại này thay cho loại kia.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
 type AuthService struct {
-	jwtSecret     []byte
-	accessExpiry  time.Duration
-	refreshExpiry time.Duration
-	userService   *UserService // Sẽ được set sau khi khởi tạo để tránh circular dependency
+	jwtSecret        []byte
+	accessExpiry     time.Duration
+	refreshExpiry    time.Duration
+	userService      *UserService // Sẽ được set sau khi khởi tạo để tránh circular dependency
+	tokens           store.TokenStore
+	websocketHandler *types.WebSocketHandler
+	timeouts         Timeouts
+
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+	stopOnce    sync.Once
+
+	// sessionTouches ghi thời điểm LastUsedAt của từng phiên được ghi gần nhất, xem RecordSessionActivity
+	touchMu        sync.Mutex
+	sessionTouches map[primitive.ObjectID]time.Time
 }
 
 type TokenClaims struct {
-	UserID primitive.ObjectID `json:"user_id"`
+	UserID    primitive.ObjectID `json:"user_id"`
+	TokenType string             `json:"token_type"`
+	// FamilyID là family của lần đăng nhập đã cấp token, thu hồi family vô hiệu hóa mọi token của nó
+	FamilyID primitive.ObjectID `json:"family_id"`
 	jwt.RegisteredClaims
 }
 
@@ -29,11 +64,15 @@ type TokenPair struct {
 	ExpiresIn    int64  `json:"expires_in"` // Thời gian hết hạn của access token (seconds)
 }
 
-func NewAuthService(jwtSecret string) *AuthService {
+func NewAuthService(jwtSecret string, tokenStore store.TokenStore, wsHandler *types.WebSocketHandler, timeouts Timeouts) *AuthService {
 	return &AuthService{
-		jwtSecret:     []byte(jwtSecret),
-		accessExpiry:  24 * time.Hour,      // 24 giờ cho access token
-		refreshExpiry: 30 * 24 * time.Hour, // 30 ngày cho refresh token
+		jwtSecret:        []byte(jwtSecret),
+		accessExpiry:     24 * time.Hour,      // 24 giờ cho access token
+		refreshExpiry:    30 * 24 * time.Hour, // 30 ngày cho refresh token
+		tokens:           tokenStore,
+		websocketHandler: wsHandler,
+		timeouts:         timeouts,
+		sessionTouches:   make(map[primitive.ObjectID]time.Time),
 	}
 }
 
@@ -67,20 +106,54 @@ func (s *AuthService) ComparePasswords(hashedPassword, password string) error {
 	return nil
 }
 
-func (s *AuthService) GenerateTokenPair(userID primitive.ObjectID) (*TokenPair, error) {
+// GenerateTokenPair cấp cặp token cho một lần đăng nhập mới từ client, mở một token family
+// và một phiên đăng nhập mới
+func (s *AuthService) GenerateTokenPair(ctx context.Context, userID primitive.ObjectID, client ClientInfo) (*TokenPair, error) {
 	// Kiểm tra userID hợp lệ
 	if userID.IsZero() {
 		return nil, errors.New("userID không hợp lệ")
 	}
 
 	now := time.Now()
-	expiryTime := now.Add(s.accessExpiry)
+	family := &models.TokenFamily{
+		ID:             primitive.NewObjectID(),
+		UserID:         userID,
+		CurrentTokenID: primitive.NewObjectID().Hex(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		ExpiresAt:      now.Add(s.refreshExpiry),
+	}
 
-	// Generate access token
+	pair, err := s.signTokenPair(userID, family.ID, family.CurrentTokenID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	writeCtx, cancel := s.timeouts.write(ctx)
+	err = s.tokens.CreateTokenFamily(writeCtx, family)
+	cancel()
+	if err != nil {
+		log.Printf("Error creating token family: %v", err)
+		return nil, errors.New("không thể tạo token")
+	}
+
+	if err := s.createSession(ctx, userID, family.ID, client, now); err != nil {
+		log.Printf("Error creating session: %v", err)
+		return nil, errors.New("không thể tạo token")
+	}
+	return pair, nil
+}
+
+// signTokenPair ký access token và refresh token thuộc family, refresh token có jti là refreshID
+func (s *AuthService) signTokenPair(userID, familyID primitive.ObjectID, refreshID string, now time.Time) (*TokenPair, error) {
+	// Generate access token. Mỗi token có jti riêng để có thể thu hồi từng token
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
-		UserID: userID,
+		UserID:    userID,
+		TokenType: TokenTypeAccess,
+		FamilyID:  familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiryTime),
+			ID:        primitive.NewObjectID().Hex(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessExpiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			Subject:   userID.Hex(),
 		},
@@ -94,8 +167,11 @@ func (s *AuthService) GenerateTokenPair(userID primitive.ObjectID) (*TokenPair,
 
 	// Generate refresh token
 	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
-		UserID: userID,
+		UserID:    userID,
+		TokenType: TokenTypeRefresh,
+		FamilyID:  familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        refreshID,
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.refreshExpiry)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			Subject:   userID.Hex(),
@@ -115,7 +191,8 @@ func (s *AuthService) GenerateTokenPair(userID primitive.ObjectID) (*TokenPair,
 	}, nil
 }
 
-func (s *AuthService) ValidateToken(tokenString string) (*TokenClaims, error) {
+// parseToken kiểm tra chữ ký, thời hạn và loại của token
+func (s *AuthService) parseToken(tokenString, tokenType string) (*TokenClaims, error) {
 	if tokenString == "" {
 		return nil, errors.New("token trống")
 	}
@@ -136,39 +213,222 @@ func (s *AuthService) ValidateToken(tokenString string) (*TokenClaims, error) {
 		return nil, errors.New("token không hợp lệ")
 	}
 
-	if claims, ok := token.Claims.(*TokenClaims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*TokenClaims)
+	// Token cấp trước khi có jti, loại token và family không thể bị thu hồi nên không còn được chấp nhận
+	if !ok || !token.Valid || claims.ID == "" || claims.TokenType != tokenType || claims.FamilyID.IsZero() {
+		return nil, errors.New("token không hợp lệ")
+	}
+	return claims, nil
+}
+
+// ValidateToken kiểm tra chữ ký, thời hạn và trạng thái thu hồi của access token
+func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*TokenClaims, error) {
+	claims, err := s.parseToken(tokenString, TokenTypeAccess)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("token không hợp lệ")
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	revoked, err := s.tokens.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		log.Printf("Error checking token revocation: %v", err)
+		return nil, errors.New("không thể xác thực token")
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	// Family bị thu hồi khi đăng xuất hoặc khi refresh token bị dùng lại
+	family, err := s.tokens.GetTokenFamily(ctx, claims.FamilyID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrTokenRevoked
+	}
+	if err != nil {
+		log.Printf("Error loading token family: %v", err)
+		return nil, errors.New("không thể xác thực token")
+	}
+	if family.IsRevoked() || family.UserID != claims.UserID {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeToken thu hồi token có claims cho tới khi token hết hạn
+func (s *AuthService) RevokeToken(ctx context.Context, claims *TokenClaims) error {
+	if claims.ExpiresAt == nil {
+		return errors.New("token không hợp lệ")
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	return s.tokens.RevokeToken(ctx, &models.RevokedToken{ID: claims.ID, ExpiresAt: claims.ExpiresAt.Time})
 }
 
-func (s *AuthService) RefreshTokens(refreshToken string) (*TokenPair, error) {
-	claims, err := s.ValidateToken(refreshToken)
+// RevokeTokenFamily thu hồi mọi access token và refresh token của family
+func (s *AuthService) RevokeTokenFamily(ctx context.Context, familyID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.tokens.RevokeTokenFamily(ctx, familyID, time.Now())
+	return err
+}
+
+// Logout thu hồi access token và kết thúc phiên của nó, cùng phiên của refresh token đi kèm
+// (nếu có). Kết nối WebSocket của các phiên này bị đóng. Refresh token không hợp lệ hoặc
+// của người khác bị bỏ qua.
+func (s *AuthService) Logout(ctx context.Context, accessClaims *TokenClaims, refreshToken string) error {
+	if err := s.RevokeToken(ctx, accessClaims); err != nil {
+		return err
+	}
+	if err := s.endSession(ctx, accessClaims.UserID, accessClaims.FamilyID); err != nil {
+		return err
+	}
+
+	if refreshToken != "" {
+		refreshClaims, err := s.parseToken(refreshToken, TokenTypeRefresh)
+		if err == nil && refreshClaims.UserID == accessClaims.UserID && refreshClaims.FamilyID != accessClaims.FamilyID {
+			if err := s.endSession(ctx, refreshClaims.UserID, refreshClaims.FamilyID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartTokenCleanup xóa các token đã thu hồi và đã hết hạn sau mỗi interval
+func (s *AuthService) StartTokenCleanup(interval time.Duration) {
+	s.stopCleanup = make(chan struct{})
+	s.cleanupDone = make(chan struct{})
+	go s.cleanupLoop(interval)
+}
+
+// Stop dừng việc dọn token đã hết hạn
+func (s *AuthService) Stop() {
+	if s.stopCleanup == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stopCleanup)
+	})
+	<-s.cleanupDone
+}
+
+func (s *AuthService) cleanupLoop(interval time.Duration) {
+	defer close(s.cleanupDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			ctx, cancel := s.timeouts.write(context.Background())
+			deleted, err := s.tokens.DeleteExpiredTokens(ctx, now)
+			cancel()
+			if err != nil {
+				log.Printf("Error deleting expired tokens: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d expired revoked tokens and token families", deleted)
+			}
+
+			// Refresh token hết hạn sau refreshExpiry kể từ lần làm mới cuối, nên phiên không được dùng
+			// lâu hơn thời gian đó không thể dùng lại được nữa
+			ctx, cancel = s.timeouts.write(context.Background())
+			deleted, err = s.tokens.DeleteIdleSessions(ctx, now.Add(-s.refreshExpiry))
+			cancel()
+			if err != nil {
+				log.Printf("Error deleting idle sessions: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d idle sessions", deleted)
+			}
+			s.pruneSessionTouches(now)
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+// RefreshTokens đổi refresh token lấy cặp token mới trong cùng family và ghi nhận hoạt động của phiên
+// từ ip. Mỗi refresh token chỉ dùng được một lần: dùng lại token đã được thay thế sẽ kết thúc phiên
+// và trả về ErrRefreshTokenReused.
+func (s *AuthService) RefreshTokens(ctx context.Context, refreshToken, ip string) (*TokenPair, error) {
+	claims, err := s.parseToken(refreshToken, TokenTypeRefresh)
 	if err != nil {
 		return nil, err
 	}
 
+	readCtx, cancel := s.timeouts.read(ctx)
+	family, err := s.tokens.GetTokenFamily(readCtx, claims.FamilyID)
+	cancel()
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrTokenRevoked
+	}
+	if err != nil {
+		log.Printf("Error loading token family: %v", err)
+		return nil, errors.New("không thể xác thực token")
+	}
+	if family.IsRevoked() || family.UserID != claims.UserID {
+		return nil, ErrTokenRevoked
+	}
+	if family.CurrentTokenID != claims.ID {
+		return nil, s.revokeReusedFamily(ctx, claims)
+	}
+
 	// Kiểm tra người dùng vẫn tồn tại trước khi cấp token mới
 	if s.userService != nil {
-		_, err = s.userService.GetUserByID(claims.UserID)
+		_, err = s.userService.GetUserByID(ctx, claims.UserID)
 		if err != nil {
 			log.Printf("User not found during token refresh: %v", err)
 			return nil, errors.New("người dùng không tồn tại")
 		}
 	}
 
-	return s.GenerateTokenPair(claims.UserID)
+	now := time.Now()
+	newRefreshID := primitive.NewObjectID().Hex()
+	pair, err := s.signTokenPair(claims.UserID, claims.FamilyID, newRefreshID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	writeCtx, cancel := s.timeouts.write(ctx)
+	rotated, err := s.tokens.RotateTokenFamily(writeCtx, claims.FamilyID, claims.ID, newRefreshID, now.Add(s.refreshExpiry), now)
+	cancel()
+	if err != nil {
+		log.Printf("Error rotating token family: %v", err)
+		return nil, errors.New("không thể tạo token")
+	}
+	// Một yêu cầu khác đã dùng cùng refresh token ngay trước yêu cầu này
+	if !rotated {
+		return nil, s.revokeReusedFamily(ctx, claims)
+	}
+
+	s.markSessionTouched(claims.FamilyID, now)
+	s.touchSession(ctx, claims.FamilyID, ip, now)
+	return pair, nil
+}
+
+// revokeReusedFamily kết thúc phiên của refresh token bị dùng lại, gồm cả kết nối WebSocket của phiên,
+// vì không thể biết bên nào đang giữ token bị đánh cắp
+func (s *AuthService) revokeReusedFamily(ctx context.Context, claims *TokenClaims) error {
+	log.Printf("Refresh token reuse detected for user %s, revoking token family %s", claims.UserID.Hex(), claims.FamilyID.Hex())
+	if err := s.endSession(ctx, claims.UserID, claims.FamilyID); err != nil {
+		log.Printf("Error revoking token family: %v", err)
+	}
+	return ErrRefreshTokenReused
 }
 
 // GetUserFromToken trả về thông tin người dùng từ token
-func (s *AuthService) GetUserFromToken(token string) (*TokenClaims, error) {
-	return s.ValidateToken(token)
+func (s *AuthService) GetUserFromToken(ctx context.Context, token string) (*TokenClaims, error) {
+	return s.ValidateToken(ctx, token)
 }
 
 // GetUserIDFromToken trích xuất userID từ token
-func (s *AuthService) GetUserIDFromToken(token string) (primitive.ObjectID, error) {
-	claims, err := s.ValidateToken(token)
+func (s *AuthService) GetUserIDFromToken(ctx context.Context, token string) (primitive.ObjectID, error) {
+	claims, err := s.ValidateToken(ctx, token)
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestAuthService(t *testing.T) *AuthService {
+	t.Helper()
+	return NewAuthService("test-secret", store.NewMemoryStore(), types.NewWebSocketHandler(), DefaultTimeouts())
+}
+
+func login(t *testing.T, s *AuthService) *TokenPair {
+	t.Helper()
+	pair, err := s.GenerateTokenPair(context.Background(), primitive.NewObjectID(), ClientInfo{UserAgent: "test", IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err)
+	}
+	return pair
+}
+
+func TestTokenTypes(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	pair := login(t, s)
+
+	if _, err := s.RefreshTokens(ctx, pair.AccessToken, "127.0.0.1"); err == nil {
+		t.Error("RefreshTokens accepted an access token")
+	}
+	if _, err := s.ValidateToken(ctx, pair.RefreshToken); err == nil {
+		t.Error("ValidateToken accepted a refresh token")
+	}
+
+	// Lần dùng sai loại không được làm hỏng family: refresh token vẫn dùng được
+	if _, err := s.ValidateToken(ctx, pair.AccessToken); err != nil {
+		t.Errorf("ValidateToken: %v", err)
+	}
+	if _, err := s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1"); err != nil {
+		t.Errorf("RefreshTokens: %v", err)
+	}
+}
+
+func TestRefreshTokenSingleUse(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	pair := login(t, s)
+
+	rotated, err := s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RefreshTokens: %v", err)
+	}
+	if rotated.RefreshToken == pair.RefreshToken {
+		t.Fatal("RefreshTokens returned the same refresh token")
+	}
+	if _, err := s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("second refresh with the same token: got %v, want ErrRefreshTokenReused", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	pair := login(t, s)
+	other := login(t, s)
+
+	rotated, err := s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("RefreshTokens: %v", err)
+	}
+	if _, err := s.ValidateToken(ctx, rotated.AccessToken); err != nil {
+		t.Fatalf("ValidateToken before reuse: %v", err)
+	}
+
+	if _, err := s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reuse: got %v, want ErrRefreshTokenReused", err)
+	}
+
+	for name, token := range map[string]string{
+		"original access token": pair.AccessToken,
+		"rotated access token":  rotated.AccessToken,
+	} {
+		if _, err := s.ValidateToken(ctx, token); !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("%s: got %v, want ErrTokenRevoked", name, err)
+		}
+	}
+	if _, err := s.RefreshTokens(ctx, rotated.RefreshToken, "127.0.0.1"); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("rotated refresh token: got %v, want ErrTokenRevoked", err)
+	}
+
+	// Family của lần đăng nhập khác không bị ảnh hưởng
+	if _, err := s.ValidateToken(ctx, other.AccessToken); err != nil {
+		t.Errorf("other family: %v", err)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+
+	for round := 0; round < 20; round++ {
+		pair := login(t, s)
+
+		const workers = 2
+		errs := make([]error, workers)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				_, errs[i] = s.RefreshTokens(ctx, pair.RefreshToken, "127.0.0.1")
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, ErrRefreshTokenReused):
+				t.Errorf("round %d: got %v, want ErrRefreshTokenReused", round, err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("round %d: %d refreshes succeeded, want 1", round, succeeded)
+		}
+	}
+}
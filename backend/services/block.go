@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrCannotBlockSelf được trả về khi người dùng tự chặn chính mình
+	ErrCannotBlockSelf = errors.New("không thể tự chặn chính mình")
+	// ErrUserNotBlocked được trả về khi bỏ chặn người chưa bị chặn
+	ErrUserNotBlocked = errors.New("người dùng này chưa bị chặn")
+	// ErrUserBlocked được trả về khi một trong hai người đã chặn người kia. Thông báo giống nhau
+	// với cả hai phía để người bị chặn không biết mình đã bị chặn.
+	ErrUserBlocked = errors.New("không thể tương tác với người dùng này")
+)
+
+// BlockedUser là một người trong danh sách chặn
+type BlockedUser struct {
+	User      *models.UserResponse `json:"user"`
+	BlockedAt time.Time            `json:"blocked_at"`
+}
+
+// BlockUser chặn blockedID. Người bị chặn không thể mở cuộc hội thoại 1-1 hay nhắn tin riêng với blockerID,
+// không thấy trạng thái online và đang gõ của blockerID và không tìm thấy blockerID khi tìm kiếm;
+// tin nhắn của người bị chặn trong các nhóm chung bị ẩn với blockerID. Chặn lại người đã chặn không có tác dụng.
+func (s *UserService) BlockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) error {
+	if blockerID == blockedID {
+		return ErrCannotBlockSelf
+	}
+	if _, err := s.GetUserByID(ctx, blockedID); err != nil {
+		return err
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.store.BlockUser(ctx, &models.UserBlock{
+		BlockerID: blockerID,
+		BlockedID: blockedID,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// UnblockUser bỏ chặn blockedID
+func (s *UserService) UnblockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	removed, err := s.store.UnblockUser(ctx, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrUserNotBlocked
+	}
+	return nil
+}
+
+// ListBlockedUsers lấy danh sách những người userID đã chặn, chặn gần đây nhất trước
+func (s *UserService) ListBlockedUsers(ctx context.Context, userID primitive.ObjectID) ([]*BlockedUser, error) {
+	readCtx, cancel := s.timeouts.read(ctx)
+	blocks, err := s.store.ListBlocks(readCtx, userID)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(blocks))
+	for i, block := range blocks {
+		ids[i] = block.BlockedID
+	}
+	users, err := s.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*BlockedUser, 0, len(blocks))
+	for _, block := range blocks {
+		user, ok := users[block.BlockedID]
+		if !ok {
+			continue
+		}
+		result = append(result, &BlockedUser{User: user.ToResponse(), BlockedAt: block.CreatedAt})
+	}
+	return result, nil
+}
+
+// BlockedIDs trả về ID của những người userID đã chặn
+func (s *UserService) BlockedIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	blocks, err := s.store.ListBlocks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(blocks))
+	for i, block := range blocks {
+		ids[i] = block.BlockedID
+	}
+	return ids, nil
+}
+
+// BlockerIDs trả về ID của những người đã chặn userID
+func (s *UserService) BlockerIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	return s.store.ListBlockerIDs(ctx, userID)
+}
+
+// BlockPeerIDs trả về ID của những người có quan hệ chặn với userID theo bất kỳ chiều nào
+func (s *UserService) BlockPeerIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	blocked, err := s.BlockedIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	blockers, err := s.BlockerIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range blockers {
+		if !containsID(blocked, id) {
+			blocked = append(blocked, id)
+		}
+	}
+	return blocked, nil
+}
+
+// IsBlocked kiểm tra một trong hai người đã chặn người kia hay chưa
+func (s *UserService) IsBlocked(ctx context.Context, userID1, userID2 primitive.ObjectID) (bool, error) {
+	peers, err := s.BlockPeerIDs(ctx, userID1)
+	if err != nil {
+		return false, err
+	}
+	return containsID(peers, userID2), nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"webchat/models"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// eventRecipients trả về người nhận của sự kiện eventType duy nhất đang chờ trong outbox
+func (e *testEnv) eventRecipients(t *testing.T, eventType string) []primitive.ObjectID {
+	t.Helper()
+	events := e.takeEvents(t, eventType)
+	if len(events) != 1 {
+		t.Fatalf("got %d %s events, want 1", len(events), eventType)
+	}
+	return events[0].Recipients
+}
+
+func TestBlockUserErrors(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob := e.newUser(t, "alice"), e.newUser(t, "bob")
+
+	for _, tc := range []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "block self", call: func() error { return e.users.BlockUser(ctx, alice, alice) }, want: ErrCannotBlockSelf},
+		{name: "block unknown user", call: func() error { return e.users.BlockUser(ctx, alice, primitive.NewObjectID()) }, want: ErrUserNotFound},
+		{name: "unblock user who is not blocked", call: func() error { return e.users.UnblockUser(ctx, alice, bob) }, want: ErrUserNotBlocked},
+		{name: "block", call: func() error { return e.users.BlockUser(ctx, alice, bob) }, want: nil},
+		{name: "block again", call: func() error { return e.users.BlockUser(ctx, alice, bob) }, want: nil},
+		{name: "unblock", call: func() error { return e.users.UnblockUser(ctx, alice, bob) }, want: nil},
+		{name: "unblock again", call: func() error { return e.users.UnblockUser(ctx, alice, bob) }, want: ErrUserNotBlocked},
+	} {
+		if err := tc.call(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestBlockPersonalConversation(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob := e.newUser(t, "alice"), e.newUser(t, "bob")
+	conv, err := e.chat.CreatePersonalConversation(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("CreatePersonalConversation: %v", err)
+	}
+	if err := e.users.BlockUser(ctx, alice, bob); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+
+	// Cả hai phía nhận cùng một lỗi
+	for _, tc := range []struct {
+		name     string
+		from, to primitive.ObjectID
+	}{
+		{name: "blocked user", from: bob, to: alice},
+		{name: "blocker", from: alice, to: bob},
+	} {
+		if _, err := e.chat.CreatePersonalConversation(ctx, tc.from, tc.to); !errors.Is(err, ErrUserBlocked) {
+			t.Errorf("%s opens the conversation: got %v, want ErrUserBlocked", tc.name, err)
+		}
+		if _, err := e.chat.SendMessage(ctx, tc.from, conv.ID, "xin chào", primitive.NilObjectID, nil, models.MessageKindText); !errors.Is(err, ErrUserBlocked) {
+			t.Errorf("%s sends: got %v, want ErrUserBlocked", tc.name, err)
+		}
+	}
+}
+
+func TestBlockInSharedGroup(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol")
+	convID := e.newGroup(t, alice, bob, carol)
+	if err := e.users.BlockUser(ctx, carol, bob); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	e.takeEvents(t, "")
+
+	// Tin nhắn của người bị chặn: người chặn không nhận sự kiện, không thấy và không bị tính chưa đọc
+	fromBob := e.send(t, bob, convID, "của bob")
+	if got, want := e.eventRecipients(t, types.EventTypeMessage), []primitive.ObjectID{alice, bob}; !equalIDSets(got, want) {
+		t.Errorf("message recipients = %v, want %v", got, want)
+	}
+	if _, ok := e.timeline(t, carol, convID)[fromBob.ID]; ok {
+		t.Error("carol sees a message from a blocked user")
+	}
+	if _, ok := e.timeline(t, alice, convID)[fromBob.ID]; !ok {
+		t.Error("alice does not see bob's message")
+	}
+	if got := e.unreadCount(t, carol, convID); got != 0 {
+		t.Errorf("carol unread = %d, want 0", got)
+	}
+
+	// Sửa và thả reaction vào tin nhắn đó cũng không tới người chặn
+	if _, err := e.chat.EditMessage(ctx, bob, fromBob.ID, "đã sửa"); err != nil {
+		t.Fatalf("EditMessage: %v", err)
+	}
+	if got, want := e.eventRecipients(t, types.EventTypeMessageEdited), []primitive.ObjectID{alice, bob}; !equalIDSets(got, want) {
+		t.Errorf("message_edited recipients = %v, want %v", got, want)
+	}
+	if _, err := e.chat.ToggleReaction(ctx, alice, fromBob.ID, "👍"); err != nil {
+		t.Fatalf("ToggleReaction: %v", err)
+	}
+	if got, want := e.eventRecipients(t, types.EventTypeMessageReaction), []primitive.ObjectID{alice, bob}; !equalIDSets(got, want) {
+		t.Errorf("message_reaction recipients = %v, want %v", got, want)
+	}
+
+	// Tin trả lời của người khác vẫn tới người chặn, với bản xem trước bị ẩn
+	reply, err := e.chat.SendMessage(ctx, alice, convID, "trả lời bob", fromBob.ID, nil, models.MessageKindText)
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	events := e.takeEvents(t, types.EventTypeMessage)
+	if len(events) != 2 {
+		t.Fatalf("got %d message events for the reply, want 2", len(events))
+	}
+	for _, event := range events {
+		var response models.MessageResponse
+		if err := json.Unmarshal(event.Payload, &response); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		masked := equalIDSets(event.Recipients, []primitive.ObjectID{carol})
+		if !masked && !equalIDSets(event.Recipients, []primitive.ObjectID{alice, bob}) {
+			t.Errorf("reply event recipients = %v, want carol alone or alice and bob", event.Recipients)
+		}
+		if preview := response.ReplyTo; preview == nil || preview.Deleted != masked || (preview.Content == "") != masked {
+			t.Errorf("reply event for %v has preview %+v, masked %v", event.Recipients, preview, masked)
+		}
+	}
+	seen, ok := e.timeline(t, carol, convID)[reply.ID]
+	if !ok {
+		t.Fatal("carol does not see alice's reply")
+	}
+	if preview := seen.ReplyTo; preview == nil || !preview.Deleted || preview.Content != "" || preview.ID != fromBob.ID {
+		t.Errorf("carol sees preview %+v, want a placeholder for %s", preview, fromBob.ID.Hex())
+	}
+
+	// Bỏ chặn: tin nhắn cũ hiện lại nhưng vẫn không bị tính chưa đọc
+	if err := e.users.UnblockUser(ctx, carol, bob); err != nil {
+		t.Fatalf("UnblockUser: %v", err)
+	}
+	if _, ok := e.timeline(t, carol, convID)[fromBob.ID]; !ok {
+		t.Error("carol does not see bob's message after unblocking")
+	}
+	if got := e.unreadCount(t, carol, convID); got != 1 {
+		t.Errorf("carol unread after unblocking = %d, want 1 (alice's reply only)", got)
+	}
+}
@@ -2,103 +2,91 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"log"
-	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"webchat/models"
+	"webchat/store"
 	"webchat/types"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// MockChatStore lưu trữ cuộc trò chuyện và tin nhắn trong bộ nhớ khi không có cơ sở dữ liệu thật
-type MockChatStore struct {
-	conversations    map[primitive.ObjectID]*models.Conversation
-	conversationList []*models.Conversation
-	messages         map[primitive.ObjectID]*models.Message
-	messagesByConv   map[primitive.ObjectID][]*models.Message
-}
+var (
+	// ErrMessageNotFound được trả về khi tin nhắn không tồn tại hoặc đã bị xóa
+	ErrMessageNotFound = errors.New("tin nhắn không tồn tại")
+	// ErrNotMessageSender được trả về khi người dùng thao tác trên tin nhắn của người khác
+	ErrNotMessageSender = errors.New("chỉ người gửi mới được sửa tin nhắn")
+	// ErrEditWindowExpired được trả về khi tin nhắn đã quá thời gian cho phép sửa
+	ErrEditWindowExpired = errors.New("đã quá thời gian cho phép sửa tin nhắn")
+	// ErrDeleteForbidden được trả về khi người dùng thu hồi tin nhắn không phải của mình ngoài vai trò quản trị viên nhóm
+	ErrDeleteForbidden = errors.New("chỉ người gửi hoặc quản trị viên nhóm mới được thu hồi tin nhắn")
+	// ErrInvalidReplyTo được trả về khi tin nhắn được trả lời không thuộc dòng thời gian chính của cùng cuộc hội thoại hoặc đã bị thu hồi
+	ErrInvalidReplyTo = errors.New("tin nhắn được trả lời không hợp lệ")
+	// ErrInvalidDeleteScope được trả về khi phạm vi xóa không phải DeleteForMe hoặc DeleteForEveryone
+	ErrInvalidDeleteScope = errors.New("phạm vi xóa tin nhắn không hợp lệ")
+	// ErrEmptyMessage được trả về khi tin nhắn không có nội dung lẫn tệp đính kèm
+	ErrEmptyMessage = errors.New("nội dung tin nhắn không được để trống")
+	// ErrMessageTooLong được trả về khi nội dung tin nhắn dài hơn maxMessageLength ký tự
+	ErrMessageTooLong = errors.New("độ dài tin nhắn không được vượt quá 2000 ký tự")
+)
 
-// Tạo một mock chat store mới
-func NewMockChatStore() *MockChatStore {
-	return &MockChatStore{
-		conversations:    make(map[primitive.ObjectID]*models.Conversation),
-		conversationList: []*models.Conversation{},
-		messages:         make(map[primitive.ObjectID]*models.Message),
-		messagesByConv:   make(map[primitive.ObjectID][]*models.Message),
-	}
-}
+// maxMessageLength là số ký tự (rune) tối đa của nội dung tin nhắn
+const maxMessageLength = 2000
+
+// DeleteScope là phạm vi xóa tin nhắn
+type DeleteScope string
+
+const (
+	DeleteForMe       DeleteScope = "me"       // chỉ ẩn tin nhắn với người xóa
+	DeleteForEveryone DeleteScope = "everyone" // thu hồi tin nhắn, mọi người chỉ còn thấy tombstone
+)
 
 type ChatService struct {
-	db               *mongo.Database
+	store            store.ChatStore
 	websocketHandler *types.WebSocketHandler
-	mockStore        *MockChatStore
-	useMock          bool
+	outbox           *OutboxDispatcher
+	users            *UserService
+	files            *FileService
+	policy           MessagePolicy
+	timeouts         Timeouts
 }
 
-func NewChatService(db *mongo.Database, wsHandler *types.WebSocketHandler) *ChatService {
-	useMock := db == nil
-	var mockStore *MockChatStore
-
-	if useMock {
-		log.Println("ChatService: Using in-memory mock database")
-		mockStore = NewMockChatStore()
-	}
-
+func NewChatService(chatStore store.ChatStore, userService *UserService, fileService *FileService, wsHandler *types.WebSocketHandler, outbox *OutboxDispatcher, policy MessagePolicy, timeouts Timeouts) *ChatService {
 	return &ChatService{
-		db:               db,
+		store:            chatStore,
+		users:            userService,
+		files:            fileService,
 		websocketHandler: wsHandler,
-		mockStore:        mockStore,
-		useMock:          useMock,
+		outbox:           outbox,
+		policy:           policy,
+		timeouts:         timeouts,
 	}
 }
 
-// CreatePersonalConversation tạo cuộc hội thoại 1-1
-func (s *ChatService) CreatePersonalConversation(userID1, userID2 primitive.ObjectID) (*models.Conversation, error) {
-	// Mock database mode
-	if s.useMock {
-		// Kiểm tra xem cuộc hội thoại đã tồn tại chưa
-		for _, conv := range s.mockStore.conversationList {
-			if conv.Type == models.ConversationTypePersonal &&
-				len(conv.Participants) == 2 &&
-				containsID(conv.Participants, userID1) &&
-				containsID(conv.Participants, userID2) {
-				return conv, nil
-			}
-		}
-
-		// Tạo cuộc hội thoại mới
-		conv := &models.Conversation{
-			ID:           primitive.NewObjectID(),
-			Type:         models.ConversationTypePersonal,
-			Participants: []primitive.ObjectID{userID1, userID2},
-			CreatedAt:    time.Now(),
-			UpdatedAt:    time.Now(),
-		}
-
-		s.mockStore.conversations[conv.ID] = conv
-		s.mockStore.conversationList = append(s.mockStore.conversationList, conv)
-		s.mockStore.messagesByConv[conv.ID] = []*models.Message{}
+// CreatePersonalConversation tạo cuộc hội thoại 1-1, trả về ErrUserBlocked nếu một trong hai người đã chặn người kia
+func (s *ChatService) CreatePersonalConversation(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.Conversation, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
 
-		return conv, nil
+	blocked, err := s.users.IsBlocked(ctx, userID1, userID2)
+	if err != nil {
+		return nil, err
 	}
-
-	// Normal database mode
-	// Kiểm tra xem cuộc hội thoại đã tồn tại chưa
-	filter := bson.M{
-		"type":         models.ConversationTypePersonal,
-		"participants": bson.M{"$all": []primitive.ObjectID{userID1, userID2}},
+	if blocked {
+		return nil, ErrUserBlocked
 	}
 
-	var existingConv models.Conversation
-	err := s.db.Collection("conversations").FindOne(context.Background(), filter).Decode(&existingConv)
+	// Kiểm tra xem cuộc hội thoại đã tồn tại chưa
+	existingConv, err := s.store.FindPersonalConversation(ctx, userID1, userID2)
 	if err == nil {
-		return &existingConv, nil
+		return existingConv, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
 	}
 
 	conv := &models.Conversation{
@@ -109,49 +97,23 @@ func (s *ChatService) CreatePersonalConversation(userID1, userID2 primitive.Obje
 		UpdatedAt:    time.Now(),
 	}
 
-	_, err = s.db.Collection("conversations").InsertOne(context.Background(), conv)
-	return conv, err
+	if err := s.store.CreateConversation(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
 }
 
 // CreateGroupConversation tạo cuộc hội thoại nhóm
-func (s *ChatService) CreateGroupConversation(name string, image string, creatorID primitive.ObjectID, participants []primitive.ObjectID) (*models.Conversation, error) {
+func (s *ChatService) CreateGroupConversation(ctx context.Context, name string, image string, creatorID primitive.ObjectID, participants []primitive.ObjectID) (*models.Conversation, error) {
 	if len(participants) > 20 {
 		return nil, errors.New("số lượng thành viên không được vượt quá 20")
 	}
 
 	// Thêm người tạo vào danh sách thành viên nếu chưa có
-	hasCreator := false
-	for _, p := range participants {
-		if p == creatorID {
-			hasCreator = true
-			break
-		}
-	}
-	if !hasCreator {
+	if !containsID(participants, creatorID) {
 		participants = append(participants, creatorID)
 	}
 
-	// Mock database mode
-	if s.useMock {
-		conv := &models.Conversation{
-			ID:           primitive.NewObjectID(),
-			Type:         models.ConversationTypeGroup,
-			Name:         name,
-			Image:        image,
-			Participants: participants,
-			Admins:       []primitive.ObjectID{creatorID},
-			CreatedAt:    time.Now(),
-			UpdatedAt:    time.Now(),
-		}
-
-		s.mockStore.conversations[conv.ID] = conv
-		s.mockStore.conversationList = append(s.mockStore.conversationList, conv)
-		s.mockStore.messagesByConv[conv.ID] = []*models.Message{}
-
-		return conv, nil
-	}
-
-	// Normal database mode
 	conv := &models.Conversation{
 		ID:           primitive.NewObjectID(),
 		Type:         models.ConversationTypeGroup,
@@ -163,93 +125,71 @@ func (s *ChatService) CreateGroupConversation(name string, image string, creator
 		UpdatedAt:    time.Now(),
 	}
 
-	_, err := s.db.Collection("conversations").InsertOne(context.Background(), conv)
-	return conv, err
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	if err := s.store.CreateConversation(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
 }
 
-// SendMessage gửi tin nhắn mới
-func (s *ChatService) SendMessage(senderID, conversationID primitive.ObjectID, content string) (*models.Message, error) {
+// SendMessage gửi tin nhắn mới và trả về tin nhắn kèm thông tin người gửi.
+// replyToID là tin nhắn được trích dẫn trong cùng cuộc hội thoại, bỏ trống nếu không trả lời tin nhắn nào.
+// attachmentIDs là các tệp senderID đã tải lên và chưa gắn vào tin nhắn nào; tin nhắn có tệp đính kèm
+// có thể không có nội dung.
+func (s *ChatService) SendMessage(ctx context.Context, senderID, conversationID primitive.ObjectID, content string, replyToID primitive.ObjectID, attachmentIDs []primitive.ObjectID, kind models.MessageKind) (*models.MessageResponse, error) {
 	// Kiểm tra độ dài tin nhắn
 	if len(content) > 2000 {
 		return nil, errors.New("độ dài tin nhắn không được vượt quá 2000 ký tự")
 	}
+	kind, err := parseMessageKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	if kind == models.MessageKindVoice && (content != "" || len(attachmentIDs) != 1) {
+		return nil, ErrInvalidVoiceMessage
+	}
+	if content == "" && len(attachmentIDs) == 0 {
+		return nil, ErrEmptyMessage
+	}
 
-	// Mock database mode
-	if s.useMock {
-		// Lấy thông tin cuộc hội thoại
-		conv, exists := s.mockStore.conversations[conversationID]
-		if !exists {
-			return nil, errors.New("cuộc hội thoại không tồn tại")
-		}
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
 
-		// Kiểm tra quyền gửi tin nhắn
-		hasAccess := false
-		for _, p := range conv.Participants {
-			if p == senderID {
-				hasAccess = true
-				break
-			}
-		}
-		if !hasAccess {
-			return nil, errors.New("không có quyền gửi tin nhắn trong cuộc hội thoại này")
+	// Lấy thông tin cuộc hội thoại
+	conv, err := s.store.GetConversation(ctx, conversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errors.New("cuộc hội thoại không tồn tại")
 		}
+		return nil, err
+	}
 
-		// Tạo tin nhắn mới
-		msg := &models.Message{
-			ID:             primitive.NewObjectID(),
-			ConversationID: conversationID,
-			SenderID:       senderID,
-			Content:        content,
-			Status:         models.MessageStatusSent,
-			ReadBy:         []primitive.ObjectID{senderID},
-			CreatedAt:      time.Now(),
-			UpdatedAt:      time.Now(),
-		}
+	// Kiểm tra quyền gửi tin nhắn
+	if !containsID(conv.Participants, senderID) {
+		return nil, errors.New("không có quyền gửi tin nhắn trong cuộc hội thoại này")
+	}
+	if err := s.checkPersonalBlock(ctx, conv, senderID); err != nil {
+		return nil, err
+	}
 
-		if conv.Type == models.ConversationTypePersonal {
-			msg.Type = models.MessageTypePersonal
-		} else {
-			msg.Type = models.MessageTypeGroup
-			msg.GroupID = conversationID
+	if !replyToID.IsZero() {
+		replyTo, err := s.store.GetMessage(ctx, replyToID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
 		}
-
-		// Lưu tin nhắn vào mock store
-		s.mockStore.messages[msg.ID] = msg
-		s.mockStore.messagesByConv[conversationID] = append(s.mockStore.messagesByConv[conversationID], msg)
-
-		// Cập nhật tin nhắn cuối cùng cho cuộc hội thoại
-		conv.LastMessage = msg
-		conv.UpdatedAt = time.Now()
-
-		// Gửi tin nhắn qua WebSocket cho tất cả người tham gia
-		for _, participantID := range conv.Participants {
-			if participantID != senderID {
-				s.websocketHandler.SendToUser(participantID, types.WebSocketMessage{
-					Type:    types.EventTypeMessage,
-					Payload: msg,
-				})
-			}
+		if err != nil || replyTo.ConversationID != conversationID || replyTo.IsDeleted || replyTo.IsHiddenFor(senderID) || replyTo.IsThreadReply() {
+			return nil, ErrInvalidReplyTo
 		}
-
-		return msg, nil
 	}
 
-	// Normal database mode
-	var conv models.Conversation
-	err := s.db.Collection("conversations").FindOne(context.Background(), bson.M{"_id": conversationID}).Decode(&conv)
+	attachments, err := s.files.attachmentRefs(ctx, senderID, attachmentIDs)
 	if err != nil {
 		return nil, err
 	}
-
-	hasAccess := false
-	for _, p := range conv.Participants {
-		if p == senderID {
-			hasAccess = true
-			break
-		}
-	}
-	if !hasAccess {
-		return nil, errors.New("không có quyền gửi tin nhắn trong cuộc hội thoại này")
+	if kind == models.MessageKindVoice && !validVoiceMessage(content, attachments) {
+		return nil, ErrInvalidVoiceMessage
 	}
 
 	msg := &models.Message{
@@ -257,7 +197,10 @@ func (s *ChatService) SendMessage(senderID, conversationID primitive.ObjectID, c
 		Type:           models.MessageTypePersonal,
 		ConversationID: conversationID,
 		SenderID:       senderID,
+		Kind:           kind,
+		ReplyToID:      replyToID,
 		Content:        content,
+		Attachments:    attachments,
 		Status:         models.MessageStatusSent,
 		ReadBy:         []primitive.ObjectID{senderID},
 		CreatedAt:      time.Now(),
@@ -268,211 +211,610 @@ func (s *ChatService) SendMessage(senderID, conversationID primitive.ObjectID, c
 		msg.Type = models.MessageTypeGroup
 		msg.GroupID = conversationID
 	}
+	if msg.UnreadExempt, err = s.blockersAmong(ctx, senderID, conv.Participants); err != nil {
+		return nil, err
+	}
 
-	_, err = s.db.Collection("messages").InsertOne(context.Background(), msg)
+	// Tin nhắn mới chưa có reaction nên response không phụ thuộc người xem và dùng được cho sự kiện
+	response, err := s.MessageResponse(ctx, primitive.NilObjectID, msg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Cập nhật tin nhắn cuối cùng của cuộc hội thoại
-	update := bson.M{
-		"$set": bson.M{
-			"last_message": msg,
-			"updated_at":   time.Now(),
-		},
+	// Sự kiện WebSocket được ghi vào outbox cùng với tin nhắn. Người gửi cũng nhận sự kiện để đồng bộ các thiết bị khác
+	recipients, err := s.withoutBlockers(ctx, senderID, conv.Participants)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.messageEvents(ctx, types.EventTypeMessage, response, recipients, msg.CreatedAt)
+	if err != nil {
+		return nil, err
 	}
-	_, err = s.db.Collection("conversations").UpdateOne(context.Background(), bson.M{"_id": conversationID}, update)
 
-	// Gửi tin nhắn qua WebSocket cho tất cả người tham gia
-	for _, participantID := range conv.Participants {
-		if participantID != senderID {
-			s.websocketHandler.SendToUser(participantID, types.WebSocketMessage{
-				Type:    types.EventTypeMessage,
-				Payload: msg,
-			})
+	// Lưu tin nhắn, gắn tệp đính kèm, cập nhật tin nhắn cuối cùng và ghi sự kiện trong cùng một transaction.
+	// Tệp vừa được gắn vào tin nhắn khác bởi một request đồng thời sẽ làm thao tác thất bại.
+	if err := s.store.SaveMessage(ctx, msg, events); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errors.New("cuộc hội thoại không tồn tại")
+		}
+		if errors.Is(err, store.ErrAttachmentUnavailable) {
+			return nil, ErrInvalidAttachment
 		}
+		return nil, err
 	}
 
-	return msg, err
+	s.outbox.Notify()
+	return response, nil
 }
 
-// GetMessages lấy danh sách tin nhắn của cuộc hội thoại
-func (s *ChatService) GetMessages(conversationID primitive.ObjectID, limit int64, before time.Time) ([]*models.Message, error) {
-	if limit > 100 {
-		limit = 100
+// messageEvents tạo sự kiện eventType mang response cho recipients. Người đã chặn tác giả của tin nhắn
+// được trích dẫn nhận một sự kiện riêng với bản xem trước bị ẩn, giống như khi họ tải lịch sử tin nhắn.
+func (s *ChatService) messageEvents(ctx context.Context, eventType string, response *models.MessageResponse, recipients []primitive.ObjectID, createdAt time.Time) ([]*models.OutboxEvent, error) {
+	var hidden []primitive.ObjectID
+	if response.ReplyTo != nil && !response.ReplyTo.SenderID.IsZero() {
+		var err error
+		if hidden, err = s.blockersAmong(ctx, response.ReplyTo.SenderID, recipients); err != nil {
+			return nil, err
+		}
 	}
 
-	// Mock database mode
-	if s.useMock {
-		var result []*models.Message
-		messages, exists := s.mockStore.messagesByConv[conversationID]
-		if !exists {
-			return []*models.Message{}, nil
+	var events []*models.OutboxEvent
+	add := func(response *models.MessageResponse, recipients []primitive.ObjectID) error {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			return err
 		}
+		events = append(events, &models.OutboxEvent{
+			ID:         primitive.NewObjectID(),
+			Type:       eventType,
+			Recipients: recipients,
+			Payload:    payload,
+			CreatedAt:  createdAt,
+		})
+		return nil
+	}
+	if len(hidden) == 0 {
+		if err := add(response, recipients); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
 
-		// Lọc tin nhắn theo thời gian và giới hạn số lượng
-		count := int64(0)
-		for i := len(messages) - 1; i >= 0 && count < limit; i-- {
-			if messages[i].CreatedAt.Before(before) && !messages[i].IsDeleted {
-				result = append(result, messages[i])
-				count++
-			}
+	visible := make([]primitive.ObjectID, 0, len(recipients)-len(hidden))
+	for _, id := range recipients {
+		if !containsID(hidden, id) {
+			visible = append(visible, id)
+		}
+	}
+	if len(visible) > 0 {
+		if err := add(response, visible); err != nil {
+			return nil, err
 		}
+	}
+	masked := *response
+	masked.ReplyTo = unavailablePreview(response.ReplyTo.ID)
+	if err := add(&masked, hidden); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
 
-		return result, nil
+// checkPersonalBlock trả về ErrUserBlocked nếu conv là cuộc hội thoại 1-1 và senderID với người còn lại
+// có quan hệ chặn theo bất kỳ chiều nào. Trong nhóm, tin nhắn của người bị chặn chỉ bị ẩn với người chặn.
+func (s *ChatService) checkPersonalBlock(ctx context.Context, conv *models.Conversation, senderID primitive.ObjectID) error {
+	if conv.Type != models.ConversationTypePersonal {
+		return nil
+	}
+	for _, participantID := range conv.Participants {
+		if participantID == senderID {
+			continue
+		}
+		blocked, err := s.users.IsBlocked(ctx, senderID, participantID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrUserBlocked
+		}
 	}
+	return nil
+}
 
-	// Normal database mode
-	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(limit)
-	filter := bson.M{
-		"conversation_id": conversationID,
-		"created_at":      bson.M{"$lt": before},
-		"is_deleted":      false,
+// blockersAmong trả về những người trong userIDs đã chặn senderID. Tin nhắn senderID gửi lúc này bị ẩn
+// với họ nên không được tính vào số tin chưa đọc của họ.
+func (s *ChatService) blockersAmong(ctx context.Context, senderID primitive.ObjectID, userIDs []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	blockerIDs, err := s.users.BlockerIDs(ctx, senderID)
+	if err != nil {
+		return nil, err
+	}
+	var among []primitive.ObjectID
+	for _, id := range userIDs {
+		if containsID(blockerIDs, id) {
+			among = append(among, id)
+		}
 	}
+	return among, nil
+}
 
-	cursor, err := s.db.Collection("messages").Find(context.Background(), filter, opts)
+// withoutBlockers bỏ những người đã chặn senderID khỏi recipients vì tin nhắn của senderID bị ẩn với họ
+func (s *ChatService) withoutBlockers(ctx context.Context, senderID primitive.ObjectID, recipients []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	blockerIDs, err := s.users.BlockerIDs(ctx, senderID)
+	if err != nil || len(blockerIDs) == 0 {
+		return recipients, err
+	}
+	filtered := make([]primitive.ObjectID, 0, len(recipients))
+	for _, id := range recipients {
+		if !containsID(blockerIDs, id) {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered, nil
+}
+
+// EditMessage thay nội dung tin nhắn của người gửi, giữ nội dung cũ trong lịch sử sửa
+// và thông báo cho các thành viên của cuộc hội thoại chưa chặn người gửi
+func (s *ChatService) EditMessage(ctx context.Context, userID, messageID primitive.ObjectID, content string) (*models.MessageResponse, error) {
+	// Sửa không được làm trống nội dung tin nhắn
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	msg, err := s.store.GetMessage(ctx, messageID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if err != nil || msg.IsDeleted {
+		return nil, ErrMessageNotFound
+	}
+	if msg.SenderID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if msg.IsVoice() {
+		return nil, ErrVoiceMessageNotEditable
+	}
+
+	now := time.Now()
+	if !s.policy.canEdit(msg.CreatedAt, now) {
+		return nil, ErrEditWindowExpired
+	}
+
+	conv, err := s.store.GetConversation(ctx, msg.ConversationID)
 	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errors.New("cuộc hội thoại không tồn tại")
+		}
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
+	// Người đã rời cuộc hội thoại không còn sửa được tin nhắn cũ của mình
+	if !containsID(conv.Participants, userID) {
+		return nil, ErrNotParticipant
+	}
 
-	var messages []*models.Message
-	if err = cursor.All(context.Background(), &messages); err != nil {
+	// Nội dung không đổi thì không tạo phiên bản mới
+	if content == msg.Content {
+		return s.MessageResponse(ctx, userID, msg)
+	}
+
+	msg.EditHistory = append(msg.EditHistory, models.MessageEdit{Content: msg.Content, ReplacedAt: now})
+	msg.Content = content
+	msg.EditedAt = &now
+	msg.UpdatedAt = now
+
+	// Sự kiện dùng chung cho mọi thành viên nên không mang reacted_by_me của riêng ai
+	response, err := s.MessageResponse(ctx, primitive.NilObjectID, msg)
+	if err != nil {
 		return nil, err
 	}
 
-	return messages, nil
-}
+	// Người gửi cũng nhận sự kiện để đồng bộ các thiết bị khác; người đã chặn người gửi thì không
+	recipients, err := s.withoutBlockers(ctx, msg.SenderID, conv.Participants)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.messageEvents(ctx, types.EventTypeMessageEdited, response, recipients, now)
+	if err != nil {
+		return nil, err
+	}
+	response.Reactions = msg.ReactionSummaries(userID)
 
-// MarkMessageAsRead đánh dấu tin nhắn đã đọc
-func (s *ChatService) MarkMessageAsRead(messageID, userID primitive.ObjectID) error {
-	// Mock database mode
-	if s.useMock {
-		msg, exists := s.mockStore.messages[messageID]
-		if !exists {
-			return errors.New("tin nhắn không tồn tại")
+	if err := s.store.EditMessage(ctx, msg, events); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
 		}
+		return nil, err
+	}
+
+	s.outbox.Notify()
+	return response, nil
+}
 
-		// Thêm người dùng vào danh sách đã đọc nếu chưa có
-		if !containsID(msg.ReadBy, userID) {
-			msg.ReadBy = append(msg.ReadBy, userID)
-			msg.Status = models.MessageStatusRead
+// DeleteMessage xóa tin nhắn theo phạm vi scope và thông báo qua sự kiện message_deleted:
+// tới mọi thành viên khi thu hồi, hoặc chỉ tới các thiết bị của người xóa khi xóa ở phía mình
+func (s *ChatService) DeleteMessage(ctx context.Context, userID, messageID primitive.ObjectID, scope DeleteScope) error {
+	if scope != DeleteForMe && scope != DeleteForEveryone {
+		return ErrInvalidDeleteScope
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	msg, err := s.store.GetMessage(ctx, messageID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrMessageNotFound
 		}
+		return err
+	}
+	conv, err := s.store.GetConversation(ctx, msg.ConversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrMessageNotFound
+		}
+		return err
+	}
+	if !containsID(conv.Participants, userID) || msg.IsHiddenFor(userID) {
+		return ErrMessageNotFound
+	}
 
+	now := time.Now()
+	newEvent := func(recipients []primitive.ObjectID) (*models.OutboxEvent, error) {
+		payload, err := json.Marshal(map[string]interface{}{
+			"message_id":      messageID.Hex(),
+			"conversation_id": conv.ID.Hex(),
+			"scope":           scope,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &models.OutboxEvent{
+			ID:         primitive.NewObjectID(),
+			Type:       types.EventTypeMessageDeleted,
+			Recipients: recipients,
+			Payload:    payload,
+			CreatedAt:  now,
+		}, nil
+	}
+
+	if scope == DeleteForMe {
+		// Store đánh dấu đã đọc cùng lúc với ẩn tin nhắn để tin không còn được tính là chưa đọc
+		event, err := newEvent([]primitive.ObjectID{userID})
+		if err != nil {
+			return err
+		}
+		if err := s.store.HideMessage(ctx, messageID, userID, []*models.OutboxEvent{event}); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return ErrMessageNotFound
+			}
+			return err
+		}
+		s.outbox.Notify()
 		return nil
 	}
 
-	// Normal database mode
-	filter := bson.M{"_id": messageID}
-	update := bson.M{
-		"$addToSet": bson.M{"read_by": userID},
-		"$set":      bson.M{"status": models.MessageStatusRead},
+	if msg.IsDeleted {
+		return ErrMessageNotFound
+	}
+	isGroupAdmin := conv.Type == models.ConversationTypeGroup && containsID(conv.Admins, userID)
+	if msg.SenderID != userID && !isGroupAdmin {
+		return ErrDeleteForbidden
 	}
 
-	_, err := s.db.Collection("messages").UpdateOne(context.Background(), filter, update)
-	return err
-}
+	// Tombstone không giữ lại nội dung, lịch sử sửa, reaction hay tệp đính kèm
+	attachments := msg.Attachments
+	msg.IsDeleted = true
+	msg.Content = ""
+	msg.EditHistory = nil
+	msg.Reactions = nil
+	msg.Attachments = nil
+	msg.DeletedAt = &now
+	msg.DeletedBy = userID
+	msg.UpdatedAt = now
 
-// BatchMarkMessagesAsRead đánh dấu nhiều tin nhắn là đã đọc cùng lúc
-func (s *ChatService) BatchMarkMessagesAsRead(messageIDs []primitive.ObjectID, userID primitive.ObjectID) error {
-	if len(messageIDs) == 0 {
-		return nil
+	event, err := newEvent(conv.Participants)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteMessage(ctx, msg, []*models.OutboxEvent{event}); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrMessageNotFound
+		}
+		return err
 	}
+	s.outbox.Notify()
 
-	// Mock database mode
-	if s.useMock {
-		senderMap := make(map[primitive.ObjectID]bool)
+	// Tệp của tin nhắn đã thu hồi không còn ai tải được, dọn sau khi sự kiện đã được ghi
+	s.files.RemoveAttachments(context.WithoutCancel(ctx), attachments)
+	return nil
+}
 
-		for _, msgID := range messageIDs {
-			msg, exists := s.mockStore.messages[msgID]
-			if !exists {
-				continue
-			}
+// MessagePageRequest chọn trang tin nhắn cần lấy. Chỉ dùng tối đa một trong Before, After
+// và Around; bỏ trống cả ba để lấy các tin nhắn mới nhất.
+type MessagePageRequest struct {
+	Before string // con trỏ: lấy các tin nhắn cũ hơn
+	After  string // con trỏ: lấy các tin nhắn mới hơn
+	Around string // con trỏ hoặc ID tin nhắn: lấy tin nhắn đó cùng các tin nhắn xung quanh
+	Limit  int64
+}
 
-			// Đánh dấu tin nhắn đã đọc
-			if !containsID(msg.ReadBy, userID) {
-				msg.ReadBy = append(msg.ReadBy, userID)
-				msg.Status = models.MessageStatusRead
-			}
+// MessagePage là một trang tin nhắn, luôn sắp xếp mới nhất trước.
+// NextCursor dùng với before để tải tin cũ hơn, PrevCursor dùng với after để tải tin mới hơn;
+// con trỏ bị bỏ trống khi không còn tin nhắn theo hướng đó.
+type MessagePage struct {
+	Messages   []*models.MessageResponse `json:"messages"`
+	NextCursor string                    `json:"next_cursor,omitempty"`
+	PrevCursor string                    `json:"prev_cursor,omitempty"`
+	HasMore    bool                      `json:"has_more"` // còn tin nhắn theo hướng đã yêu cầu
+}
+
+// GetMessages lấy một trang tin nhắn của cuộc hội thoại mà userID nhìn thấy: tin nhắn đã thu hồi
+// được trả về dưới dạng tombstone, tin nhắn userID đã xóa ở phía mình và tin nhắn của những người
+// userID đã chặn bị bỏ qua
+func (s *ChatService) GetMessages(ctx context.Context, userID, conversationID primitive.ObjectID, req MessagePageRequest) (*MessagePage, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	blockedIDs, err := s.users.BlockedIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.messagePage(ctx, conversationID, store.MessageQuery{Viewer: userID, ExcludeSenders: blockedIDs}, req)
+}
 
-			// Ghi nhận ID người gửi để thông báo
-			if msg.SenderID != userID {
-				senderMap[msg.SenderID] = true
+// messagePage lấy một trang tin nhắn theo req trong phạm vi của scope (người xem, thread)
+func (s *ChatService) messagePage(ctx context.Context, conversationID primitive.ObjectID, scope store.MessageQuery, req MessagePageRequest) (*MessagePage, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 50
+	} else if limit > 100 {
+		limit = 100
+	}
+
+	var messages []*models.Message
+	var page *MessagePage
+	var err error
+	switch {
+	case req.After != "":
+		var after primitive.ObjectID
+		if after, err = decodeMessageCursor(req.After); err != nil {
+			return nil, err
+		}
+		messages, page, err = s.messagesAfter(ctx, conversationID, scope, after, limit)
+	case req.Around != "":
+		var anchor primitive.ObjectID
+		if anchor, err = decodeMessageCursor(req.Around); err != nil {
+			return nil, err
+		}
+		messages, page, err = s.messagesAround(ctx, conversationID, scope, anchor, limit)
+	default:
+		var before primitive.ObjectID
+		if req.Before != "" {
+			if before, err = decodeMessageCursor(req.Before); err != nil {
+				return nil, err
 			}
 		}
+		messages, page, err = s.messagesBefore(ctx, conversationID, scope, before, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Messages, err = s.MessageResponses(ctx, scope.Viewer, messages); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
 
-		// Chuyển đổi messageIDs thành mảng các chuỗi hex
-		messageIDsHex := make([]string, len(messageIDs))
-		for i, id := range messageIDs {
-			messageIDsHex[i] = id.Hex()
+// messagesBefore lấy limit tin nhắn cũ hơn before, hoặc mới nhất nếu before bỏ trống
+func (s *ChatService) messagesBefore(ctx context.Context, conversationID primitive.ObjectID, scope store.MessageQuery, before primitive.ObjectID, limit int64) ([]*models.Message, *MessagePage, error) {
+	// Lấy thêm một tin nhắn để biết còn trang tiếp theo hay không
+	query := scope
+	query.Before, query.Limit = before, limit+1
+	messages, err := s.store.ListMessages(ctx, conversationID, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := &MessagePage{}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+	}
+	if n := len(messages); n > 0 {
+		if page.HasMore {
+			page.NextCursor = encodeMessageCursor(messages[n-1].ID)
 		}
+		if !before.IsZero() {
+			page.PrevCursor = encodeMessageCursor(messages[0].ID)
+		}
+	}
+	return messages, page, nil
+}
 
-		// Gửi thông báo trạng thái tin nhắn đã đọc qua WebSocket
-		for senderID := range senderMap {
-			s.websocketHandler.SendToUser(senderID, types.WebSocketMessage{
-				Type: types.EventTypeRead,
-				Payload: map[string]interface{}{
-					"message_ids": messageIDsHex,
-					"user_id":     userID.Hex(),
-					"status":      models.MessageStatusRead,
-				},
-			})
+// messagesAfter lấy limit tin nhắn mới hơn after, gần after nhất trước
+func (s *ChatService) messagesAfter(ctx context.Context, conversationID primitive.ObjectID, scope store.MessageQuery, after primitive.ObjectID, limit int64) ([]*models.Message, *MessagePage, error) {
+	query := scope
+	query.After, query.Ascending, query.Limit = after, true, limit+1
+	messages, err := s.store.ListMessages(ctx, conversationID, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := &MessagePage{}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+	}
+	messages = reverseMessages(messages)
+	if n := len(messages); n > 0 {
+		if page.HasMore {
+			page.PrevCursor = encodeMessageCursor(messages[0].ID)
 		}
+		page.NextCursor = encodeMessageCursor(messages[n-1].ID)
+	}
+	return messages, page, nil
+}
 
-		return nil
+// messagesAround lấy tin nhắn anchor cùng khoảng một nửa limit tin nhắn ở mỗi phía
+func (s *ChatService) messagesAround(ctx context.Context, conversationID primitive.ObjectID, scope store.MessageQuery, anchorID primitive.ObjectID, limit int64) ([]*models.Message, *MessagePage, error) {
+	anchor, err := s.store.GetMessage(ctx, anchorID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, nil, err
+	}
+	if err != nil || anchor.ConversationID != conversationID || anchor.ThreadRootID != scope.ThreadRootID ||
+		anchor.IsHiddenFor(scope.Viewer) || containsID(scope.ExcludeSenders, anchor.SenderID) {
+		return nil, nil, ErrMessageNotFound
 	}
 
-	// Normal database mode
-	filter := bson.M{"_id": bson.M{"$in": messageIDs}}
-	update := bson.M{
-		"$addToSet": bson.M{"read_by": userID},
-		"$set":      bson.M{"status": models.MessageStatusRead},
+	olderLimit := (limit - 1) / 2
+	newerLimit := limit - 1 - olderLimit
+
+	olderQuery := scope
+	olderQuery.Before, olderQuery.Limit = anchorID, olderLimit+1
+	older, err := s.store.ListMessages(ctx, conversationID, olderQuery)
+	if err != nil {
+		return nil, nil, err
 	}
+	newerQuery := scope
+	newerQuery.After, newerQuery.Ascending, newerQuery.Limit = anchorID, true, newerLimit+1
+	newer, err := s.store.ListMessages(ctx, conversationID, newerQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hasOlder := int64(len(older)) > olderLimit
+	if hasOlder {
+		older = older[:olderLimit]
+	}
+	hasNewer := int64(len(newer)) > newerLimit
+	if hasNewer {
+		newer = newer[:newerLimit]
+	}
+
+	messages := make([]*models.Message, 0, len(newer)+1+len(older))
+	messages = append(messages, reverseMessages(newer)...)
+	messages = append(messages, anchor)
+	messages = append(messages, older...)
 
-	_, err := s.db.Collection("messages").UpdateMany(context.Background(), filter, update)
+	page := &MessagePage{HasMore: hasOlder || hasNewer}
+	if hasOlder {
+		page.NextCursor = encodeMessageCursor(messages[len(messages)-1].ID)
+	}
+	if hasNewer {
+		page.PrevCursor = encodeMessageCursor(messages[0].ID)
+	}
+	return messages, page, nil
+}
+
+// reverseMessages đảo thứ tự tin nhắn tại chỗ
+func reverseMessages(messages []*models.Message) []*models.Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// MarkMessageAsRead đánh dấu tin nhắn đã đọc
+func (s *ChatService) MarkMessageAsRead(ctx context.Context, messageID, userID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	msg, err := s.store.GetMessage(ctx, messageID)
 	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrMessageNotFound
+		}
 		return err
 	}
 
-	// Lấy thông tin về các tin nhắn để xác định người gửi
-	var messages []*models.Message
-	cursor, err := s.db.Collection("messages").Find(
-		context.Background(),
-		bson.M{"_id": bson.M{"$in": messageIDs}},
-	)
+	return s.markRead(ctx, []*models.Message{msg}, userID)
+}
+
+// BatchMarkMessagesAsRead đánh dấu nhiều tin nhắn là đã đọc cùng lúc. ID không tồn tại bị bỏ qua.
+func (s *ChatService) BatchMarkMessagesAsRead(ctx context.Context, messageIDs []primitive.ObjectID, userID primitive.ObjectID) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	messages, err := s.store.GetMessagesByIDs(ctx, messageIDs)
 	if err != nil {
 		return err
 	}
-	defer cursor.Close(context.Background())
+	return s.markRead(ctx, messages, userID)
+}
 
-	if err = cursor.All(context.Background(), &messages); err != nil {
-		return err
+// markRead đánh dấu messages đã đọc sau khi kiểm tra userID là thành viên của mọi cuộc hội thoại chứa
+// chúng. Mỗi người gửi nhận một sự kiện read qua outbox, chỉ liệt kê tin nhắn của chính họ.
+func (s *ChatService) markRead(ctx context.Context, messages []*models.Message, userID primitive.ObjectID) error {
+	if len(messages) == 0 {
+		return nil
 	}
 
-	// Gửi thông báo đến người gửi tin nhắn
-	senderMap := make(map[primitive.ObjectID]bool)
+	checked := make(map[primitive.ObjectID]bool)
 	for _, msg := range messages {
-		if msg.SenderID != userID && !senderMap[msg.SenderID] {
-			senderMap[msg.SenderID] = true
-
-			// Chuyển đổi messageIDs thành mảng các chuỗi hex
-			messageIDsHex := make([]string, len(messageIDs))
-			for i, id := range messageIDs {
-				messageIDsHex[i] = id.Hex()
+		if checked[msg.ConversationID] {
+			continue
+		}
+		conv, err := s.store.GetConversation(ctx, msg.ConversationID)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return ErrMessageNotFound
 			}
+			return err
+		}
+		if !containsID(conv.Participants, userID) {
+			return ErrNotParticipant
+		}
+		checked[msg.ConversationID] = true
+	}
 
-			// Gửi thông báo trạng thái tin nhắn đã đọc qua WebSocket
-			s.websocketHandler.SendToUser(msg.SenderID, types.WebSocketMessage{
-				Type: types.EventTypeRead,
-				Payload: map[string]interface{}{
-					"message_ids": messageIDsHex,
-					"user_id":     userID.Hex(),
-					"status":      models.MessageStatusRead,
-				},
-			})
+	ids := make([]primitive.ObjectID, len(messages))
+	var senders []primitive.ObjectID
+	bySender := make(map[primitive.ObjectID][]string)
+	for i, msg := range messages {
+		ids[i] = msg.ID
+		if msg.SenderID == userID {
+			continue
 		}
+		if _, ok := bySender[msg.SenderID]; !ok {
+			senders = append(senders, msg.SenderID)
+		}
+		bySender[msg.SenderID] = append(bySender[msg.SenderID], msg.ID.Hex())
+	}
+
+	now := time.Now()
+	events := make([]*models.OutboxEvent, 0, len(senders))
+	for _, senderID := range senders {
+		payload, err := json.Marshal(map[string]interface{}{
+			"message_ids": bySender[senderID],
+			"user_id":     userID.Hex(),
+			"status":      models.MessageStatusRead,
+		})
+		if err != nil {
+			return err
+		}
+		events = append(events, &models.OutboxEvent{
+			ID:         primitive.NewObjectID(),
+			Type:       types.EventTypeRead,
+			Recipients: []primitive.ObjectID{senderID},
+			Payload:    payload,
+			CreatedAt:  now,
+		})
 	}
 
+	if err := s.store.MarkMessagesRead(ctx, ids, userID, events); err != nil {
+		return err
+	}
+	s.outbox.Notify()
 	return nil
 }
 
@@ -486,57 +828,64 @@ func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
 	return false
 }
 
+// ConversationListRequest chọn trang và bộ lọc cho danh sách cuộc hội thoại
+type ConversationListRequest struct {
+	Cursor     string                  // con trỏ next_cursor của trang trước, bỏ trống để lấy trang đầu
+	Type       models.ConversationType // lọc theo loại cuộc hội thoại
+	UnreadOnly bool                    // chỉ lấy cuộc hội thoại còn tin nhắn chưa đọc
+	NamePrefix string                  // lọc theo tiền tố tên cuộc hội thoại
+	Limit      int64
+}
+
+// ConversationPage là một trang cuộc hội thoại, mới cập nhật trước
+type ConversationPage struct {
+	Conversations []*models.ConversationResponse `json:"conversations"`
+	NextCursor    string                         `json:"next_cursor,omitempty"`
+	HasMore       bool                           `json:"has_more"`
+}
+
 // GetConversations lấy danh sách cuộc hội thoại của người dùng
-func (s *ChatService) GetConversations(userID primitive.ObjectID, limit int64) ([]*models.Conversation, error) {
+func (s *ChatService) GetConversations(ctx context.Context, userID primitive.ObjectID, req ConversationListRequest) (*ConversationPage, error) {
+	limit := req.Limit
 	if limit <= 0 {
 		limit = 20
 	} else if limit > 50 {
 		limit = 50
 	}
 
-	// Mock database mode
-	if s.useMock {
-		var result []*models.Conversation
-
-		// Lọc các cuộc hội thoại có chứa userID trong danh sách participants
-		for _, conv := range s.mockStore.conversationList {
-			for _, participantID := range conv.Participants {
-				if participantID == userID {
-					result = append(result, conv)
-					break
-				}
-			}
-
-			// Giới hạn số lượng cuộc hội thoại
-			if int64(len(result)) >= limit {
-				break
-			}
+	query := store.ConversationQuery{
+		Type:       req.Type,
+		UnreadOnly: req.UnreadOnly,
+		NamePrefix: req.NamePrefix,
+		// Lấy thêm một cuộc hội thoại để biết còn trang tiếp theo hay không
+		Limit: limit + 1,
+	}
+	if req.Cursor != "" {
+		cursor, err := decodeConversationCursor(req.Cursor)
+		if err != nil {
+			return nil, err
 		}
-
-		// Sắp xếp theo thời gian cập nhật gần nhất (hoặc theo thời gian tin nhắn cuối cùng)
-		sort.Slice(result, func(i, j int) bool {
-			return result[i].UpdatedAt.After(result[j].UpdatedAt)
-		})
-
-		return result, nil
+		query.After = cursor
 	}
 
-	// Normal database mode
-	opts := options.Find().SetSort(bson.M{"updated_at": -1}).SetLimit(limit)
-	filter := bson.M{
-		"participants": userID,
-	}
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
 
-	cursor, err := s.db.Collection("conversations").Find(context.Background(), filter, opts)
+	conversations, err := s.store.ListConversations(ctx, userID, query)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
 
-	var conversations []*models.Conversation
-	if err = cursor.All(context.Background(), &conversations); err != nil {
-		return nil, err
+	page := &ConversationPage{}
+	if int64(len(conversations)) > limit {
+		conversations = conversations[:limit]
+		page.HasMore = true
+		last := conversations[len(conversations)-1]
+		page.NextCursor = encodeConversationCursor(last.UpdatedAt, last.ID)
 	}
 
-	return conversations, nil
+	if page.Conversations, err = s.ConversationResponses(ctx, userID, conversations); err != nil {
+		return nil, err
+	}
+	return page, nil
 }
@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testEnv nối các service thật trên memory store. Dispatcher không chạy nên sự kiện ở lại outbox
+// để test đọc bằng takeEvents.
+type testEnv struct {
+	store   *store.MemoryStore
+	auth    *AuthService
+	users   *UserService
+	chat    *ChatService
+	friends *FriendService
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	st := store.NewMemoryStore()
+	ws := types.NewWebSocketHandler()
+	timeouts := DefaultTimeouts()
+	auth := NewAuthService("test-secret", st, ws, timeouts)
+	users := NewUserService(st, auth, timeouts)
+	auth.SetUserService(users)
+	outbox := NewOutboxDispatcher(st, ws, time.Hour, timeouts)
+	return &testEnv{
+		store:   st,
+		auth:    auth,
+		users:   users,
+		chat:    NewChatService(st, users, nil, ws, outbox, DefaultMessagePolicy(), timeouts),
+		friends: NewFriendService(st, users, ws, outbox, timeouts),
+	}
+}
+
+func (e *testEnv) newUser(t *testing.T, name string) primitive.ObjectID {
+	t.Helper()
+	user := &models.User{ID: primitive.NewObjectID(), Email: name + "@example.com", Name: name}
+	if err := e.store.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user.ID
+}
+
+func (e *testEnv) newGroup(t *testing.T, creator primitive.ObjectID, members ...primitive.ObjectID) primitive.ObjectID {
+	t.Helper()
+	conv, err := e.chat.CreateGroupConversation(context.Background(), "group", "", creator, members)
+	if err != nil {
+		t.Fatalf("CreateGroupConversation: %v", err)
+	}
+	return conv.ID
+}
+
+func (e *testEnv) send(t *testing.T, sender, convID primitive.ObjectID, content string) *models.MessageResponse {
+	t.Helper()
+	msg, err := e.chat.SendMessage(context.Background(), sender, convID, content, primitive.NilObjectID, nil, models.MessageKindText)
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	return msg
+}
+
+// saveMessage ghi thẳng một tin nhắn vào store, cho những trạng thái mà service không tạo ra được,
+// như tin nhắn cũ hoặc tin nhắn của người đã rời cuộc hội thoại
+func (e *testEnv) saveMessage(t *testing.T, convID, sender primitive.ObjectID, createdAt time.Time) *models.Message {
+	t.Helper()
+	msg := &models.Message{
+		ID:             primitive.NewObjectID(),
+		Type:           models.MessageTypeGroup,
+		ConversationID: convID,
+		SenderID:       sender,
+		Content:        "cũ",
+		Status:         models.MessageStatusSent,
+		ReadBy:         []primitive.ObjectID{sender},
+		CreatedAt:      createdAt,
+		UpdatedAt:      createdAt,
+	}
+	if err := e.store.SaveMessage(context.Background(), msg, nil); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	return msg
+}
+
+// timeline trả về các tin nhắn userID thấy trong trang đầu của cuộc hội thoại, theo ID
+func (e *testEnv) timeline(t *testing.T, userID, convID primitive.ObjectID) map[primitive.ObjectID]*models.MessageResponse {
+	t.Helper()
+	page, err := e.chat.GetMessages(context.Background(), userID, convID, MessagePageRequest{})
+	if err != nil {
+		t.Fatalf("GetMessages: %v", err)
+	}
+	messages := make(map[primitive.ObjectID]*models.MessageResponse, len(page.Messages))
+	for _, msg := range page.Messages {
+		messages[msg.ID] = msg
+	}
+	return messages
+}
+
+func (e *testEnv) unreadCount(t *testing.T, userID, convID primitive.ObjectID) int64 {
+	t.Helper()
+	conv, err := e.store.GetConversation(context.Background(), convID)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	return conv.UnreadCountFor(userID)
+}
+
+// takeEvents trả về các sự kiện eventType đang chờ trong outbox rồi xóa toàn bộ outbox
+func (e *testEnv) takeEvents(t *testing.T, eventType string) []*models.OutboxEvent {
+	t.Helper()
+	ctx := context.Background()
+	pending, err := e.store.PendingOutboxEvents(ctx, 0)
+	if err != nil {
+		t.Fatalf("PendingOutboxEvents: %v", err)
+	}
+	var events []*models.OutboxEvent
+	ids := make([]primitive.ObjectID, len(pending))
+	for i, event := range pending {
+		ids[i] = event.ID
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	if err := e.store.DeleteOutboxEvents(ctx, ids); err != nil {
+		t.Fatalf("DeleteOutboxEvents: %v", err)
+	}
+	return events
+}
+
+func TestMarkMessagesRead(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol, outsider := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol"), e.newUser(t, "outsider")
+	convID := e.newGroup(t, alice, bob, carol)
+	a1 := e.send(t, alice, convID, "một")
+	a2 := e.send(t, alice, convID, "hai")
+	c1 := e.send(t, carol, convID, "ba")
+	b1 := e.send(t, bob, convID, "bốn")
+	e.takeEvents(t, "")
+
+	ids := []primitive.ObjectID{a1.ID, a2.ID, c1.ID, b1.ID, primitive.NewObjectID()}
+	for _, tc := range []struct {
+		name string
+		mark func(userID primitive.ObjectID) error
+		want error
+	}{
+		{name: "single outsider", mark: func(userID primitive.ObjectID) error {
+			return e.chat.MarkMessageAsRead(ctx, a1.ID, userID)
+		}, want: ErrNotParticipant},
+		{name: "batch outsider", mark: func(userID primitive.ObjectID) error {
+			return e.chat.BatchMarkMessagesAsRead(ctx, ids, userID)
+		}, want: ErrNotParticipant},
+		{name: "single unknown message", mark: func(userID primitive.ObjectID) error {
+			return e.chat.MarkMessageAsRead(ctx, primitive.NewObjectID(), userID)
+		}, want: ErrMessageNotFound},
+	} {
+		if err := tc.mark(outsider); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	msg, err := e.store.GetMessage(ctx, a1.ID)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if containsID(msg.ReadBy, outsider) {
+		t.Error("outsider was added to read_by")
+	}
+	if events := e.takeEvents(t, types.EventTypeRead); len(events) != 0 {
+		t.Errorf("outsider produced %d read events", len(events))
+	}
+
+	// Mỗi người gửi nhận đúng một sự kiện chỉ chứa tin nhắn của họ, người đọc không nhận gì
+	if err := e.chat.BatchMarkMessagesAsRead(ctx, ids, bob); err != nil {
+		t.Fatalf("BatchMarkMessagesAsRead: %v", err)
+	}
+	want := map[primitive.ObjectID][]string{
+		alice: {a1.ID.Hex(), a2.ID.Hex()},
+		carol: {c1.ID.Hex()},
+	}
+	events := e.takeEvents(t, types.EventTypeRead)
+	if len(events) != len(want) {
+		t.Fatalf("got %d read events, want %d", len(events), len(want))
+	}
+	for _, event := range events {
+		if len(event.Recipients) != 1 {
+			t.Fatalf("read event recipients = %v, want one sender", event.Recipients)
+		}
+		var payload struct {
+			MessageIDs []string `json:"message_ids"`
+			UserID     string   `json:"user_id"`
+		}
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		recipient := event.Recipients[0]
+		if got, ok := want[recipient]; !ok || !equalStrings(payload.MessageIDs, got) {
+			t.Errorf("event for %s lists %v, want %v", recipient.Hex(), payload.MessageIDs, want[recipient])
+		}
+		if payload.UserID != bob.Hex() {
+			t.Errorf("event user_id = %s, want %s", payload.UserID, bob.Hex())
+		}
+	}
+	for _, id := range []primitive.ObjectID{a1.ID, a2.ID, c1.ID} {
+		msg, err := e.store.GetMessage(ctx, id)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !containsID(msg.ReadBy, bob) {
+			t.Errorf("message %s: bob is not in read_by", id.Hex())
+		}
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol")
+	convID := e.newGroup(t, alice, bob, carol)
+	msg := e.send(t, alice, convID, "một")
+	expired := e.saveMessage(t, convID, alice, time.Now().Add(-time.Hour))
+	deleted := e.send(t, alice, convID, "sẽ bị thu hồi")
+	if err := e.chat.DeleteMessage(ctx, alice, deleted.ID, DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	// Tin nhắn của người không còn trong cuộc hội thoại
+	otherConvID := e.newGroup(t, bob, carol)
+	left := e.saveMessage(t, otherConvID, alice, time.Now())
+
+	for _, tc := range []struct {
+		name    string
+		user    primitive.ObjectID
+		message primitive.ObjectID
+		content string
+		want    error
+	}{
+		{name: "other user", user: bob, message: msg.ID, content: "hai", want: ErrNotMessageSender},
+		{name: "blank content", user: alice, message: msg.ID, content: " \n\t ", want: ErrEmptyMessage},
+		{name: "too long", user: alice, message: msg.ID, content: strings.Repeat("ạ", maxMessageLength+1), want: ErrMessageTooLong},
+		{name: "edit window expired", user: alice, message: expired.ID, content: "hai", want: ErrEditWindowExpired},
+		{name: "deleted message", user: alice, message: deleted.ID, content: "hai", want: ErrMessageNotFound},
+		{name: "unknown message", user: alice, message: primitive.NewObjectID(), content: "hai", want: ErrMessageNotFound},
+		{name: "sender left the conversation", user: alice, message: left.ID, content: "hai", want: ErrNotParticipant},
+	} {
+		if _, err := e.chat.EditMessage(ctx, tc.user, tc.message, tc.content); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	e.takeEvents(t, "")
+
+	// Độ dài tính theo ký tự chứ không theo byte
+	longest := strings.Repeat("ạ", maxMessageLength)
+	for _, content := range []string{"hai", "  hai  ", longest} {
+		edited, err := e.chat.EditMessage(ctx, alice, msg.ID, content)
+		if err != nil {
+			t.Fatalf("EditMessage(%q): %v", content, err)
+		}
+		if want := strings.TrimSpace(content); edited.Content != want || !edited.Edited {
+			t.Errorf("EditMessage(%q) = %q edited %v, want %q edited", content, edited.Content, edited.Edited, want)
+		}
+	}
+
+	stored, err := e.store.GetMessage(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	// Sửa thành nội dung không đổi, kể cả chỉ khác khoảng trắng, không tạo phiên bản mới
+	var history []string
+	for _, edit := range stored.EditHistory {
+		history = append(history, edit.Content)
+	}
+	if want := []string{"một", "hai"}; !equalStrings(history, want) {
+		t.Errorf("edit history = %v, want %v", history, want)
+	}
+
+	events := e.takeEvents(t, types.EventTypeMessageEdited)
+	if len(events) != 2 {
+		t.Fatalf("got %d message_edited events, want 2", len(events))
+	}
+	for _, event := range events {
+		if !equalIDSets(event.Recipients, []primitive.ObjectID{alice, bob, carol}) {
+			t.Errorf("message_edited recipients = %v, want every participant", event.Recipients)
+		}
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	admin, bob, carol, outsider := e.newUser(t, "admin"), e.newUser(t, "bob"), e.newUser(t, "carol"), e.newUser(t, "outsider")
+	convID := e.newGroup(t, admin, bob, carol)
+	fromAdmin := e.send(t, admin, convID, "của admin")
+	fromCarol := e.send(t, carol, convID, "của carol")
+	fromBob := e.send(t, bob, convID, "của bob")
+	e.takeEvents(t, "")
+
+	for _, tc := range []struct {
+		name    string
+		user    primitive.ObjectID
+		message primitive.ObjectID
+		scope   DeleteScope
+		want    error
+	}{
+		{name: "unknown scope", user: admin, message: fromAdmin.ID, scope: "all", want: ErrInvalidDeleteScope},
+		{name: "member recalls another member's message", user: bob, message: fromCarol.ID, scope: DeleteForEveryone, want: ErrDeleteForbidden},
+		{name: "outsider hides", user: outsider, message: fromAdmin.ID, scope: DeleteForMe, want: ErrMessageNotFound},
+		{name: "outsider recalls", user: outsider, message: fromAdmin.ID, scope: DeleteForEveryone, want: ErrMessageNotFound},
+		{name: "unknown message", user: admin, message: primitive.NewObjectID(), scope: DeleteForMe, want: ErrMessageNotFound},
+	} {
+		if err := e.chat.DeleteMessage(ctx, tc.user, tc.message, tc.scope); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if events := e.takeEvents(t, types.EventTypeMessageDeleted); len(events) != 0 {
+		t.Errorf("rejected deletes produced %d message_deleted events", len(events))
+	}
+
+	// Xóa ở phía mình: chỉ người xóa không còn thấy tin nhắn, và tin không còn được tính là chưa đọc
+	if got := e.unreadCount(t, bob, convID); got != 2 {
+		t.Fatalf("bob unread before hiding = %d, want 2", got)
+	}
+	if err := e.chat.DeleteMessage(ctx, bob, fromAdmin.ID, DeleteForMe); err != nil {
+		t.Fatalf("DeleteMessage for me: %v", err)
+	}
+	if _, ok := e.timeline(t, bob, convID)[fromAdmin.ID]; ok {
+		t.Error("bob still sees the hidden message")
+	}
+	if _, ok := e.timeline(t, carol, convID)[fromAdmin.ID]; !ok {
+		t.Error("carol no longer sees a message bob hid")
+	}
+	if got := e.unreadCount(t, bob, convID); got != 1 {
+		t.Errorf("bob unread after hiding = %d, want 1", got)
+	}
+	events := e.takeEvents(t, types.EventTypeMessageDeleted)
+	if len(events) != 1 || !equalIDSets(events[0].Recipients, []primitive.ObjectID{bob}) {
+		t.Errorf("hide events = %d, want one for bob only", len(events))
+	}
+	if err := e.chat.DeleteMessage(ctx, bob, fromAdmin.ID, DeleteForMe); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("hiding twice: got %v, want ErrMessageNotFound", err)
+	}
+
+	// Thu hồi: người gửi và quản trị viên nhóm được phép, mọi người còn thấy tombstone
+	for _, tc := range []struct {
+		name    string
+		user    primitive.ObjectID
+		message primitive.ObjectID
+	}{
+		{name: "sender", user: bob, message: fromBob.ID},
+		{name: "group admin", user: admin, message: fromCarol.ID},
+	} {
+		if err := e.chat.DeleteMessage(ctx, tc.user, tc.message, DeleteForEveryone); err != nil {
+			t.Fatalf("%s recalls: %v", tc.name, err)
+		}
+		tombstone, ok := e.timeline(t, carol, convID)[tc.message]
+		if !ok || !tombstone.Deleted || tombstone.Content != "" {
+			t.Errorf("%s recalls: carol sees %+v, want a tombstone", tc.name, tombstone)
+		}
+		events := e.takeEvents(t, types.EventTypeMessageDeleted)
+		if len(events) != 1 || !equalIDSets(events[0].Recipients, []primitive.ObjectID{admin, bob, carol}) {
+			t.Errorf("%s recalls: want one message_deleted event for every participant", tc.name)
+		}
+		if err := e.chat.DeleteMessage(ctx, tc.user, tc.message, DeleteForEveryone); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("%s recalls twice: got %v, want ErrMessageNotFound", tc.name, err)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalIDSets so sánh hai danh sách ID không tính thứ tự
+func equalIDSets(a, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !containsID(b, id) {
+			return false
+		}
+	}
+	return true
+}
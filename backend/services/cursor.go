@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidCursor được trả về khi con trỏ phân trang không giải mã được
+var ErrInvalidCursor = errors.New("con trỏ phân trang không hợp lệ")
+
+// Con trỏ phân trang là chuỗi base64 URL-safe của ObjectID.
+// Client coi con trỏ là chuỗi mờ và chỉ gửi lại nguyên vẹn cho server.
+func encodeMessageCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// decodeMessageCursor chấp nhận con trỏ do server trả về, ID tin nhắn dạng hex
+// và thời gian RFC3339 của tham số before cũ để không làm hỏng client hiện có
+func decodeMessageCursor(cursor string) (primitive.ObjectID, error) {
+	if raw, err := base64.RawURLEncoding.DecodeString(cursor); err == nil && len(raw) == len(primitive.ObjectID{}) {
+		var id primitive.ObjectID
+		copy(id[:], raw)
+		return id, nil
+	}
+	if id, err := primitive.ObjectIDFromHex(cursor); err == nil {
+		return id, nil
+	}
+	if t, err := time.Parse(time.RFC3339, cursor); err == nil {
+		// ID nhỏ nhất của giây t: mọi tin nhắn tạo trước t có ID nhỏ hơn
+		return primitive.NewObjectIDFromTimestamp(t), nil
+	}
+	return primitive.NilObjectID, ErrInvalidCursor
+}
+
+// Con trỏ của danh sách cuộc hội thoại gồm UpdatedAt (Unix nano giây) và ID của phần tử cuối trang
+func encodeConversationCursor(updatedAt time.Time, id primitive.ObjectID) string {
+	raw := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(raw, uint64(updatedAt.UnixNano()))
+	raw = append(raw, id[:]...)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeConversationCursor(cursor string) (*store.ConversationCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) != 8+len(primitive.ObjectID{}) {
+		return nil, ErrInvalidCursor
+	}
+
+	var id primitive.ObjectID
+	copy(id[:], raw[8:])
+	return &store.ConversationCursor{
+		UpdatedAt: time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8]))).UTC(),
+		ID:        id,
+	}, nil
+}
+
+// Con trỏ của kết quả tìm kiếm người dùng gồm mức độ khớp, ID và tên (chữ thường) của phần tử cuối trang
+func encodeUserSearchCursor(cursor *store.UserSearchCursor) string {
+	raw := make([]byte, 0, 1+len(cursor.ID)+len(cursor.Name))
+	raw = append(raw, byte(cursor.Rank))
+	raw = append(raw, cursor.ID[:]...)
+	raw = append(raw, cursor.Name...)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeUserSearchCursor(cursor string) (*store.UserSearchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	idEnd := 1 + len(primitive.ObjectID{})
+	if err != nil || len(raw) < idEnd || !utf8.Valid(raw[idEnd:]) {
+		return nil, ErrInvalidCursor
+	}
+
+	var id primitive.ObjectID
+	copy(id[:], raw[1:idEnd])
+	return &store.UserSearchCursor{
+		Rank: int(raw[0]),
+		Name: string(raw[idEnd:]),
+		ID:   id,
+	}, nil
+}
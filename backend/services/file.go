@@ -0,0 +1,451 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"webchat/blob"
+	"webchat/media"
+	"webchat/models"
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxAttachmentsPerMessage giới hạn số tệp gắn vào một tin nhắn
+	maxAttachmentsPerMessage = 10
+	// maxFilenameLength tính theo byte, đủ cho tên tệp trên mọi hệ điều hành phổ biến
+	maxFilenameLength = 255
+	// sniffLength là số byte đầu tiên http.DetectContentType cần để nhận diện loại tệp
+	sniffLength = 512
+)
+
+var (
+	// ErrFileTooLarge được trả về khi tệp vượt quá UploadPolicy.MaxSize
+	ErrFileTooLarge = errors.New("tệp vượt quá kích thước cho phép")
+	// ErrEmptyFile được trả về khi tệp tải lên không có nội dung
+	ErrEmptyFile = errors.New("tệp không có nội dung")
+	// ErrFileTypeNotAllowed được trả về khi nội dung tệp không thuộc các loại được hỗ trợ
+	ErrFileTypeNotAllowed = errors.New("loại tệp không được hỗ trợ")
+	// ErrAttachmentNotFound được trả về khi tệp không tồn tại hoặc người dùng không có quyền xem
+	ErrAttachmentNotFound = errors.New("tệp không tồn tại")
+	// ErrInvalidAttachment được trả về khi tệp gắn vào tin nhắn không tồn tại, không do người gửi tải lên
+	// hoặc đã được gắn vào tin nhắn khác
+	ErrInvalidAttachment = errors.New("tệp đính kèm không hợp lệ")
+	// ErrTooManyAttachments được trả về khi tin nhắn có quá nhiều tệp đính kèm
+	ErrTooManyAttachments = errors.New("tin nhắn có quá nhiều tệp đính kèm")
+	// ErrInvalidImage được trả về khi tệp có chữ ký của định dạng ảnh nhưng không giải mã được
+	ErrInvalidImage = errors.New("ảnh bị hỏng hoặc không đúng định dạng")
+)
+
+// UploadPolicy chứa các giới hạn khi tải tệp lên
+type UploadPolicy struct {
+	MaxSize int64  // kích thước tối đa của một tệp, tính theo byte
+	TempDir string // thư mục chứa tệp tạm trong lúc nhận upload, bỏ trống để dùng thư mục tạm của hệ thống
+}
+
+// DefaultUploadPolicy trả về giá trị mặc định của UploadPolicy
+func DefaultUploadPolicy() UploadPolicy {
+	return UploadPolicy{
+		MaxSize: 25 << 20,
+	}
+}
+
+// FileService nhận tệp tải lên, lưu nội dung vào blob store và kiểm soát quyền tải tệp về
+type FileService struct {
+	blobs    blob.Store
+	store    store.ChatStore
+	policy   UploadPolicy
+	timeouts Timeouts
+}
+
+func NewFileService(blobs blob.Store, chatStore store.ChatStore, policy UploadPolicy, timeouts Timeouts) *FileService {
+	return &FileService{
+		blobs:    blobs,
+		store:    chatStore,
+		policy:   policy,
+		timeouts: timeouts,
+	}
+}
+
+// MaxSize trả về kích thước tối đa của một tệp tải lên
+func (s *FileService) MaxSize() int64 {
+	return s.policy.MaxSize
+}
+
+// UploadFile lưu tệp đọc từ r và tạo bản ghi tệp chưa gắn vào tin nhắn nào.
+// Loại tệp được xác định từ nội dung chứ không theo tên tệp hay header của client.
+// Ảnh JPEG, PNG và GIF được bỏ metadata trước khi lưu, kèm kích thước, ảnh thu nhỏ và blurhash;
+// tệp âm thanh WAV, Ogg và WebM được đọc thời lượng và dạng sóng.
+func (s *FileService) UploadFile(ctx context.Context, uploaderID primitive.ObjectID, filename string, r io.Reader) (*models.Attachment, error) {
+	// Ghi ra tệp tạm để biết kích thước trước khi gửi tới blob store và để đọc lại phần đầu khi nhận diện loại tệp
+	tmp, err := os.CreateTemp(s.policy.TempDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	size, err := io.Copy(tmp, io.LimitReader(r, s.policy.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > s.policy.MaxSize {
+		return nil, ErrFileTooLarge
+	}
+	if size == 0 {
+		return nil, ErrEmptyFile
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !allowedContentType(contentType) {
+		return nil, ErrFileTypeNotAllowed
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var content io.Reader = tmp
+	var img *media.Image
+	if media.IsImage(contentType) {
+		// Ảnh không lớn hơn MaxSize nên được đọc hết vào bộ nhớ để giải mã
+		data, err := io.ReadAll(tmp)
+		if err != nil {
+			return nil, err
+		}
+		img, err = media.ProcessImage(data, contentType)
+		if errors.Is(err, media.ErrInvalidImage) {
+			return nil, ErrInvalidImage
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, size = bytes.NewReader(img.Data), int64(len(img.Data))
+	}
+
+	var audio *models.AudioInfo
+	if media.IsAudio(contentType) {
+		// Tệp không đọc được thông tin (codec khác, WebM có video...) vẫn được lưu như tệp thường.
+		// ReadAt không làm thay đổi vị trí đọc của tmp nên nội dung vẫn được gửi từ đầu.
+		info, err := media.ProcessAudio(tmp, size, contentType)
+		if err == nil {
+			contentType = info.ContentType
+			audio = &models.AudioInfo{
+				DurationMs: info.Duration.Milliseconds(),
+				Waveform:   info.Waveform,
+			}
+		} else if !errors.Is(err, media.ErrUnsupportedAudio) {
+			return nil, err
+		}
+	}
+
+	key, err := newBlobKey("attachments")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.blobs.Put(ctx, key, content, size, contentType); err != nil {
+		return nil, err
+	}
+
+	attachment := &models.Attachment{
+		ID:          primitive.NewObjectID(),
+		UploaderID:  uploaderID,
+		Key:         key,
+		Filename:    sanitizeFilename(filename),
+		ContentType: contentType,
+		Size:        size,
+		Audio:       audio,
+		CreatedAt:   time.Now(),
+	}
+	if img != nil {
+		if err := s.saveImageInfo(ctx, attachment, img); err != nil {
+			s.deleteBlob(key)
+			return nil, err
+		}
+	}
+
+	writeCtx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+	if err := s.store.CreateAttachment(writeCtx, attachment); err != nil {
+		s.deleteBlob(key)
+		if attachment.ThumbnailKey != "" {
+			s.deleteBlob(attachment.ThumbnailKey)
+		}
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// saveImageInfo lưu ảnh thu nhỏ (nếu có) vào blob store và ghi thông tin ảnh vào attachment
+func (s *FileService) saveImageInfo(ctx context.Context, attachment *models.Attachment, img *media.Image) error {
+	attachment.Image = &models.ImageInfo{
+		Width:  img.Width,
+		Height: img.Height,
+	}
+	if img.Thumbnail == nil {
+		return nil
+	}
+
+	key, err := newBlobKey("thumbnails")
+	if err != nil {
+		return err
+	}
+	if err := s.blobs.Put(ctx, key, bytes.NewReader(img.Thumbnail), int64(len(img.Thumbnail)), img.ThumbnailType); err != nil {
+		return err
+	}
+	attachment.ThumbnailKey = key
+	attachment.ThumbnailType = img.ThumbnailType
+	attachment.Image.ThumbnailWidth = img.ThumbnailWidth
+	attachment.Image.ThumbnailHeight = img.ThumbnailHeight
+	attachment.Image.Blurhash = img.Blurhash
+	return nil
+}
+
+// OpenAttachment kiểm tra quyền của userID và mở nội dung tệp, người gọi phải đóng Object trả về.
+// Tệp chưa gắn vào tin nhắn chỉ người tải lên xem được; tệp đã gắn thì mọi thành viên của cuộc hội thoại
+// xem được, trừ khi tin nhắn đã bị thu hồi hoặc userID đã xóa tin nhắn ở phía mình.
+func (s *FileService) OpenAttachment(ctx context.Context, userID, id primitive.ObjectID) (*models.Attachment, blob.Object, error) {
+	attachment, err := s.authorize(ctx, userID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	object, err := s.openBlob(ctx, attachment.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachment, object, nil
+}
+
+// OpenThumbnail mở ảnh thu nhỏ của tệp ảnh với cùng điều kiện quyền xem như OpenAttachment.
+// Trả về ErrAttachmentNotFound nếu tệp không phải ảnh hoặc ảnh quá lớn để tạo ảnh thu nhỏ.
+func (s *FileService) OpenThumbnail(ctx context.Context, userID, id primitive.ObjectID) (*models.Attachment, blob.Object, error) {
+	attachment, err := s.authorize(ctx, userID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attachment.ThumbnailKey == "" {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	object, err := s.openBlob(ctx, attachment.ThumbnailKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachment, object, nil
+}
+
+func (s *FileService) openBlob(ctx context.Context, key string) (blob.Object, error) {
+	// Nội dung tệp được đọc dần trong suốt response nên không áp dụng timeout của database
+	object, err := s.blobs.Open(ctx, key)
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, ErrAttachmentNotFound
+	}
+	return object, err
+}
+
+func (s *FileService) authorize(ctx context.Context, userID, id primitive.ObjectID) (*models.Attachment, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	attachment, err := s.store.GetAttachment(ctx, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if !attachment.IsAttached() {
+		if attachment.UploaderID != userID {
+			return nil, ErrAttachmentNotFound
+		}
+		return attachment, nil
+	}
+
+	conv, err := s.store.GetConversation(ctx, attachment.ConversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if !containsID(conv.Participants, userID) {
+		return nil, ErrAttachmentNotFound
+	}
+
+	msg, err := s.store.GetMessage(ctx, attachment.MessageID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if msg.IsDeleted || msg.IsHiddenFor(userID) {
+		return nil, ErrAttachmentNotFound
+	}
+	return attachment, nil
+}
+
+// attachmentRefs kiểm tra các tệp senderID muốn gắn vào tin nhắn và trả về tham chiếu theo đúng thứ tự
+func (s *FileService) attachmentRefs(ctx context.Context, senderID primitive.ObjectID, ids []primitive.ObjectID) ([]models.AttachmentRef, error) {
+	if len(ids) > maxAttachmentsPerMessage {
+		return nil, ErrTooManyAttachments
+	}
+
+	refs := make([]models.AttachmentRef, 0, len(ids))
+	for i, id := range ids {
+		if containsID(ids[:i], id) {
+			return nil, ErrInvalidAttachment
+		}
+		attachment, err := s.store.GetAttachment(ctx, id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return nil, ErrInvalidAttachment
+			}
+			return nil, err
+		}
+		if attachment.UploaderID != senderID || attachment.IsAttached() {
+			return nil, ErrInvalidAttachment
+		}
+		refs = append(refs, attachment.Ref())
+	}
+	return refs, nil
+}
+
+// RemoveAttachments xóa nội dung và bản ghi của các tệp thuộc tin nhắn đã bị thu hồi.
+// Lỗi chỉ được ghi log: tệp của tin nhắn đã thu hồi không còn ai tải được nên có thể dọn lại sau.
+func (s *FileService) RemoveAttachments(ctx context.Context, refs []models.AttachmentRef) {
+	if len(refs) == 0 {
+		return
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	removed := make([]primitive.ObjectID, 0, len(refs))
+	for _, ref := range refs {
+		attachment, err := s.store.GetAttachment(ctx, ref.ID)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error loading attachment %s: %v", ref.ID.Hex(), err)
+			continue
+		}
+		if err := s.blobs.Delete(ctx, attachment.Key); err != nil {
+			log.Printf("Error deleting attachment blob %s: %v", attachment.Key, err)
+			continue
+		}
+		if attachment.ThumbnailKey != "" {
+			if err := s.blobs.Delete(ctx, attachment.ThumbnailKey); err != nil {
+				log.Printf("Error deleting thumbnail blob %s: %v", attachment.ThumbnailKey, err)
+				continue
+			}
+		}
+		removed = append(removed, attachment.ID)
+	}
+	if err := s.store.DeleteAttachments(ctx, removed); err != nil {
+		log.Printf("Error deleting attachment records: %v", err)
+	}
+}
+
+// deleteBlob xóa nội dung tệp không còn bản ghi nào trỏ tới, chỉ ghi log nếu lỗi
+func (s *FileService) deleteBlob(key string) {
+	ctx, cancel := s.timeouts.write(context.Background())
+	defer cancel()
+	if err := s.blobs.Delete(ctx, key); err != nil {
+		log.Printf("Error deleting orphaned blob %s: %v", key, err)
+	}
+}
+
+// allowedContentType chấp nhận ảnh, âm thanh, video, tài liệu và tệp nén phổ biến.
+// HTML, XML và các loại trình duyệt có thể thực thi bị từ chối dù tệp luôn được tải về với nosniff.
+func allowedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	switch mediaType {
+	case "application/pdf", "application/zip", "application/x-gzip", "application/x-rar-compressed",
+		"application/ogg", "text/plain", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// inlineContentType cho biết tệp có được hiển thị trực tiếp trên trình duyệt thay vì tải về hay không
+func inlineContentType(contentType string) bool {
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentDisposition trả về giá trị header Content-Disposition khi tải tệp về
+func ContentDisposition(attachment *models.Attachment) string {
+	disposition := "attachment"
+	if inlineContentType(attachment.ContentType) {
+		disposition = "inline"
+	}
+	// FormatMediaType tự mã hóa tên tệp không phải ASCII theo RFC 2231
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}); value != "" {
+		return value
+	}
+	return disposition
+}
+
+// sanitizeFilename chỉ giữ phần tên của đường dẫn client gửi lên, bỏ ký tự điều khiển và cắt bớt tên quá dài
+func sanitizeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+
+	for len(filename) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(filename)
+		filename = filename[:len(filename)-size]
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		return "file"
+	}
+	return filename
+}
+
+// newBlobKey tạo key ngẫu nhiên trong thư mục prefix, không để lộ ID tệp hay người tải lên
+func newBlobKey(prefix string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + "/" + hex.EncodeToString(buf), nil
+}
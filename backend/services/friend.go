@@ -0,0 +1,493 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FriendStatusActive là trạng thái của một quan hệ bạn bè còn hiệu lực
+const FriendStatusActive = "active"
+
+var (
+	// ErrCannotFriendSelf được trả về khi người dùng gửi lời mời kết bạn cho chính mình
+	ErrCannotFriendSelf = errors.New("không thể gửi lời mời kết bạn cho chính mình")
+	// ErrFriendRequestExists được trả về khi người dùng đã gửi lời mời cho người này và lời mời còn đang chờ
+	ErrFriendRequestExists = errors.New("bạn đã gửi lời mời kết bạn cho người này")
+	// ErrAlreadyFriends được trả về khi hai người đã là bạn bè
+	ErrAlreadyFriends = errors.New("hai người đã là bạn bè")
+	// ErrFriendRequestNotFound được trả về khi lời mời không tồn tại, không gửi cho người dùng hoặc đã được xử lý
+	ErrFriendRequestNotFound = errors.New("không tìm thấy lời mời kết bạn")
+	// ErrNotFriends được trả về khi hủy kết bạn với người không có trong danh sách bạn bè
+	ErrNotFriends = errors.New("người này không có trong danh sách bạn bè")
+	// ErrInvalidFriendAction được trả về khi thao tác hàng loạt không phải accept hoặc reject
+	ErrInvalidFriendAction = errors.New("thao tác không hợp lệ")
+)
+
+// FriendUser là thông tin rút gọn của người gửi hoặc người nhận lời mời kết bạn
+type FriendUser struct {
+	ID     primitive.ObjectID `json:"id"`
+	Name   string             `json:"name"`
+	Avatar string             `json:"avatar"`
+}
+
+// Friend là một người trong danh sách bạn bè
+type Friend struct {
+	ID       primitive.ObjectID `json:"id"`
+	Name     string             `json:"name"`
+	Avatar   string             `json:"avatar"`
+	IsOnline bool               `json:"isOnline"`
+	Status   string             `json:"status"`
+}
+
+// FriendRequestResponse là lời mời kết bạn nhìn từ phía một người dùng:
+// lời mời nhận được có Sender, lời mời đã gửi có Recipient
+type FriendRequestResponse struct {
+	ID        primitive.ObjectID         `json:"id"`
+	Sender    *FriendUser                `json:"sender,omitempty"`
+	Recipient *FriendUser                `json:"recipient,omitempty"`
+	Status    models.FriendRequestStatus `json:"status"`
+	CreatedAt time.Time                  `json:"createdAt"`
+}
+
+// FriendRequestList là các lời mời đang chờ của người dùng, mới nhất trước
+type FriendRequestList struct {
+	Received []*FriendRequestResponse `json:"received"`
+	Sent     []*FriendRequestResponse `json:"sent"`
+}
+
+// FriendRequestUpdateEvent là payload của sự kiện WebSocket khi lời mời được chấp nhận, bị từ chối
+// hoặc quan hệ bạn bè bị hủy. UserID là người đã thực hiện thay đổi.
+type FriendRequestUpdateEvent struct {
+	RequestID primitive.ObjectID         `json:"requestId"`
+	Status    models.FriendRequestStatus `json:"status"`
+	UserID    primitive.ObjectID         `json:"userId"`
+}
+
+// FriendStatusEvent là payload của sự kiện WebSocket khi một người bạn kết nối hoặc ngắt kết nối
+type FriendStatusEvent struct {
+	UserID   primitive.ObjectID `json:"userId"`
+	IsOnline bool               `json:"isOnline"`
+}
+
+// FriendRequestBatchResult là kết quả xử lý một lời mời trong thao tác hàng loạt
+type FriendRequestBatchResult struct {
+	RequestID primitive.ObjectID `json:"requestId"`
+	Success   bool               `json:"success"`
+	Error     string             `json:"error,omitempty"`
+	Friend    *Friend            `json:"friend,omitempty"` // người bạn mới khi chấp nhận thành công
+}
+
+type FriendService struct {
+	store            store.FriendStore
+	users            *UserService
+	websocketHandler *types.WebSocketHandler
+	outbox           *OutboxDispatcher
+	timeouts         Timeouts
+}
+
+func NewFriendService(friendStore store.FriendStore, userService *UserService, wsHandler *types.WebSocketHandler, outbox *OutboxDispatcher, timeouts Timeouts) *FriendService {
+	return &FriendService{
+		store:            friendStore,
+		users:            userService,
+		websocketHandler: wsHandler,
+		outbox:           outbox,
+		timeouts:         timeouts,
+	}
+}
+
+// ListFriends trả về bạn bè của userID theo thứ tự tên
+func (s *FriendService) ListFriends(ctx context.Context, userID primitive.ObjectID) ([]*Friend, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	friendIDs, err := s.friendIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.users.GetUsersByIDs(ctx, friendIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	friends := []*Friend{}
+	for _, friendID := range friendIDs {
+		if user, ok := users[friendID]; ok {
+			friends = append(friends, s.friend(user))
+		}
+	}
+	sort.SliceStable(friends, func(i, j int) bool {
+		return strings.ToLower(friends[i].Name) < strings.ToLower(friends[j].Name)
+	})
+	return friends, nil
+}
+
+// FriendIDs trả về ID bạn bè của userID
+func (s *FriendService) FriendIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	return s.friendIDs(ctx, userID)
+}
+
+func (s *FriendService) friendIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	requests, err := s.store.ListFriendRequests(ctx, userID, models.FriendRequestAccepted)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(requests))
+	for i, req := range requests {
+		ids[i] = req.OtherUser(userID)
+	}
+	return ids, nil
+}
+
+// ListFriendRequests trả về các lời mời đang chờ mà userID đã nhận và đã gửi
+func (s *FriendService) ListFriendRequests(ctx context.Context, userID primitive.ObjectID) (*FriendRequestList, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	requests, err := s.store.ListFriendRequests(ctx, userID, models.FriendRequestPending)
+	if err != nil {
+		return nil, err
+	}
+	otherIDs := make([]primitive.ObjectID, len(requests))
+	for i, req := range requests {
+		otherIDs[i] = req.OtherUser(userID)
+	}
+	users, err := s.users.GetUsersByIDs(ctx, otherIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &FriendRequestList{
+		Received: []*FriendRequestResponse{},
+		Sent:     []*FriendRequestResponse{},
+	}
+	for _, req := range requests {
+		other, ok := users[req.OtherUser(userID)]
+		if !ok {
+			continue
+		}
+		response := friendRequestResponse(req, userID, other)
+		if req.RecipientID == userID {
+			list.Received = append(list.Received, response)
+		} else {
+			list.Sent = append(list.Sent, response)
+		}
+	}
+	return list, nil
+}
+
+// SendFriendRequest gửi lời mời kết bạn từ userID tới recipientID và trả về lời mời nhìn từ phía userID.
+// Nếu recipientID đã gửi lời mời cho userID trước đó, lời mời đó được chấp nhận ngay: kết quả là lời mời
+// đã chấp nhận cùng người bạn mới (khác nil chỉ trong trường hợp này).
+func (s *FriendService) SendFriendRequest(ctx context.Context, userID, recipientID primitive.ObjectID) (*FriendRequestResponse, *Friend, error) {
+	if userID == recipientID {
+		return nil, nil, ErrCannotFriendSelf
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	recipient, err := s.users.GetUserByID(ctx, recipientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocked, err := s.users.IsBlocked(ctx, userID, recipientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blocked {
+		return nil, nil, ErrUserBlocked
+	}
+
+	// Hai người gửi cho nhau cùng lúc: một lời mời được lưu, lời mời kia gặp ErrDuplicateFriendRequest
+	// và ở lượt thứ hai sẽ thấy lời mời của người kia để chấp nhận
+	for attempt := 0; attempt < 2; attempt++ {
+		existing, err := s.store.FindFriendRequest(ctx, userID, recipientID)
+		if err == nil {
+			switch {
+			case existing.Status == models.FriendRequestAccepted:
+				return nil, nil, ErrAlreadyFriends
+			case existing.SenderID == userID:
+				return nil, nil, ErrFriendRequestExists
+			}
+			friend, err := s.acceptRequest(ctx, userID, existing, recipient)
+			if err != nil {
+				return nil, nil, err
+			}
+			existing.Status = models.FriendRequestAccepted
+			return friendRequestResponse(existing, userID, recipient), friend, nil
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return nil, nil, err
+		}
+
+		sender, err := s.users.GetUserByID(ctx, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		now := time.Now()
+		req := &models.FriendRequest{
+			ID:          primitive.NewObjectID(),
+			SenderID:    userID,
+			RecipientID: recipientID,
+			PairKey:     models.FriendPairKey(userID, recipientID),
+			Status:      models.FriendRequestPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		payload, err := json.Marshal(friendRequestResponse(req, recipientID, sender))
+		if err != nil {
+			return nil, nil, err
+		}
+		event := &models.OutboxEvent{
+			ID:         primitive.NewObjectID(),
+			Type:       types.EventTypeFriendRequest,
+			Recipients: []primitive.ObjectID{recipientID},
+			Payload:    payload,
+			CreatedAt:  now,
+		}
+
+		err = s.store.CreateFriendRequest(ctx, req, []*models.OutboxEvent{event})
+		if errors.Is(err, store.ErrDuplicateFriendRequest) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		s.outbox.Notify()
+		return friendRequestResponse(req, userID, recipient), nil, nil
+	}
+	return nil, nil, ErrFriendRequestExists
+}
+
+// AcceptFriendRequest chấp nhận lời mời requestID mà userID đã nhận và trả về người bạn mới
+func (s *FriendService) AcceptFriendRequest(ctx context.Context, userID, requestID primitive.ObjectID) (*Friend, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	req, err := s.receivedRequest(ctx, userID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := s.users.GetUserByID(ctx, req.SenderID)
+	if err != nil {
+		return nil, err
+	}
+	return s.acceptRequest(ctx, userID, req, sender)
+}
+
+// acceptRequest chấp nhận lời mời đang chờ req thay cho userID (người nhận) và báo cho cả hai người
+func (s *FriendService) acceptRequest(ctx context.Context, userID primitive.ObjectID, req *models.FriendRequest, sender *models.User) (*Friend, error) {
+	now := time.Now()
+	event, err := friendUpdateEvent(req, models.FriendRequestAccepted, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	accepted, err := s.store.AcceptFriendRequest(ctx, req.ID, now, []*models.OutboxEvent{event})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrFriendRequestNotFound
+		}
+		return nil, err
+	}
+	if !accepted {
+		return nil, ErrFriendRequestNotFound
+	}
+	s.outbox.Notify()
+	return s.friend(sender), nil
+}
+
+// RejectFriendRequest từ chối lời mời requestID mà userID đã nhận. Lời mời bị xóa nên người gửi
+// có thể gửi lại sau; người gửi nhận sự kiện friend_request_update với trạng thái rejected.
+func (s *FriendService) RejectFriendRequest(ctx context.Context, userID, requestID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	req, err := s.receivedRequest(ctx, userID, requestID)
+	if err != nil {
+		return err
+	}
+	event, err := friendUpdateEvent(req, models.FriendRequestRejected, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	deleted, err := s.store.DeleteFriendRequest(ctx, req.ID, models.FriendRequestPending, []*models.OutboxEvent{event})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrFriendRequestNotFound
+		}
+		return err
+	}
+	if !deleted {
+		return ErrFriendRequestNotFound
+	}
+	s.outbox.Notify()
+	return nil
+}
+
+// receivedRequest lấy lời mời đang chờ requestID mà userID là người nhận
+func (s *FriendService) receivedRequest(ctx context.Context, userID, requestID primitive.ObjectID) (*models.FriendRequest, error) {
+	req, err := s.store.GetFriendRequest(ctx, requestID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrFriendRequestNotFound
+		}
+		return nil, err
+	}
+	if req.RecipientID != userID || req.Status != models.FriendRequestPending {
+		return nil, ErrFriendRequestNotFound
+	}
+	return req, nil
+}
+
+// ProcessFriendRequests chấp nhận (action "accept") hoặc từ chối (action "reject") nhiều lời mời.
+// Lời mời không hợp lệ không làm dừng các lời mời còn lại mà được báo lỗi trong kết quả của nó.
+func (s *FriendService) ProcessFriendRequests(ctx context.Context, userID primitive.ObjectID, requestIDs []primitive.ObjectID, action string) ([]*FriendRequestBatchResult, error) {
+	if action != "accept" && action != "reject" {
+		return nil, ErrInvalidFriendAction
+	}
+
+	results := make([]*FriendRequestBatchResult, 0, len(requestIDs))
+	for _, requestID := range requestIDs {
+		result := &FriendRequestBatchResult{RequestID: requestID}
+		var err error
+		if action == "accept" {
+			result.Friend, err = s.AcceptFriendRequest(ctx, userID, requestID)
+		} else {
+			err = s.RejectFriendRequest(ctx, userID, requestID)
+		}
+		switch {
+		case err == nil:
+			result.Success = true
+		case errors.Is(err, ErrFriendRequestNotFound), errors.Is(err, ErrUserNotFound):
+			result.Error = err.Error()
+		default:
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RemoveFriend hủy kết bạn giữa userID và friendID, cả hai người nhận sự kiện friend_request_update
+// với trạng thái removed
+func (s *FriendService) RemoveFriend(ctx context.Context, userID, friendID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	req, err := s.store.FindFriendRequest(ctx, userID, friendID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrNotFriends
+		}
+		return err
+	}
+	if req.Status != models.FriendRequestAccepted {
+		return ErrNotFriends
+	}
+
+	event, err := friendUpdateEvent(req, models.FriendRequestRemoved, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	deleted, err := s.store.DeleteFriendRequest(ctx, req.ID, models.FriendRequestAccepted, []*models.OutboxEvent{event})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrNotFriends
+		}
+		return err
+	}
+	if !deleted {
+		return ErrNotFriends
+	}
+	s.outbox.Notify()
+	return nil
+}
+
+// NotifyFriendStatus gửi sự kiện friend_status tới những người bạn đang online của userID.
+// Trạng thái online chỉ có ý nghĩa tức thời nên sự kiện được gửi thẳng, không qua outbox.
+func (s *FriendService) NotifyFriendStatus(ctx context.Context, userID primitive.ObjectID, isOnline bool) {
+	friendIDs, err := s.FriendIDs(ctx, userID)
+	if err != nil {
+		log.Printf("Error listing friends of user %s: %v", userID.Hex(), err)
+		return
+	}
+	// Người có quan hệ chặn với userID không nhận được trạng thái online của userID
+	peerIDs, err := s.users.BlockPeerIDs(ctx, userID)
+	if err != nil {
+		log.Printf("Error listing blocks of user %s: %v", userID.Hex(), err)
+		return
+	}
+
+	message := types.WebSocketMessage{
+		Type:    types.EventTypeFriendStatus,
+		Payload: FriendStatusEvent{UserID: userID, IsOnline: isOnline},
+	}
+	for _, friendID := range friendIDs {
+		if containsID(peerIDs, friendID) {
+			continue
+		}
+		if err := s.websocketHandler.SendToUser(friendID, message); err != nil {
+			log.Printf("Error sending friend status to user %s: %v", friendID.Hex(), err)
+		}
+	}
+}
+
+func (s *FriendService) friend(user *models.User) *Friend {
+	return &Friend{
+		ID:       user.ID,
+		Name:     user.Name,
+		Avatar:   user.Avatar,
+		IsOnline: s.websocketHandler.IsOnline(user.ID),
+		Status:   FriendStatusActive,
+	}
+}
+
+// friendRequestResponse dựng lời mời nhìn từ phía viewerID, other là người còn lại trong lời mời
+func friendRequestResponse(req *models.FriendRequest, viewerID primitive.ObjectID, other *models.User) *FriendRequestResponse {
+	response := &FriendRequestResponse{
+		ID:        req.ID,
+		Status:    req.Status,
+		CreatedAt: req.CreatedAt,
+	}
+	user := &FriendUser{ID: other.ID, Name: other.Name, Avatar: other.Avatar}
+	if req.RecipientID == viewerID {
+		response.Sender = user
+	} else {
+		response.Recipient = user
+	}
+	return response
+}
+
+// friendUpdateEvent tạo sự kiện friend_request_update gửi tới cả hai người trong lời mời,
+// người thực hiện cũng nhận để đồng bộ các thiết bị khác
+func friendUpdateEvent(req *models.FriendRequest, status models.FriendRequestStatus, userID primitive.ObjectID, now time.Time) (*models.OutboxEvent, error) {
+	payload, err := json.Marshal(FriendRequestUpdateEvent{
+		RequestID: req.ID,
+		Status:    status,
+		UserID:    userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.OutboxEvent{
+		ID:         primitive.NewObjectID(),
+		Type:       types.EventTypeFriendUpdate,
+		Recipients: []primitive.ObjectID{req.SenderID, req.RecipientID},
+		Payload:    payload,
+		CreatedAt:  now,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"webchat/models"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (e *testEnv) friendIDs(t *testing.T, userID primitive.ObjectID) []primitive.ObjectID {
+	t.Helper()
+	ids, err := e.friends.FriendIDs(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("FriendIDs: %v", err)
+	}
+	return ids
+}
+
+// friendUpdate trả về trạng thái của sự kiện friend_request_update duy nhất đang chờ trong outbox,
+// sau khi kiểm tra cả hai người đều nhận được
+func (e *testEnv) friendUpdate(t *testing.T, userA, userB primitive.ObjectID) models.FriendRequestStatus {
+	t.Helper()
+	events := e.takeEvents(t, types.EventTypeFriendUpdate)
+	if len(events) != 1 {
+		t.Fatalf("got %d friend_request_update events, want 1", len(events))
+	}
+	if !equalIDSets(events[0].Recipients, []primitive.ObjectID{userA, userB}) {
+		t.Errorf("friend_request_update recipients = %v, want both users", events[0].Recipients)
+	}
+	var update FriendRequestUpdateEvent
+	if err := json.Unmarshal(events[0].Payload, &update); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return update.Status
+}
+
+func TestFriendRequestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol")
+
+	if _, _, err := e.friends.SendFriendRequest(ctx, alice, alice); !errors.Is(err, ErrCannotFriendSelf) {
+		t.Errorf("request to self: got %v, want ErrCannotFriendSelf", err)
+	}
+
+	sent, friend, err := e.friends.SendFriendRequest(ctx, alice, bob)
+	if err != nil {
+		t.Fatalf("SendFriendRequest: %v", err)
+	}
+	if sent.Status != models.FriendRequestPending || friend != nil || sent.Recipient == nil {
+		t.Errorf("new request = %+v with friend %v, want a pending request to bob", sent, friend)
+	}
+	events := e.takeEvents(t, types.EventTypeFriendRequest)
+	if len(events) != 1 || !equalIDSets(events[0].Recipients, []primitive.ObjectID{bob}) {
+		t.Errorf("want one friend_request event for bob, got %d", len(events))
+	}
+
+	// Chỉ người nhận mới xử lý được lời mời đang chờ
+	for _, tc := range []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "resend", call: func() error {
+			_, _, err := e.friends.SendFriendRequest(ctx, alice, bob)
+			return err
+		}, want: ErrFriendRequestExists},
+		{name: "sender accepts", call: func() error {
+			_, err := e.friends.AcceptFriendRequest(ctx, alice, sent.ID)
+			return err
+		}, want: ErrFriendRequestNotFound},
+		{name: "third user rejects", call: func() error {
+			return e.friends.RejectFriendRequest(ctx, carol, sent.ID)
+		}, want: ErrFriendRequestNotFound},
+		{name: "remove before accepting", call: func() error {
+			return e.friends.RemoveFriend(ctx, alice, bob)
+		}, want: ErrNotFriends},
+	} {
+		if err := tc.call(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// Từ chối xóa lời mời nên người gửi có thể gửi lại
+	if err := e.friends.RejectFriendRequest(ctx, bob, sent.ID); err != nil {
+		t.Fatalf("RejectFriendRequest: %v", err)
+	}
+	if got := e.friendUpdate(t, alice, bob); got != models.FriendRequestRejected {
+		t.Errorf("reject event status = %s, want rejected", got)
+	}
+	if err := e.friends.RejectFriendRequest(ctx, bob, sent.ID); !errors.Is(err, ErrFriendRequestNotFound) {
+		t.Errorf("rejecting twice: got %v, want ErrFriendRequestNotFound", err)
+	}
+	if sent, _, err = e.friends.SendFriendRequest(ctx, alice, bob); err != nil {
+		t.Fatalf("SendFriendRequest after reject: %v", err)
+	}
+	e.takeEvents(t, "")
+
+	// Lời mời ngược chiều chấp nhận lời mời đang chờ
+	accepted, friend, err := e.friends.SendFriendRequest(ctx, bob, alice)
+	if err != nil {
+		t.Fatalf("SendFriendRequest back: %v", err)
+	}
+	if accepted.ID != sent.ID || accepted.Status != models.FriendRequestAccepted || friend == nil || friend.ID != alice {
+		t.Errorf("request back = %+v with friend %+v, want alice's request accepted", accepted, friend)
+	}
+	if got := e.friendUpdate(t, alice, bob); got != models.FriendRequestAccepted {
+		t.Errorf("accept event status = %s, want accepted", got)
+	}
+	for _, tc := range []struct {
+		user, friend primitive.ObjectID
+	}{{alice, bob}, {bob, alice}} {
+		if got := e.friendIDs(t, tc.user); !equalIDSets(got, []primitive.ObjectID{tc.friend}) {
+			t.Errorf("friends of %s = %v, want %s", tc.user.Hex(), got, tc.friend.Hex())
+		}
+	}
+	if _, _, err := e.friends.SendFriendRequest(ctx, alice, bob); !errors.Is(err, ErrAlreadyFriends) {
+		t.Errorf("request between friends: got %v, want ErrAlreadyFriends", err)
+	}
+	if _, err := e.friends.AcceptFriendRequest(ctx, alice, sent.ID); !errors.Is(err, ErrFriendRequestNotFound) {
+		t.Errorf("accepting an accepted request: got %v, want ErrFriendRequestNotFound", err)
+	}
+
+	// Hủy kết bạn từ phía nào cũng được, chỉ một lần
+	if err := e.friends.RemoveFriend(ctx, bob, alice); err != nil {
+		t.Fatalf("RemoveFriend: %v", err)
+	}
+	if got := e.friendUpdate(t, alice, bob); got != models.FriendRequestRemoved {
+		t.Errorf("remove event status = %s, want removed", got)
+	}
+	if err := e.friends.RemoveFriend(ctx, alice, bob); !errors.Is(err, ErrNotFriends) {
+		t.Errorf("removing twice: got %v, want ErrNotFriends", err)
+	}
+	if got := e.friendIDs(t, alice); len(got) != 0 {
+		t.Errorf("friends of alice after removal = %v, want none", got)
+	}
+
+	// Người đã chặn hoặc bị chặn không gửi được lời mời
+	if err := e.users.BlockUser(ctx, bob, alice); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		from, to primitive.ObjectID
+	}{
+		{name: "blocked user", from: alice, to: bob},
+		{name: "blocker", from: bob, to: alice},
+	} {
+		if _, _, err := e.friends.SendFriendRequest(ctx, tc.from, tc.to); !errors.Is(err, ErrUserBlocked) {
+			t.Errorf("%s sends: got %v, want ErrUserBlocked", tc.name, err)
+		}
+	}
+}
+
+func TestProcessFriendRequests(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol")
+	fromBob, _, err := e.friends.SendFriendRequest(ctx, bob, alice)
+	if err != nil {
+		t.Fatalf("SendFriendRequest: %v", err)
+	}
+	// Lời mời alice đã gửi: alice không xử lý được
+	toCarol, _, err := e.friends.SendFriendRequest(ctx, alice, carol)
+	if err != nil {
+		t.Fatalf("SendFriendRequest: %v", err)
+	}
+
+	if _, err := e.friends.ProcessFriendRequests(ctx, alice, []primitive.ObjectID{fromBob.ID}, "ignore"); !errors.Is(err, ErrInvalidFriendAction) {
+		t.Errorf("unknown action: got %v, want ErrInvalidFriendAction", err)
+	}
+
+	results, err := e.friends.ProcessFriendRequests(ctx, alice, []primitive.ObjectID{toCarol.ID, fromBob.ID, primitive.NewObjectID()}, "accept")
+	if err != nil {
+		t.Fatalf("ProcessFriendRequests: %v", err)
+	}
+	want := []bool{false, true, false}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Success != want[i] {
+			t.Errorf("result %d = %+v, want success %v", i, result, want[i])
+		}
+	}
+	if friend := results[1].Friend; friend == nil || friend.ID != bob {
+		t.Errorf("accepted result friend = %+v, want bob", friend)
+	}
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+
+	"webchat/models"
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MessageResponse gắn thông tin người gửi vào một tin nhắn mà viewer xem
+func (s *ChatService) MessageResponse(ctx context.Context, viewer primitive.ObjectID, msg *models.Message) (*models.MessageResponse, error) {
+	responses, err := s.MessageResponses(ctx, viewer, []*models.Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	return responses[0], nil
+}
+
+// MessageResponses gắn thông tin người gửi và bản xem trước của tin nhắn được trích dẫn vào các tin nhắn.
+// Các tin nhắn được trích dẫn và mọi người gửi đều được lấy trong một lần.
+// viewer quyết định reacted_by_me của reaction và ẩn bản xem trước tin nhắn của người viewer đã chặn;
+// để trống khi response được gửi cho nhiều người.
+func (s *ChatService) MessageResponses(ctx context.Context, viewer primitive.ObjectID, messages []*models.Message) ([]*models.MessageResponse, error) {
+	var replyToIDs []primitive.ObjectID
+	for _, msg := range messages {
+		if !msg.ReplyToID.IsZero() && !containsID(replyToIDs, msg.ReplyToID) {
+			replyToIDs = append(replyToIDs, msg.ReplyToID)
+		}
+	}
+	replies := make(map[primitive.ObjectID]*models.Message, len(replyToIDs))
+	var blockedIDs []primitive.ObjectID
+	if len(replyToIDs) > 0 {
+		found, err := s.store.GetMessagesByIDs(ctx, replyToIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, reply := range found {
+			replies[reply.ID] = reply
+		}
+		if !viewer.IsZero() {
+			if blockedIDs, err = s.users.BlockedIDs(ctx, viewer); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	senderIDs := make([]primitive.ObjectID, 0, len(messages)+len(replies))
+	for _, msg := range messages {
+		senderIDs = append(senderIDs, msg.SenderID)
+	}
+	for _, reply := range replies {
+		senderIDs = append(senderIDs, reply.SenderID)
+	}
+
+	users, err := s.users.GetUsersByIDs(ctx, senderIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]*models.MessageResponse, len(messages))
+	for i, msg := range messages {
+		responses[i] = msg.ToResponse(userOrPlaceholder(users, msg.SenderID))
+		if !viewer.IsZero() {
+			responses[i].Reactions = msg.ReactionSummaries(viewer)
+		}
+		if msg.ReplyToID.IsZero() {
+			continue
+		}
+		if reply, ok := replies[msg.ReplyToID]; ok && !containsID(blockedIDs, reply.SenderID) {
+			responses[i].ReplyTo = reply.ToPreview(userOrPlaceholder(users, reply.SenderID))
+		} else {
+			// Tin nhắn gốc không còn trong store hoặc của người viewer đã chặn: hiển thị như đã bị thu hồi
+			responses[i].ReplyTo = unavailablePreview(msg.ReplyToID)
+		}
+	}
+	return responses, nil
+}
+
+// unavailablePreview là bản xem trước của tin nhắn được trích dẫn mà người xem không được thấy
+func unavailablePreview(id primitive.ObjectID) *models.MessagePreview {
+	return &models.MessagePreview{ID: id, Deleted: true}
+}
+
+// ConversationResponse gắn thông tin thành viên và tin nhắn cuối vào một cuộc hội thoại
+func (s *ChatService) ConversationResponse(ctx context.Context, userID primitive.ObjectID, conv *models.Conversation) (*models.ConversationResponse, error) {
+	responses, err := s.ConversationResponses(ctx, userID, []*models.Conversation{conv})
+	if err != nil {
+		return nil, err
+	}
+	return responses[0], nil
+}
+
+// ConversationResponses gắn thông tin thành viên, người gửi tin nhắn cuối và số tin chưa đọc
+// của userID vào các cuộc hội thoại. Mọi người dùng cần thiết được lấy trong một lần.
+func (s *ChatService) ConversationResponses(ctx context.Context, userID primitive.ObjectID, convs []*models.Conversation) ([]*models.ConversationResponse, error) {
+	lastMessages, err := s.visibleLastMessages(ctx, userID, convs)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []primitive.ObjectID
+	for i, conv := range convs {
+		userIDs = append(userIDs, conv.Participants...)
+		if lastMessages[i] != nil {
+			userIDs = append(userIDs, lastMessages[i].SenderID)
+		}
+	}
+
+	users, err := s.users.GetUsersByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]*models.ConversationResponse, len(convs))
+	for i, conv := range convs {
+		participants := make([]*models.User, len(conv.Participants))
+		for j, participantID := range conv.Participants {
+			participants[j] = userOrPlaceholder(users, participantID)
+		}
+
+		var lastMessage *models.MessageResponse
+		if msg := lastMessages[i]; msg != nil {
+			lastMessage = msg.ToResponse(userOrPlaceholder(users, msg.SenderID))
+			lastMessage.Reactions = msg.ReactionSummaries(userID)
+		}
+
+		responses[i] = conv.ToResponse(participants, lastMessage)
+		responses[i].UnreadCount = conv.UnreadCountFor(userID)
+	}
+	return responses, nil
+}
+
+// visibleLastMessages trả về tin nhắn cuối mà userID nhìn thấy của từng cuộc hội thoại.
+// Chỉ khi userID đã xóa tin nhắn cuối ở phía mình hoặc đã chặn người gửi mới cần truy vấn tin nhắn liền trước.
+func (s *ChatService) visibleLastMessages(ctx context.Context, userID primitive.ObjectID, convs []*models.Conversation) ([]*models.Message, error) {
+	blockedIDs, err := s.users.BlockedIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	lastMessages := make([]*models.Message, len(convs))
+	for i, conv := range convs {
+		last := conv.LastMessage
+		if last == nil || (!last.IsHiddenFor(userID) && !containsID(blockedIDs, last.SenderID)) {
+			lastMessages[i] = last
+			continue
+		}
+
+		messages, err := s.store.ListMessages(ctx, conv.ID, store.MessageQuery{Limit: 1, Viewer: userID, ExcludeSenders: blockedIDs})
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			lastMessages[i] = messages[0]
+		}
+	}
+	return lastMessages, nil
+}
+
+// userOrPlaceholder trả về người dùng đã lấy, hoặc một bản ghi chỉ có ID nếu người dùng không còn tồn tại
+func userOrPlaceholder(users map[primitive.ObjectID]*models.User, id primitive.ObjectID) *models.User {
+	if user, ok := users[id]; ok {
+		return user
+	}
+	return &models.User{ID: id, Name: "Người dùng không tồn tại"}
+}
@@ -0,0 +1,20 @@
+package services
+
+import "time"
+
+// MessagePolicy chứa các giới hạn nghiệp vụ khi thao tác với tin nhắn đã gửi
+type MessagePolicy struct {
+	EditWindow time.Duration // thời gian sau khi gửi mà người gửi còn được sửa tin nhắn, <= 0 để không giới hạn
+}
+
+// DefaultMessagePolicy trả về giá trị mặc định của MessagePolicy
+func DefaultMessagePolicy() MessagePolicy {
+	return MessagePolicy{
+		EditWindow: 15 * time.Minute,
+	}
+}
+
+// canEdit cho biết tin nhắn tạo lúc createdAt còn trong thời gian được sửa hay không
+func (p MessagePolicy) canEdit(createdAt, now time.Time) bool {
+	return p.EditWindow <= 0 || now.Sub(createdAt) <= p.EditWindow
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// outboxBatchSize là số sự kiện tối đa được đọc trong mỗi lượt gửi
+const outboxBatchSize = 100
+
+// OutboxDispatcher gửi các sự kiện trong outbox qua WebSocket rồi xóa chúng.
+// Sự kiện chỉ bị xóa sau khi đã gửi nên mỗi sự kiện được gửi ít nhất một lần,
+// kể cả khi server dừng giữa chừng: lần khởi động sau sẽ gửi tiếp phần còn lại.
+type OutboxDispatcher struct {
+	store    store.OutboxStore
+	ws       *types.WebSocketHandler
+	interval time.Duration
+	timeouts Timeouts
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewOutboxDispatcher(outboxStore store.OutboxStore, wsHandler *types.WebSocketHandler, interval time.Duration, timeouts Timeouts) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		store:    outboxStore,
+		ws:       wsHandler,
+		interval: interval,
+		timeouts: timeouts,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start chạy vòng lặp gửi sự kiện: ngay khi được Notify hoặc định kỳ sau mỗi interval
+func (d *OutboxDispatcher) Start() {
+	go d.run()
+}
+
+// Stop dừng vòng lặp và chờ lượt gửi hiện tại kết thúc
+func (d *OutboxDispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
+
+// Notify báo có sự kiện mới; không chặn nếu dispatcher đã có tín hiệu chờ xử lý
+func (d *OutboxDispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *OutboxDispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	// Gửi các sự kiện còn sót lại từ lần chạy trước
+	d.drain()
+
+	for {
+		select {
+		case <-d.wake:
+			d.drain()
+		case <-ticker.C:
+			d.drain()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// drain gửi lần lượt từng lô sự kiện cho tới khi outbox trống hoặc gặp lỗi
+func (d *OutboxDispatcher) drain() {
+	for {
+		sent, err := d.dispatchBatch()
+		if err != nil {
+			log.Printf("Error dispatching outbox events: %v", err)
+			return
+		}
+		if sent < outboxBatchSize {
+			return
+		}
+	}
+}
+
+func (d *OutboxDispatcher) dispatchBatch() (int, error) {
+	ctx, cancel := d.timeouts.write(context.Background())
+	defer cancel()
+
+	events, err := d.store.PendingOutboxEvents(ctx, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+		message := types.WebSocketMessage{
+			Type:    event.Type,
+			Payload: json.RawMessage(event.Payload),
+		}
+		for _, recipientID := range event.Recipients {
+			// Người nhận offline sẽ lấy tin nhắn qua API nên lỗi gửi không giữ lại sự kiện
+			if err := d.ws.SendToUser(recipientID, message); err != nil {
+				log.Printf("Error sending %s event to user %s: %v", event.Type, recipientID.Hex(), err)
+			}
+		}
+	}
+
+	if err := d.store.DeleteOutboxEvents(ctx, ids); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxEmojiLength đủ cho các emoji ghép nhiều ký tự (cờ, gia đình, màu da)
+	maxEmojiLength = 32
+	// maxReactionsPerUser giới hạn số emoji khác nhau một người thả vào một tin nhắn
+	maxReactionsPerUser = 20
+)
+
+var (
+	// ErrInvalidEmoji được trả về khi reaction không phải một emoji hợp lệ
+	ErrInvalidEmoji = errors.New("emoji không hợp lệ")
+	// ErrTooManyReactions được trả về khi người dùng đã thả quá nhiều emoji vào một tin nhắn
+	ErrTooManyReactions = errors.New("bạn đã thả quá nhiều emoji vào tin nhắn này")
+)
+
+// ReactionEvent là payload của sự kiện WebSocket khi một reaction được thêm hoặc gỡ
+type ReactionEvent struct {
+	MessageID      primitive.ObjectID  `json:"message_id"`
+	ConversationID primitive.ObjectID  `json:"conversation_id"`
+	ThreadRootID   *primitive.ObjectID `json:"thread_root_id,omitempty"`
+	UserID         primitive.ObjectID  `json:"user_id"`
+	Emoji          string              `json:"emoji"`
+	Added          bool                `json:"added"`
+}
+
+// ReactionGroup là danh sách người đã thả một emoji, theo thứ tự thả
+type ReactionGroup struct {
+	Emoji string                 `json:"emoji"`
+	Count int                    `json:"count"`
+	Users []*models.UserResponse `json:"users"`
+}
+
+// validEmoji chấp nhận chuỗi ngắn không có khoảng trắng, ký tự điều khiển hay chữ cái ASCII.
+// Chữ số, # và * vẫn được dùng trong các emoji keycap như 1️⃣.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	hasSymbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			return false
+		case r < utf8.RuneSelf:
+			if !unicode.IsDigit(r) && r != '#' && r != '*' {
+				return false
+			}
+		default:
+			hasSymbol = true
+		}
+	}
+	return hasSymbol
+}
+
+// visibleMessage lấy tin nhắn userID còn thấy được (để thả reaction, đánh dấu đã nghe...) và cuộc hội thoại chứa nó
+func (s *ChatService) visibleMessage(ctx context.Context, userID, messageID primitive.ObjectID) (*models.Message, *models.Conversation, error) {
+	msg, err := s.store.GetMessage(ctx, messageID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if msg.IsDeleted || msg.IsHiddenFor(userID) {
+		return nil, nil, ErrMessageNotFound
+	}
+
+	conv, err := s.store.GetConversation(ctx, msg.ConversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if !containsID(conv.Participants, userID) {
+		return nil, nil, ErrNotParticipant
+	}
+	return msg, conv, nil
+}
+
+// ToggleReaction thả emoji vào tin nhắn, hoặc gỡ nếu userID đã thả emoji đó, rồi trả về tin nhắn
+// với reaction mới nhất. Các thành viên của cuộc hội thoại chưa chặn người gửi tin nhắn nhận sự kiện message_reaction.
+func (s *ChatService) ToggleReaction(ctx context.Context, userID, messageID primitive.ObjectID, emoji string) (*models.MessageResponse, error) {
+	if !validEmoji(emoji) {
+		return nil, ErrInvalidEmoji
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	msg, conv, err := s.visibleMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	added := !msg.HasReaction(userID, emoji)
+	if added {
+		count := 0
+		for _, reaction := range msg.Reactions {
+			if reaction.UserID == userID {
+				count++
+			}
+		}
+		if count >= maxReactionsPerUser {
+			return nil, ErrTooManyReactions
+		}
+	}
+
+	now := time.Now()
+	change := ReactionEvent{
+		MessageID:      msg.ID,
+		ConversationID: conv.ID,
+		UserID:         userID,
+		Emoji:          emoji,
+		Added:          added,
+	}
+	if msg.IsThreadReply() {
+		rootID := msg.ThreadRootID
+		change.ThreadRootID = &rootID
+	}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	// Người thả reaction cũng nhận sự kiện để đồng bộ các thiết bị khác;
+	// người đã chặn người gửi tin nhắn không thấy tin nhắn nên không nhận sự kiện
+	recipients, err := s.withoutBlockers(ctx, msg.SenderID, conv.Participants)
+	if err != nil {
+		return nil, err
+	}
+	event := &models.OutboxEvent{
+		ID:         primitive.NewObjectID(),
+		Type:       types.EventTypeMessageReaction,
+		Recipients: recipients,
+		Payload:    payload,
+		CreatedAt:  now,
+	}
+
+	// Store bỏ qua thao tác đã được một request đồng thời thực hiện và khi đó không ghi sự kiện
+	var changed bool
+	if added {
+		reaction := models.Reaction{Emoji: emoji, UserID: userID, CreatedAt: now}
+		changed, err = s.store.AddReaction(ctx, messageID, reaction, []*models.OutboxEvent{event})
+	} else {
+		changed, err = s.store.RemoveReaction(ctx, messageID, userID, emoji, []*models.OutboxEvent{event})
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if changed {
+		s.outbox.Notify()
+	}
+
+	// Đọc lại để trả về cả reaction của những người khác thả cùng lúc
+	if msg, err = s.store.GetMessage(ctx, messageID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return s.MessageResponse(ctx, userID, msg)
+}
+
+// ListReactions trả về những người đã thả từng emoji vào tin nhắn, theo thứ tự emoji được thả lần đầu
+func (s *ChatService) ListReactions(ctx context.Context, userID, messageID primitive.ObjectID) ([]*ReactionGroup, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	msg, _, err := s.visibleMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]primitive.ObjectID, 0, len(msg.Reactions))
+	for _, reaction := range msg.Reactions {
+		userIDs = append(userIDs, reaction.UserID)
+	}
+	users, err := s.users.GetUsersByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*ReactionGroup{}
+	byEmoji := make(map[string]*ReactionGroup)
+	for _, reaction := range msg.Reactions {
+		group, ok := byEmoji[reaction.Emoji]
+		if !ok {
+			group = &ReactionGroup{Emoji: reaction.Emoji, Users: []*models.UserResponse{}}
+			byEmoji[reaction.Emoji] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.Users = append(group.Users, userOrPlaceholder(users, reaction.UserID).ToResponse())
+	}
+	return groups, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidEmoji(t *testing.T) {
+	for _, tc := range []struct {
+		emoji string
+		want  bool
+	}{
+		{emoji: "👍", want: true},
+		{emoji: "👍🏽", want: true},
+		{emoji: "👨‍👩‍👧", want: true},
+		{emoji: "1️⃣", want: true},
+		{emoji: "", want: false},
+		{emoji: "a", want: false},
+		{emoji: "1", want: false},
+		{emoji: "👍 ", want: false},
+		{emoji: "👍\n", want: false},
+		{emoji: strings.Repeat("👍", 9), want: false},
+	} {
+		if got := validEmoji(tc.emoji); got != tc.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", tc.emoji, got, tc.want)
+		}
+	}
+}
+
+func TestToggleReaction(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol")
+	convID := e.newGroup(t, alice, bob, carol)
+	msg := e.send(t, alice, convID, "xin chào")
+	e.takeEvents(t, "")
+
+	// Mỗi lần bấm đổi trạng thái emoji của người bấm; summary giữ thứ tự emoji được thả lần đầu
+	for _, tc := range []struct {
+		name    string
+		user    primitive.ObjectID
+		emoji   string
+		added   bool
+		summary string // emoji:count:reacted_by_me theo góc nhìn của user
+	}{
+		{name: "bob adds", user: bob, emoji: "👍", added: true, summary: "👍:1:true"},
+		{name: "carol adds the same emoji", user: carol, emoji: "👍", added: true, summary: "👍:2:true"},
+		{name: "carol adds another emoji", user: carol, emoji: "❤️", added: true, summary: "👍:2:true ❤️:1:true"},
+		{name: "bob removes", user: bob, emoji: "👍", added: false, summary: "👍:1:false ❤️:1:false"},
+		{name: "carol removes the first emoji", user: carol, emoji: "👍", added: false, summary: "❤️:1:true"},
+		{name: "bob adds again", user: bob, emoji: "👍", added: true, summary: "❤️:1:false 👍:1:true"},
+	} {
+		response, err := e.chat.ToggleReaction(ctx, tc.user, msg.ID, tc.emoji)
+		if err != nil {
+			t.Fatalf("%s: ToggleReaction: %v", tc.name, err)
+		}
+		var parts []string
+		for _, reaction := range response.Reactions {
+			parts = append(parts, fmt.Sprintf("%s:%d:%v", reaction.Emoji, reaction.Count, reaction.ReactedByMe))
+		}
+		if got := strings.Join(parts, " "); got != tc.summary {
+			t.Errorf("%s: reactions = %q, want %q", tc.name, got, tc.summary)
+		}
+
+		events := e.takeEvents(t, types.EventTypeMessageReaction)
+		if len(events) != 1 {
+			t.Fatalf("%s: got %d message_reaction events, want 1", tc.name, len(events))
+		}
+		var change ReactionEvent
+		if err := json.Unmarshal(events[0].Payload, &change); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", tc.name, err)
+		}
+		if change.UserID != tc.user || change.Emoji != tc.emoji || change.Added != tc.added {
+			t.Errorf("%s: event = %+v, want %s by %s added %v", tc.name, change, tc.emoji, tc.user.Hex(), tc.added)
+		}
+		if !equalIDSets(events[0].Recipients, []primitive.ObjectID{alice, bob, carol}) {
+			t.Errorf("%s: event recipients = %v, want every participant", tc.name, events[0].Recipients)
+		}
+	}
+}
+
+func TestToggleReactionErrors(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, outsider := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "outsider")
+	convID := e.newGroup(t, alice, bob)
+	msg := e.send(t, alice, convID, "xin chào")
+	deleted := e.send(t, alice, convID, "sẽ bị thu hồi")
+	if err := e.chat.DeleteMessage(ctx, alice, deleted.ID, DeleteForEveryone); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	// Thả đủ số emoji tối đa: emoji mới bị từ chối nhưng vẫn gỡ được emoji đã thả
+	for i := 0; i < maxReactionsPerUser; i++ {
+		if _, err := e.chat.ToggleReaction(ctx, bob, msg.ID, string(rune(0x1F600+i))); err != nil {
+			t.Fatalf("ToggleReaction %d: %v", i, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		user    primitive.ObjectID
+		message primitive.ObjectID
+		emoji   string
+		want    error
+	}{
+		{name: "invalid emoji", user: alice, message: msg.ID, emoji: "ok", want: ErrInvalidEmoji},
+		{name: "outsider", user: outsider, message: msg.ID, emoji: "👍", want: ErrNotParticipant},
+		{name: "deleted message", user: alice, message: deleted.ID, emoji: "👍", want: ErrMessageNotFound},
+		{name: "one emoji too many", user: bob, message: msg.ID, emoji: "👍", want: ErrTooManyReactions},
+		{name: "removing at the limit", user: bob, message: msg.ID, emoji: string(rune(0x1F600)), want: nil},
+		{name: "adding after removing one", user: bob, message: msg.ID, emoji: "👍", want: nil},
+	} {
+		if _, err := e.chat.ToggleReaction(ctx, tc.user, tc.message, tc.emoji); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"webchat/models"
+	"webchat/search"
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxSearchTerms giới hạn số từ khóa trong một truy vấn tìm kiếm
+	maxSearchTerms = 10
+	// snippetContextWords là số từ đứng trước từ khóa đầu tiên được giữ lại trong đoạn trích
+	snippetContextWords = 5
+	// maxSnippetLength là số ký tự tối đa của đoạn trích, không tính dấu "…"
+	maxSnippetLength = 160
+)
+
+var (
+	// ErrEmptySearchQuery được trả về khi truy vấn không có từ khóa nào (chỉ có khoảng trắng, dấu câu...)
+	ErrEmptySearchQuery = errors.New("từ khóa tìm kiếm không được để trống")
+	// ErrSearchQueryTooLong được trả về khi truy vấn có quá nhiều từ khóa
+	ErrSearchQueryTooLong = errors.New("từ khóa tìm kiếm quá dài")
+)
+
+// MessageSearchRequest là truy vấn tìm kiếm tin nhắn cùng các bộ lọc, các trường bỏ trống không được dùng để lọc
+type MessageSearchRequest struct {
+	Query          string
+	ConversationID primitive.ObjectID
+	SenderID       primitive.ObjectID
+	Since          time.Time // tin nhắn tạo từ thời điểm này trở đi
+	Until          time.Time // tin nhắn tạo trước thời điểm này
+	HasAttachment  bool
+	Cursor         string // next_cursor của trang trước
+	Limit          int64
+}
+
+// SnippetPart là một đoạn của đoạn trích, Highlight cho biết đoạn đó là từ khớp với từ khóa
+type SnippetPart struct {
+	Text      string `json:"text"`
+	Highlight bool   `json:"highlight,omitempty"`
+}
+
+// MessageSearchResult là một tin nhắn khớp với truy vấn.
+// Cursor dùng làm tham số around khi lấy tin nhắn (hoặc tin trả lời trong thread nếu tin nhắn có
+// thread_root_id) để mở tin nhắn giữa các tin xung quanh.
+type MessageSearchResult struct {
+	Message *models.MessageResponse `json:"message"`
+	Snippet []SnippetPart           `json:"snippet"`
+	Cursor  string                  `json:"cursor"`
+}
+
+// MessageSearchPage là một trang kết quả tìm kiếm, mới nhất trước
+type MessageSearchPage struct {
+	Results    []*MessageSearchResult `json:"results"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+	HasMore    bool                   `json:"has_more"`
+}
+
+// SearchMessages tìm các tin nhắn chứa mọi từ trong req.Query, không phân biệt hoa thường và dấu,
+// trong các cuộc hội thoại userID đang tham gia. Tin nhắn đã thu hồi, tin nhắn userID đã xóa
+// ở phía mình và tin nhắn của những người userID đã chặn không được trả về.
+func (s *ChatService) SearchMessages(ctx context.Context, userID primitive.ObjectID, req MessageSearchRequest) (*MessageSearchPage, error) {
+	terms := search.Terms(req.Query)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearchQuery
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, ErrSearchQueryTooLong
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 20
+	} else if limit > 50 {
+		limit = 50
+	}
+
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := store.MessageSearchQuery{
+		Terms:          terms,
+		Viewer:         userID,
+		ConversationID: req.ConversationID,
+		SenderID:       req.SenderID,
+		Since:          req.Since,
+		Until:          req.Until,
+		HasAttachment:  req.HasAttachment,
+		Limit:          limit + 1, // lấy thêm một tin nhắn để biết còn trang tiếp theo hay không
+	}
+	if req.Cursor != "" {
+		before, err := decodeMessageCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query.Before = before
+	}
+	if !req.ConversationID.IsZero() {
+		conv, err := s.store.GetConversation(ctx, req.ConversationID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+		if err != nil || !containsID(conv.Participants, userID) {
+			return nil, ErrNotParticipant
+		}
+	}
+
+	blockedIDs, err := s.users.BlockedIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	query.ExcludeSenders = blockedIDs
+
+	messages, err := s.store.SearchMessages(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessageSearchPage{Results: []*MessageSearchResult{}}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+		page.NextCursor = encodeMessageCursor(messages[limit-1].ID)
+	}
+
+	responses, err := s.MessageResponses(ctx, userID, messages)
+	if err != nil {
+		return nil, err
+	}
+	for i, msg := range messages {
+		page.Results = append(page.Results, &MessageSearchResult{
+			Message: responses[i],
+			Snippet: buildSnippet(msg.Content, terms),
+			Cursor:  encodeMessageCursor(msg.ID),
+		})
+	}
+	return page, nil
+}
+
+// buildSnippet cắt đoạn nội dung quanh từ khớp đầu tiên và đánh dấu mọi từ khớp với terms trong đoạn đó
+func buildSnippet(content string, terms []string) []SnippetPart {
+	matches := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		matches[term] = true
+	}
+	tokens := search.Tokens(content)
+
+	// Bắt đầu vài từ trước từ khớp đầu tiên để người dùng thấy ngữ cảnh
+	start := 0
+	for i, token := range tokens {
+		if matches[token.Term] {
+			start = tokens[max(i-snippetContextWords, 0)].Start
+			break
+		}
+	}
+	// Cắt ở cuối từ cuối cùng còn nằm trọn trong giới hạn độ dài
+	end := len(content)
+	if utf8.RuneCountInString(content[start:]) > maxSnippetLength {
+		end = start
+		for _, token := range tokens {
+			if token.Start < start {
+				continue
+			}
+			if utf8.RuneCountInString(content[start:token.End]) > maxSnippetLength {
+				break
+			}
+			end = token.End
+		}
+		if end == start {
+			// Một từ dài hơn cả đoạn trích: cắt theo số ký tự
+			end = start + len(string([]rune(content[start:])[:maxSnippetLength]))
+		}
+	}
+
+	parts := []SnippetPart{}
+	// text thêm nội dung thường, nối vào đoạn thường ngay trước nếu có
+	text := func(s string) {
+		if n := len(parts); n > 0 && !parts[n-1].Highlight {
+			parts[n-1].Text += s
+		} else if s != "" {
+			parts = append(parts, SnippetPart{Text: s})
+		}
+	}
+	if start > 0 {
+		text("…")
+	}
+	pos := start
+	for _, token := range tokens {
+		if token.Start < start || token.End > end || !matches[token.Term] {
+			continue
+		}
+		text(content[pos:token.Start])
+		parts = append(parts, SnippetPart{Text: content[token.Start:token.End], Highlight: true})
+		pos = token.End
+	}
+	text(content[pos:end])
+	if end < len(content) {
+		text("…")
+	}
+	return parts
+}
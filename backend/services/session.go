@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"webchat/models"
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sessionTouchInterval là khoảng thời gian tối thiểu giữa hai lần ghi LastUsedAt của cùng một phiên,
+// để các yêu cầu API liên tiếp không ghi vào database mỗi lần
+const sessionTouchInterval = time.Minute
+
+// maxUserAgentLength giới hạn độ dài user agent được lưu cùng phiên
+const maxUserAgentLength = 512
+
+// ErrSessionNotFound được trả về khi phiên không tồn tại hoặc thuộc về người dùng khác
+var ErrSessionNotFound = errors.New("không tìm thấy phiên đăng nhập")
+
+// ClientInfo mô tả thiết bị thực hiện đăng nhập
+type ClientInfo struct {
+	Device    string // tên thiết bị do client gửi, để trống thì suy ra từ UserAgent
+	UserAgent string
+	IP        string
+}
+
+// SessionInfo là một phiên trong danh sách phiên đăng nhập của người dùng
+type SessionInfo struct {
+	*models.Session
+	Current bool `json:"current"` // phiên của access token đang gọi API
+}
+
+// createSession lưu phiên của lần đăng nhập đã tạo token family familyID
+func (s *AuthService) createSession(ctx context.Context, userID, familyID primitive.ObjectID, client ClientInfo, now time.Time) error {
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	device := strings.TrimSpace(client.Device)
+	if device == "" {
+		device = describeDevice(userAgent)
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	err := s.tokens.CreateSession(ctx, &models.Session{
+		ID:         familyID,
+		UserID:     userID,
+		Device:     device,
+		UserAgent:  userAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	})
+	if err == nil {
+		s.markSessionTouched(familyID, now)
+	}
+	return err
+}
+
+// RecordSessionActivity cập nhật thời điểm dùng gần nhất và IP của phiên đã cấp token.
+// Mỗi phiên được ghi tối đa một lần trong sessionTouchInterval; lỗi chỉ được ghi log.
+func (s *AuthService) RecordSessionActivity(ctx context.Context, claims *TokenClaims, ip string) {
+	now := time.Now()
+	s.touchMu.Lock()
+	last, ok := s.sessionTouches[claims.FamilyID]
+	if ok && now.Sub(last) < sessionTouchInterval {
+		s.touchMu.Unlock()
+		return
+	}
+	s.sessionTouches[claims.FamilyID] = now
+	s.touchMu.Unlock()
+
+	s.touchSession(ctx, claims.FamilyID, ip, now)
+}
+
+func (s *AuthService) touchSession(ctx context.Context, sessionID primitive.ObjectID, ip string, now time.Time) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	if err := s.tokens.TouchSession(ctx, sessionID, ip, now); err != nil {
+		log.Printf("Error updating session %s: %v", sessionID.Hex(), err)
+	}
+}
+
+func (s *AuthService) markSessionTouched(sessionID primitive.ObjectID, at time.Time) {
+	s.touchMu.Lock()
+	s.sessionTouches[sessionID] = at
+	s.touchMu.Unlock()
+}
+
+// pruneSessionTouches bỏ các mốc đã cũ hơn sessionTouchInterval, chúng không còn chặn lần ghi tiếp theo
+func (s *AuthService) pruneSessionTouches(now time.Time) {
+	s.touchMu.Lock()
+	defer s.touchMu.Unlock()
+
+	for id, last := range s.sessionTouches {
+		if now.Sub(last) >= sessionTouchInterval {
+			delete(s.sessionTouches, id)
+		}
+	}
+}
+
+// ListSessions lấy các phiên đăng nhập của userID, dùng gần đây nhất trước.
+// currentID là phiên của access token đang gọi API.
+func (s *AuthService) ListSessions(ctx context.Context, userID, currentID primitive.ObjectID) ([]*SessionInfo, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	sessions, err := s.tokens.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = &SessionInfo{Session: session, Current: session.ID == currentID}
+	}
+	return infos, nil
+}
+
+// RevokeSession đăng xuất phiên sessionID của userID: mọi token của phiên bị thu hồi
+// và kết nối WebSocket mở bằng token của phiên bị đóng ngay
+func (s *AuthService) RevokeSession(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	readCtx, cancel := s.timeouts.read(ctx)
+	session, err := s.tokens.GetSession(readCtx, sessionID)
+	cancel()
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return ErrSessionNotFound
+	}
+
+	return s.endSession(ctx, userID, sessionID)
+}
+
+// RevokeOtherSessions đăng xuất mọi phiên của userID trừ currentID và trả về số phiên đã đăng xuất
+func (s *AuthService) RevokeOtherSessions(ctx context.Context, userID, currentID primitive.ObjectID) (int, error) {
+	readCtx, cancel := s.timeouts.read(ctx)
+	sessions, err := s.tokens.ListSessions(readCtx, userID)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID == currentID {
+			continue
+		}
+		if err := s.endSession(ctx, userID, session.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// endSession thu hồi token family của phiên, xóa phiên và đóng kết nối WebSocket mở bằng token của phiên
+func (s *AuthService) endSession(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	if err := s.RevokeTokenFamily(ctx, sessionID); err != nil {
+		return err
+	}
+
+	writeCtx, cancel := s.timeouts.write(ctx)
+	_, err := s.tokens.DeleteSession(writeCtx, sessionID)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	s.touchMu.Lock()
+	delete(s.sessionTouches, sessionID)
+	s.touchMu.Unlock()
+
+	s.websocketHandler.CloseSession(userID, sessionID)
+	return nil
+}
+
+// describeDevice tạo tên thiết bị dễ đọc như "Chrome trên Windows" từ user agent
+func describeDevice(userAgent string) string {
+	var browser, platform string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+	// Android và iOS phải được kiểm tra trước Linux và macOS vì user agent của chúng chứa cả hai
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"), strings.Contains(userAgent, "Macintosh"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " trên " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return "Thiết bị không xác định"
+	}
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	chromeWindows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	safariIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+)
+
+// loginSession đăng nhập userID từ client và trả về cặp token cùng ID phiên của lần đăng nhập
+func loginSession(t *testing.T, s *AuthService, userID primitive.ObjectID, client ClientInfo) (*TokenPair, primitive.ObjectID) {
+	t.Helper()
+	ctx := context.Background()
+	pair, err := s.GenerateTokenPair(ctx, userID, client)
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err)
+	}
+	claims, err := s.ValidateToken(ctx, pair.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	return pair, claims.FamilyID
+}
+
+func TestDescribeDevice(t *testing.T) {
+	for _, tc := range []struct {
+		userAgent string
+		want      string
+	}{
+		{userAgent: chromeWindows, want: "Chrome trên Windows"},
+		{userAgent: safariIPhone, want: "Safari trên iOS"},
+		{userAgent: "Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", want: "Chrome trên Android"},
+		{userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", want: "Firefox trên Linux"},
+		{userAgent: "curl/8.4.0", want: "Thiết bị không xác định"},
+		{userAgent: "", want: "Thiết bị không xác định"},
+	} {
+		if got := describeDevice(tc.userAgent); got != tc.want {
+			t.Errorf("describeDevice(%q) = %q, want %q", tc.userAgent, got, tc.want)
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	userID := primitive.NewObjectID()
+	_, laptop := loginSession(t, s, userID, ClientInfo{UserAgent: chromeWindows, IP: "10.0.0.1"})
+	_, phone := loginSession(t, s, userID, ClientInfo{Device: "  Điện thoại của tôi ", UserAgent: safariIPhone, IP: "10.0.0.2"})
+	loginSession(t, s, primitive.NewObjectID(), ClientInfo{UserAgent: chromeWindows})
+
+	sessions, err := s.ListSessions(ctx, userID, laptop)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	want := map[primitive.ObjectID]struct {
+		device  string
+		current bool
+	}{
+		laptop: {device: "Chrome trên Windows", current: true},
+		phone:  {device: "Điện thoại của tôi", current: false},
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("got %d sessions, want %d", len(sessions), len(want))
+	}
+	for _, session := range sessions {
+		w, ok := want[session.ID]
+		if !ok {
+			t.Errorf("unexpected session %s", session.ID.Hex())
+			continue
+		}
+		if session.UserID != userID || session.Device != w.device || session.Current != w.current {
+			t.Errorf("session %s = %q current %v, want %q current %v", session.ID.Hex(), session.Device, session.Current, w.device, w.current)
+		}
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	userID, otherUser := primitive.NewObjectID(), primitive.NewObjectID()
+	current, currentID := loginSession(t, s, userID, ClientInfo{UserAgent: chromeWindows})
+	revoked, revokedID := loginSession(t, s, userID, ClientInfo{UserAgent: safariIPhone})
+	other, otherID := loginSession(t, s, otherUser, ClientInfo{UserAgent: chromeWindows})
+
+	// Phiên của người khác và phiên không tồn tại trả về cùng một lỗi
+	for name, sessionID := range map[string]primitive.ObjectID{
+		"other user's session": otherID,
+		"unknown session":      primitive.NewObjectID(),
+	} {
+		if err := s.RevokeSession(ctx, userID, sessionID); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s: got %v, want ErrSessionNotFound", name, err)
+		}
+	}
+	if _, err := s.ValidateToken(ctx, other.AccessToken); err != nil {
+		t.Fatalf("other user's token after a rejected revoke: %v", err)
+	}
+
+	if err := s.RevokeSession(ctx, userID, revokedID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if _, err := s.ValidateToken(ctx, revoked.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked access token: got %v, want ErrTokenRevoked", err)
+	}
+	if _, err := s.RefreshTokens(ctx, revoked.RefreshToken, "127.0.0.1"); err == nil {
+		t.Error("revoked refresh token still works")
+	}
+	if err := s.RevokeSession(ctx, userID, revokedID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking twice: got %v, want ErrSessionNotFound", err)
+	}
+	if _, err := s.ValidateToken(ctx, current.AccessToken); err != nil {
+		t.Errorf("current session after revoking another: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, userID, currentID)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != currentID {
+		t.Errorf("sessions after revoke = %d, want only the current one", len(sessions))
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestAuthService(t)
+	userID := primitive.NewObjectID()
+	current, currentID := loginSession(t, s, userID, ClientInfo{UserAgent: chromeWindows})
+	var others []*TokenPair
+	for i := 0; i < 2; i++ {
+		pair, _ := loginSession(t, s, userID, ClientInfo{UserAgent: safariIPhone})
+		others = append(others, pair)
+	}
+	other, _ := loginSession(t, s, primitive.NewObjectID(), ClientInfo{UserAgent: chromeWindows})
+
+	revoked, err := s.RevokeOtherSessions(ctx, userID, currentID)
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions: %v", err)
+	}
+	if revoked != len(others) {
+		t.Errorf("RevokeOtherSessions = %d, want %d", revoked, len(others))
+	}
+	for i, pair := range others {
+		if _, err := s.ValidateToken(ctx, pair.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("session %d: got %v, want ErrTokenRevoked", i, err)
+		}
+	}
+	for name, pair := range map[string]*TokenPair{"current session": current, "other user": other} {
+		if _, err := s.ValidateToken(ctx, pair.AccessToken); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if revoked, err := s.RevokeOtherSessions(ctx, userID, currentID); err != nil || revoked != 0 {
+		t.Errorf("second RevokeOtherSessions = %d, %v; want 0", revoked, err)
+	}
+}
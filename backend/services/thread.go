@@ -0,0 +1,239 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrInvalidThreadRoot được trả về khi mở thread trên một tin trả lời trong thread khác
+	ErrInvalidThreadRoot = errors.New("không thể mở thread trên tin trả lời trong thread")
+	// ErrNotParticipant được trả về khi người dùng không phải thành viên của cuộc hội thoại
+	ErrNotParticipant = errors.New("bạn không phải thành viên của cuộc hội thoại này")
+)
+
+// ThreadPage là một trang tin trả lời trong thread cùng tin nhắn gốc
+// và trạng thái theo dõi của người xem
+type ThreadPage struct {
+	Root *models.MessageResponse `json:"root"`
+	*MessagePage
+	Following   bool  `json:"following"`
+	UnreadCount int64 `json:"unread_count"`
+}
+
+// threadRoot lấy tin nhắn gốc của thread và cuộc hội thoại chứa nó, đồng thời kiểm tra userID là thành viên
+func (s *ChatService) threadRoot(ctx context.Context, userID, rootID primitive.ObjectID) (*models.Message, *models.Conversation, error) {
+	root, err := s.store.GetMessage(ctx, rootID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if root.IsHiddenFor(userID) {
+		return nil, nil, ErrMessageNotFound
+	}
+	if root.IsThreadReply() {
+		return nil, nil, ErrInvalidThreadRoot
+	}
+
+	conv, err := s.store.GetConversation(ctx, root.ConversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if !containsID(conv.Participants, userID) {
+		return nil, nil, ErrNotParticipant
+	}
+	return root, conv, nil
+}
+
+// SendThreadReply gửi tin trả lời trong thread của tin nhắn rootID. Người gửi tự động theo dõi thread;
+// sự kiện chỉ được gửi tới người theo dõi thread và các thành viên đã bật nhận mọi tin trả lời trong thread
+func (s *ChatService) SendThreadReply(ctx context.Context, senderID, rootID primitive.ObjectID, content string) (*models.MessageResponse, error) {
+	if len(content) > 2000 {
+		return nil, errors.New("độ dài tin nhắn không được vượt quá 2000 ký tự")
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	root, conv, err := s.threadRoot(ctx, senderID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	if root.IsDeleted {
+		return nil, ErrMessageNotFound
+	}
+	if err := s.checkPersonalBlock(ctx, conv, senderID); err != nil {
+		return nil, err
+	}
+
+	msg := &models.Message{
+		ID:             primitive.NewObjectID(),
+		Type:           models.MessageTypePersonal,
+		ConversationID: conv.ID,
+		SenderID:       senderID,
+		ThreadRootID:   rootID,
+		Content:        content,
+		Status:         models.MessageStatusSent,
+		ReadBy:         []primitive.ObjectID{senderID},
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	if conv.Type == models.ConversationTypeGroup {
+		msg.Type = models.MessageTypeGroup
+		msg.GroupID = conv.ID
+	}
+	if msg.UnreadExempt, err = s.blockersAmong(ctx, senderID, conv.Participants); err != nil {
+		return nil, err
+	}
+
+	response, err := s.MessageResponse(ctx, senderID, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := s.withoutBlockers(ctx, senderID, threadRecipients(root, conv, senderID))
+	if err != nil {
+		return nil, err
+	}
+	event := &models.OutboxEvent{
+		ID:         primitive.NewObjectID(),
+		Type:       types.EventTypeThreadMessage,
+		Recipients: recipients,
+		Payload:    payload,
+		CreatedAt:  msg.CreatedAt,
+	}
+
+	// Lưu tin trả lời, cập nhật thống kê thread của tin nhắn gốc và ghi sự kiện trong cùng một transaction
+	if err := s.store.SaveMessage(ctx, msg, []*models.OutboxEvent{event}); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	s.outbox.Notify()
+	return response, nil
+}
+
+// threadRecipients trả về những người nhận sự kiện tin trả lời mới: người theo dõi thread (kể cả người gửi
+// tin nhắn gốc ở tin trả lời đầu tiên), các thành viên đã bật nhận mọi tin trả lời và người gửi,
+// để đồng bộ các thiết bị khác của người gửi
+func threadRecipients(root *models.Message, conv *models.Conversation, senderID primitive.ObjectID) []primitive.ObjectID {
+	candidates := make([]primitive.ObjectID, 0, len(root.ThreadFollowers)+len(conv.ThreadOptIns)+2)
+	candidates = append(candidates, senderID)
+	candidates = append(candidates, root.ThreadFollowers...)
+	if root.ThreadReplyCount == 0 {
+		candidates = append(candidates, root.SenderID)
+	}
+	candidates = append(candidates, conv.ThreadOptIns...)
+
+	recipients := make([]primitive.ObjectID, 0, len(candidates))
+	for _, id := range candidates {
+		// Người đã rời cuộc hội thoại không nhận tin trả lời dù vẫn còn trong danh sách theo dõi
+		if containsID(recipients, id) || !containsID(conv.Participants, id) {
+			continue
+		}
+		recipients = append(recipients, id)
+	}
+	return recipients
+}
+
+// GetThreadMessages lấy tin nhắn gốc và một trang tin trả lời trong thread của rootID mà userID nhìn thấy
+func (s *ChatService) GetThreadMessages(ctx context.Context, userID, rootID primitive.ObjectID, req MessagePageRequest) (*ThreadPage, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	root, conv, err := s.threadRoot(ctx, userID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	blockedIDs, err := s.users.BlockedIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := store.MessageQuery{Viewer: userID, ThreadRootID: rootID, ExcludeSenders: blockedIDs}
+	page, err := s.messagePage(ctx, conv.ID, scope, req)
+	if err != nil {
+		return nil, err
+	}
+	rootResponse, err := s.MessageResponse(ctx, userID, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ThreadPage{
+		Root:        rootResponse,
+		MessagePage: page,
+		Following:   root.IsFollowingThread(userID),
+		UnreadCount: root.ThreadUnreadCountFor(userID),
+	}, nil
+}
+
+// FollowThread theo dõi hoặc bỏ theo dõi thread của tin nhắn rootID
+func (s *ChatService) FollowThread(ctx context.Context, userID, rootID primitive.ObjectID, follow bool) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	if _, _, err := s.threadRoot(ctx, userID, rootID); err != nil {
+		return err
+	}
+
+	if err := s.store.FollowThread(ctx, rootID, userID, follow); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrMessageNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// MarkThreadRead đánh dấu userID đã đọc mọi tin trả lời trong thread của rootID
+func (s *ChatService) MarkThreadRead(ctx context.Context, userID, rootID primitive.ObjectID) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	if _, _, err := s.threadRoot(ctx, userID, rootID); err != nil {
+		return err
+	}
+
+	return s.store.MarkThreadRead(ctx, rootID, userID)
+}
+
+// SetThreadNotifications bật hoặc tắt việc nhận mọi tin trả lời trong thread của cuộc hội thoại,
+// kể cả các thread userID không theo dõi
+func (s *ChatService) SetThreadNotifications(ctx context.Context, userID, conversationID primitive.ObjectID, enabled bool) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	conv, err := s.store.GetConversation(ctx, conversationID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return errors.New("cuộc hội thoại không tồn tại")
+		}
+		return err
+	}
+	if !containsID(conv.Participants, userID) {
+		return ErrNotParticipant
+	}
+
+	return s.store.SetThreadOptIn(ctx, conversationID, userID, enabled)
+}
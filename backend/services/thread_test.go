@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"webchat/models"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (e *testEnv) reply(t *testing.T, sender, rootID primitive.ObjectID, content string) *models.MessageResponse {
+	t.Helper()
+	msg, err := e.chat.SendThreadReply(context.Background(), sender, rootID, content)
+	if err != nil {
+		t.Fatalf("SendThreadReply: %v", err)
+	}
+	return msg
+}
+
+// threadRecipients trả về người nhận của sự kiện thread_message duy nhất đang chờ trong outbox
+func (e *testEnv) threadRecipients(t *testing.T) []primitive.ObjectID {
+	t.Helper()
+	events := e.takeEvents(t, types.EventTypeThreadMessage)
+	if len(events) != 1 {
+		t.Fatalf("got %d thread_message events, want 1", len(events))
+	}
+	return events[0].Recipients
+}
+
+func TestThreadFollowersAndUnread(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, carol, dave := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "carol"), e.newUser(t, "dave")
+	convID := e.newGroup(t, alice, bob, carol, dave)
+	root := e.send(t, alice, convID, "gốc")
+	e.takeEvents(t, "")
+
+	type state struct {
+		following bool
+		unread    int64
+	}
+	check := func(step string, want map[primitive.ObjectID]state) {
+		t.Helper()
+		for userID, want := range want {
+			page, err := e.chat.GetThreadMessages(ctx, userID, root.ID, MessagePageRequest{})
+			if err != nil {
+				t.Fatalf("%s: GetThreadMessages: %v", step, err)
+			}
+			if got := (state{page.Following, page.UnreadCount}); got != want {
+				t.Errorf("%s: user %s has %+v, want %+v", step, userID.Hex(), got, want)
+			}
+		}
+	}
+
+	// Tin trả lời đầu tiên: người trả lời và người gửi tin nhắn gốc bắt đầu theo dõi
+	e.reply(t, bob, root.ID, "một")
+	if got, want := e.threadRecipients(t), []primitive.ObjectID{alice, bob}; !equalIDSets(got, want) {
+		t.Errorf("first reply recipients = %v, want %v", got, want)
+	}
+	check("first reply", map[primitive.ObjectID]state{
+		alice: {following: true, unread: 1},
+		bob:   {following: true, unread: 0},
+		carol: {following: false, unread: 0},
+	})
+
+	// Người bật nhận mọi tin trả lời nhận sự kiện nhưng không có số chưa đọc của thread
+	if err := e.chat.SetThreadNotifications(ctx, dave, convID, true); err != nil {
+		t.Fatalf("SetThreadNotifications: %v", err)
+	}
+	if err := e.chat.FollowThread(ctx, carol, root.ID, true); err != nil {
+		t.Fatalf("FollowThread: %v", err)
+	}
+	e.reply(t, alice, root.ID, "hai")
+	if got, want := e.threadRecipients(t), []primitive.ObjectID{alice, bob, carol, dave}; !equalIDSets(got, want) {
+		t.Errorf("second reply recipients = %v, want %v", got, want)
+	}
+	check("second reply", map[primitive.ObjectID]state{
+		alice: {following: true, unread: 1},
+		bob:   {following: true, unread: 1},
+		carol: {following: true, unread: 1},
+		dave:  {following: false, unread: 0},
+	})
+
+	// Bỏ theo dõi xóa số chưa đọc và dừng sự kiện; đánh dấu đã đọc chỉ ảnh hưởng người đọc
+	if err := e.chat.FollowThread(ctx, bob, root.ID, false); err != nil {
+		t.Fatalf("FollowThread: %v", err)
+	}
+	if err := e.chat.MarkThreadRead(ctx, alice, root.ID); err != nil {
+		t.Fatalf("MarkThreadRead: %v", err)
+	}
+	if err := e.chat.SetThreadNotifications(ctx, dave, convID, false); err != nil {
+		t.Fatalf("SetThreadNotifications: %v", err)
+	}
+	e.reply(t, carol, root.ID, "ba")
+	if got, want := e.threadRecipients(t), []primitive.ObjectID{alice, carol}; !equalIDSets(got, want) {
+		t.Errorf("third reply recipients = %v, want %v", got, want)
+	}
+	check("third reply", map[primitive.ObjectID]state{
+		alice: {following: true, unread: 1},
+		bob:   {following: false, unread: 0},
+		carol: {following: true, unread: 1},
+	})
+
+	// Tin trả lời không làm thay đổi số chưa đọc của cuộc hội thoại
+	for _, userID := range []primitive.ObjectID{bob, carol, dave} {
+		if got := e.unreadCount(t, userID, convID); got != 1 {
+			t.Errorf("user %s conversation unread = %d, want 1", userID.Hex(), got)
+		}
+	}
+}
+
+func TestThreadErrors(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	alice, bob, outsider := e.newUser(t, "alice"), e.newUser(t, "bob"), e.newUser(t, "outsider")
+	convID := e.newGroup(t, alice, bob)
+	root := e.send(t, alice, convID, "gốc")
+	reply := e.reply(t, bob, root.ID, "một")
+
+	for _, tc := range []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "outsider reads", call: func() error {
+			_, err := e.chat.GetThreadMessages(ctx, outsider, root.ID, MessagePageRequest{})
+			return err
+		}, want: ErrNotParticipant},
+		{name: "outsider replies", call: func() error {
+			_, err := e.chat.SendThreadReply(ctx, outsider, root.ID, "xin chào")
+			return err
+		}, want: ErrNotParticipant},
+		{name: "outsider follows", call: func() error {
+			return e.chat.FollowThread(ctx, outsider, root.ID, true)
+		}, want: ErrNotParticipant},
+		{name: "reply used as root", call: func() error {
+			_, err := e.chat.SendThreadReply(ctx, alice, reply.ID, "xin chào")
+			return err
+		}, want: ErrInvalidThreadRoot},
+		{name: "unknown root", call: func() error {
+			return e.chat.MarkThreadRead(ctx, alice, primitive.NewObjectID())
+		}, want: ErrMessageNotFound},
+	} {
+		if err := tc.call(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts giới hạn thời gian của mỗi thao tác với database.
+// Deadline được cộng dồn với context của request: thao tác dừng khi một trong hai kết thúc trước.
+type Timeouts struct {
+	Read  time.Duration // truy vấn đọc: lấy người dùng, danh sách tin nhắn, hội thoại...
+	Write time.Duration // thao tác ghi: tạo người dùng, gửi tin nhắn, đánh dấu đã đọc...
+}
+
+// DefaultTimeouts trả về giá trị mặc định, ngắn hơn WriteTimeout 15s của HTTP server
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Read:  5 * time.Second,
+		Write: 10 * time.Second,
+	}
+}
+
+func (t Timeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+func (t Timeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+// withTimeout bỏ qua timeout <= 0 để có thể tắt giới hạn khi cần
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -3,112 +3,55 @@ package services
 import (
 	"context"
 	"errors"
-	"log"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"webchat/models"
+	"webchat/store"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// MockUserStore lưu trữ người dùng trong bộ nhớ khi không có cơ sở dữ liệu thật
-type MockUserStore struct {
-	users map[string]*models.User
-	idMap map[primitive.ObjectID]*models.User
-}
+// ErrUserNotFound được trả về khi người dùng không tồn tại
+var ErrUserNotFound = errors.New("không tìm thấy người dùng")
 
-// Tạo một mock store mới
-func NewMockUserStore() *MockUserStore {
-	return &MockUserStore{
-		users: make(map[string]*models.User),
-		idMap: make(map[primitive.ObjectID]*models.User),
-	}
+// maxUserSearchLength giới hạn độ dài (tính theo ký tự) của từ khóa tìm kiếm người dùng
+const maxUserSearchLength = 100
+
+// UserSearchPage là một trang kết quả tìm kiếm người dùng
+type UserSearchPage struct {
+	Users      []*models.UserResponse `json:"users"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+	HasMore    bool                   `json:"has_more"`
 }
 
 type UserService struct {
-	db          *mongo.Database
+	store       store.UserStore
 	authService *AuthService
-	mockStore   *MockUserStore
-	useMock     bool
+	timeouts    Timeouts
+	cache       *userCache
 }
 
-func NewUserService(db *mongo.Database, authService *AuthService) *UserService {
-	useMock := db == nil
-	var mockStore *MockUserStore
-
-	if useMock {
-		log.Println("UserService: Using in-memory mock database")
-		mockStore = NewMockUserStore()
-
-		// Tạo tài khoản demo mặc định để test
-		demoID := primitive.NewObjectID()
-		hashedPassword, _ := authService.HashPassword("123456")
-		demoUser := &models.User{
-			ID:        demoID,
-			Email:     "demo@example.com",
-			Password:  hashedPassword,
-			Name:      "Người dùng Demo",
-			Status:    models.UserStatusOffline,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-		}
-
-		// Lưu vào mock store
-		mockStore.users[demoUser.Email] = demoUser
-		mockStore.idMap[demoUser.ID] = demoUser
-
-		log.Printf("Created demo user: %s with password: 123456", demoUser.Email)
-	}
-
+func NewUserService(userStore store.UserStore, authService *AuthService, timeouts Timeouts) *UserService {
 	return &UserService{
-		db:          db,
+		store:       userStore,
 		authService: authService,
-		mockStore:   mockStore,
-		useMock:     useMock,
+		timeouts:    timeouts,
+		cache:       newUserCache(userCacheTTL),
 	}
 }
 
 // CreateUser tạo người dùng mới
-func (s *UserService) CreateUser(email, password, name string) (*models.User, error) {
-	// Mock database mode
-	if s.useMock {
-		// Kiểm tra email đã tồn tại
-		if _, exists := s.mockStore.users[email]; exists {
-			return nil, errors.New("email đã được sử dụng")
-		}
-
-		// Hash mật khẩu
-		hashedPassword, err := s.authService.HashPassword(password)
-		if err != nil {
-			return nil, err
-		}
-
-		// Tạo người dùng mới
-		user := &models.User{
-			ID:        primitive.NewObjectID(),
-			Email:     email,
-			Password:  hashedPassword,
-			Name:      name,
-			Status:    models.UserStatusOffline,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-		}
-
-		// Lưu vào mock store
-		s.mockStore.users[email] = user
-		s.mockStore.idMap[user.ID] = user
-
-		return user, nil
-	}
-
-	// Normal database mode
-	// Kiểm tra email đã tồn tại
-	var existingUser models.User
-	err := s.db.Collection("users").FindOne(context.Background(), bson.M{"email": email}).Decode(&existingUser)
-	if err == nil {
-		return nil, errors.New("email đã được sử dụng")
+func (s *UserService) CreateUser(ctx context.Context, email, password, name string) (*models.User, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	// Kiểm tra email đã tồn tại trước khi hash mật khẩu
+	if _, err := s.store.GetUserByEmail(ctx, email); err == nil {
+		return nil, store.ErrDuplicateEmail
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
 	}
 
 	// Hash mật khẩu
@@ -127,106 +70,151 @@ func (s *UserService) CreateUser(email, password, name string) (*models.User, er
 		UpdatedAt: time.Now(),
 	}
 
-	_, err = s.db.Collection("users").InsertOne(context.Background(), user)
-	return user, err
+	if err := s.store.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 // GetUserByEmail lấy thông tin người dùng theo email
-func (s *UserService) GetUserByEmail(email string) (*models.User, error) {
-	// Mock database mode
-	if s.useMock {
-		user, exists := s.mockStore.users[email]
-		if !exists {
-			return nil, errors.New("không tìm thấy người dùng")
-		}
-		return user, nil
-	}
+func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
 
-	// Normal database mode
-	var user models.User
-	err := s.db.Collection("users").FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	user, err := s.store.GetUserByEmail(ctx, email)
 	if err != nil {
-		return nil, err
+		return nil, userError(err)
 	}
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByID lấy thông tin người dùng theo ID
-func (s *UserService) GetUserByID(id primitive.ObjectID) (*models.User, error) {
-	// Mock database mode
-	if s.useMock {
-		user, exists := s.mockStore.idMap[id]
-		if !exists {
-			return nil, errors.New("không tìm thấy người dùng")
-		}
-		return user, nil
+func (s *UserService) GetUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	user, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, userError(err)
 	}
+	return user, nil
+}
 
-	// Normal database mode
-	var user models.User
-	err := s.db.Collection("users").FindOne(context.Background(), bson.M{"_id": id}).Decode(&user)
+// GetUsersByIDs lấy nhiều người dùng theo ID, ưu tiên cache và chỉ truy vấn store một lần
+// cho các người dùng còn thiếu. Người dùng không tồn tại không có trong kết quả.
+func (s *UserService) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]*models.User, error) {
+	users, missing := s.cache.get(ids)
+	if len(missing) == 0 {
+		return users, nil
+	}
+
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	fetched, err := s.store.GetUsersByIDs(ctx, missing)
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	s.cache.set(fetched)
+	for _, user := range fetched {
+		users[user.ID] = user
+	}
+	return users, nil
 }
 
 // UpdateUser cập nhật thông tin người dùng
-func (s *UserService) UpdateUser(id primitive.ObjectID, name, avatar string) (*models.User, error) {
-	// Mock database mode
-	if s.useMock {
-		user, exists := s.mockStore.idMap[id]
-		if !exists {
-			return nil, errors.New("không tìm thấy người dùng")
-		}
+func (s *UserService) UpdateUser(ctx context.Context, id primitive.ObjectID, name, avatar string) (*models.User, error) {
+	writeCtx, cancel := s.timeouts.write(ctx)
+	defer cancel()
 
-		user.Name = name
-		user.Avatar = avatar
-		user.UpdatedAt = time.Now()
-
-		return user, nil
+	if err := s.store.UpdateUserProfile(writeCtx, id, name, avatar, time.Now()); err != nil {
+		return nil, userError(err)
 	}
+	s.cache.invalidate(id)
+
+	return s.GetUserByID(ctx, id)
+}
 
-	// Normal database mode
-	update := bson.M{
-		"$set": bson.M{
-			"name":       name,
-			"avatar":     avatar,
-			"updated_at": time.Now(),
-		},
+// UpdateUserStatus cập nhật trạng thái người dùng
+func (s *UserService) UpdateUserStatus(ctx context.Context, id primitive.ObjectID, status models.UserStatus) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	if err := s.store.UpdateUserStatus(ctx, id, status, time.Now()); err != nil {
+		return userError(err)
 	}
+	s.cache.invalidate(id)
+	return nil
+}
 
-	_, err := s.db.Collection("users").UpdateOne(context.Background(), bson.M{"_id": id}, update)
-	if err != nil {
-		return nil, err
+// SearchUsers tìm người dùng có tên hoặc email khớp với query, không phân biệt hoa thường.
+// Người khớp hoàn toàn đứng trước, rồi đến người có tên, một từ trong tên hoặc email bắt đầu bằng query,
+// cuối cùng là người có tên hoặc email chứa query (chỉ khi query có từ 3 ký tự). Người tìm và những người
+// đã chặn người tìm không có trong kết quả.
+func (s *UserService) SearchUsers(ctx context.Context, callerID primitive.ObjectID, query, cursor string, limit int64) (*UserSearchPage, error) {
+	text := strings.ToLower(strings.TrimSpace(query))
+	if text == "" {
+		return nil, ErrEmptySearchQuery
+	}
+	if utf8.RuneCountInString(text) > maxUserSearchLength {
+		return nil, ErrSearchQueryTooLong
 	}
 
-	return s.GetUserByID(id)
-}
+	if limit <= 0 {
+		limit = 20
+	} else if limit > 50 {
+		limit = 50
+	}
 
-// UpdateUserStatus cập nhật trạng thái người dùng
-func (s *UserService) UpdateUserStatus(id primitive.ObjectID, status models.UserStatus) error {
-	// Mock database mode
-	if s.useMock {
-		user, exists := s.mockStore.idMap[id]
-		if !exists {
-			return errors.New("không tìm thấy người dùng")
+	searchQuery := store.UserSearchQuery{
+		Text:  text,
+		Limit: limit + 1, // lấy thêm một người để biết còn trang tiếp theo hay không
+	}
+	if cursor != "" {
+		after, err := decodeUserSearchCursor(cursor)
+		if err != nil {
+			return nil, err
 		}
+		searchQuery.After = after
+	}
+
+	// Những người đã chặn người tìm không xuất hiện trong kết quả
+	blockerIDs, err := s.BlockerIDs(ctx, callerID)
+	if err != nil {
+		return nil, err
+	}
+	searchQuery.Exclude = append(blockerIDs, callerID)
 
-		user.Status = status
-		user.UpdatedAt = time.Now()
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
 
-		return nil
+	users, err := s.store.SearchUsers(ctx, searchQuery)
+	if err != nil {
+		return nil, err
 	}
 
-	// Normal database mode
-	update := bson.M{
-		"$set": bson.M{
-			"status":     status,
-			"updated_at": time.Now(),
-		},
+	page := &UserSearchPage{Users: []*models.UserResponse{}}
+	if int64(len(users)) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		rank, _ := store.UserSearchRank(last, text)
+		page.HasMore = true
+		page.NextCursor = encodeUserSearchCursor(&store.UserSearchCursor{
+			Rank: rank,
+			Name: strings.ToLower(last.Name),
+			ID:   last.ID,
+		})
 	}
+	for _, user := range users {
+		page.Users = append(page.Users, user.ToResponse())
+	}
+	return page, nil
+}
 
-	_, err := s.db.Collection("users").UpdateOne(context.Background(), bson.M{"_id": id}, update)
+// userError chuyển lỗi không tìm thấy của store thành thông báo cho người dùng
+func userError(err error) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrUserNotFound
+	}
 	return err
 }
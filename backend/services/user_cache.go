@@ -0,0 +1,91 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// userCacheTTL đủ ngắn để thay đổi hồ sơ từ instance khác sớm được cập nhật
+	userCacheTTL = 30 * time.Second
+	// userCacheMaxSize giới hạn bộ nhớ của cache, vượt quá thì dọn các mục đã hết hạn
+	userCacheMaxSize = 10000
+)
+
+type userCacheEntry struct {
+	user    *models.User
+	expires time.Time
+}
+
+// userCache lưu tạm người dùng để hiển thị người gửi và thành viên mà không truy vấn lại mỗi lần.
+// Các bản ghi được sao chép khi ghi vào và khi trả ra nên người gọi có thể sửa tự do.
+type userCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[primitive.ObjectID]userCacheEntry
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		ttl:     ttl,
+		entries: make(map[primitive.ObjectID]userCacheEntry),
+	}
+}
+
+// get trả về các người dùng còn trong cache và danh sách ID cần lấy từ store
+func (c *userCache) get(ids []primitive.ObjectID) (map[primitive.ObjectID]*models.User, []primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	found := make(map[primitive.ObjectID]*models.User, len(ids))
+	var missing []primitive.ObjectID
+	for _, id := range ids {
+		if _, done := found[id]; done {
+			continue
+		}
+		entry, ok := c.entries[id]
+		if !ok || now.After(entry.expires) {
+			if !containsID(missing, id) {
+				missing = append(missing, id)
+			}
+			continue
+		}
+		user := *entry.user
+		found[id] = &user
+	}
+	return found, missing
+}
+
+func (c *userCache) set(users []*models.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries)+len(users) > userCacheMaxSize {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries)+len(users) > userCacheMaxSize {
+			c.entries = make(map[primitive.ObjectID]userCacheEntry)
+		}
+	}
+
+	for _, user := range users {
+		clone := *user
+		c.entries[user.ID] = userCacheEntry{user: &clone, expires: now.Add(c.ttl)}
+	}
+}
+
+// invalidate xóa người dùng khỏi cache sau khi thông tin thay đổi
+func (c *userCache) invalidate(id primitive.ObjectID) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
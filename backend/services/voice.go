@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"webchat/models"
+	"webchat/store"
+	"webchat/types"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrInvalidMessageKind được trả về khi loại tin nhắn không phải text hoặc voice
+	ErrInvalidMessageKind = errors.New("loại tin nhắn không hợp lệ")
+	// ErrInvalidVoiceMessage được trả về khi tin nhắn thoại có nội dung chữ hoặc không có đúng một tệp âm thanh đọc được
+	ErrInvalidVoiceMessage = errors.New("tin nhắn thoại phải có đúng một tệp âm thanh và không có nội dung chữ")
+	// ErrNotVoiceMessage được trả về khi đánh dấu đã nghe một tin nhắn không phải tin nhắn thoại
+	ErrNotVoiceMessage = errors.New("tin nhắn không phải tin nhắn thoại")
+	// ErrVoiceMessageNotEditable được trả về khi sửa nội dung tin nhắn thoại
+	ErrVoiceMessageNotEditable = errors.New("không thể sửa tin nhắn thoại")
+)
+
+// PlayedEvent là payload của sự kiện WebSocket khi một người nghe tin nhắn thoại lần đầu
+type PlayedEvent struct {
+	MessageID      primitive.ObjectID `json:"message_id"`
+	ConversationID primitive.ObjectID `json:"conversation_id"`
+	UserID         primitive.ObjectID `json:"user_id"`
+	PlayedAt       time.Time          `json:"played_at"`
+}
+
+// parseMessageKind đổi loại tin nhắn client gửi lên, chuỗi rỗng là tin nhắn chữ
+func parseMessageKind(kind models.MessageKind) (models.MessageKind, error) {
+	switch kind {
+	case "", models.MessageKindText:
+		return models.MessageKindText, nil
+	case models.MessageKindVoice:
+		return models.MessageKindVoice, nil
+	}
+	return "", ErrInvalidMessageKind
+}
+
+// validVoiceMessage kiểm tra tin nhắn thoại chỉ gồm một tệp âm thanh đã đọc được thời lượng
+func validVoiceMessage(content string, attachments []models.AttachmentRef) bool {
+	return content == "" && len(attachments) == 1 && attachments[0].Audio != nil
+}
+
+// MarkVoicePlayed đánh dấu userID đã nghe tin nhắn thoại, độc lập với trạng thái đã đọc.
+// Chỉ lần nghe đầu tiên tạo sự kiện message_played, gửi tới người gửi và các thiết bị khác của người nghe.
+// Người gửi nghe lại tin nhắn của mình không được tính.
+func (s *ChatService) MarkVoicePlayed(ctx context.Context, userID, messageID primitive.ObjectID) (*models.MessageResponse, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	msg, conv, err := s.visibleMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !msg.IsVoice() {
+		return nil, ErrNotVoiceMessage
+	}
+	if msg.SenderID == userID || containsID(msg.PlayedBy, userID) {
+		return s.MessageResponse(ctx, userID, msg)
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(PlayedEvent{
+		MessageID:      msg.ID,
+		ConversationID: conv.ID,
+		UserID:         userID,
+		PlayedAt:       now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	event := &models.OutboxEvent{
+		ID:         primitive.NewObjectID(),
+		Type:       types.EventTypeMessagePlayed,
+		Recipients: []primitive.ObjectID{msg.SenderID, userID},
+		Payload:    payload,
+		CreatedAt:  now,
+	}
+
+	changed, err := s.store.MarkMessagePlayed(ctx, messageID, userID, []*models.OutboxEvent{event})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if changed {
+		s.outbox.Notify()
+	}
+
+	if msg, err = s.store.GetMessage(ctx, messageID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return s.MessageResponse(ctx, userID, msg)
+}
@@ -0,0 +1,874 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore lưu trữ dữ liệu trong bộ nhớ khi không có cơ sở dữ liệu thật.
+// MemoryStore triển khai cả UserStore và ChatStore và an toàn khi dùng đồng thời:
+// mọi bản ghi được sao chép khi ghi vào và khi trả ra nên người gọi không chia sẻ
+// con trỏ với dữ liệu bên trong store.
+type MemoryStore struct {
+	mu sync.RWMutex
+	// version tăng sau mỗi lần ghi, dùng để biết khi nào cần ghi snapshot
+	version uint64
+
+	snapshotPath string
+	savedVersion uint64
+	stopSnapshot chan struct{}
+	snapshotDone chan struct{}
+
+	users            map[string]*models.User
+	usersByID        map[primitive.ObjectID]*models.User
+	conversations    map[primitive.ObjectID]*models.Conversation
+	conversationList []*models.Conversation
+	messages         map[primitive.ObjectID]*models.Message
+	messagesByConv   map[primitive.ObjectID][]*models.Message
+	messagesByThread map[primitive.ObjectID][]*models.Message // tin trả lời theo tin nhắn gốc của thread
+	attachments      map[primitive.ObjectID]*models.Attachment
+	friendRequests   map[primitive.ObjectID]*models.FriendRequest
+	friendPairs      map[string]*models.FriendRequest       // PairKey -> lời mời hoặc quan hệ bạn bè của cặp người dùng
+	searchIndex      map[string]map[primitive.ObjectID]bool // từ khóa -> các tin nhắn chứa từ khóa đó
+	userPrefixes     []userSearchKey                        // khóa tìm kiếm tiền tố của người dùng, sắp xếp tăng dần
+	userTrigrams     map[string]map[primitive.ObjectID]bool // bộ ba ký tự -> người dùng có tên hoặc email chứa nó
+	outbox           []*models.OutboxEvent
+
+	// blocks ánh xạ người chặn -> người bị chặn -> bản ghi, blockedBy là chỉ mục ngược lại
+	blocks    map[primitive.ObjectID]map[primitive.ObjectID]*models.UserBlock
+	blockedBy map[primitive.ObjectID]map[primitive.ObjectID]bool
+
+	revokedTokens map[string]time.Time // jti -> thời điểm token hết hạn
+	tokenFamilies map[primitive.ObjectID]*models.TokenFamily
+	sessions      map[primitive.ObjectID]*models.Session
+}
+
+// NewMemoryStore tạo một memory store rỗng
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:            make(map[string]*models.User),
+		usersByID:        make(map[primitive.ObjectID]*models.User),
+		conversations:    make(map[primitive.ObjectID]*models.Conversation),
+		conversationList: []*models.Conversation{},
+		messages:         make(map[primitive.ObjectID]*models.Message),
+		messagesByConv:   make(map[primitive.ObjectID][]*models.Message),
+		messagesByThread: make(map[primitive.ObjectID][]*models.Message),
+		attachments:      make(map[primitive.ObjectID]*models.Attachment),
+		friendRequests:   make(map[primitive.ObjectID]*models.FriendRequest),
+		friendPairs:      make(map[string]*models.FriendRequest),
+		blocks:           make(map[primitive.ObjectID]map[primitive.ObjectID]*models.UserBlock),
+		blockedBy:        make(map[primitive.ObjectID]map[primitive.ObjectID]bool),
+		revokedTokens:    make(map[string]time.Time),
+		tokenFamilies:    make(map[primitive.ObjectID]*models.TokenFamily),
+		sessions:         make(map[primitive.ObjectID]*models.Session),
+		searchIndex:      make(map[string]map[primitive.ObjectID]bool),
+		userTrigrams:     make(map[string]map[primitive.ObjectID]bool),
+	}
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.Email]; exists {
+		return ErrDuplicateEmail
+	}
+
+	s.putUser(cloneUser(user))
+	s.version++
+	return nil
+}
+
+// putUser thêm người dùng vào các chỉ mục, người gọi phải giữ khóa ghi
+func (s *MemoryStore) putUser(user *models.User) {
+	s.users[user.Email] = user
+	s.usersByID[user.ID] = user
+	s.indexUser(user)
+}
+
+func (s *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[email]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (s *MemoryStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.usersByID[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (s *MemoryStore) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.User{}
+	for _, id := range ids {
+		if user, exists := s.usersByID[id]; exists {
+			result = append(result, cloneUser(user))
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) UpdateUserProfile(ctx context.Context, id primitive.ObjectID, name, avatar string, updatedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.usersByID[id]
+	if !exists {
+		return ErrNotFound
+	}
+
+	s.unindexUser(user)
+	user.Name = name
+	user.Avatar = avatar
+	user.UpdatedAt = updatedAt
+	s.indexUser(user)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserStatus(ctx context.Context, id primitive.ObjectID, status models.UserStatus, updatedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.usersByID[id]
+	if !exists {
+		return ErrNotFound
+	}
+
+	user.Status = status
+	user.UpdatedAt = updatedAt
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) CreateConversation(ctx context.Context, conv *models.Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putConversation(cloneConversation(conv))
+	s.version++
+	return nil
+}
+
+// putConversation thêm cuộc hội thoại vào các chỉ mục, người gọi phải giữ khóa ghi
+func (s *MemoryStore) putConversation(conv *models.Conversation) {
+	s.conversations[conv.ID] = conv
+	s.conversationList = append(s.conversationList, conv)
+	if _, exists := s.messagesByConv[conv.ID]; !exists {
+		s.messagesByConv[conv.ID] = []*models.Message{}
+	}
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*models.Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conv, exists := s.conversations[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneConversation(conv), nil
+}
+
+func (s *MemoryStore) FindPersonalConversation(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, conv := range s.conversationList {
+		if conv.Type == models.ConversationTypePersonal &&
+			len(conv.Participants) == 2 &&
+			containsID(conv.Participants, userID1) &&
+			containsID(conv.Participants, userID2) {
+			return cloneConversation(conv), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListConversations(ctx context.Context, userID primitive.ObjectID, query ConversationQuery) ([]*models.Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Conversation{}
+	for _, conv := range s.conversationList {
+		if !containsID(conv.Participants, userID) || !query.matches(conv, userID) {
+			continue
+		}
+		if query.After != nil && !query.After.follows(conv) {
+			continue
+		}
+		result = append(result, conv)
+	}
+
+	// Sắp xếp trước rồi mới giới hạn số lượng, giống như truy vấn MongoDB
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].UpdatedAt.Equal(result[j].UpdatedAt) {
+			return result[i].UpdatedAt.After(result[j].UpdatedAt)
+		}
+		return compareIDs(result[i].ID, result[j].ID) > 0
+	})
+	if query.Limit > 0 && int64(len(result)) > query.Limit {
+		result = result[:query.Limit]
+	}
+
+	return cloneConversations(result), nil
+}
+
+func (s *MemoryStore) SaveMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Giữ khóa ghi trong suốt thao tác nên ba bước được áp dụng nguyên tử
+	conv, exists := s.conversations[msg.ConversationID]
+	if !exists {
+		return ErrNotFound
+	}
+	var root *models.Message
+	if msg.IsThreadReply() {
+		if root, exists = s.messages[msg.ThreadRootID]; !exists {
+			return ErrNotFound
+		}
+	}
+	// Kiểm tra mọi tệp trước khi thay đổi bất cứ gì để không gắn dở một phần;
+	// một tệp xuất hiện hai lần cũng bị coi là đã được gắn
+	seen := make(map[primitive.ObjectID]bool, len(msg.Attachments))
+	for _, ref := range msg.Attachments {
+		attachment, exists := s.attachments[ref.ID]
+		if !exists || attachment.UploaderID != msg.SenderID || attachment.IsAttached() || seen[ref.ID] {
+			return ErrAttachmentUnavailable
+		}
+		seen[ref.ID] = true
+	}
+	for _, ref := range msg.Attachments {
+		attachment := s.attachments[ref.ID]
+		attachment.ConversationID = msg.ConversationID
+		attachment.MessageID = msg.ID
+	}
+
+	if root != nil {
+		s.putMessage(cloneMessage(msg))
+		s.addThreadReply(conv, root, msg)
+		for _, event := range events {
+			s.outbox = append(s.outbox, cloneOutboxEvent(event))
+		}
+		s.version++
+		return nil
+	}
+
+	s.putMessage(cloneMessage(msg))
+	conv.LastMessage = cloneMessage(msg)
+	conv.UpdatedAt = msg.CreatedAt
+	if !msg.IsDeleted {
+		for _, participantID := range conv.Participants {
+			if participantID != msg.SenderID && !containsID(msg.ReadBy, participantID) && !containsID(msg.UnreadExempt, participantID) {
+				addUnread(conv, participantID, 1)
+			}
+		}
+	}
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+// addThreadReply cập nhật thống kê thread và người theo dõi của tin nhắn gốc, người gọi phải giữ khóa ghi
+func (s *MemoryStore) addThreadReply(conv *models.Conversation, root, reply *models.Message) {
+	if root.ThreadReplyCount == 0 && !containsID(root.ThreadFollowers, root.SenderID) {
+		root.ThreadFollowers = append(root.ThreadFollowers, root.SenderID)
+	}
+	if !containsID(root.ThreadFollowers, reply.SenderID) {
+		root.ThreadFollowers = append(root.ThreadFollowers, reply.SenderID)
+	}
+
+	if root.ThreadUnreadCounts == nil {
+		root.ThreadUnreadCounts = make(map[string]int64)
+	}
+	for _, followerID := range root.ThreadFollowers {
+		if followerID != reply.SenderID && !containsID(reply.UnreadExempt, followerID) {
+			root.ThreadUnreadCounts[followerID.Hex()]++
+		}
+	}
+
+	lastReplyAt := reply.CreatedAt
+	root.ThreadReplyCount++
+	root.ThreadLastReplyAt = &lastReplyAt
+
+	if conv.LastMessage != nil && conv.LastMessage.ID == root.ID {
+		conv.LastMessage = cloneMessage(root)
+	}
+}
+
+func (s *MemoryStore) EditMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Tin nhắn có thể đã bị thu hồi sau khi service đọc nó
+	existing, exists := s.messages[msg.ID]
+	if !exists || existing.IsDeleted {
+		return ErrNotFound
+	}
+
+	edited := cloneMessage(msg)
+	s.unindexMessage(existing)
+	existing.Content = edited.Content
+	existing.EditedAt = edited.EditedAt
+	existing.EditHistory = edited.EditHistory
+	existing.UpdatedAt = edited.UpdatedAt
+	s.indexMessage(existing)
+
+	if conv, exists := s.conversations[existing.ConversationID]; exists &&
+		conv.LastMessage != nil && conv.LastMessage.ID == existing.ID {
+		conv.LastMessage = cloneMessage(existing)
+	}
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) DeleteMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.messages[msg.ID]
+	if !exists || existing.IsDeleted {
+		return ErrNotFound
+	}
+
+	conv, exists := s.conversations[existing.ConversationID]
+	if exists && !existing.IsThreadReply() {
+		for _, participantID := range conv.Participants {
+			if participantID != existing.SenderID && !containsID(existing.ReadBy, participantID) && !containsID(existing.UnreadExempt, participantID) {
+				addUnread(conv, participantID, -1)
+			}
+		}
+	}
+
+	tombstone := cloneMessage(msg)
+	s.unindexMessage(existing)
+	existing.IsDeleted = true
+	existing.Content = tombstone.Content
+	existing.EditHistory = tombstone.EditHistory
+	existing.Reactions = tombstone.Reactions
+	existing.Attachments = tombstone.Attachments
+	existing.DeletedAt = tombstone.DeletedAt
+	existing.DeletedBy = tombstone.DeletedBy
+	existing.UpdatedAt = tombstone.UpdatedAt
+
+	if exists && conv.LastMessage != nil && conv.LastMessage.ID == existing.ID {
+		conv.LastMessage = cloneMessage(existing)
+	}
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) HideMessage(ctx context.Context, id, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[id]
+	if !exists {
+		return ErrNotFound
+	}
+
+	// Tin nhắn đã xóa ở phía mình không còn được tính là chưa đọc
+	s.markRead(msg, userID)
+	if !containsID(msg.HiddenFor, userID) {
+		msg.HiddenFor = append(msg.HiddenFor, userID)
+	}
+	if conv, exists := s.conversations[msg.ConversationID]; exists &&
+		conv.LastMessage != nil && conv.LastMessage.ID == msg.ID {
+		conv.LastMessage = cloneMessage(msg)
+	}
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) AddReaction(ctx context.Context, messageID primitive.ObjectID, reaction models.Reaction, events []*models.OutboxEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[messageID]
+	if !exists || msg.IsDeleted {
+		return false, ErrNotFound
+	}
+	if msg.HasReaction(reaction.UserID, reaction.Emoji) {
+		return false, nil
+	}
+
+	msg.Reactions = append(msg.Reactions, reaction)
+	s.refreshLastMessage(msg)
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) RemoveReaction(ctx context.Context, messageID, userID primitive.ObjectID, emoji string, events []*models.OutboxEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[messageID]
+	if !exists {
+		return false, ErrNotFound
+	}
+	if !msg.HasReaction(userID, emoji) {
+		return false, nil
+	}
+
+	reactions := make([]models.Reaction, 0, len(msg.Reactions)-1)
+	for _, reaction := range msg.Reactions {
+		if reaction.UserID != userID || reaction.Emoji != emoji {
+			reactions = append(reactions, reaction)
+		}
+	}
+	msg.Reactions = reactions
+	s.refreshLastMessage(msg)
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) CreateAttachment(ctx context.Context, attachment *models.Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attachments[attachment.ID] = cloneAttachment(attachment)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) GetAttachment(ctx context.Context, id primitive.ObjectID) (*models.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	attachment, exists := s.attachments[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneAttachment(attachment), nil
+}
+
+func (s *MemoryStore) DeleteAttachments(ctx context.Context, ids []primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		delete(s.attachments, id)
+	}
+	s.version++
+	return nil
+}
+
+// putMessage thêm tin nhắn vào các chỉ mục, người gọi phải giữ khóa ghi.
+// Tin nhắn của mỗi cuộc hội thoại và mỗi thread được giữ theo thứ tự ID để phân trang bằng tìm kiếm nhị phân.
+func (s *MemoryStore) putMessage(msg *models.Message) {
+	s.messages[msg.ID] = msg
+	s.indexMessage(msg)
+
+	if msg.IsThreadReply() {
+		s.messagesByThread[msg.ThreadRootID] = insertByID(s.messagesByThread[msg.ThreadRootID], msg)
+	} else {
+		s.messagesByConv[msg.ConversationID] = insertByID(s.messagesByConv[msg.ConversationID], msg)
+	}
+}
+
+// insertByID chèn msg vào danh sách đã sắp xếp theo ID
+func insertByID(messages []*models.Message, msg *models.Message) []*models.Message {
+	i := sort.Search(len(messages), func(i int) bool {
+		return compareIDs(messages[i].ID, msg.ID) > 0
+	})
+	messages = append(messages, nil)
+	copy(messages[i+1:], messages[i:])
+	messages[i] = msg
+	return messages
+}
+
+func (s *MemoryStore) GetMessage(ctx context.Context, id primitive.ObjectID) (*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msg, exists := s.messages[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneMessage(msg), nil
+}
+
+func (s *MemoryStore) GetMessagesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Message{}
+	for _, id := range ids {
+		if msg, exists := s.messages[id]; exists {
+			result = append(result, cloneMessage(msg))
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) ListMessages(ctx context.Context, conversationID primitive.ObjectID, query MessageQuery) ([]*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := s.messagesByConv[conversationID]
+	if !query.ThreadRootID.IsZero() {
+		messages = s.messagesByThread[query.ThreadRootID]
+	}
+
+	// Xác định đoạn [lo, hi) nằm giữa After và Before
+	lo, hi := 0, len(messages)
+	if !query.After.IsZero() {
+		lo = sort.Search(len(messages), func(i int) bool {
+			return compareIDs(messages[i].ID, query.After) > 0
+		})
+	}
+	if !query.Before.IsZero() {
+		hi = sort.Search(len(messages), func(i int) bool {
+			return compareIDs(messages[i].ID, query.Before) >= 0
+		})
+	}
+
+	result := []*models.Message{}
+	full := func() bool {
+		return query.Limit > 0 && int64(len(result)) >= query.Limit
+	}
+	visible := func(msg *models.Message) bool {
+		if msg.ConversationID != conversationID || msg.ThreadRootID != query.ThreadRootID {
+			return false
+		}
+		if containsID(query.ExcludeSenders, msg.SenderID) {
+			return false
+		}
+		return query.Viewer.IsZero() || !containsID(msg.HiddenFor, query.Viewer)
+	}
+	if query.Ascending {
+		for i := lo; i < hi && !full(); i++ {
+			if visible(messages[i]) {
+				result = append(result, cloneMessage(messages[i]))
+			}
+		}
+	} else {
+		for i := hi - 1; i >= lo && !full(); i-- {
+			if visible(messages[i]) {
+				result = append(result, cloneMessage(messages[i]))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) MarkMessagesRead(ctx context.Context, ids []primitive.ObjectID, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if msg, exists := s.messages[id]; exists {
+			s.markRead(msg, userID)
+		}
+	}
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+// markRead thêm userID vào danh sách đã đọc của msg và giảm số tin chưa đọc nếu đây là lần đầu userID đọc nó.
+// Người gọi phải giữ s.mu.
+func (s *MemoryStore) markRead(msg *models.Message, userID primitive.ObjectID) {
+	if !containsID(msg.ReadBy, userID) {
+		msg.ReadBy = append(msg.ReadBy, userID)
+		if msg.SenderID != userID && !msg.IsDeleted && !msg.IsThreadReply() && !containsID(msg.UnreadExempt, userID) {
+			if conv, exists := s.conversations[msg.ConversationID]; exists {
+				addUnread(conv, userID, -1)
+			}
+		}
+	}
+	msg.Status = models.MessageStatusRead
+}
+
+func (s *MemoryStore) MarkMessagePlayed(ctx context.Context, messageID, userID primitive.ObjectID, events []*models.OutboxEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[messageID]
+	if !exists || msg.IsDeleted {
+		return false, ErrNotFound
+	}
+	if containsID(msg.PlayedBy, userID) {
+		return false, nil
+	}
+
+	msg.PlayedBy = append(msg.PlayedBy, userID)
+	s.refreshLastMessage(msg)
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) FollowThread(ctx context.Context, rootID, userID primitive.ObjectID, follow bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, exists := s.messages[rootID]
+	if !exists {
+		return ErrNotFound
+	}
+
+	if follow {
+		if !containsID(root.ThreadFollowers, userID) {
+			root.ThreadFollowers = append(root.ThreadFollowers, userID)
+		}
+	} else {
+		followers := root.ThreadFollowers[:0]
+		for _, id := range root.ThreadFollowers {
+			if id != userID {
+				followers = append(followers, id)
+			}
+		}
+		root.ThreadFollowers = followers
+		delete(root.ThreadUnreadCounts, userID.Hex())
+	}
+	s.refreshLastMessage(root)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) MarkThreadRead(ctx context.Context, rootID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, exists := s.messages[rootID]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(root.ThreadUnreadCounts, userID.Hex())
+	s.refreshLastMessage(root)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) SetThreadOptIn(ctx context.Context, conversationID, userID primitive.ObjectID, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conv, exists := s.conversations[conversationID]
+	if !exists {
+		return ErrNotFound
+	}
+
+	optIns := make([]primitive.ObjectID, 0, len(conv.ThreadOptIns)+1)
+	for _, id := range conv.ThreadOptIns {
+		if id != userID {
+			optIns = append(optIns, id)
+		}
+	}
+	if enabled {
+		optIns = append(optIns, userID)
+	}
+	conv.ThreadOptIns = optIns
+	s.version++
+	return nil
+}
+
+// refreshLastMessage cập nhật bản sao tin nhắn cuối nếu msg là tin nhắn cuối của cuộc hội thoại,
+// người gọi phải giữ khóa ghi
+func (s *MemoryStore) refreshLastMessage(msg *models.Message) {
+	if conv, exists := s.conversations[msg.ConversationID]; exists &&
+		conv.LastMessage != nil && conv.LastMessage.ID == msg.ID {
+		conv.LastMessage = cloneMessage(msg)
+	}
+}
+
+func (s *MemoryStore) PendingOutboxEvents(ctx context.Context, limit int) ([]*models.OutboxEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.OutboxEvent{}
+	for _, event := range s.outbox {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, cloneOutboxEvent(event))
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) DeleteOutboxEvents(ctx context.Context, ids []primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := s.outbox[:0]
+	for _, event := range s.outbox {
+		if !containsID(ids, event.ID) {
+			remaining = append(remaining, event)
+		}
+	}
+	// Xóa tham chiếu ở phần đuôi để GC thu hồi các sự kiện đã gửi
+	for i := len(remaining); i < len(s.outbox); i++ {
+		s.outbox[i] = nil
+	}
+	s.outbox = remaining
+	s.version++
+	return nil
+}
+
+func cloneUser(user *models.User) *models.User {
+	clone := *user
+	return &clone
+}
+
+// addUnread thay đổi số tin nhắn chưa đọc của một thành viên, không để giá trị âm
+func addUnread(conv *models.Conversation, userID primitive.ObjectID, delta int64) {
+	if conv.UnreadCounts == nil {
+		conv.UnreadCounts = make(map[string]int64)
+	}
+	key := userID.Hex()
+	if count := conv.UnreadCounts[key] + delta; count > 0 {
+		conv.UnreadCounts[key] = count
+	} else {
+		delete(conv.UnreadCounts, key)
+	}
+}
+
+func cloneConversation(conv *models.Conversation) *models.Conversation {
+	clone := *conv
+	clone.Participants = append([]primitive.ObjectID(nil), conv.Participants...)
+	clone.Admins = append([]primitive.ObjectID(nil), conv.Admins...)
+	clone.ThreadOptIns = append([]primitive.ObjectID(nil), conv.ThreadOptIns...)
+	if conv.UnreadCounts != nil {
+		clone.UnreadCounts = make(map[string]int64, len(conv.UnreadCounts))
+		for userID, count := range conv.UnreadCounts {
+			clone.UnreadCounts[userID] = count
+		}
+	}
+	if conv.LastMessage != nil {
+		clone.LastMessage = cloneMessage(conv.LastMessage)
+	}
+	return &clone
+}
+
+func cloneConversations(convs []*models.Conversation) []*models.Conversation {
+	result := make([]*models.Conversation, len(convs))
+	for i, conv := range convs {
+		result[i] = cloneConversation(conv)
+	}
+	return result
+}
+
+func cloneAttachment(attachment *models.Attachment) *models.Attachment {
+	clone := *attachment
+	clone.Image = cloneImageInfo(attachment.Image)
+	clone.Audio = cloneAudioInfo(attachment.Audio)
+	return &clone
+}
+
+func cloneImageInfo(info *models.ImageInfo) *models.ImageInfo {
+	if info == nil {
+		return nil
+	}
+	clone := *info
+	return &clone
+}
+
+func cloneAudioInfo(info *models.AudioInfo) *models.AudioInfo {
+	if info == nil {
+		return nil
+	}
+	clone := *info
+	clone.Waveform = append([]int(nil), info.Waveform...)
+	return &clone
+}
+
+func cloneMessage(msg *models.Message) *models.Message {
+	clone := *msg
+	clone.ReadBy = append([]primitive.ObjectID(nil), msg.ReadBy...)
+	clone.PlayedBy = append([]primitive.ObjectID(nil), msg.PlayedBy...)
+	clone.HiddenFor = append([]primitive.ObjectID(nil), msg.HiddenFor...)
+	clone.UnreadExempt = append([]primitive.ObjectID(nil), msg.UnreadExempt...)
+	clone.EditHistory = append([]models.MessageEdit(nil), msg.EditHistory...)
+	clone.Reactions = append([]models.Reaction(nil), msg.Reactions...)
+	clone.Attachments = append([]models.AttachmentRef(nil), msg.Attachments...)
+	for i, ref := range clone.Attachments {
+		clone.Attachments[i].Image = cloneImageInfo(ref.Image)
+		clone.Attachments[i].Audio = cloneAudioInfo(ref.Audio)
+	}
+	clone.ThreadFollowers = append([]primitive.ObjectID(nil), msg.ThreadFollowers...)
+	if msg.ThreadUnreadCounts != nil {
+		clone.ThreadUnreadCounts = make(map[string]int64, len(msg.ThreadUnreadCounts))
+		for userID, count := range msg.ThreadUnreadCounts {
+			clone.ThreadUnreadCounts[userID] = count
+		}
+	}
+	if msg.ThreadLastReplyAt != nil {
+		lastReplyAt := *msg.ThreadLastReplyAt
+		clone.ThreadLastReplyAt = &lastReplyAt
+	}
+	if msg.EditedAt != nil {
+		editedAt := *msg.EditedAt
+		clone.EditedAt = &editedAt
+	}
+	if msg.DeletedAt != nil {
+		deletedAt := *msg.DeletedAt
+		clone.DeletedAt = &deletedAt
+	}
+	return &clone
+}
+
+// Hàm tiện ích để kiểm tra một ID có trong mảng ID không
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, existingID := range ids {
+		if existingID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// compareIDs so sánh hai ObjectID theo thứ tự byte, cũng là thứ tự thời điểm tạo
+func compareIDs(a, b primitive.ObjectID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func cloneOutboxEvent(event *models.OutboxEvent) *models.OutboxEvent {
+	clone := *event
+	clone.Recipients = append([]primitive.ObjectID(nil), event.Recipients...)
+	clone.Payload = append([]byte(nil), event.Payload...)
+	return &clone
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"sort"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// putBlock thêm quan hệ chặn vào các chỉ mục, người gọi phải giữ khóa ghi
+func (s *MemoryStore) putBlock(block *models.UserBlock) {
+	if s.blocks[block.BlockerID] == nil {
+		s.blocks[block.BlockerID] = make(map[primitive.ObjectID]*models.UserBlock)
+	}
+	s.blocks[block.BlockerID][block.BlockedID] = block
+	if s.blockedBy[block.BlockedID] == nil {
+		s.blockedBy[block.BlockedID] = make(map[primitive.ObjectID]bool)
+	}
+	s.blockedBy[block.BlockedID][block.BlockerID] = true
+}
+
+func (s *MemoryStore) BlockUser(ctx context.Context, block *models.UserBlock) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.blocks[block.BlockerID][block.BlockedID]; exists {
+		return false, nil
+	}
+
+	clone := *block
+	s.putBlock(&clone)
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) UnblockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.blocks[blockerID][blockedID]; !exists {
+		return false, nil
+	}
+
+	delete(s.blocks[blockerID], blockedID)
+	if len(s.blocks[blockerID]) == 0 {
+		delete(s.blocks, blockerID)
+	}
+	delete(s.blockedBy[blockedID], blockerID)
+	if len(s.blockedBy[blockedID]) == 0 {
+		delete(s.blockedBy, blockedID)
+	}
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) ListBlocks(ctx context.Context, blockerID primitive.ObjectID) ([]*models.UserBlock, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*models.UserBlock, 0, len(s.blocks[blockerID]))
+	for _, block := range s.blocks[blockerID] {
+		clone := *block
+		result = append(result, &clone)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.After(result[j].CreatedAt)
+		}
+		return compareIDs(result[i].BlockedID, result[j].BlockedID) < 0
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) ListBlockerIDs(ctx context.Context, blockedID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]primitive.ObjectID, 0, len(s.blockedBy[blockedID]))
+	for blockerID := range s.blockedBy[blockedID] {
+		result = append(result, blockerID)
+	}
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// putFriendRequest thêm lời mời vào các chỉ mục, người gọi phải giữ khóa ghi
+func (s *MemoryStore) putFriendRequest(req *models.FriendRequest) {
+	s.friendRequests[req.ID] = req
+	s.friendPairs[req.PairKey] = req
+}
+
+func (s *MemoryStore) CreateFriendRequest(ctx context.Context, req *models.FriendRequest, events []*models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.friendPairs[req.PairKey]; exists {
+		return ErrDuplicateFriendRequest
+	}
+
+	s.putFriendRequest(cloneFriendRequest(req))
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) GetFriendRequest(ctx context.Context, id primitive.ObjectID) (*models.FriendRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	req, exists := s.friendRequests[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneFriendRequest(req), nil
+}
+
+func (s *MemoryStore) FindFriendRequest(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.FriendRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	req, exists := s.friendPairs[models.FriendPairKey(userID1, userID2)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneFriendRequest(req), nil
+}
+
+func (s *MemoryStore) ListFriendRequests(ctx context.Context, userID primitive.ObjectID, status models.FriendRequestStatus) ([]*models.FriendRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.FriendRequest{}
+	for _, req := range s.friendRequests {
+		if req.Status == status && (req.SenderID == userID || req.RecipientID == userID) {
+			result = append(result, cloneFriendRequest(req))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return compareIDs(result[i].ID, result[j].ID) > 0
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) AcceptFriendRequest(ctx context.Context, id primitive.ObjectID, acceptedAt time.Time, events []*models.OutboxEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, exists := s.friendRequests[id]
+	if !exists {
+		return false, ErrNotFound
+	}
+	if req.Status != models.FriendRequestPending {
+		return false, nil
+	}
+
+	req.Status = models.FriendRequestAccepted
+	req.UpdatedAt = acceptedAt
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteFriendRequest(ctx context.Context, id primitive.ObjectID, status models.FriendRequestStatus, events []*models.OutboxEvent) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, exists := s.friendRequests[id]
+	if !exists {
+		return false, ErrNotFound
+	}
+	if req.Status != status {
+		return false, nil
+	}
+
+	delete(s.friendRequests, id)
+	delete(s.friendPairs, req.PairKey)
+	for _, event := range events {
+		s.outbox = append(s.outbox, cloneOutboxEvent(event))
+	}
+	s.version++
+	return true, nil
+}
+
+func cloneFriendRequest(req *models.FriendRequest) *models.FriendRequest {
+	clone := *req
+	return &clone
+}
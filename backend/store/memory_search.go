@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"sort"
+
+	"webchat/models"
+	"webchat/search"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// indexMessage thêm các từ khóa trong nội dung tin nhắn vào chỉ mục tìm kiếm, người gọi phải giữ khóa ghi.
+// Tin nhắn đã thu hồi không được đưa vào chỉ mục.
+func (s *MemoryStore) indexMessage(msg *models.Message) {
+	if msg.IsDeleted {
+		return
+	}
+	for _, term := range search.Terms(msg.Content) {
+		ids, exists := s.searchIndex[term]
+		if !exists {
+			ids = make(map[primitive.ObjectID]bool)
+			s.searchIndex[term] = ids
+		}
+		ids[msg.ID] = true
+	}
+}
+
+// unindexMessage xóa tin nhắn khỏi chỉ mục tìm kiếm theo nội dung hiện tại, người gọi phải giữ khóa ghi
+func (s *MemoryStore) unindexMessage(msg *models.Message) {
+	for _, term := range search.Terms(msg.Content) {
+		if ids, exists := s.searchIndex[term]; exists {
+			delete(ids, msg.ID)
+			if len(ids) == 0 {
+				delete(s.searchIndex, term)
+			}
+		}
+	}
+}
+
+func (s *MemoryStore) SearchMessages(ctx context.Context, query MessageSearchQuery) ([]*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Message{}
+	if len(query.Terms) == 0 {
+		return result, nil
+	}
+
+	// Duyệt danh sách ngắn nhất rồi kiểm tra các từ khóa còn lại
+	var candidates map[primitive.ObjectID]bool
+	for _, term := range query.Terms {
+		ids := s.searchIndex[term]
+		if len(ids) == 0 {
+			return result, nil
+		}
+		if candidates == nil || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+
+	participating := make(map[primitive.ObjectID]bool)
+	for id := range candidates {
+		msg := s.messages[id]
+		if msg == nil || !query.matches(msg) || containsID(msg.HiddenFor, query.Viewer) {
+			continue
+		}
+		if !query.Before.IsZero() && compareIDs(msg.ID, query.Before) >= 0 {
+			continue
+		}
+		hasAll := true
+		for _, term := range query.Terms {
+			if !s.searchIndex[term][id] {
+				hasAll = false
+				break
+			}
+		}
+		if !hasAll {
+			continue
+		}
+
+		allowed, checked := participating[msg.ConversationID]
+		if !checked {
+			conv, exists := s.conversations[msg.ConversationID]
+			allowed = exists && containsID(conv.Participants, query.Viewer)
+			participating[msg.ConversationID] = allowed
+		}
+		if allowed {
+			result = append(result, msg)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return compareIDs(result[i].ID, result[j].ID) > 0
+	})
+	if query.Limit > 0 && int64(len(result)) > query.Limit {
+		result = result[:query.Limit]
+	}
+	for i, msg := range result {
+		result[i] = cloneMessage(msg)
+	}
+	return result, nil
+}
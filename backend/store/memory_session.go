@@ -0,0 +1,97 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *MemoryStore) CreateSession(ctx context.Context, session *models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clone := *session
+	s.sessions[session.ID] = &clone
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) GetSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	clone := *session
+	return &clone, nil
+}
+
+func (s *MemoryStore) ListSessions(ctx context.Context, userID primitive.ObjectID) ([]*models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := []*models.Session{}
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			clone := *session
+			sessions = append(sessions, &clone)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return bytes.Compare(sessions[i].ID[:], sessions[j].ID[:]) < 0
+	})
+	return sessions, nil
+}
+
+func (s *MemoryStore) TouchSession(ctx context.Context, id primitive.ObjectID, ip string, lastUsedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[id]
+	if !exists {
+		return nil
+	}
+	session.IP = ip
+	session.LastUsedAt = lastUsedAt
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) DeleteSession(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[id]; !exists {
+		return false, nil
+	}
+	delete(s.sessions, id)
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, session := range s.sessions {
+		if session.LastUsedAt.Before(before) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.version++
+	}
+	return deleted, nil
+}
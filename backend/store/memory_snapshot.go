@@ -0,0 +1,241 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memorySnapshot là nội dung được ghi ra file snapshot của MemoryStore.
+// Dùng BSON để giữ nguyên các tag của models (kể cả mật khẩu đã hash mà JSON bỏ qua).
+type memorySnapshot struct {
+	SavedAt       time.Time              `bson:"saved_at"`
+	Users         []*models.User         `bson:"users"`
+	Conversations []*models.Conversation `bson:"conversations"`
+	Messages      []*models.Message      `bson:"messages"`
+	Attachments   []*models.Attachment   `bson:"attachments"`
+	Outbox        []*models.OutboxEvent  `bson:"outbox"`
+
+	// FriendRequests gồm cả lời mời đang chờ và quan hệ bạn bè
+	FriendRequests []*models.FriendRequest `bson:"friend_requests"`
+	Blocks         []*models.UserBlock     `bson:"blocks"`
+	RevokedTokens  []*models.RevokedToken  `bson:"revoked_tokens"`
+	TokenFamilies  []*models.TokenFamily   `bson:"token_families"`
+	Sessions       []*models.Session       `bson:"sessions"`
+}
+
+// EnableSnapshots nạp dữ liệu từ file snapshot (nếu có) và ghi snapshot định kỳ
+// sau mỗi interval khi dữ liệu thay đổi. Gọi Close để dừng và ghi lần cuối.
+func (s *MemoryStore) EnableSnapshots(path string, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("chu kỳ ghi snapshot phải lớn hơn 0")
+	}
+
+	if err := s.loadSnapshot(path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.snapshotPath = path
+	s.savedVersion = s.version
+	s.stopSnapshot = make(chan struct{})
+	s.snapshotDone = make(chan struct{})
+	s.mu.Unlock()
+
+	go s.snapshotLoop(interval)
+	return nil
+}
+
+func (s *MemoryStore) snapshotLoop(interval time.Duration) {
+	defer close(s.snapshotDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SaveSnapshot(); err != nil {
+				log.Printf("Error saving memory store snapshot: %v", err)
+			}
+		case <-s.stopSnapshot:
+			return
+		}
+	}
+}
+
+// Close dừng việc ghi snapshot định kỳ và ghi snapshot lần cuối
+func (s *MemoryStore) Close() error {
+	if s.stopSnapshot == nil {
+		return nil
+	}
+
+	close(s.stopSnapshot)
+	<-s.snapshotDone
+	s.stopSnapshot = nil
+	return s.SaveSnapshot()
+}
+
+// SaveSnapshot ghi toàn bộ dữ liệu ra file nếu có thay đổi kể từ lần ghi trước.
+// File được ghi vào file tạm rồi đổi tên để không bao giờ để lại snapshot dở dang.
+func (s *MemoryStore) SaveSnapshot() error {
+	s.mu.RLock()
+	path := s.snapshotPath
+	version := s.version
+	if path == "" || version == s.savedVersion {
+		s.mu.RUnlock()
+		return nil
+	}
+	data, err := bson.Marshal(s.buildSnapshot())
+	s.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("không thể mã hóa snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if version > s.savedVersion {
+		s.savedVersion = version
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// buildSnapshot sao chép dữ liệu hiện tại, người gọi phải giữ khóa đọc
+func (s *MemoryStore) buildSnapshot() *memorySnapshot {
+	snapshot := &memorySnapshot{
+		SavedAt:       time.Now(),
+		Users:         make([]*models.User, 0, len(s.usersByID)),
+		Conversations: s.conversationList,
+		Messages:      make([]*models.Message, 0, len(s.messages)),
+		Attachments:   make([]*models.Attachment, 0, len(s.attachments)),
+		Outbox:        s.outbox,
+
+		FriendRequests: make([]*models.FriendRequest, 0, len(s.friendRequests)),
+		Blocks:         []*models.UserBlock{},
+		RevokedTokens:  make([]*models.RevokedToken, 0, len(s.revokedTokens)),
+		TokenFamilies:  make([]*models.TokenFamily, 0, len(s.tokenFamilies)),
+		Sessions:       make([]*models.Session, 0, len(s.sessions)),
+	}
+	for _, user := range s.usersByID {
+		snapshot.Users = append(snapshot.Users, user)
+	}
+	// Giữ thứ tự gửi của tin nhắn trong từng cuộc hội thoại và từng thread
+	for _, messages := range s.messagesByConv {
+		snapshot.Messages = append(snapshot.Messages, messages...)
+	}
+	for _, messages := range s.messagesByThread {
+		snapshot.Messages = append(snapshot.Messages, messages...)
+	}
+	for _, attachment := range s.attachments {
+		snapshot.Attachments = append(snapshot.Attachments, attachment)
+	}
+	for _, req := range s.friendRequests {
+		snapshot.FriendRequests = append(snapshot.FriendRequests, req)
+	}
+	for _, blocks := range s.blocks {
+		for _, block := range blocks {
+			snapshot.Blocks = append(snapshot.Blocks, block)
+		}
+	}
+	for id, expiresAt := range s.revokedTokens {
+		snapshot.RevokedTokens = append(snapshot.RevokedTokens, &models.RevokedToken{ID: id, ExpiresAt: expiresAt})
+	}
+	for _, family := range s.tokenFamilies {
+		snapshot.TokenFamilies = append(snapshot.TokenFamilies, family)
+	}
+	for _, session := range s.sessions {
+		snapshot.Sessions = append(snapshot.Sessions, session)
+	}
+	return snapshot
+}
+
+// loadSnapshot thay thế dữ liệu hiện tại bằng nội dung file snapshot.
+// Không có file snapshot không phải là lỗi: store giữ nguyên trạng thái rỗng.
+func (s *MemoryStore) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("không thể đọc snapshot: %w", err)
+	}
+
+	var snapshot memorySnapshot
+	if err := bson.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("snapshot không hợp lệ: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range snapshot.Users {
+		s.putUser(user)
+	}
+	for _, conv := range snapshot.Conversations {
+		s.putConversation(conv)
+	}
+	for _, msg := range snapshot.Messages {
+		s.putMessage(msg)
+	}
+	for _, attachment := range snapshot.Attachments {
+		s.attachments[attachment.ID] = attachment
+	}
+	for _, req := range snapshot.FriendRequests {
+		s.putFriendRequest(req)
+	}
+	for _, block := range snapshot.Blocks {
+		s.putBlock(block)
+	}
+	for _, token := range snapshot.RevokedTokens {
+		s.revokedTokens[token.ID] = token.ExpiresAt
+	}
+	for _, family := range snapshot.TokenFamilies {
+		s.tokenFamilies[family.ID] = family
+	}
+	for _, session := range snapshot.Sessions {
+		s.sessions[session.ID] = session
+	}
+	s.outbox = append(s.outbox, snapshot.Outbox...)
+
+	log.Printf("Loaded memory store snapshot from %s (%d users, %d conversations, %d messages)",
+		path, len(snapshot.Users), len(snapshot.Conversations), len(snapshot.Messages))
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("không thể tạo thư mục snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("không thể tạo file snapshot tạm: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("không thể ghi snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("không thể ghi snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("không thể ghi snapshot: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
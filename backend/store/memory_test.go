@@ -0,0 +1,20 @@
+package store_test
+
+import (
+	"testing"
+
+	"webchat/store"
+	"webchat/store/storetest"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	storetest.RunUserStoreTests(t, func(t *testing.T) store.UserStore {
+		return store.NewMemoryStore()
+	})
+}
+
+func TestMemoryChatStore(t *testing.T) {
+	storetest.RunChatStoreTests(t, func(t *testing.T) store.ChatStore {
+		return store.NewMemoryStore()
+	})
+}
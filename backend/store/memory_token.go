@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *MemoryStore) RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.revokedTokens[token.ID]; exists {
+		return nil
+	}
+	s.revokedTokens[token.ID] = token.ExpiresAt
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revokedTokens[id]
+	return revoked, nil
+}
+
+func (s *MemoryStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, expiresAt := range s.revokedTokens {
+		if expiresAt.Before(before) {
+			delete(s.revokedTokens, id)
+			deleted++
+		}
+	}
+	for id, family := range s.tokenFamilies {
+		if family.ExpiresAt.Before(before) {
+			delete(s.tokenFamilies, id)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.version++
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) CreateTokenFamily(ctx context.Context, family *models.TokenFamily) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokenFamilies[family.ID] = cloneTokenFamily(family)
+	s.version++
+	return nil
+}
+
+func (s *MemoryStore) GetTokenFamily(ctx context.Context, id primitive.ObjectID) (*models.TokenFamily, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	family, exists := s.tokenFamilies[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return cloneTokenFamily(family), nil
+}
+
+func (s *MemoryStore) RotateTokenFamily(ctx context.Context, id primitive.ObjectID, oldTokenID, newTokenID string, expiresAt, updatedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	family, exists := s.tokenFamilies[id]
+	if !exists || family.IsRevoked() || family.CurrentTokenID != oldTokenID {
+		return false, nil
+	}
+	family.CurrentTokenID = newTokenID
+	family.ExpiresAt = expiresAt
+	family.UpdatedAt = updatedAt
+	s.version++
+	return true, nil
+}
+
+func (s *MemoryStore) RevokeTokenFamily(ctx context.Context, id primitive.ObjectID, revokedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	family, exists := s.tokenFamilies[id]
+	if !exists || family.IsRevoked() {
+		return false, nil
+	}
+	family.RevokedAt = &revokedAt
+	s.version++
+	return true, nil
+}
+
+func cloneTokenFamily(family *models.TokenFamily) *models.TokenFamily {
+	clone := *family
+	if family.RevokedAt != nil {
+		revokedAt := *family.RevokedAt
+		clone.RevokedAt = &revokedAt
+	}
+	return &clone
+}
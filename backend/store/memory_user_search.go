@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// userSearchKey là một khóa trong chỉ mục tiền tố người dùng
+type userSearchKey struct {
+	key string
+	id  primitive.ObjectID
+}
+
+func (k userSearchKey) less(other userSearchKey) bool {
+	if k.key != other.key {
+		return k.key < other.key
+	}
+	return compareIDs(k.id, other.id) < 0
+}
+
+// userPrefixKeys trả về các chuỗi chữ thường mà từ khóa khớp tiền tố phải là tiền tố của ít nhất một
+// trong số đó: tên, phần tên bắt đầu từ mỗi từ sau từ đầu tiên và email
+func userPrefixKeys(user *models.User) []string {
+	name := strings.ToLower(user.Name)
+	keys := []string{name}
+	seen := map[string]bool{name: true}
+	for i := 0; i < len(name); i++ {
+		if name[i] == ' ' && !seen[name[i+1:]] {
+			seen[name[i+1:]] = true
+			keys = append(keys, name[i+1:])
+		}
+	}
+	if email := strings.ToLower(user.Email); !seen[email] {
+		keys = append(keys, email)
+	}
+	return keys
+}
+
+// trigrams trả về các bộ ba ký tự liên tiếp khác nhau của text
+func trigrams(text string) []string {
+	runes := []rune(text)
+	result := []string{}
+	seen := make(map[string]bool)
+	for i := 0; i+3 <= len(runes); i++ {
+		trigram := string(runes[i : i+3])
+		if !seen[trigram] {
+			seen[trigram] = true
+			result = append(result, trigram)
+		}
+	}
+	return result
+}
+
+// userTrigrams trả về các bộ ba ký tự của tên và email người dùng ở dạng chữ thường
+func userTrigrams(user *models.User) []string {
+	return trigrams(strings.ToLower(user.Name) + "\n" + strings.ToLower(user.Email))
+}
+
+// indexUser thêm tên và email người dùng vào chỉ mục tìm kiếm, người gọi phải giữ khóa ghi
+func (s *MemoryStore) indexUser(user *models.User) {
+	for _, key := range userPrefixKeys(user) {
+		entry := userSearchKey{key: key, id: user.ID}
+		i := sort.Search(len(s.userPrefixes), func(i int) bool { return !s.userPrefixes[i].less(entry) })
+		s.userPrefixes = append(s.userPrefixes, userSearchKey{})
+		copy(s.userPrefixes[i+1:], s.userPrefixes[i:])
+		s.userPrefixes[i] = entry
+	}
+	for _, trigram := range userTrigrams(user) {
+		ids, exists := s.userTrigrams[trigram]
+		if !exists {
+			ids = make(map[primitive.ObjectID]bool)
+			s.userTrigrams[trigram] = ids
+		}
+		ids[user.ID] = true
+	}
+}
+
+// unindexUser xóa người dùng khỏi chỉ mục tìm kiếm theo tên và email hiện tại, người gọi phải giữ khóa ghi
+func (s *MemoryStore) unindexUser(user *models.User) {
+	for _, key := range userPrefixKeys(user) {
+		entry := userSearchKey{key: key, id: user.ID}
+		i := sort.Search(len(s.userPrefixes), func(i int) bool { return !s.userPrefixes[i].less(entry) })
+		if i < len(s.userPrefixes) && s.userPrefixes[i] == entry {
+			s.userPrefixes = append(s.userPrefixes[:i], s.userPrefixes[i+1:]...)
+		}
+	}
+	for _, trigram := range userTrigrams(user) {
+		if ids, exists := s.userTrigrams[trigram]; exists {
+			delete(ids, user.ID)
+			if len(ids) == 0 {
+				delete(s.userTrigrams, trigram)
+			}
+		}
+	}
+}
+
+func (s *MemoryStore) SearchUsers(ctx context.Context, query UserSearchQuery) ([]*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.User{}
+	if query.Text == "" {
+		return result, nil
+	}
+
+	// Các khóa bắt đầu bằng từ khóa nằm liền nhau trong danh sách đã sắp xếp
+	candidates := make(map[primitive.ObjectID]bool)
+	i := sort.Search(len(s.userPrefixes), func(i int) bool { return s.userPrefixes[i].key >= query.Text })
+	for ; i < len(s.userPrefixes) && strings.HasPrefix(s.userPrefixes[i].key, query.Text); i++ {
+		candidates[s.userPrefixes[i].id] = true
+	}
+	// Người dùng chứa từ khóa phải chứa mọi bộ ba ký tự của nó: lấy danh sách ngắn nhất rồi kiểm tra lại
+	if utf8.RuneCountInString(query.Text) >= MinUserSubstringLength {
+		var shortest map[primitive.ObjectID]bool
+		for _, trigram := range trigrams(query.Text) {
+			ids := s.userTrigrams[trigram]
+			if shortest == nil || len(ids) < len(shortest) {
+				shortest = ids
+			}
+		}
+		for id := range shortest {
+			candidates[id] = true
+		}
+	}
+
+	cursors := make(map[primitive.ObjectID]*UserSearchCursor, len(candidates))
+	for id := range candidates {
+		user := s.usersByID[id]
+		if user == nil || containsID(query.Exclude, id) {
+			continue
+		}
+		rank, ok := UserSearchRank(user, query.Text)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(user.Name)
+		if query.After != nil && !query.After.follows(rank, name, id) {
+			continue
+		}
+		cursors[id] = &UserSearchCursor{Rank: rank, Name: name, ID: id}
+		result = append(result, user)
+	}
+
+	// result[i] đứng trước result[j] khi result[j] đứng sau vị trí của result[i]
+	sort.Slice(result, func(i, j int) bool {
+		next := cursors[result[j].ID]
+		return cursors[result[i].ID].follows(next.Rank, next.Name, next.ID)
+	})
+	if query.Limit > 0 && int64(len(result)) > query.Limit {
+		result = result[:query.Limit]
+	}
+	for i, user := range result {
+		result[i] = cloneUser(user)
+	}
+	return result, nil
+}
@@ -0,0 +1,1273 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore lưu trữ dữ liệu trong MongoDB.
+// MongoStore triển khai cả UserStore và ChatStore.
+type MongoStore struct {
+	db *mongo.Database
+	// transactions cho biết server hỗ trợ multi-document transaction (replica set hoặc mongos)
+	transactions bool
+}
+
+// NewMongoStore tạo store sử dụng database MongoDB đã kết nối
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+func (s *MongoStore) users() *mongo.Collection {
+	return s.db.Collection("users")
+}
+
+func (s *MongoStore) conversations() *mongo.Collection {
+	return s.db.Collection("conversations")
+}
+
+func (s *MongoStore) messages() *mongo.Collection {
+	return s.db.Collection("messages")
+}
+
+func (s *MongoStore) attachments() *mongo.Collection {
+	return s.db.Collection("attachments")
+}
+
+func (s *MongoStore) friendRequests() *mongo.Collection {
+	return s.db.Collection("friend_requests")
+}
+
+func (s *MongoStore) userBlocks() *mongo.Collection {
+	return s.db.Collection("user_blocks")
+}
+
+func (s *MongoStore) revokedTokens() *mongo.Collection {
+	return s.db.Collection("revoked_tokens")
+}
+
+func (s *MongoStore) tokenFamilies() *mongo.Collection {
+	return s.db.Collection("token_families")
+}
+
+func (s *MongoStore) sessions() *mongo.Collection {
+	return s.db.Collection("sessions")
+}
+
+func (s *MongoStore) outbox() *mongo.Collection {
+	return s.db.Collection("outbox_events")
+}
+
+// DetectTransactions kiểm tra server có hỗ trợ transaction hay không.
+// MongoDB standalone không hỗ trợ transaction, khi đó các thao tác ghi tuần tự từng bước và không còn
+// nguyên tử; main chỉ chấp nhận điều này khi MONGODB_ALLOW_NO_TRANSACTIONS=true.
+func (s *MongoStore) DetectTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := s.db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+
+	s.transactions = hello.SetName != "" || hello.Msg == "isdbgrid"
+	return s.transactions, nil
+}
+
+// mongoUser là document người dùng kèm sort_name: tên chữ thường để SearchUsers sắp xếp và phân trang
+// theo thứ tự byte giống bộ nhớ và SQLite. Collation của MongoDB xếp "Ánh" trước "Bảo" còn
+// UserSearchCursor thì không, nên cursor sẽ bỏ sót hoặc lặp người dùng.
+type mongoUser struct {
+	models.User `bson:",inline"`
+	SortName    string `bson:"sort_name"`
+}
+
+// CreateUser dựa vào index unique "email_unique" (migration 1) để chống trùng email,
+// kể cả khi hai yêu cầu đăng ký cùng email đến đồng thời
+func (s *MongoStore) CreateUser(ctx context.Context, user *models.User) error {
+	_, err := s.users().InsertOne(ctx, mongoUser{User: *user, SortName: strings.ToLower(user.Name)})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (s *MongoStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return s.findUser(ctx, bson.M{"email": email})
+}
+
+func (s *MongoStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	return s.findUser(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoStore) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.User, error) {
+	if len(ids) == 0 {
+		return []*models.User{}, nil
+	}
+
+	cursor, err := s.users().Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []*models.User{}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoStore) findUser(ctx context.Context, filter bson.M) (*models.User, error) {
+	var user models.User
+	err := s.users().FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) UpdateUserProfile(ctx context.Context, id primitive.ObjectID, name, avatar string, updatedAt time.Time) error {
+	return s.updateUser(ctx, id, bson.M{
+		"name":       name,
+		"sort_name":  strings.ToLower(name),
+		"avatar":     avatar,
+		"updated_at": updatedAt,
+	})
+}
+
+func (s *MongoStore) UpdateUserStatus(ctx context.Context, id primitive.ObjectID, status models.UserStatus, updatedAt time.Time) error {
+	return s.updateUser(ctx, id, bson.M{
+		"status":     status,
+		"updated_at": updatedAt,
+	})
+}
+
+func (s *MongoStore) SearchUsers(ctx context.Context, query UserSearchQuery) ([]*models.User, error) {
+	users := []*models.User{}
+	if query.Text == "" {
+		return users, nil
+	}
+
+	text := regexp.QuoteMeta(query.Text)
+	// query.Text đã là chữ thường nên tên được so khớp trên sort_name giống strings.ToLower của UserSearchRank
+	match := bson.A{
+		bson.M{"sort_name": primitive.Regex{Pattern: "(^| )" + text}},
+		bson.M{"email": primitive.Regex{Pattern: "^" + text, Options: "i"}},
+	}
+	if utf8.RuneCountInString(query.Text) >= MinUserSubstringLength {
+		match = bson.A{
+			bson.M{"sort_name": primitive.Regex{Pattern: text}},
+			bson.M{"email": primitive.Regex{Pattern: text, Options: "i"}},
+		}
+	}
+	filter := bson.M{"$or": match}
+	if len(query.Exclude) > 0 {
+		filter["_id"] = bson.M{"$nin": query.Exclude}
+	}
+	matches := func(field, pattern string) bson.M {
+		return bson.M{"$regexMatch": bson.M{"input": field, "regex": pattern, "options": "i"}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		// match_rank theo cùng quy tắc với UserSearchRank
+		{{Key: "$addFields", Value: bson.M{
+			"match_rank": bson.M{"$switch": bson.M{
+				"branches": bson.A{
+					bson.M{"case": bson.M{"$or": bson.A{matches("$sort_name", "^"+text+"$"), matches("$email", "^"+text+"$")}}, "then": UserMatchExact},
+					bson.M{"case": bson.M{"$or": bson.A{matches("$sort_name", "(^| )"+text), matches("$email", "^"+text)}}, "then": UserMatchPrefix},
+				},
+				"default": UserMatchSubstring,
+			}},
+		}}},
+	}
+	if query.After != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"match_rank": bson.M{"$gt": query.After.Rank}},
+			bson.M{"match_rank": query.After.Rank, "sort_name": bson.M{"$gt": query.After.Name}},
+			bson.M{"match_rank": query.After.Rank, "sort_name": query.After.Name, "_id": bson.M{"$gt": query.After.ID}},
+		}}}})
+	}
+	// Không dùng collation: chuỗi được so sánh theo byte như UserSearchCursor.follows
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.D{
+		{Key: "match_rank", Value: 1}, {Key: "sort_name", Value: 1}, {Key: "_id", Value: 1},
+	}}})
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: query.Limit}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.M{"match_rank": 0, "sort_name": 0}}})
+
+	cursor, err := s.users().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// BlockUser dựa vào index unique "blocker_blocked_unique" (migration 9): khi hai request chặn cùng lúc,
+// request upsert sau nhận lỗi trùng khóa và được coi như đã chặn từ trước
+func (s *MongoStore) BlockUser(ctx context.Context, block *models.UserBlock) (bool, error) {
+	result, err := s.userBlocks().UpdateOne(ctx,
+		bson.M{"blocker_id": block.BlockerID, "blocked_id": block.BlockedID},
+		bson.M{"$setOnInsert": bson.M{"created_at": block.CreatedAt}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (s *MongoStore) UnblockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) (bool, error) {
+	result, err := s.userBlocks().DeleteOne(ctx, bson.M{"blocker_id": blockerID, "blocked_id": blockedID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) ListBlocks(ctx context.Context, blockerID primitive.ObjectID) ([]*models.UserBlock, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "blocked_id", Value: 1}})
+	cursor, err := s.userBlocks().Find(ctx, bson.M{"blocker_id": blockerID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	blocks := []*models.UserBlock{}
+	if err = cursor.All(ctx, &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func (s *MongoStore) ListBlockerIDs(ctx context.Context, blockedID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := s.userBlocks().Find(ctx, bson.M{"blocked_id": blockedID},
+		options.Find().SetProjection(bson.M{"blocker_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	blocks := []*models.UserBlock{}
+	if err = cursor.All(ctx, &blocks); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(blocks))
+	for i, block := range blocks {
+		ids[i] = block.BlockerID
+	}
+	return ids, nil
+}
+
+func (s *MongoStore) RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	_, err := s.revokedTokens().InsertOne(ctx, token)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *MongoStore) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	err := s.revokedTokens().FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteExpiredTokens xóa ngay các bản ghi đã hết hạn; index TTL "expires_at_ttl" (migration 10 và 11)
+// cũng tự xóa chúng nhưng chỉ chạy khoảng mỗi phút một lần
+func (s *MongoStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	filter := bson.M{"expires_at": bson.M{"$lt": before}}
+	var deleted int64
+	for _, coll := range []*mongo.Collection{s.revokedTokens(), s.tokenFamilies()} {
+		result, err := coll.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += result.DeletedCount
+	}
+	return deleted, nil
+}
+
+func (s *MongoStore) CreateTokenFamily(ctx context.Context, family *models.TokenFamily) error {
+	_, err := s.tokenFamilies().InsertOne(ctx, family)
+	return err
+}
+
+func (s *MongoStore) GetTokenFamily(ctx context.Context, id primitive.ObjectID) (*models.TokenFamily, error) {
+	var family models.TokenFamily
+	if err := s.tokenFamilies().FindOne(ctx, bson.M{"_id": id}).Decode(&family); err != nil {
+		return nil, mapError(err)
+	}
+	return &family, nil
+}
+
+func (s *MongoStore) RotateTokenFamily(ctx context.Context, id primitive.ObjectID, oldTokenID, newTokenID string, expiresAt, updatedAt time.Time) (bool, error) {
+	result, err := s.tokenFamilies().UpdateOne(ctx,
+		bson.M{"_id": id, "current_token_id": oldTokenID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"current_token_id": newTokenID, "expires_at": expiresAt, "updated_at": updatedAt}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func (s *MongoStore) RevokeTokenFamily(ctx context.Context, id primitive.ObjectID, revokedAt time.Time) (bool, error) {
+	result, err := s.tokenFamilies().UpdateOne(ctx,
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": revokedAt}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func (s *MongoStore) CreateSession(ctx context.Context, session *models.Session) error {
+	_, err := s.sessions().InsertOne(ctx, session)
+	return err
+}
+
+func (s *MongoStore) GetSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error) {
+	var session models.Session
+	if err := s.sessions().FindOne(ctx, bson.M{"_id": id}).Decode(&session); err != nil {
+		return nil, mapError(err)
+	}
+	return &session, nil
+}
+
+func (s *MongoStore) ListSessions(ctx context.Context, userID primitive.ObjectID) ([]*models.Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}, {Key: "_id", Value: 1}})
+	cursor, err := s.sessions().Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []*models.Session{}
+	if err = cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *MongoStore) TouchSession(ctx context.Context, id primitive.ObjectID, ip string, lastUsedAt time.Time) error {
+	_, err := s.sessions().UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"ip": ip, "last_used_at": lastUsedAt}})
+	return err
+}
+
+func (s *MongoStore) DeleteSession(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := s.sessions().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.sessions().DeleteMany(ctx, bson.M{"last_used_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoStore) updateUser(ctx context.Context, id primitive.ObjectID, fields bson.M) error {
+	result, err := s.users().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) CreateConversation(ctx context.Context, conv *models.Conversation) error {
+	_, err := s.conversations().InsertOne(ctx, conv)
+	return err
+}
+
+func (s *MongoStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*models.Conversation, error) {
+	return s.findConversation(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoStore) FindPersonalConversation(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.Conversation, error) {
+	return s.findConversation(ctx, bson.M{
+		"type": models.ConversationTypePersonal,
+		"participants": bson.M{
+			"$all":  []primitive.ObjectID{userID1, userID2},
+			"$size": 2,
+		},
+	})
+}
+
+func (s *MongoStore) findConversation(ctx context.Context, filter bson.M) (*models.Conversation, error) {
+	var conv models.Conversation
+	err := s.conversations().FindOne(ctx, filter).Decode(&conv)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &conv, nil
+}
+
+func (s *MongoStore) ListConversations(ctx context.Context, userID primitive.ObjectID, query ConversationQuery) ([]*models.Conversation, error) {
+	filter := bson.M{"participants": userID}
+	if query.Type != "" {
+		filter["type"] = query.Type
+	}
+	if query.UnreadOnly {
+		filter["unread_counts."+userID.Hex()] = bson.M{"$gt": 0}
+	}
+	if query.NamePrefix != "" {
+		filter["name"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query.NamePrefix), Options: "i"}
+	}
+	if query.After != nil {
+		filter["$or"] = bson.A{
+			bson.M{"updated_at": bson.M{"$lt": query.After.UpdatedAt}},
+			bson.M{"updated_at": query.After.UpdatedAt, "_id": bson.M{"$lt": query.After.ID}},
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+
+	cursor, err := s.conversations().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	conversations := []*models.Conversation{}
+	if err = cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+func (s *MongoStore) SaveMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		return s.saveMessage(ctx, msg, events)
+	})
+}
+
+// inTransaction chạy fn trong một transaction nếu server hỗ trợ, ngược lại chạy tuần tự (xem DetectTransactions).
+// Trong transaction, ctx truyền cho fn là SessionContext nên mọi thao tác dùng ctx đó.
+func (s *MongoStore) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !s.transactions {
+		return fn(ctx)
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
+// saveMessage thực hiện các bước ghi của SaveMessage
+func (s *MongoStore) saveMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	if err := s.bindAttachments(ctx, msg); err != nil {
+		return err
+	}
+	if msg.IsThreadReply() {
+		return s.saveThreadReply(ctx, msg, events)
+	}
+
+	var conv models.Conversation
+	err := s.conversations().FindOne(ctx, bson.M{"_id": msg.ConversationID},
+		options.FindOne().SetProjection(bson.M{"participants": 1})).Decode(&conv)
+	if err != nil {
+		return mapError(err)
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"last_message": msg,
+			"updated_at":   msg.CreatedAt,
+		},
+	}
+	// Tăng số tin chưa đọc của các thành viên khác người gửi, chưa đọc tin nhắn và không chặn người gửi
+	unread := bson.M{}
+	if !msg.IsDeleted {
+		for _, participantID := range conv.Participants {
+			if participantID != msg.SenderID && !containsID(msg.ReadBy, participantID) && !containsID(msg.UnreadExempt, participantID) {
+				unread["unread_counts."+participantID.Hex()] = 1
+			}
+		}
+	}
+	if len(unread) > 0 {
+		update["$inc"] = unread
+	}
+
+	result, err := s.conversations().UpdateOne(ctx, bson.M{"_id": msg.ConversationID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := s.messages().InsertOne(ctx, msg); err != nil {
+		return err
+	}
+
+	return s.insertOutboxEvents(ctx, events)
+}
+
+// saveThreadReply lưu tin trả lời trong thread và cập nhật thống kê, người theo dõi của tin nhắn gốc
+func (s *MongoStore) saveThreadReply(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	var root models.Message
+	err := s.messages().FindOne(ctx, bson.M{"_id": msg.ThreadRootID, "conversation_id": msg.ConversationID},
+		options.FindOne().SetProjection(bson.M{"sender_id": 1, "thread_reply_count": 1, "thread_followers": 1})).Decode(&root)
+	if err != nil {
+		return mapError(err)
+	}
+
+	followers := root.ThreadFollowers
+	if root.ThreadReplyCount == 0 && !containsID(followers, root.SenderID) {
+		followers = append(followers, root.SenderID)
+	}
+	if !containsID(followers, msg.SenderID) {
+		followers = append(followers, msg.SenderID)
+	}
+
+	inc := bson.M{"thread_reply_count": 1}
+	for _, followerID := range followers {
+		if followerID != msg.SenderID && !containsID(msg.UnreadExempt, followerID) {
+			inc["thread_unread_counts."+followerID.Hex()] = 1
+		}
+	}
+	_, err = s.messages().UpdateOne(ctx, bson.M{"_id": root.ID}, bson.M{
+		"$inc":      inc,
+		"$set":      bson.M{"thread_last_reply_at": msg.CreatedAt},
+		"$addToSet": bson.M{"thread_followers": bson.M{"$each": followers}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Thống kê thread cũng hiển thị ở tin nhắn cuối được nhúng trong cuộc hội thoại
+	_, err = s.conversations().UpdateOne(ctx,
+		bson.M{"_id": msg.ConversationID, "last_message._id": root.ID},
+		bson.M{
+			"$inc": bson.M{"last_message.thread_reply_count": 1},
+			"$set": bson.M{"last_message.thread_last_reply_at": msg.CreatedAt},
+		})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.messages().InsertOne(ctx, msg); err != nil {
+		return err
+	}
+	return s.insertOutboxEvents(ctx, events)
+}
+
+// bindAttachments gắn các tệp của msg vào tin nhắn. Điều kiện message_id chưa có bảo đảm mỗi tệp
+// chỉ được gắn một lần; số document thay đổi ít hơn số tệp nghĩa là có tệp không hợp lệ và transaction bị hủy.
+func (s *MongoStore) bindAttachments(ctx context.Context, msg *models.Message) error {
+	if len(msg.Attachments) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, len(msg.Attachments))
+	for i, ref := range msg.Attachments {
+		ids[i] = ref.ID
+	}
+	result, err := s.attachments().UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "uploader_id": msg.SenderID, "message_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"conversation_id": msg.ConversationID, "message_id": msg.ID}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount != int64(len(ids)) {
+		return ErrAttachmentUnavailable
+	}
+	return nil
+}
+
+func (s *MongoStore) insertOutboxEvents(ctx context.Context, events []*models.OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(events))
+	for i, event := range events {
+		docs[i] = event
+	}
+	_, err := s.outbox().InsertMany(ctx, docs)
+	return err
+}
+
+func (s *MongoStore) EditMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		// Điều kiện is_deleted ngăn lần sửa chạy đồng thời với thu hồi ghi đè tombstone
+		result, err := s.messages().UpdateOne(ctx, bson.M{"_id": msg.ID, "is_deleted": false}, bson.M{
+			"$set": bson.M{
+				"content":      msg.Content,
+				"edited_at":    msg.EditedAt,
+				"edit_history": msg.EditHistory,
+				"updated_at":   msg.UpdatedAt,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return ErrNotFound
+		}
+
+		// Bản sao tin nhắn cuối được nhúng trong cuộc hội thoại nên phải cập nhật theo
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": msg.ConversationID, "last_message._id": msg.ID},
+			bson.M{"$set": bson.M{
+				"last_message.content":      msg.Content,
+				"last_message.edited_at":    msg.EditedAt,
+				"last_message.edit_history": msg.EditHistory,
+				"last_message.updated_at":   msg.UpdatedAt,
+			}})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+}
+
+func (s *MongoStore) DeleteMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		tombstone := bson.M{
+			"is_deleted":   true,
+			"content":      msg.Content,
+			"edit_history": msg.EditHistory,
+			"reactions":    msg.Reactions,
+			"attachments":  msg.Attachments,
+			"deleted_at":   msg.DeletedAt,
+			"deleted_by":   msg.DeletedBy,
+			"updated_at":   msg.UpdatedAt,
+		}
+
+		// Điều kiện is_deleted bảo đảm số tin chưa đọc chỉ bị trừ một lần khi có request đồng thời;
+		// read_by của bản ghi trước khi cập nhật cho biết ai chưa đọc tin nhắn
+		var before models.Message
+		err := s.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": msg.ID, "is_deleted": false},
+			bson.M{"$set": tombstone},
+			options.FindOneAndUpdate().SetProjection(bson.M{
+				"conversation_id": 1, "sender_id": 1, "read_by": 1, "unread_exempt": 1, "thread_root_id": 1,
+			}),
+		).Decode(&before)
+		if err != nil {
+			return mapError(err)
+		}
+
+		// Tin trả lời trong thread không được tính vào số tin chưa đọc của cuộc hội thoại
+		var conv models.Conversation
+		if !before.IsThreadReply() {
+			err = s.conversations().FindOne(ctx, bson.M{"_id": before.ConversationID},
+				options.FindOne().SetProjection(bson.M{"participants": 1})).Decode(&conv)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				return err
+			}
+		}
+		unread := make(map[primitive.ObjectID]int64)
+		for _, participantID := range conv.Participants {
+			if participantID != before.SenderID && !containsID(before.ReadBy, participantID) && !containsID(before.UnreadExempt, participantID) {
+				unread[participantID] = 1
+			}
+		}
+		if err := s.decrementUnread(ctx, before.ConversationID, unread); err != nil {
+			return err
+		}
+
+		lastMessage := bson.M{}
+		for field, value := range tombstone {
+			lastMessage["last_message."+field] = value
+		}
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": before.ConversationID, "last_message._id": msg.ID},
+			bson.M{"$set": lastMessage})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+}
+
+func (s *MongoStore) HideMessage(ctx context.Context, id, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		// Tin nhắn đã xóa ở phía mình không còn được tính là chưa đọc. Điều kiện read_by $ne bảo đảm
+		// số tin chưa đọc chỉ bị trừ một lần, bản ghi trước khi cập nhật cho biết có cần trừ hay không.
+		var unread models.Message
+		err := s.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "read_by": bson.M{"$ne": userID}},
+			bson.M{"$addToSet": bson.M{"read_by": userID}, "$set": bson.M{"status": models.MessageStatusRead}},
+			options.FindOneAndUpdate().SetProjection(bson.M{
+				"conversation_id": 1, "sender_id": 1, "is_deleted": 1, "unread_exempt": 1, "thread_root_id": 1,
+			}),
+		).Decode(&unread)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		if err == nil && unread.SenderID != userID && !unread.IsDeleted && !unread.IsThreadReply() && !containsID(unread.UnreadExempt, userID) {
+			if err := s.decrementUnread(ctx, unread.ConversationID, map[primitive.ObjectID]int64{userID: 1}); err != nil {
+				return err
+			}
+		}
+
+		var msg models.Message
+		err = s.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": id},
+			bson.M{"$addToSet": bson.M{"hidden_for": userID}},
+			options.FindOneAndUpdate().SetProjection(bson.M{"conversation_id": 1}),
+		).Decode(&msg)
+		if err != nil {
+			return mapError(err)
+		}
+
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": msg.ConversationID, "last_message._id": id},
+			bson.M{"$addToSet": bson.M{"last_message.hidden_for": userID}})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+}
+
+func (s *MongoStore) MarkMessagePlayed(ctx context.Context, messageID, userID primitive.ObjectID, events []*models.OutboxEvent) (bool, error) {
+	var played bool
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		// Điều kiện played_by $ne bảo đảm sự kiện chỉ được ghi một lần khi có request đồng thời
+		var msg models.Message
+		err := s.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": messageID, "is_deleted": false, "played_by": bson.M{"$ne": userID}},
+			bson.M{"$push": bson.M{"played_by": userID}},
+			options.FindOneAndUpdate().SetProjection(bson.M{"conversation_id": 1}),
+		).Decode(&msg)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Phân biệt tin nhắn không tồn tại với người đã nghe trước đó
+			return s.messages().FindOne(ctx, bson.M{"_id": messageID, "is_deleted": false},
+				options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		}
+		if err != nil {
+			return err
+		}
+		played = true
+
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": msg.ConversationID, "last_message._id": messageID},
+			bson.M{"$push": bson.M{"last_message.played_by": userID}})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+	return played, mapError(err)
+}
+
+func (s *MongoStore) AddReaction(ctx context.Context, messageID primitive.ObjectID, reaction models.Reaction, events []*models.OutboxEvent) (bool, error) {
+	var added bool
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		// Điều kiện $elemMatch bảo đảm mỗi người chỉ thả mỗi emoji một lần khi có request đồng thời
+		var msg models.Message
+		err := s.messages().FindOneAndUpdate(ctx,
+			bson.M{
+				"_id":        messageID,
+				"is_deleted": false,
+				"reactions":  bson.M{"$not": bson.M{"$elemMatch": bson.M{"user_id": reaction.UserID, "emoji": reaction.Emoji}}},
+			},
+			bson.M{"$push": bson.M{"reactions": reaction}},
+			options.FindOneAndUpdate().SetProjection(bson.M{"conversation_id": 1}),
+		).Decode(&msg)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Phân biệt tin nhắn không tồn tại với reaction đã có
+			return s.messages().FindOne(ctx, bson.M{"_id": messageID, "is_deleted": false},
+				options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		}
+		if err != nil {
+			return err
+		}
+		added = true
+
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": msg.ConversationID, "last_message._id": messageID},
+			bson.M{"$push": bson.M{"last_message.reactions": reaction}})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+	return added, mapError(err)
+}
+
+func (s *MongoStore) RemoveReaction(ctx context.Context, messageID, userID primitive.ObjectID, emoji string, events []*models.OutboxEvent) (bool, error) {
+	var removed bool
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		pull := bson.M{"$pull": bson.M{"reactions": bson.M{"user_id": userID, "emoji": emoji}}}
+		var msg models.Message
+		err := s.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": messageID, "reactions": bson.M{"$elemMatch": bson.M{"user_id": userID, "emoji": emoji}}},
+			pull,
+			options.FindOneAndUpdate().SetProjection(bson.M{"conversation_id": 1}),
+		).Decode(&msg)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return s.messages().FindOne(ctx, bson.M{"_id": messageID},
+				options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
+
+		_, err = s.conversations().UpdateOne(ctx,
+			bson.M{"_id": msg.ConversationID, "last_message._id": messageID},
+			bson.M{"$pull": bson.M{"last_message.reactions": bson.M{"user_id": userID, "emoji": emoji}}})
+		if err != nil {
+			return err
+		}
+
+		return s.insertOutboxEvents(ctx, events)
+	})
+	return removed, mapError(err)
+}
+
+func (s *MongoStore) GetMessage(ctx context.Context, id primitive.ObjectID) (*models.Message, error) {
+	var msg models.Message
+	err := s.messages().FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &msg, nil
+}
+
+func (s *MongoStore) GetMessagesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.Message, error) {
+	return s.findMessages(ctx, bson.M{"_id": bson.M{"$in": ids}}, nil)
+}
+
+func (s *MongoStore) ListMessages(ctx context.Context, conversationID primitive.ObjectID, query MessageQuery) ([]*models.Message, error) {
+	filter := bson.M{"conversation_id": conversationID}
+	if query.ThreadRootID.IsZero() {
+		filter["thread_root_id"] = bson.M{"$exists": false}
+	} else {
+		filter["thread_root_id"] = query.ThreadRootID
+	}
+	if !query.Viewer.IsZero() {
+		filter["hidden_for"] = bson.M{"$ne": query.Viewer}
+	}
+	if len(query.ExcludeSenders) > 0 {
+		filter["sender_id"] = bson.M{"$nin": query.ExcludeSenders}
+	}
+	idRange := bson.M{}
+	if !query.Before.IsZero() {
+		idRange["$lt"] = query.Before
+	}
+	if !query.After.IsZero() {
+		idRange["$gt"] = query.After
+	}
+	if len(idRange) > 0 {
+		filter["_id"] = idRange
+	}
+
+	order := -1
+	if query.Ascending {
+		order = 1
+	}
+	opts := options.Find().SetSort(bson.M{"_id": order})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	return s.findMessages(ctx, filter, opts)
+}
+
+func (s *MongoStore) SearchMessages(ctx context.Context, query MessageSearchQuery) ([]*models.Message, error) {
+	if len(query.Terms) == 0 {
+		return []*models.Message{}, nil
+	}
+
+	// Chỉ tìm trong các cuộc hội thoại người xem đang tham gia
+	cursor, err := s.conversations().Find(ctx, bson.M{"participants": query.Viewer},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var convs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &convs); err != nil {
+		return nil, err
+	}
+	convIDs := make([]primitive.ObjectID, 0, len(convs))
+	for _, conv := range convs {
+		if query.ConversationID.IsZero() || conv.ID == query.ConversationID {
+			convIDs = append(convIDs, conv.ID)
+		}
+	}
+	if len(convIDs) == 0 {
+		return []*models.Message{}, nil
+	}
+
+	// Text index tách từ theo default_language "none" (không bỏ stop word hay lấy gốc từ) và bỏ qua
+	// hoa thường và dấu như search.Normalize. Mỗi từ khóa được đặt trong ngoặc kép để tin nhắn phải
+	// chứa tất cả các từ khóa thay vì chỉ một trong số đó.
+	phrases := make([]string, len(query.Terms))
+	for i, term := range query.Terms {
+		phrases[i] = `"` + term + `"`
+	}
+	filter := bson.M{
+		"$text":           bson.M{"$search": strings.Join(phrases, " ")},
+		"conversation_id": bson.M{"$in": convIDs},
+		"is_deleted":      false,
+		"hidden_for":      bson.M{"$ne": query.Viewer},
+	}
+	sender := bson.M{}
+	if !query.SenderID.IsZero() {
+		sender["$eq"] = query.SenderID
+	}
+	if len(query.ExcludeSenders) > 0 {
+		sender["$nin"] = query.ExcludeSenders
+	}
+	if len(sender) > 0 {
+		filter["sender_id"] = sender
+	}
+	createdAt := bson.M{}
+	if !query.Since.IsZero() {
+		createdAt["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		createdAt["$lt"] = query.Until
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	if query.HasAttachment {
+		filter["attachments.0"] = bson.M{"$exists": true}
+	}
+	if !query.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": query.Before}
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	return s.findMessages(ctx, filter, opts)
+}
+
+func (s *MongoStore) findMessages(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*models.Message, error) {
+	cursor, err := s.messages().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []*models.Message{}
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *MongoStore) MarkMessagesRead(ctx context.Context, ids []primitive.ObjectID, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		if err := s.markMessagesRead(ctx, ids, userID); err != nil {
+			return err
+		}
+		return s.insertOutboxEvents(ctx, events)
+	})
+}
+
+// markMessagesRead thực hiện các bước ghi của MarkMessagesRead
+func (s *MongoStore) markMessagesRead(ctx context.Context, ids []primitive.ObjectID, userID primitive.ObjectID) error {
+	update := bson.M{
+		"$addToSet": bson.M{"read_by": userID},
+		"$set":      bson.M{"status": models.MessageStatusRead},
+	}
+
+	// Các tin nhắn người dùng chưa đọc được tính vào số tin chưa đọc, nhóm theo cuộc hội thoại
+	cursor, err := s.messages().Find(ctx, bson.M{
+		"_id":            bson.M{"$in": ids},
+		"read_by":        bson.M{"$ne": userID},
+		"unread_exempt":  bson.M{"$ne": userID},
+		"sender_id":      bson.M{"$ne": userID},
+		"is_deleted":     false,
+		"thread_root_id": bson.M{"$exists": false},
+	}, options.Find().SetProjection(bson.M{"conversation_id": 1}))
+	if err != nil {
+		return err
+	}
+	var unread []models.Message
+	if err := cursor.All(ctx, &unread); err != nil {
+		return err
+	}
+	byConversation := make(map[primitive.ObjectID][]mongo.WriteModel)
+	for _, msg := range unread {
+		// Điều kiện read_by $ne bảo đảm mỗi tin nhắn chỉ được trừ một lần khi có request đồng thời
+		byConversation[msg.ConversationID] = append(byConversation[msg.ConversationID],
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": msg.ID, "read_by": bson.M{"$ne": userID}}).
+				SetUpdate(update))
+	}
+
+	for convID, writes := range byConversation {
+		result, err := s.messages().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		if err := s.decrementUnread(ctx, convID, map[primitive.ObjectID]int64{userID: result.ModifiedCount}); err != nil {
+			return err
+		}
+	}
+
+	// Các tin nhắn còn lại (của chính người dùng hoặc đã đọc) vẫn được đánh dấu như trước
+	_, err = s.messages().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, update)
+	return err
+}
+
+// decrementUnread trừ số tin chưa đọc của từng người trong counts tại cuộc hội thoại convID.
+// $inc có thể làm số đếm âm khi dữ liệu lệch nên dùng pipeline update với $max để dừng ở 0 như các store khác.
+func (s *MongoStore) decrementUnread(ctx context.Context, convID primitive.ObjectID, counts map[primitive.ObjectID]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	set := bson.M{}
+	for userID, n := range counts {
+		field := "unread_counts." + userID.Hex()
+		set[field] = bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{"$" + field, n}}}}
+	}
+	_, err := s.conversations().UpdateOne(ctx, bson.M{"_id": convID}, mongo.Pipeline{{{Key: "$set", Value: set}}})
+	return err
+}
+
+func (s *MongoStore) FollowThread(ctx context.Context, rootID, userID primitive.ObjectID, follow bool) error {
+	update := bson.M{"$addToSet": bson.M{"thread_followers": userID}}
+	if !follow {
+		update = bson.M{
+			"$pull":  bson.M{"thread_followers": userID},
+			"$unset": bson.M{"thread_unread_counts." + userID.Hex(): ""},
+		}
+	}
+
+	result, err := s.messages().UpdateOne(ctx, bson.M{"_id": rootID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) MarkThreadRead(ctx context.Context, rootID, userID primitive.ObjectID) error {
+	result, err := s.messages().UpdateOne(ctx, bson.M{"_id": rootID},
+		bson.M{"$unset": bson.M{"thread_unread_counts." + userID.Hex(): ""}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) SetThreadOptIn(ctx context.Context, conversationID, userID primitive.ObjectID, enabled bool) error {
+	update := bson.M{"$addToSet": bson.M{"thread_opt_ins": userID}}
+	if !enabled {
+		update = bson.M{"$pull": bson.M{"thread_opt_ins": userID}}
+	}
+
+	result, err := s.conversations().UpdateOne(ctx, bson.M{"_id": conversationID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) CreateAttachment(ctx context.Context, attachment *models.Attachment) error {
+	_, err := s.attachments().InsertOne(ctx, attachment)
+	return err
+}
+
+func (s *MongoStore) GetAttachment(ctx context.Context, id primitive.ObjectID) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := s.attachments().FindOne(ctx, bson.M{"_id": id}).Decode(&attachment); err != nil {
+		return nil, mapError(err)
+	}
+	return &attachment, nil
+}
+
+func (s *MongoStore) DeleteAttachments(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.attachments().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// CreateFriendRequest dựa vào index unique "pair_key_unique" (migration 8) để mỗi cặp người dùng
+// chỉ có một bản ghi, kể cả khi hai người gửi lời mời cho nhau cùng lúc
+func (s *MongoStore) CreateFriendRequest(ctx context.Context, req *models.FriendRequest, events []*models.OutboxEvent) error {
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		if _, err := s.friendRequests().InsertOne(ctx, req); err != nil {
+			return err
+		}
+		return s.insertOutboxEvents(ctx, events)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateFriendRequest
+	}
+	return err
+}
+
+func (s *MongoStore) GetFriendRequest(ctx context.Context, id primitive.ObjectID) (*models.FriendRequest, error) {
+	return s.findFriendRequest(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoStore) FindFriendRequest(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.FriendRequest, error) {
+	return s.findFriendRequest(ctx, bson.M{"pair_key": models.FriendPairKey(userID1, userID2)})
+}
+
+func (s *MongoStore) findFriendRequest(ctx context.Context, filter bson.M) (*models.FriendRequest, error) {
+	var req models.FriendRequest
+	if err := s.friendRequests().FindOne(ctx, filter).Decode(&req); err != nil {
+		return nil, mapError(err)
+	}
+	return &req, nil
+}
+
+func (s *MongoStore) ListFriendRequests(ctx context.Context, userID primitive.ObjectID, status models.FriendRequestStatus) ([]*models.FriendRequest, error) {
+	filter := bson.M{
+		"$or":    bson.A{bson.M{"sender_id": userID}, bson.M{"recipient_id": userID}},
+		"status": status,
+	}
+	cursor, err := s.friendRequests().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	requests := []*models.FriendRequest{}
+	if err = cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (s *MongoStore) AcceptFriendRequest(ctx context.Context, id primitive.ObjectID, acceptedAt time.Time, events []*models.OutboxEvent) (bool, error) {
+	var accepted bool
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		result, err := s.friendRequests().UpdateOne(ctx,
+			bson.M{"_id": id, "status": models.FriendRequestPending},
+			bson.M{"$set": bson.M{"status": models.FriendRequestAccepted, "updated_at": acceptedAt}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return s.friendRequestExists(ctx, id)
+		}
+		accepted = true
+		return s.insertOutboxEvents(ctx, events)
+	})
+	return accepted, mapError(err)
+}
+
+func (s *MongoStore) DeleteFriendRequest(ctx context.Context, id primitive.ObjectID, status models.FriendRequestStatus, events []*models.OutboxEvent) (bool, error) {
+	var deleted bool
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		result, err := s.friendRequests().DeleteOne(ctx, bson.M{"_id": id, "status": status})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			return s.friendRequestExists(ctx, id)
+		}
+		deleted = true
+		return s.insertOutboxEvents(ctx, events)
+	})
+	return deleted, mapError(err)
+}
+
+// friendRequestExists trả về mongo.ErrNoDocuments nếu lời mời không tồn tại
+func (s *MongoStore) friendRequestExists(ctx context.Context, id primitive.ObjectID) error {
+	return s.friendRequests().FindOne(ctx, bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+}
+
+func (s *MongoStore) PendingOutboxEvents(ctx context.Context, limit int) ([]*models.OutboxEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := s.outbox().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []*models.OutboxEvent{}
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *MongoStore) DeleteOutboxEvents(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.outbox().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// mapError chuyển lỗi của driver MongoDB sang lỗi chung của package store
+func mapError(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
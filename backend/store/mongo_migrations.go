@@ -0,0 +1,373 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrationTimeout giới hạn thời gian chạy của mỗi migration (tạo index có thể chậm trên dữ liệu lớn)
+const migrationTimeout = 5 * time.Minute
+
+// MigrationStatus mô tả trạng thái của một migration trong backend lưu trữ
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// mongoMigration là một bước thay đổi schema/index của MongoDB, áp dụng đúng một lần theo thứ tự Version
+type mongoMigration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// mongoMigrations liệt kê toàn bộ lịch sử schema của backend MongoDB.
+// Chỉ thêm migration mới vào cuối danh sách, không sửa migration đã phát hành.
+var mongoMigrations = []mongoMigration{
+	{
+		Version: 1,
+		Name:    "create_core_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			if err := createIndexes(ctx, db.Collection("users"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetName("email_unique").SetUnique(true),
+			}); err != nil {
+				return fmt.Errorf("users: %w (kiểm tra email trùng lặp trước khi chạy lại)", err)
+			}
+
+			if err := createIndexes(ctx, db.Collection("conversations"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "participants", Value: 1}, {Key: "updated_at", Value: -1}},
+				Options: options.Index().SetName("participants_updated_at"),
+			}); err != nil {
+				return fmt.Errorf("conversations: %w", err)
+			}
+
+			if err := createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "conversation_id", Value: 1}, {Key: "created_at", Value: -1}},
+				Options: options.Index().SetName("conversation_id_created_at"),
+			}); err != nil {
+				return fmt.Errorf("messages: %w", err)
+			}
+			return nil
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create_outbox_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Tạo collection trước vì không thể tạo collection bên trong transaction
+			err := db.CreateCollection(ctx, "outbox_events")
+			var cmdErr mongo.CommandError
+			if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+				return err
+			}
+
+			return createIndexes(ctx, db.Collection("outbox_events"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+				Options: options.Index().SetName("created_at_id"),
+			})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_message_cursor_index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Phân trang tin nhắn theo _id trong từng cuộc hội thoại
+			return createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "conversation_id", Value: 1}, {Key: "_id", Value: 1}},
+				Options: options.Index().SetName("conversation_id_id"),
+			})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "backfill_unread_counts",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			if err := createIndexes(ctx, db.Collection("conversations"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "participants", Value: 1}, {Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}},
+				Options: options.Index().SetName("participants_updated_at_id"),
+			}); err != nil {
+				return err
+			}
+			return backfillUnreadCounts(ctx, db)
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_thread_index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Chỉ tin trả lời trong thread có thread_root_id nên index không chứa tin nhắn thường
+			return createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+				Keys: bson.D{{Key: "thread_root_id", Value: 1}, {Key: "_id", Value: 1}},
+				Options: options.Index().SetName("thread_root_id_id").
+					SetPartialFilterExpression(bson.M{"thread_root_id": bson.M{"$exists": true}}),
+			})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create_attachments_collection",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Tệp được gắn vào tin nhắn bên trong transaction gửi tin nên collection phải có sẵn
+			err := db.CreateCollection(ctx, "attachments")
+			var cmdErr mongo.CommandError
+			if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_message_text_index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Tìm kiếm tin nhắn; "none" giữ nguyên mọi từ thay vì áp dụng quy tắc tiếng Anh cho tin nhắn tiếng Việt
+			return createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "content", Value: "text"}},
+				Options: options.Index().SetName("content_text").SetDefaultLanguage("none"),
+			})
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create_friend_request_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// pair_key unique: mỗi cặp người dùng chỉ có một lời mời hoặc một quan hệ bạn bè
+			return createIndexes(ctx, db.Collection("friend_requests"),
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "pair_key", Value: 1}},
+					Options: options.Index().SetName("pair_key_unique").SetUnique(true),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "sender_id", Value: 1}, {Key: "status", Value: 1}},
+					Options: options.Index().SetName("sender_id_status"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "recipient_id", Value: 1}, {Key: "status", Value: 1}},
+					Options: options.Index().SetName("recipient_id_status"),
+				},
+			)
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_user_block_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return createIndexes(ctx, db.Collection("user_blocks"),
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "blocker_id", Value: 1}, {Key: "blocked_id", Value: 1}},
+					Options: options.Index().SetName("blocker_blocked_unique").SetUnique(true),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "blocked_id", Value: 1}},
+					Options: options.Index().SetName("blocked_id"),
+				},
+			)
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create_revoked_token_ttl_index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// MongoDB tự xóa token đã thu hồi khi token hết hạn
+			return createIndexes(ctx, db.Collection("revoked_tokens"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			})
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create_token_family_ttl_index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Family hết hạn cùng refresh token mới nhất của nó
+			return createIndexes(ctx, db.Collection("token_families"), mongo.IndexModel{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			})
+		},
+	},
+	{
+		Version: 12,
+		Name:    "create_session_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Phiên không dùng quá lâu được AuthService xóa định kỳ nên không cần index TTL
+			return createIndexes(ctx, db.Collection("sessions"),
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "last_used_at", Value: -1}},
+					Options: options.Index().SetName("user_last_used"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "last_used_at", Value: 1}},
+					Options: options.Index().SetName("last_used_at"),
+				},
+			)
+		},
+	},
+	{
+		Version: 13,
+		Name:    "backfill_user_sort_name",
+		Up:      backfillUserSortNames,
+	},
+}
+
+// backfillUserSortNames ghi sort_name cho các người dùng tạo trước khi SearchUsers sắp xếp theo trường này
+func backfillUserSortNames(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("users").Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Name string             `bson:"name"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		_, err := db.Collection("users").UpdateOne(ctx, bson.M{"_id": user.ID},
+			bson.M{"$set": bson.M{"sort_name": strings.ToLower(user.Name)}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// backfillUnreadCounts tính số tin chưa đọc của từng thành viên cho các cuộc hội thoại có sẵn
+func backfillUnreadCounts(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("conversations").Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"participants": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var conv struct {
+			ID           primitive.ObjectID   `bson:"_id"`
+			Participants []primitive.ObjectID `bson:"participants"`
+		}
+		if err := cursor.Decode(&conv); err != nil {
+			return err
+		}
+
+		counts := bson.M{}
+		for _, participantID := range conv.Participants {
+			count, err := db.Collection("messages").CountDocuments(ctx, bson.M{
+				"conversation_id": conv.ID,
+				"is_deleted":      false,
+				"sender_id":       bson.M{"$ne": participantID},
+				"read_by":         bson.M{"$ne": participantID},
+			})
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				counts[participantID.Hex()] = count
+			}
+		}
+
+		_, err := db.Collection("conversations").UpdateOne(ctx, bson.M{"_id": conv.ID},
+			bson.M{"$set": bson.M{"unread_counts": counts}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// mongoMigrationRecord là document lưu trong collection schema_migrations
+type mongoMigrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+func (s *MongoStore) migrationsCollection() *mongo.Collection {
+	return s.db.Collection("schema_migrations")
+}
+
+// Migrate áp dụng các migration chưa chạy và ghi nhận phiên bản đã áp dụng.
+// Các migration đều idempotent nên nhiều instance khởi động cùng lúc vẫn an toàn.
+func (s *MongoStore) Migrate() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	for i, status := range statuses {
+		if status.Applied {
+			continue
+		}
+		m := mongoMigrations[i]
+
+		ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+		err := m.Up(ctx, s.db)
+		if err == nil {
+			_, err = s.migrationsCollection().InsertOne(ctx, mongoMigrationRecord{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			})
+			if mongo.IsDuplicateKeyError(err) {
+				err = nil // instance khác vừa ghi nhận migration này
+			}
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) thất bại: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied MongoDB migration %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// MigrationStatus trả về trạng thái của mọi migration theo thứ tự phiên bản
+func (s *MongoStore) MigrationStatus() ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.migrationsCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []mongoMigrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time, len(records))
+	for _, r := range records {
+		applied[r.Version] = r.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(mongoMigrations))
+	for i, m := range mongoMigrations {
+		appliedAt, ok := applied[m.Version]
+		statuses[i] = MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+func createIndexes(ctx context.Context, coll *mongo.Collection, indexes ...mongo.IndexModel) error {
+	_, err := coll.Indexes().CreateMany(ctx, indexes)
+	if err != nil && mongo.IsDuplicateKeyError(err) {
+		return errors.New("dữ liệu hiện có vi phạm index unique")
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"webchat/store"
+	"webchat/store/storetest"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newMongoStore tạo một database MongoDB riêng cho mỗi kiểm thử và xóa nó khi kiểm thử kết thúc.
+// Kiểm thử bị bỏ qua nếu không có MONGODB_URI.
+func newMongoStore(t *testing.T) *store.MongoStore {
+	t.Helper()
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI chưa được thiết lập")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("mongo.Connect: %v", err)
+	}
+	db := client.Database("webchat_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+
+	s := store.NewMongoStore(db)
+	if _, err := s.DetectTransactions(ctx); err != nil {
+		t.Fatalf("DetectTransactions: %v", err)
+	}
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return s
+}
+
+func TestMongoUserStore(t *testing.T) {
+	storetest.RunUserStoreTests(t, func(t *testing.T) store.UserStore {
+		return newMongoStore(t)
+	})
+}
+
+func TestMongoChatStore(t *testing.T) {
+	storetest.RunChatStoreTests(t, func(t *testing.T) store.ChatStore {
+		return newMongoStore(t)
+	})
+}
@@ -0,0 +1,1702 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"webchat/models"
+	"webchat/search"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite" // driver "sqlite" thuần Go, không cần cgo
+)
+
+func init() {
+	// lower() của SQLite chỉ xử lý ký tự ASCII, unicode_lower dùng để so khớp tên tiếng Việt
+	sqlite.MustRegisterDeterministicScalarFunction("unicode_lower", 1,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			if text, ok := args[0].(string); ok {
+				return strings.ToLower(text), nil
+			}
+			return args[0], nil
+		})
+	// search_terms trả về mảng JSON các từ khóa tìm kiếm của nội dung, dùng với json_each khi tạo chỉ mục
+	sqlite.MustRegisterDeterministicScalarFunction("search_terms", 1,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			text, _ := args[0].(string)
+			terms, err := json.Marshal(search.Terms(text))
+			return string(terms), err
+		})
+}
+
+// SQLStore lưu trữ dữ liệu qua database/sql với SQLite.
+// SQLStore triển khai cả UserStore và ChatStore.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore mở (hoặc tạo mới) file SQLite tại path và áp dụng các migration còn thiếu
+func OpenSQLiteStore(path string) (*SQLStore, error) {
+	db, err := OpenSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSQLStore(db)
+	if err := s.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenSQLiteDB mở file SQLite tại path với các pragma mà SQLStore cần, không chạy migration
+func OpenSQLiteDB(path string) (*sql.DB, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("không thể tạo thư mục database: %w", err)
+		}
+	}
+
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite chỉ cho phép một writer, dùng một kết nối để tránh lỗi "database is locked"
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// NewSQLStore tạo store trên một kết nối database/sql đã mở.
+// Người gọi chịu trách nhiệm gọi Migrate trước khi sử dụng.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close đóng kết nối database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// rowScanner là phần chung của *sql.Row và *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const userColumns = `id, email, password, name, avatar, status, created_at, updated_at`
+
+func (s *SQLStore) CreateUser(ctx context.Context, user *models.User) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID.Hex(), user.Email, user.Password, user.Name, user.Avatar, user.Status,
+		toUnix(user.CreatedAt), toUnix(user.UpdatedAt))
+	if err != nil && isUniqueViolation(err, "users.email") {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (s *SQLStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+}
+
+func (s *SQLStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id.Hex()))
+}
+
+func (s *SQLStore) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.User, error) {
+	users := []*models.User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders(len(ids))+`)`, idArgs(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func scanUser(row rowScanner) (*models.User, error) {
+	var user models.User
+	var id string
+	var createdAt, updatedAt int64
+	err := row.Scan(&id, &user.Email, &user.Password, &user.Name, &user.Avatar, &user.Status, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, mapSQLError(err)
+	}
+
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	user.CreatedAt = fromUnix(createdAt)
+	user.UpdatedAt = fromUnix(updatedAt)
+	return &user, nil
+}
+
+func (s *SQLStore) UpdateUserProfile(ctx context.Context, id primitive.ObjectID, name, avatar string, updatedAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET name = ?, avatar = ?, updated_at = ? WHERE id = ?`,
+		name, avatar, toUnix(updatedAt), id.Hex())
+	return checkAffected(result, err)
+}
+
+func (s *SQLStore) UpdateUserStatus(ctx context.Context, id primitive.ObjectID, status models.UserStatus, updatedAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET status = ?, updated_at = ? WHERE id = ?`,
+		status, toUnix(updatedAt), id.Hex())
+	return checkAffected(result, err)
+}
+
+func (s *SQLStore) SearchUsers(ctx context.Context, query UserSearchQuery) ([]*models.User, error) {
+	users := []*models.User{}
+	if query.Text == "" {
+		return users, nil
+	}
+
+	// match_rank theo cùng quy tắc với UserSearchRank, 3 nghĩa là không khớp
+	text := escapeLike(query.Text)
+	substring := utf8.RuneCountInString(query.Text) >= MinUserSubstringLength
+	args := []interface{}{
+		query.Text, query.Text,
+		text + "%", text + "%", "% " + text + "%",
+		substring, "%" + text + "%", "%" + text + "%",
+	}
+	where := `match_rank < 3`
+	if len(query.Exclude) > 0 {
+		where += ` AND id NOT IN (` + placeholders(len(query.Exclude)) + `)`
+		args = append(args, idArgs(query.Exclude)...)
+	}
+	if query.After != nil {
+		where += ` AND (match_rank > ? OR (match_rank = ? AND (sort_name > ? OR (sort_name = ? AND id > ?))))`
+		args = append(args, query.After.Rank, query.After.Rank, query.After.Name, query.After.Name, query.After.ID.Hex())
+	}
+	args = append(args, sqlLimit(query.Limit))
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM (
+		SELECT `+userColumns+`, unicode_lower(name) AS sort_name, CASE
+			WHEN unicode_lower(name) = ? OR unicode_lower(email) = ? THEN 0
+			WHEN unicode_lower(name) LIKE ? ESCAPE '\' OR unicode_lower(email) LIKE ? ESCAPE '\'
+				OR unicode_lower(name) LIKE ? ESCAPE '\' THEN 1
+			WHEN ? AND (unicode_lower(name) LIKE ? ESCAPE '\' OR unicode_lower(email) LIKE ? ESCAPE '\') THEN 2
+			ELSE 3 END AS match_rank
+		FROM users)
+		WHERE `+where+`
+		ORDER BY match_rank, sort_name, id
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) BlockUser(ctx context.Context, block *models.UserBlock) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)`,
+		block.BlockerID.Hex(), block.BlockedID.Hex(), toUnix(block.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLStore) UnblockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?`,
+		blockerID.Hex(), blockedID.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLStore) ListBlocks(ctx context.Context, blockerID primitive.ObjectID) ([]*models.UserBlock, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT blocked_id, created_at FROM user_blocks
+		WHERE blocker_id = ?
+		ORDER BY created_at DESC, blocked_id`, blockerID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*models.UserBlock{}
+	for rows.Next() {
+		var blockedID string
+		var createdAt int64
+		if err := rows.Scan(&blockedID, &createdAt); err != nil {
+			return nil, err
+		}
+		block := &models.UserBlock{BlockerID: blockerID, CreatedAt: fromUnix(createdAt)}
+		if block.BlockedID, err = primitive.ObjectIDFromHex(blockedID); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+func (s *SQLStore) ListBlockerIDs(ctx context.Context, blockedID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT blocker_id FROM user_blocks WHERE blocked_id = ?`, blockedID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []primitive.ObjectID{}
+	for rows.Next() {
+		var idStr string
+		if err := rows.Scan(&idStr); err != nil {
+			return nil, err
+		}
+		id, err := primitive.ObjectIDFromHex(idStr)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLStore) RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO revoked_tokens (id, expires_at) VALUES (?, ?)`,
+		token.ID, toUnix(token.ExpiresAt))
+	return err
+}
+
+func (s *SQLStore) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, `SELECT 1 FROM revoked_tokens WHERE id = ?`, id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLStore) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	var deleted int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"revoked_tokens", "token_families"} {
+			result, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at < ?`, toUnix(before))
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += rows
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (s *SQLStore) CreateTokenFamily(ctx context.Context, family *models.TokenFamily) error {
+	var revokedAt interface{}
+	if family.RevokedAt != nil {
+		revokedAt = toUnix(*family.RevokedAt)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO token_families
+		(id, user_id, current_token_id, revoked_at, created_at, updated_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		family.ID.Hex(), family.UserID.Hex(), family.CurrentTokenID, revokedAt,
+		toUnix(family.CreatedAt), toUnix(family.UpdatedAt), toUnix(family.ExpiresAt))
+	return err
+}
+
+func (s *SQLStore) GetTokenFamily(ctx context.Context, id primitive.ObjectID) (*models.TokenFamily, error) {
+	var userID string
+	var revokedAt sql.NullInt64
+	var createdAt, updatedAt, expiresAt int64
+	family := &models.TokenFamily{ID: id}
+	err := s.db.QueryRowContext(ctx, `SELECT user_id, current_token_id, revoked_at, created_at, updated_at, expires_at
+		FROM token_families WHERE id = ?`, id.Hex()).
+		Scan(&userID, &family.CurrentTokenID, &revokedAt, &createdAt, &updatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if family.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		t := fromUnix(revokedAt.Int64)
+		family.RevokedAt = &t
+	}
+	family.CreatedAt = fromUnix(createdAt)
+	family.UpdatedAt = fromUnix(updatedAt)
+	family.ExpiresAt = fromUnix(expiresAt)
+	return family, nil
+}
+
+func (s *SQLStore) RotateTokenFamily(ctx context.Context, id primitive.ObjectID, oldTokenID, newTokenID string, expiresAt, updatedAt time.Time) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `UPDATE token_families SET current_token_id = ?, expires_at = ?, updated_at = ?
+		WHERE id = ? AND current_token_id = ? AND revoked_at IS NULL`,
+		newTokenID, toUnix(expiresAt), toUnix(updatedAt), id.Hex(), oldTokenID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) RevokeTokenFamily(ctx context.Context, id primitive.ObjectID, revokedAt time.Time) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `UPDATE token_families SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		toUnix(revokedAt), id.Hex())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) CreateSession(ctx context.Context, session *models.Session) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sessions (id, user_id, device, user_agent, ip, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.ID.Hex(), session.UserID.Hex(), session.Device, session.UserAgent, session.IP,
+		toUnix(session.CreatedAt), toUnix(session.LastUsedAt))
+	return err
+}
+
+func (s *SQLStore) GetSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error) {
+	return scanSession(s.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id.Hex()))
+}
+
+func (s *SQLStore) ListSessions(ctx context.Context, userID primitive.ObjectID) ([]*models.Session, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ?
+		ORDER BY last_used_at DESC, id`, userID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLStore) TouchSession(ctx context.Context, id primitive.ObjectID, ip string, lastUsedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET ip = ?, last_used_at = ? WHERE id = ?`,
+		ip, toUnix(lastUsedAt), id.Hex())
+	return err
+}
+
+func (s *SQLStore) DeleteSession(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (s *SQLStore) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE last_used_at < ?`, toUnix(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const sessionColumns = `id, user_id, device, user_agent, ip, created_at, last_used_at`
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	var id, userID string
+	var createdAt, lastUsedAt int64
+	session := &models.Session{}
+	err := row.Scan(&id, &userID, &session.Device, &session.UserAgent, &session.IP, &createdAt, &lastUsedAt)
+	if err != nil {
+		return nil, mapSQLError(err)
+	}
+
+	if session.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	if session.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return nil, err
+	}
+	session.CreatedAt = fromUnix(createdAt)
+	session.LastUsedAt = fromUnix(lastUsedAt)
+	return session, nil
+}
+
+func (s *SQLStore) CreateConversation(ctx context.Context, conv *models.Conversation) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var lastMessageID interface{}
+		if conv.LastMessage != nil {
+			lastMessageID = conv.LastMessage.ID.Hex()
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO conversations (id, type, name, image, last_message_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			conv.ID.Hex(), conv.Type, conv.Name, conv.Image, lastMessageID,
+			toUnix(conv.CreatedAt), toUnix(conv.UpdatedAt))
+		if err != nil {
+			return err
+		}
+
+		for i, participantID := range conv.Participants {
+			_, err := tx.ExecContext(ctx, `INSERT INTO conversation_participants (conversation_id, user_id, position, is_admin)
+				VALUES (?, ?, ?, ?)`,
+				conv.ID.Hex(), participantID.Hex(), i, containsID(conv.Admins, participantID))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const conversationColumns = `c.id, c.type, c.name, c.image, c.last_message_id, c.created_at, c.updated_at`
+
+func (s *SQLStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*models.Conversation, error) {
+	return s.findConversation(ctx, `SELECT `+conversationColumns+` FROM conversations c WHERE c.id = ?`, id.Hex())
+}
+
+func (s *SQLStore) FindPersonalConversation(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.Conversation, error) {
+	return s.findConversation(ctx, `SELECT `+conversationColumns+` FROM conversations c
+		WHERE c.type = ?
+		AND EXISTS (SELECT 1 FROM conversation_participants p WHERE p.conversation_id = c.id AND p.user_id = ?)
+		AND EXISTS (SELECT 1 FROM conversation_participants p WHERE p.conversation_id = c.id AND p.user_id = ?)
+		AND (SELECT COUNT(*) FROM conversation_participants p WHERE p.conversation_id = c.id) = 2
+		LIMIT 1`,
+		models.ConversationTypePersonal, userID1.Hex(), userID2.Hex())
+}
+
+func (s *SQLStore) findConversation(ctx context.Context, query string, args ...interface{}) (*models.Conversation, error) {
+	convs, err := s.queryConversations(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(convs) == 0 {
+		return nil, ErrNotFound
+	}
+	return convs[0], nil
+}
+
+func (s *SQLStore) ListConversations(ctx context.Context, userID primitive.ObjectID, query ConversationQuery) ([]*models.Conversation, error) {
+	where := `p.user_id = ?`
+	args := []interface{}{userID.Hex()}
+	if query.Type != "" {
+		where += ` AND c.type = ?`
+		args = append(args, query.Type)
+	}
+	if query.UnreadOnly {
+		where += ` AND p.unread_count > 0`
+	}
+	if query.NamePrefix != "" {
+		where += ` AND unicode_lower(c.name) LIKE ? ESCAPE '\'`
+		args = append(args, escapeLike(strings.ToLower(query.NamePrefix))+"%")
+	}
+	if query.After != nil {
+		where += ` AND (c.updated_at < ? OR (c.updated_at = ? AND c.id < ?))`
+		updatedAt := toUnix(query.After.UpdatedAt)
+		args = append(args, updatedAt, updatedAt, query.After.ID.Hex())
+	}
+	args = append(args, sqlLimit(query.Limit))
+
+	return s.queryConversations(ctx, `SELECT `+conversationColumns+` FROM conversations c
+		JOIN conversation_participants p ON p.conversation_id = c.id
+		WHERE `+where+`
+		ORDER BY c.updated_at DESC, c.id DESC
+		LIMIT ?`, args...)
+}
+
+// queryConversations đọc các cuộc hội thoại rồi nạp thành viên và tin nhắn cuối theo lô
+func (s *SQLStore) queryConversations(ctx context.Context, query string, args ...interface{}) ([]*models.Conversation, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []*models.Conversation{}
+	byID := make(map[string]*models.Conversation)
+	lastMessageIDs := make(map[string][]*models.Conversation)
+	for rows.Next() {
+		var conv models.Conversation
+		var id string
+		var lastMessageID sql.NullString
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&id, &conv.Type, &conv.Name, &conv.Image, &lastMessageID, &createdAt, &updatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if conv.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conv.Participants = []primitive.ObjectID{}
+		conv.CreatedAt = fromUnix(createdAt)
+		conv.UpdatedAt = fromUnix(updatedAt)
+
+		conversations = append(conversations, &conv)
+		byID[id] = &conv
+		if lastMessageID.Valid {
+			lastMessageIDs[lastMessageID.String] = append(lastMessageIDs[lastMessageID.String], &conv)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return conversations, nil
+	}
+
+	if err := s.loadParticipants(ctx, byID); err != nil {
+		return nil, err
+	}
+
+	if len(lastMessageIDs) > 0 {
+		ids := make([]string, 0, len(lastMessageIDs))
+		for id := range lastMessageIDs {
+			ids = append(ids, id)
+		}
+		messages, err := s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE id IN (`+placeholders(len(ids))+`)`, stringArgs(ids)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			for _, conv := range lastMessageIDs[msg.ID.Hex()] {
+				conv.LastMessage = msg
+			}
+		}
+	}
+
+	return conversations, nil
+}
+
+func (s *SQLStore) loadParticipants(ctx context.Context, byID map[string]*models.Conversation) error {
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT conversation_id, user_id, is_admin, unread_count, thread_opt_in FROM conversation_participants
+		WHERE conversation_id IN (`+placeholders(len(ids))+`)
+		ORDER BY conversation_id, position`, stringArgs(ids)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var convID, userHex string
+		var isAdmin, threadOptIn bool
+		var unread int64
+		if err := rows.Scan(&convID, &userHex, &isAdmin, &unread, &threadOptIn); err != nil {
+			return err
+		}
+		userID, err := primitive.ObjectIDFromHex(userHex)
+		if err != nil {
+			return err
+		}
+
+		conv := byID[convID]
+		conv.Participants = append(conv.Participants, userID)
+		if isAdmin {
+			conv.Admins = append(conv.Admins, userID)
+		}
+		if threadOptIn {
+			conv.ThreadOptIns = append(conv.ThreadOptIns, userID)
+		}
+		if unread > 0 {
+			if conv.UnreadCounts == nil {
+				conv.UnreadCounts = make(map[string]int64)
+			}
+			conv.UnreadCounts[userHex] = unread
+		}
+	}
+	return rows.Err()
+}
+
+const messageColumns = `id, type, kind, conversation_id, group_id, sender_id, reply_to_id, thread_root_id, content, status,
+	is_deleted, deleted_at, deleted_by, edited_at, edit_history, attachments, thread_reply_count, thread_last_reply_at, created_at, updated_at`
+
+func (s *SQLStore) SaveMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if msg.IsThreadReply() {
+			if err := addThreadReply(ctx, tx, msg); err != nil {
+				return err
+			}
+		} else {
+			result, err := tx.ExecContext(ctx, `UPDATE conversations SET last_message_id = ?, updated_at = ? WHERE id = ?`,
+				msg.ID.Hex(), toUnix(msg.CreatedAt), msg.ConversationID.Hex())
+			if err := checkAffected(result, err); err != nil {
+				return err
+			}
+		}
+
+		groupID, replyToID, threadRootID := "", "", ""
+		if !msg.GroupID.IsZero() {
+			groupID = msg.GroupID.Hex()
+		}
+		if !msg.ReplyToID.IsZero() {
+			replyToID = msg.ReplyToID.Hex()
+		}
+		if msg.IsThreadReply() {
+			threadRootID = msg.ThreadRootID.Hex()
+		}
+		var threadLastReplyAt interface{}
+		if msg.ThreadLastReplyAt != nil {
+			threadLastReplyAt = toUnix(*msg.ThreadLastReplyAt)
+		}
+
+		deletedAt, deletedBy := messageDeleteArgs(msg)
+		editedAt, editHistory, err := messageEditArgs(msg)
+		if err != nil {
+			return err
+		}
+		attachments, err := messageAttachmentsArg(msg)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO messages (`+messageColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			msg.ID.Hex(), msg.Type, msg.Kind, msg.ConversationID.Hex(), groupID, msg.SenderID.Hex(), replyToID, threadRootID,
+			msg.Content, msg.Status, msg.IsDeleted, deletedAt, deletedBy, editedAt, editHistory, attachments,
+			msg.ThreadReplyCount, threadLastReplyAt, toUnix(msg.CreatedAt), toUnix(msg.UpdatedAt))
+		if err != nil {
+			return err
+		}
+
+		// Điều kiện message_id = '' bảo đảm mỗi tệp chỉ được gắn vào một tin nhắn
+		for _, ref := range msg.Attachments {
+			result, err := tx.ExecContext(ctx, `UPDATE attachments SET conversation_id = ?, message_id = ?
+				WHERE id = ? AND uploader_id = ? AND message_id = ''`,
+				msg.ConversationID.Hex(), msg.ID.Hex(), ref.ID.Hex(), msg.SenderID.Hex())
+			if err := checkAffected(result, err); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return ErrAttachmentUnavailable
+				}
+				return err
+			}
+		}
+
+		for _, userID := range msg.ReadBy {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_reads (message_id, user_id) VALUES (?, ?)`,
+				msg.ID.Hex(), userID.Hex()); err != nil {
+				return err
+			}
+		}
+		for _, userID := range msg.PlayedBy {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_plays (message_id, user_id) VALUES (?, ?)`,
+				msg.ID.Hex(), userID.Hex()); err != nil {
+				return err
+			}
+		}
+		for _, userID := range msg.HiddenFor {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_hides (message_id, user_id) VALUES (?, ?)`,
+				msg.ID.Hex(), userID.Hex()); err != nil {
+				return err
+			}
+		}
+		for _, userID := range msg.UnreadExempt {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_unread_exemptions (message_id, user_id) VALUES (?, ?)`,
+				msg.ID.Hex(), userID.Hex()); err != nil {
+				return err
+			}
+		}
+		for _, reaction := range msg.Reactions {
+			if _, err := insertReaction(ctx, tx, msg.ID, reaction); err != nil {
+				return err
+			}
+		}
+		if !msg.IsDeleted {
+			if err := insertMessageTerms(ctx, tx, msg.ID, msg.Content); err != nil {
+				return err
+			}
+		}
+
+		// Tăng số tin chưa đọc của các thành viên khác người gửi, chưa đọc tin nhắn và không chặn người gửi
+		if !msg.IsDeleted && !msg.IsThreadReply() {
+			readers := append([]primitive.ObjectID{msg.SenderID}, msg.ReadBy...)
+			readers = append(readers, msg.UnreadExempt...)
+			_, err = tx.ExecContext(ctx, `UPDATE conversation_participants SET unread_count = unread_count + 1
+				WHERE conversation_id = ? AND user_id NOT IN (`+placeholders(len(readers))+`)`,
+				append([]interface{}{msg.ConversationID.Hex()}, idArgs(readers)...)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return insertOutboxEvents(ctx, tx, events)
+	})
+}
+
+// addThreadReply cập nhật thống kê thread và người theo dõi của tin nhắn gốc trước khi lưu tin trả lời
+func addThreadReply(ctx context.Context, tx *sql.Tx, msg *models.Message) error {
+	rootID := msg.ThreadRootID.Hex()
+	var rootSender string
+	var replyCount int64
+	err := tx.QueryRowContext(ctx, `SELECT sender_id, thread_reply_count FROM messages WHERE id = ? AND conversation_id = ?`,
+		rootID, msg.ConversationID.Hex()).Scan(&rootSender, &replyCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	followers := []string{msg.SenderID.Hex()}
+	if replyCount == 0 {
+		followers = append(followers, rootSender)
+	}
+	for _, userID := range followers {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO thread_followers (root_id, user_id) VALUES (?, ?)`,
+			rootID, userID); err != nil {
+			return err
+		}
+	}
+
+	skipped := append([]primitive.ObjectID{msg.SenderID}, msg.UnreadExempt...)
+	_, err = tx.ExecContext(ctx, `UPDATE thread_followers SET unread_count = unread_count + 1
+		WHERE root_id = ? AND user_id NOT IN (`+placeholders(len(skipped))+`)`,
+		append([]interface{}{rootID}, idArgs(skipped)...)...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE messages SET thread_reply_count = thread_reply_count + 1, thread_last_reply_at = ? WHERE id = ?`,
+		toUnix(msg.CreatedAt), rootID)
+	return err
+}
+
+func (s *SQLStore) EditMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	editedAt, editHistory, err := messageEditArgs(msg)
+	if err != nil {
+		return err
+	}
+
+	// Tin nhắn cuối của cuộc hội thoại được đọc qua last_message_id nên không cần cập nhật thêm.
+	// Điều kiện is_deleted ngăn một lần sửa đồng thời với thu hồi khôi phục nội dung tin nhắn.
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE messages SET content = ?, edited_at = ?, edit_history = ?, updated_at = ? WHERE id = ? AND is_deleted = 0`,
+			msg.Content, editedAt, editHistory, toUnix(msg.UpdatedAt), msg.ID.Hex())
+		if err := checkAffected(result, err); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_terms WHERE message_id = ?`, msg.ID.Hex()); err != nil {
+			return err
+		}
+		if err := insertMessageTerms(ctx, tx, msg.ID, msg.Content); err != nil {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+}
+
+func (s *SQLStore) DeleteMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error {
+	deletedAt, deletedBy := messageDeleteArgs(msg)
+	_, editHistory, err := messageEditArgs(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		// Điều kiện is_deleted bảo đảm số tin chưa đọc chỉ bị trừ một lần
+		result, err := tx.ExecContext(ctx, `UPDATE messages SET is_deleted = 1, content = ?, edit_history = ?, attachments = '[]',
+			deleted_at = ?, deleted_by = ?, updated_at = ?
+			WHERE id = ? AND is_deleted = 0`,
+			msg.Content, editHistory, deletedAt, deletedBy, toUnix(msg.UpdatedAt), msg.ID.Hex())
+		if err := checkAffected(result, err); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_reactions WHERE message_id = ?`, msg.ID.Hex()); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_terms WHERE message_id = ?`, msg.ID.Hex()); err != nil {
+			return err
+		}
+
+		// Trừ số tin chưa đọc của các thành viên khác người gửi và chưa đọc tin nhắn;
+		// tin trả lời trong thread không được tính vào số tin chưa đọc của cuộc hội thoại
+		_, err = tx.ExecContext(ctx, `UPDATE conversation_participants SET unread_count = MAX(unread_count - 1, 0)
+			WHERE conversation_id = (SELECT conversation_id FROM messages WHERE id = ? AND thread_root_id = '')
+			AND user_id != (SELECT sender_id FROM messages WHERE id = ?)
+			AND NOT EXISTS (SELECT 1 FROM message_reads r
+				WHERE r.message_id = ? AND r.user_id = conversation_participants.user_id)
+			AND NOT EXISTS (SELECT 1 FROM message_unread_exemptions e
+				WHERE e.message_id = ? AND e.user_id = conversation_participants.user_id)`,
+			msg.ID.Hex(), msg.ID.Hex(), msg.ID.Hex(), msg.ID.Hex())
+		if err != nil {
+			return err
+		}
+
+		return insertOutboxEvents(ctx, tx, events)
+	})
+}
+
+func (s *SQLStore) HideMessage(ctx context.Context, id, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := messageExists(ctx, tx, id); err != nil {
+			return err
+		}
+
+		// Tin nhắn đã xóa ở phía mình không còn được tính là chưa đọc
+		if err := markMessagesRead(ctx, tx, []primitive.ObjectID{id}, userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_hides (message_id, user_id) VALUES (?, ?)`,
+			id.Hex(), userID.Hex())
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+}
+
+func (s *SQLStore) MarkMessagePlayed(ctx context.Context, messageID, userID primitive.ObjectID, events []*models.OutboxEvent) (bool, error) {
+	var played bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, `SELECT 1 FROM messages WHERE id = ? AND is_deleted = 0`, messageID.Hex()).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_plays (message_id, user_id) VALUES (?, ?)`,
+			messageID.Hex(), userID.Hex())
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil || affected == 0 {
+			return err
+		}
+		played = true
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	return played, err
+}
+
+func (s *SQLStore) AddReaction(ctx context.Context, messageID primitive.ObjectID, reaction models.Reaction, events []*models.OutboxEvent) (bool, error) {
+	var added bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, `SELECT 1 FROM messages WHERE id = ? AND is_deleted = 0`, messageID.Hex()).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if added, err = insertReaction(ctx, tx, messageID, reaction); err != nil || !added {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	return added, err
+}
+
+func (s *SQLStore) RemoveReaction(ctx context.Context, messageID, userID primitive.ObjectID, emoji string, events []*models.OutboxEvent) (bool, error) {
+	var removed bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := messageExists(ctx, tx, messageID); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`,
+			messageID.Hex(), userID.Hex(), emoji)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		removed = true
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	return removed, err
+}
+
+// insertMessageTerms thêm các từ khóa tìm kiếm trong nội dung tin nhắn vào bảng message_terms
+func insertMessageTerms(ctx context.Context, tx *sql.Tx, messageID primitive.ObjectID, content string) error {
+	for _, term := range search.Terms(content) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO message_terms (term, message_id) VALUES (?, ?)`,
+			term, messageID.Hex()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertReaction ghi reaction nếu người dùng chưa thả emoji đó và cho biết đã ghi hay chưa
+func insertReaction(ctx context.Context, tx *sql.Tx, messageID primitive.ObjectID, reaction models.Reaction) (bool, error) {
+	result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)`,
+		messageID.Hex(), reaction.UserID.Hex(), reaction.Emoji, toUnix(reaction.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLStore) FollowThread(ctx context.Context, rootID, userID primitive.ObjectID, follow bool) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := messageExists(ctx, tx, rootID); err != nil {
+			return err
+		}
+
+		query := `INSERT OR IGNORE INTO thread_followers (root_id, user_id) VALUES (?, ?)`
+		if !follow {
+			query = `DELETE FROM thread_followers WHERE root_id = ? AND user_id = ?`
+		}
+		_, err := tx.ExecContext(ctx, query, rootID.Hex(), userID.Hex())
+		return err
+	})
+}
+
+func (s *SQLStore) MarkThreadRead(ctx context.Context, rootID, userID primitive.ObjectID) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := messageExists(ctx, tx, rootID); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `UPDATE thread_followers SET unread_count = 0 WHERE root_id = ? AND user_id = ?`,
+			rootID.Hex(), userID.Hex())
+		return err
+	})
+}
+
+func (s *SQLStore) SetThreadOptIn(ctx context.Context, conversationID, userID primitive.ObjectID, enabled bool) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE conversation_participants SET thread_opt_in = ? WHERE conversation_id = ? AND user_id = ?`,
+		enabled, conversationID.Hex(), userID.Hex())
+	return checkAffected(result, err)
+}
+
+const attachmentColumns = `id, uploader_id, conversation_id, message_id, storage_key, filename, content_type, size,
+	image, thumbnail_key, thumbnail_content_type, audio, created_at`
+
+func (s *SQLStore) CreateAttachment(ctx context.Context, attachment *models.Attachment) error {
+	conversationID, messageID := "", ""
+	if !attachment.ConversationID.IsZero() {
+		conversationID = attachment.ConversationID.Hex()
+	}
+	if attachment.IsAttached() {
+		messageID = attachment.MessageID.Hex()
+	}
+	// Thông tin ảnh và âm thanh được lưu dạng JSON, chuỗi rỗng nếu không có
+	var image, audio string
+	if attachment.Image != nil {
+		data, err := json.Marshal(attachment.Image)
+		if err != nil {
+			return err
+		}
+		image = string(data)
+	}
+	if attachment.Audio != nil {
+		data, err := json.Marshal(attachment.Audio)
+		if err != nil {
+			return err
+		}
+		audio = string(data)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO attachments (`+attachmentColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		attachment.ID.Hex(), attachment.UploaderID.Hex(), conversationID, messageID, attachment.Key,
+		attachment.Filename, attachment.ContentType, attachment.Size,
+		image, attachment.ThumbnailKey, attachment.ThumbnailType, audio, toUnix(attachment.CreatedAt))
+	return err
+}
+
+func (s *SQLStore) GetAttachment(ctx context.Context, id primitive.ObjectID) (*models.Attachment, error) {
+	var attachment models.Attachment
+	var attachmentID, uploaderID, conversationID, messageID, image, audio string
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id.Hex()).Scan(
+		&attachmentID, &uploaderID, &conversationID, &messageID, &attachment.Key,
+		&attachment.Filename, &attachment.ContentType, &attachment.Size,
+		&image, &attachment.ThumbnailKey, &attachment.ThumbnailType, &audio, &createdAt)
+	if err != nil {
+		return nil, mapSQLError(err)
+	}
+
+	if attachment.ID, err = primitive.ObjectIDFromHex(attachmentID); err != nil {
+		return nil, err
+	}
+	if attachment.UploaderID, err = primitive.ObjectIDFromHex(uploaderID); err != nil {
+		return nil, err
+	}
+	if conversationID != "" {
+		if attachment.ConversationID, err = primitive.ObjectIDFromHex(conversationID); err != nil {
+			return nil, err
+		}
+	}
+	if messageID != "" {
+		if attachment.MessageID, err = primitive.ObjectIDFromHex(messageID); err != nil {
+			return nil, err
+		}
+	}
+	if image != "" {
+		if err := json.Unmarshal([]byte(image), &attachment.Image); err != nil {
+			return nil, err
+		}
+	}
+	if audio != "" {
+		if err := json.Unmarshal([]byte(audio), &attachment.Audio); err != nil {
+			return nil, err
+		}
+	}
+	attachment.CreatedAt = fromUnix(createdAt)
+	return &attachment, nil
+}
+
+func (s *SQLStore) DeleteAttachments(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM attachments WHERE id IN (`+placeholders(len(ids))+`)`, idArgs(ids)...)
+	return err
+}
+
+const friendRequestColumns = `id, sender_id, recipient_id, pair_key, status, created_at, updated_at`
+
+func (s *SQLStore) CreateFriendRequest(ctx context.Context, req *models.FriendRequest, events []*models.OutboxEvent) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO friend_requests (`+friendRequestColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			req.ID.Hex(), req.SenderID.Hex(), req.RecipientID.Hex(), req.PairKey, req.Status,
+			toUnix(req.CreatedAt), toUnix(req.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	if err != nil && isUniqueViolation(err, "friend_requests.pair_key") {
+		return ErrDuplicateFriendRequest
+	}
+	return err
+}
+
+func (s *SQLStore) GetFriendRequest(ctx context.Context, id primitive.ObjectID) (*models.FriendRequest, error) {
+	return scanFriendRequest(s.db.QueryRowContext(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests WHERE id = ?`, id.Hex()))
+}
+
+func (s *SQLStore) FindFriendRequest(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.FriendRequest, error) {
+	return scanFriendRequest(s.db.QueryRowContext(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests WHERE pair_key = ?`,
+		models.FriendPairKey(userID1, userID2)))
+}
+
+func (s *SQLStore) ListFriendRequests(ctx context.Context, userID primitive.ObjectID, status models.FriendRequestStatus) ([]*models.FriendRequest, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE (sender_id = ? OR recipient_id = ?) AND status = ?
+		ORDER BY id DESC`, userID.Hex(), userID.Hex(), status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*models.FriendRequest{}
+	for rows.Next() {
+		req, err := scanFriendRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+func scanFriendRequest(row rowScanner) (*models.FriendRequest, error) {
+	var req models.FriendRequest
+	var id, senderID, recipientID string
+	var createdAt, updatedAt int64
+	err := row.Scan(&id, &senderID, &recipientID, &req.PairKey, &req.Status, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, mapSQLError(err)
+	}
+
+	if req.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	if req.SenderID, err = primitive.ObjectIDFromHex(senderID); err != nil {
+		return nil, err
+	}
+	if req.RecipientID, err = primitive.ObjectIDFromHex(recipientID); err != nil {
+		return nil, err
+	}
+	req.CreatedAt = fromUnix(createdAt)
+	req.UpdatedAt = fromUnix(updatedAt)
+	return &req, nil
+}
+
+func (s *SQLStore) AcceptFriendRequest(ctx context.Context, id primitive.ObjectID, acceptedAt time.Time, events []*models.OutboxEvent) (bool, error) {
+	var accepted bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE friend_requests SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+			models.FriendRequestAccepted, toUnix(acceptedAt), id.Hex(), models.FriendRequestPending)
+		if accepted, err = friendRequestChanged(ctx, tx, id, result, err); err != nil || !accepted {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	return accepted, err
+}
+
+func (s *SQLStore) DeleteFriendRequest(ctx context.Context, id primitive.ObjectID, status models.FriendRequestStatus, events []*models.OutboxEvent) (bool, error) {
+	var deleted bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `DELETE FROM friend_requests WHERE id = ? AND status = ?`, id.Hex(), status)
+		if deleted, err = friendRequestChanged(ctx, tx, id, result, err); err != nil || !deleted {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+	return deleted, err
+}
+
+// friendRequestChanged trả về true nếu câu lệnh có điều kiện trạng thái đã thay đổi lời mời id,
+// false nếu lời mời có trạng thái khác và ErrNotFound nếu lời mời không tồn tại
+func friendRequestChanged(ctx context.Context, tx *sql.Tx, id primitive.ObjectID, result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	var exists int
+	err = tx.QueryRowContext(ctx, `SELECT 1 FROM friend_requests WHERE id = ?`, id.Hex()).Scan(&exists)
+	return false, mapSQLError(err)
+}
+
+// messageExists trả về ErrNotFound nếu tin nhắn không tồn tại
+func messageExists(ctx context.Context, tx *sql.Tx, id primitive.ObjectID) error {
+	var exists int
+	err := tx.QueryRowContext(ctx, `SELECT 1 FROM messages WHERE id = ?`, id.Hex()).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// messageDeleteArgs chuyển thời điểm thu hồi (NULL nếu chưa thu hồi) và người thu hồi sang giá trị cột
+func messageDeleteArgs(msg *models.Message) (interface{}, string) {
+	var deletedAt interface{}
+	if msg.DeletedAt != nil {
+		deletedAt = toUnix(*msg.DeletedAt)
+	}
+	deletedBy := ""
+	if !msg.DeletedBy.IsZero() {
+		deletedBy = msg.DeletedBy.Hex()
+	}
+	return deletedAt, deletedBy
+}
+
+// messageEditArgs chuyển thời điểm sửa (NULL nếu chưa sửa) và lịch sử sửa (mảng JSON) sang giá trị cột
+func messageEditArgs(msg *models.Message) (interface{}, string, error) {
+	var editedAt interface{}
+	if msg.EditedAt != nil {
+		editedAt = toUnix(*msg.EditedAt)
+	}
+
+	history := msg.EditHistory
+	if history == nil {
+		history = []models.MessageEdit{}
+	}
+	editHistory, err := json.Marshal(history)
+	if err != nil {
+		return nil, "", err
+	}
+	return editedAt, string(editHistory), nil
+}
+
+// messageAttachmentsArg chuyển danh sách tệp đính kèm sang giá trị cột (mảng JSON)
+func messageAttachmentsArg(msg *models.Message) (string, error) {
+	attachments := msg.Attachments
+	if attachments == nil {
+		attachments = []models.AttachmentRef{}
+	}
+	data, err := json.Marshal(attachments)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (s *SQLStore) GetMessage(ctx context.Context, id primitive.ObjectID) (*models.Message, error) {
+	messages, err := s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrNotFound
+	}
+	return messages[0], nil
+}
+
+func (s *SQLStore) GetMessagesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.Message, error) {
+	if len(ids) == 0 {
+		return []*models.Message{}, nil
+	}
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE id IN (`+placeholders(len(ids))+`)`, idArgs(ids)...)
+}
+
+func (s *SQLStore) ListMessages(ctx context.Context, conversationID primitive.ObjectID, query MessageQuery) ([]*models.Message, error) {
+	// ID được lưu dạng hex cùng độ dài nên so sánh chuỗi cho cùng thứ tự với ObjectID
+	where := `conversation_id = ? AND thread_root_id = ?`
+	args := []interface{}{conversationID.Hex(), ""}
+	if !query.ThreadRootID.IsZero() {
+		args[1] = query.ThreadRootID.Hex()
+	}
+	if !query.Viewer.IsZero() {
+		where += ` AND NOT EXISTS (SELECT 1 FROM message_hides h WHERE h.message_id = messages.id AND h.user_id = ?)`
+		args = append(args, query.Viewer.Hex())
+	}
+	if len(query.ExcludeSenders) > 0 {
+		where += ` AND sender_id NOT IN (` + placeholders(len(query.ExcludeSenders)) + `)`
+		args = append(args, idArgs(query.ExcludeSenders)...)
+	}
+	if !query.Before.IsZero() {
+		where += ` AND id < ?`
+		args = append(args, query.Before.Hex())
+	}
+	if !query.After.IsZero() {
+		where += ` AND id > ?`
+		args = append(args, query.After.Hex())
+	}
+
+	order := `DESC`
+	if query.Ascending {
+		order = `ASC`
+	}
+	args = append(args, sqlLimit(query.Limit))
+
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE `+where+`
+		ORDER BY id `+order+`
+		LIMIT ?`, args...)
+}
+
+func (s *SQLStore) SearchMessages(ctx context.Context, query MessageSearchQuery) ([]*models.Message, error) {
+	if len(query.Terms) == 0 {
+		return []*models.Message{}, nil
+	}
+
+	// Bảng message_terms là chỉ mục ngược: tin nhắn khớp khi có đủ số dòng của các từ khóa khác nhau
+	where := `id IN (SELECT message_id FROM message_terms WHERE term IN (` + placeholders(len(query.Terms)) + `)
+			GROUP BY message_id HAVING COUNT(*) = ?)
+		AND is_deleted = 0
+		AND conversation_id IN (SELECT conversation_id FROM conversation_participants WHERE user_id = ?)
+		AND NOT EXISTS (SELECT 1 FROM message_hides h WHERE h.message_id = messages.id AND h.user_id = ?)`
+	args := append(stringArgs(query.Terms), len(query.Terms), query.Viewer.Hex(), query.Viewer.Hex())
+	if !query.ConversationID.IsZero() {
+		where += ` AND conversation_id = ?`
+		args = append(args, query.ConversationID.Hex())
+	}
+	if !query.SenderID.IsZero() {
+		where += ` AND sender_id = ?`
+		args = append(args, query.SenderID.Hex())
+	}
+	if len(query.ExcludeSenders) > 0 {
+		where += ` AND sender_id NOT IN (` + placeholders(len(query.ExcludeSenders)) + `)`
+		args = append(args, idArgs(query.ExcludeSenders)...)
+	}
+	if !query.Since.IsZero() {
+		where += ` AND created_at >= ?`
+		args = append(args, toUnix(query.Since))
+	}
+	if !query.Until.IsZero() {
+		where += ` AND created_at < ?`
+		args = append(args, toUnix(query.Until))
+	}
+	if query.HasAttachment {
+		where += ` AND attachments != '[]'`
+	}
+	if !query.Before.IsZero() {
+		where += ` AND id < ?`
+		args = append(args, query.Before.Hex())
+	}
+	args = append(args, sqlLimit(query.Limit))
+
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ?`, args...)
+}
+
+// queryMessages đọc các tin nhắn rồi nạp danh sách người đã đọc trong một truy vấn
+func (s *SQLStore) queryMessages(ctx context.Context, query string, args ...interface{}) ([]*models.Message, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*models.Message{}
+	byID := make(map[string]*models.Message)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+		byID[msg.ID.Hex()] = msg
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	// Người đã đọc, đã nghe, đã xóa tin nhắn ở phía mình, không tính tin nhắn là chưa đọc,
+	// người theo dõi thread và reaction được đọc cùng một truy vấn
+	var userArgs []interface{}
+	for i := 0; i < 6; i++ {
+		userArgs = append(userArgs, stringArgs(ids)...)
+	}
+	userRows, err := s.db.QueryContext(ctx, `SELECT 'read', message_id, user_id, 0, '', rowid FROM message_reads
+		WHERE message_id IN (`+placeholders(len(ids))+`)
+		UNION ALL
+		SELECT 'play', message_id, user_id, 0, '', rowid FROM message_plays
+		WHERE message_id IN (`+placeholders(len(ids))+`)
+		UNION ALL
+		SELECT 'hide', message_id, user_id, 0, '', rowid FROM message_hides
+		WHERE message_id IN (`+placeholders(len(ids))+`)
+		UNION ALL
+		SELECT 'exempt', message_id, user_id, 0, '', rowid FROM message_unread_exemptions
+		WHERE message_id IN (`+placeholders(len(ids))+`)
+		UNION ALL
+		SELECT 'follow', root_id, user_id, unread_count, '', rowid FROM thread_followers
+		WHERE root_id IN (`+placeholders(len(ids))+`)
+		UNION ALL
+		SELECT 'react', message_id, user_id, created_at, emoji, rowid FROM message_reactions
+		WHERE message_id IN (`+placeholders(len(ids))+`)
+		ORDER BY 6`, userArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer userRows.Close()
+
+	for userRows.Next() {
+		var kind, msgID, userHex, emoji string
+		var number, rowID int64
+		if err := userRows.Scan(&kind, &msgID, &userHex, &number, &emoji, &rowID); err != nil {
+			return nil, err
+		}
+		userID, err := primitive.ObjectIDFromHex(userHex)
+		if err != nil {
+			return nil, err
+		}
+		msg := byID[msgID]
+		switch kind {
+		case "read":
+			msg.ReadBy = append(msg.ReadBy, userID)
+		case "play":
+			msg.PlayedBy = append(msg.PlayedBy, userID)
+		case "hide":
+			msg.HiddenFor = append(msg.HiddenFor, userID)
+		case "exempt":
+			msg.UnreadExempt = append(msg.UnreadExempt, userID)
+		case "follow":
+			msg.ThreadFollowers = append(msg.ThreadFollowers, userID)
+			if number > 0 {
+				if msg.ThreadUnreadCounts == nil {
+					msg.ThreadUnreadCounts = make(map[string]int64)
+				}
+				msg.ThreadUnreadCounts[userHex] = number
+			}
+		case "react":
+			msg.Reactions = append(msg.Reactions, models.Reaction{Emoji: emoji, UserID: userID, CreatedAt: fromUnix(number)})
+		}
+	}
+	return messages, userRows.Err()
+}
+
+func scanMessage(row rowScanner) (*models.Message, error) {
+	var msg models.Message
+	var id, convID, groupID, senderID, replyToID, threadRootID string
+	var createdAt, updatedAt int64
+	var deletedAt, editedAt, threadLastReplyAt sql.NullInt64
+	var deletedBy, editHistory, attachments string
+	err := row.Scan(&id, &msg.Type, &msg.Kind, &convID, &groupID, &senderID, &replyToID, &threadRootID, &msg.Content, &msg.Status,
+		&msg.IsDeleted, &deletedAt, &deletedBy, &editedAt, &editHistory, &attachments, &msg.ThreadReplyCount, &threadLastReplyAt,
+		&createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	if msg.ConversationID, err = primitive.ObjectIDFromHex(convID); err != nil {
+		return nil, err
+	}
+	if msg.SenderID, err = primitive.ObjectIDFromHex(senderID); err != nil {
+		return nil, err
+	}
+	if groupID != "" {
+		if msg.GroupID, err = primitive.ObjectIDFromHex(groupID); err != nil {
+			return nil, err
+		}
+	}
+	if replyToID != "" {
+		if msg.ReplyToID, err = primitive.ObjectIDFromHex(replyToID); err != nil {
+			return nil, err
+		}
+	}
+	if threadRootID != "" {
+		if msg.ThreadRootID, err = primitive.ObjectIDFromHex(threadRootID); err != nil {
+			return nil, err
+		}
+	}
+	if threadLastReplyAt.Valid {
+		t := fromUnix(threadLastReplyAt.Int64)
+		msg.ThreadLastReplyAt = &t
+	}
+	if deletedAt.Valid {
+		t := fromUnix(deletedAt.Int64)
+		msg.DeletedAt = &t
+	}
+	if deletedBy != "" {
+		if msg.DeletedBy, err = primitive.ObjectIDFromHex(deletedBy); err != nil {
+			return nil, err
+		}
+	}
+	if editedAt.Valid {
+		t := fromUnix(editedAt.Int64)
+		msg.EditedAt = &t
+	}
+	if err := json.Unmarshal([]byte(editHistory), &msg.EditHistory); err != nil {
+		return nil, err
+	}
+	if len(msg.EditHistory) == 0 {
+		msg.EditHistory = nil
+	}
+	if err := json.Unmarshal([]byte(attachments), &msg.Attachments); err != nil {
+		return nil, err
+	}
+	if len(msg.Attachments) == 0 {
+		msg.Attachments = nil
+	}
+	msg.ReadBy = []primitive.ObjectID{}
+	msg.CreatedAt = fromUnix(createdAt)
+	msg.UpdatedAt = fromUnix(updatedAt)
+	return &msg, nil
+}
+
+func (s *SQLStore) MarkMessagesRead(ctx context.Context, ids []primitive.ObjectID, userID primitive.ObjectID, events []*models.OutboxEvent) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := markMessagesRead(ctx, tx, ids, userID); err != nil {
+			return err
+		}
+		return insertOutboxEvents(ctx, tx, events)
+	})
+}
+
+// markMessagesRead ghi nhận userID đã đọc các tin nhắn trong transaction tx
+func markMessagesRead(ctx context.Context, tx *sql.Tx, ids []primitive.ObjectID, userID primitive.ObjectID) error {
+	// Giảm số tin chưa đọc theo các tin nhắn người dùng đọc lần đầu, trước khi ghi nhận đã đọc
+	args := idArgs(ids)
+	args = append(args, userID.Hex(), userID.Hex(), userID.Hex(), userID.Hex())
+	args = append(args, idArgs(ids)...)
+	_, err := tx.ExecContext(ctx, `UPDATE conversation_participants SET unread_count = MAX(unread_count - (
+			SELECT COUNT(*) FROM messages m
+			WHERE m.id IN (`+placeholders(len(ids))+`)
+			AND m.conversation_id = conversation_participants.conversation_id
+			AND m.sender_id != ? AND m.is_deleted = 0 AND m.thread_root_id = ''
+			AND NOT EXISTS (SELECT 1 FROM message_reads r WHERE r.message_id = m.id AND r.user_id = ?)
+			AND NOT EXISTS (SELECT 1 FROM message_unread_exemptions e WHERE e.message_id = m.id AND e.user_id = ?)
+		), 0)
+		WHERE user_id = ?
+		AND conversation_id IN (SELECT conversation_id FROM messages WHERE id IN (`+placeholders(len(ids))+`))`,
+		args...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO message_reads (message_id, user_id)
+		SELECT id, ? FROM messages WHERE id IN (`+placeholders(len(ids))+`)`,
+		append([]interface{}{userID.Hex()}, idArgs(ids)...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE messages SET status = ? WHERE id IN (`+placeholders(len(ids))+`)`,
+		append([]interface{}{models.MessageStatusRead}, idArgs(ids)...)...)
+	return err
+}
+
+// insertOutboxEvents ghi các sự kiện trong cùng transaction với dữ liệu gây ra chúng
+func insertOutboxEvents(ctx context.Context, tx *sql.Tx, events []*models.OutboxEvent) error {
+	for _, event := range events {
+		// Danh sách người nhận được lưu dưới dạng mảng JSON các ID hex
+		recipients, err := json.Marshal(event.Recipients)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO outbox_events (id, type, recipients, payload, created_at) VALUES (?, ?, ?, ?, ?)`,
+			event.ID.Hex(), event.Type, string(recipients), event.Payload, toUnix(event.CreatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) PendingOutboxEvents(ctx context.Context, limit int) ([]*models.OutboxEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, type, recipients, payload, created_at FROM outbox_events
+		ORDER BY created_at, id
+		LIMIT ?`, sqlLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*models.OutboxEvent{}
+	for rows.Next() {
+		var event models.OutboxEvent
+		var id, recipients string
+		var createdAt int64
+		if err := rows.Scan(&id, &event.Type, &recipients, &event.Payload, &createdAt); err != nil {
+			return nil, err
+		}
+		if event.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(recipients), &event.Recipients); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = fromUnix(createdAt)
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLStore) DeleteOutboxEvents(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM outbox_events WHERE id IN (`+placeholders(len(ids))+`)`, idArgs(ids)...)
+	return err
+}
+
+// withTx chạy fn trong một transaction, rollback nếu fn trả về lỗi
+func (s *SQLStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// mapSQLError chuyển lỗi của database/sql sang lỗi chung của package store
+func mapSQLError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func isUniqueViolation(err error, column string) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed: "+column)
+}
+
+// Thời gian được lưu dưới dạng Unix nano giây theo UTC
+func toUnix(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromUnix(nanos int64) time.Time {
+	return time.Unix(0, nanos).UTC()
+}
+
+// sqlLimit chuyển limit <= 0 (không giới hạn) sang giá trị LIMIT của SQLite
+func sqlLimit(limit int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+// escapeLike thoát các ký tự đặc biệt của LIKE, dùng cùng ESCAPE '\'
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func idArgs(ids []primitive.ObjectID) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id.Hex()
+	}
+	return args
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,382 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sqlMigration là một bước thay đổi schema, được áp dụng đúng một lần theo thứ tự Version
+type sqlMigration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// sqlMigrations liệt kê toàn bộ lịch sử schema của backend SQL.
+// Chỉ thêm migration mới vào cuối danh sách, không sửa migration đã phát hành.
+var sqlMigrations = []sqlMigration{
+	{
+		Version: 1,
+		Name:    "create_core_tables",
+		Statements: []string{
+			`CREATE TABLE users (
+				id         TEXT PRIMARY KEY,
+				email      TEXT NOT NULL UNIQUE,
+				password   TEXT NOT NULL,
+				name       TEXT NOT NULL,
+				avatar     TEXT NOT NULL DEFAULT '',
+				status     TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			)`,
+			`CREATE TABLE conversations (
+				id              TEXT PRIMARY KEY,
+				type            TEXT NOT NULL,
+				name            TEXT NOT NULL DEFAULT '',
+				image           TEXT NOT NULL DEFAULT '',
+				last_message_id TEXT,
+				created_at      INTEGER NOT NULL,
+				updated_at      INTEGER NOT NULL
+			)`,
+			`CREATE TABLE conversation_participants (
+				conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+				user_id         TEXT NOT NULL,
+				position        INTEGER NOT NULL,
+				is_admin        INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (conversation_id, user_id)
+			)`,
+			`CREATE INDEX idx_conversation_participants_user ON conversation_participants (user_id)`,
+			`CREATE TABLE messages (
+				id              TEXT PRIMARY KEY,
+				type            TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				group_id        TEXT NOT NULL DEFAULT '',
+				sender_id       TEXT NOT NULL,
+				content         TEXT NOT NULL,
+				status          TEXT NOT NULL,
+				is_deleted      INTEGER NOT NULL DEFAULT 0,
+				created_at      INTEGER NOT NULL,
+				updated_at      INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_messages_conversation_created ON messages (conversation_id, created_at)`,
+			`CREATE TABLE message_reads (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id    TEXT NOT NULL,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create_outbox_events",
+		Statements: []string{
+			`CREATE TABLE outbox_events (
+				id         TEXT PRIMARY KEY,
+				type       TEXT NOT NULL,
+				recipients TEXT NOT NULL,
+				payload    BLOB NOT NULL,
+				created_at INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_outbox_events_created ON outbox_events (created_at, id)`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_message_cursor_index",
+		Statements: []string{
+			`CREATE INDEX idx_messages_conversation_id ON messages (conversation_id, id)`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add_unread_counts",
+		Statements: []string{
+			`ALTER TABLE conversation_participants ADD COLUMN unread_count INTEGER NOT NULL DEFAULT 0`,
+			// Tính lại số tin chưa đọc cho dữ liệu có sẵn
+			`UPDATE conversation_participants SET unread_count = (
+				SELECT COUNT(*) FROM messages m
+				WHERE m.conversation_id = conversation_participants.conversation_id
+				AND m.is_deleted = 0
+				AND m.sender_id != conversation_participants.user_id
+				AND NOT EXISTS (SELECT 1 FROM message_reads r
+					WHERE r.message_id = m.id AND r.user_id = conversation_participants.user_id)
+			)`,
+			`CREATE INDEX idx_conversations_updated ON conversations (updated_at, id)`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add_message_edits",
+		Statements: []string{
+			`ALTER TABLE messages ADD COLUMN edited_at INTEGER`,
+			// Lịch sử sửa được lưu dưới dạng mảng JSON các phiên bản cũ
+			`ALTER TABLE messages ADD COLUMN edit_history TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add_message_deletion",
+		Statements: []string{
+			`ALTER TABLE messages ADD COLUMN deleted_at INTEGER`,
+			`ALTER TABLE messages ADD COLUMN deleted_by TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE message_hides (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id    TEXT NOT NULL,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add_message_replies",
+		Statements: []string{
+			`ALTER TABLE messages ADD COLUMN reply_to_id TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add_threads",
+		Statements: []string{
+			`ALTER TABLE messages ADD COLUMN thread_root_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages ADD COLUMN thread_reply_count INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE messages ADD COLUMN thread_last_reply_at INTEGER`,
+			`CREATE INDEX idx_messages_thread ON messages (thread_root_id, id) WHERE thread_root_id != ''`,
+			`CREATE TABLE thread_followers (
+				root_id      TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id      TEXT NOT NULL,
+				unread_count INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (root_id, user_id)
+			)`,
+			`ALTER TABLE conversation_participants ADD COLUMN thread_opt_in INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add_message_reactions",
+		Statements: []string{
+			`CREATE TABLE message_reactions (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id    TEXT NOT NULL,
+				emoji      TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (message_id, user_id, emoji)
+			)`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add_attachments",
+		Statements: []string{
+			`CREATE TABLE attachments (
+				id              TEXT PRIMARY KEY,
+				uploader_id     TEXT NOT NULL,
+				conversation_id TEXT NOT NULL DEFAULT '',
+				message_id      TEXT NOT NULL DEFAULT '',
+				storage_key     TEXT NOT NULL,
+				filename        TEXT NOT NULL,
+				content_type    TEXT NOT NULL,
+				size            INTEGER NOT NULL,
+				created_at      INTEGER NOT NULL
+			)`,
+			`ALTER TABLE messages ADD COLUMN attachments TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add_attachment_images",
+		Statements: []string{
+			`ALTER TABLE attachments ADD COLUMN image TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE attachments ADD COLUMN thumbnail_key TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE attachments ADD COLUMN thumbnail_content_type TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add_voice_messages",
+		Statements: []string{
+			`ALTER TABLE attachments ADD COLUMN audio TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages ADD COLUMN kind TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE message_plays (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id    TEXT NOT NULL,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add_message_search",
+		Statements: []string{
+			`CREATE TABLE message_terms (
+				term       TEXT NOT NULL,
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				PRIMARY KEY (term, message_id)
+			) WITHOUT ROWID`,
+			`CREATE INDEX idx_message_terms_message ON message_terms (message_id)`,
+			`INSERT INTO message_terms (term, message_id)
+				SELECT t.value, m.id FROM messages m, json_each(search_terms(m.content)) t
+				WHERE m.is_deleted = 0`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add_friend_requests",
+		Statements: []string{
+			// pair_key unique: mỗi cặp người dùng chỉ có một lời mời hoặc một quan hệ bạn bè, kể cả khi hai người gửi cùng lúc
+			`CREATE TABLE friend_requests (
+				id           TEXT PRIMARY KEY,
+				sender_id    TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				pair_key     TEXT NOT NULL UNIQUE,
+				status       TEXT NOT NULL,
+				created_at   INTEGER NOT NULL,
+				updated_at   INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_friend_requests_sender ON friend_requests (sender_id, status)`,
+			`CREATE INDEX idx_friend_requests_recipient ON friend_requests (recipient_id, status)`,
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add_user_blocks",
+		Statements: []string{
+			`CREATE TABLE user_blocks (
+				blocker_id TEXT NOT NULL,
+				blocked_id TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (blocker_id, blocked_id)
+			) WITHOUT ROWID`,
+			`CREATE INDEX idx_user_blocks_blocked ON user_blocks (blocked_id)`,
+		},
+	},
+	{
+		Version: 16,
+		Name:    "add_revoked_tokens",
+		Statements: []string{
+			`CREATE TABLE revoked_tokens (
+				id         TEXT PRIMARY KEY,
+				expires_at INTEGER NOT NULL
+			) WITHOUT ROWID`,
+			`CREATE INDEX idx_revoked_tokens_expires ON revoked_tokens (expires_at)`,
+		},
+	},
+	{
+		Version: 17,
+		Name:    "add_token_families",
+		Statements: []string{
+			`CREATE TABLE token_families (
+				id               TEXT PRIMARY KEY,
+				user_id          TEXT NOT NULL,
+				current_token_id TEXT NOT NULL,
+				revoked_at       INTEGER,
+				created_at       INTEGER NOT NULL,
+				updated_at       INTEGER NOT NULL,
+				expires_at       INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_token_families_expires ON token_families (expires_at)`,
+		},
+	},
+	{
+		Version: 18,
+		Name:    "add_sessions",
+		Statements: []string{
+			// id trùng với id của token family được tạo cùng phiên
+			`CREATE TABLE sessions (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL,
+				device       TEXT NOT NULL,
+				user_agent   TEXT NOT NULL,
+				ip           TEXT NOT NULL,
+				created_at   INTEGER NOT NULL,
+				last_used_at INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_sessions_user ON sessions (user_id, last_used_at)`,
+			`CREATE INDEX idx_sessions_last_used ON sessions (last_used_at)`,
+		},
+	},
+	{
+		Version: 19,
+		Name:    "add_message_unread_exemptions",
+		Statements: []string{
+			`CREATE TABLE message_unread_exemptions (
+				message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+				user_id    TEXT NOT NULL,
+				PRIMARY KEY (message_id, user_id)
+			)`,
+		},
+	},
+}
+
+// Migrate áp dụng các migration chưa chạy, mỗi migration trong một transaction riêng
+func (s *SQLStore) Migrate() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	for i, status := range statuses {
+		if status.Applied {
+			continue
+		}
+		m := sqlMigrations[i]
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) thất bại: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied SQL migration %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// MigrationStatus trả về trạng thái của mọi migration theo thứ tự phiên bản
+func (s *SQLStore) MigrationStatus() ([]MigrationStatus, error) {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("không thể tạo bảng schema_migrations: %w", err)
+	}
+
+	rows, err := s.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = fromUnix(appliedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(sqlMigrations))
+	for i, m := range sqlMigrations {
+		appliedAt, ok := applied[m.Version]
+		statuses[i] = MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+func (s *SQLStore) applyMigration(m sqlMigration) error {
+	return s.withTx(context.Background(), func(tx *sql.Tx) error {
+		for _, stmt := range m.Statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now().UnixNano())
+		return err
+	})
+}
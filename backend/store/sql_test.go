@@ -0,0 +1,32 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"webchat/store"
+	"webchat/store/storetest"
+)
+
+// newSQLStore mở một file SQLite mới đã áp dụng mọi migration trong thư mục tạm của kiểm thử
+func newSQLStore(t *testing.T) *store.SQLStore {
+	t.Helper()
+	s, err := store.OpenSQLiteStore(filepath.Join(t.TempDir(), "webchat.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLUserStore(t *testing.T) {
+	storetest.RunUserStoreTests(t, func(t *testing.T) store.UserStore {
+		return newSQLStore(t)
+	})
+}
+
+func TestSQLChatStore(t *testing.T) {
+	storetest.RunChatStoreTests(t, func(t *testing.T) store.ChatStore {
+		return newSQLStore(t)
+	})
+}
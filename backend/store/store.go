@@ -0,0 +1,347 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"webchat/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound được trả về khi bản ghi cần tìm không tồn tại
+	ErrNotFound = errors.New("không tìm thấy dữ liệu")
+	// ErrDuplicateEmail được trả về khi email đã được đăng ký bởi người dùng khác
+	ErrDuplicateEmail = errors.New("email đã được sử dụng")
+	// ErrDuplicateFriendRequest được trả về khi hai người dùng đã có lời mời kết bạn đang chờ hoặc đã là bạn bè
+	ErrDuplicateFriendRequest = errors.New("đã có lời mời kết bạn giữa hai người dùng")
+	// ErrAttachmentUnavailable được trả về khi tệp đính kèm của tin nhắn không tồn tại,
+	// không do người gửi tải lên hoặc đã được gắn vào tin nhắn khác
+	ErrAttachmentUnavailable = errors.New("tệp đính kèm không hợp lệ")
+)
+
+// UserStore định nghĩa các thao tác lưu trữ người dùng mà mọi backend phải hỗ trợ
+type UserStore interface {
+	TokenStore
+
+	// CreateUser lưu người dùng mới, trả về ErrDuplicateEmail nếu email đã tồn tại
+	CreateUser(ctx context.Context, user *models.User) error
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	GetUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+	// GetUsersByIDs lấy nhiều người dùng trong một truy vấn, bỏ qua các ID không tồn tại
+	GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.User, error)
+	UpdateUserProfile(ctx context.Context, id primitive.ObjectID, name, avatar string, updatedAt time.Time) error
+	UpdateUserStatus(ctx context.Context, id primitive.ObjectID, status models.UserStatus, updatedAt time.Time) error
+	// SearchUsers trả về các người dùng có tên hoặc email khớp với query.Text, khớp hoàn toàn trước,
+	// rồi khớp tiền tố, rồi khớp chuỗi con; cùng mức thì sắp xếp theo tên (chữ thường) rồi ID
+	SearchUsers(ctx context.Context, query UserSearchQuery) ([]*models.User, error)
+
+	// BlockUser lưu quan hệ chặn, trả về false nếu block.BlockerID đã chặn block.BlockedID từ trước
+	BlockUser(ctx context.Context, block *models.UserBlock) (bool, error)
+	// UnblockUser xóa quan hệ chặn, trả về false nếu blockerID chưa chặn blockedID
+	UnblockUser(ctx context.Context, blockerID, blockedID primitive.ObjectID) (bool, error)
+	// ListBlocks trả về những người blockerID đã chặn, chặn gần đây nhất trước
+	ListBlocks(ctx context.Context, blockerID primitive.ObjectID) ([]*models.UserBlock, error)
+	// ListBlockerIDs trả về ID của những người đã chặn blockedID
+	ListBlockerIDs(ctx context.Context, blockedID primitive.ObjectID) ([]primitive.ObjectID, error)
+}
+
+// TokenStore định nghĩa các thao tác lưu trữ token đã bị thu hồi, family của refresh token và phiên đăng nhập
+type TokenStore interface {
+	// RevokeToken đánh dấu token đã bị thu hồi; thu hồi lại token đã thu hồi không có tác dụng
+	RevokeToken(ctx context.Context, token *models.RevokedToken) error
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+	// DeleteExpiredTokens xóa các token đã thu hồi và các family có ExpiresAt trước before,
+	// trả về tổng số bản ghi đã xóa
+	DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error)
+
+	CreateTokenFamily(ctx context.Context, family *models.TokenFamily) error
+	// GetTokenFamily trả về ErrNotFound nếu family không tồn tại hoặc đã bị xóa khi hết hạn
+	GetTokenFamily(ctx context.Context, id primitive.ObjectID) (*models.TokenFamily, error)
+	// RotateTokenFamily chuyển CurrentTokenID từ oldTokenID sang newTokenID và gia hạn family tới expiresAt.
+	// Trả về false nếu family không tồn tại, đã bị thu hồi hoặc CurrentTokenID không còn là oldTokenID,
+	// nên hai yêu cầu làm mới đồng thời bằng cùng một token chỉ có một yêu cầu thành công.
+	RotateTokenFamily(ctx context.Context, id primitive.ObjectID, oldTokenID, newTokenID string, expiresAt, updatedAt time.Time) (bool, error)
+	// RevokeTokenFamily thu hồi family, trả về false nếu family không tồn tại hoặc đã bị thu hồi từ trước
+	RevokeTokenFamily(ctx context.Context, id primitive.ObjectID, revokedAt time.Time) (bool, error)
+
+	CreateSession(ctx context.Context, session *models.Session) error
+	// GetSession trả về ErrNotFound nếu phiên không tồn tại
+	GetSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error)
+	// ListSessions trả về các phiên của userID, dùng gần đây nhất trước
+	ListSessions(ctx context.Context, userID primitive.ObjectID) ([]*models.Session, error)
+	// TouchSession cập nhật thời điểm dùng gần nhất và IP của phiên; phiên không tồn tại được bỏ qua
+	TouchSession(ctx context.Context, id primitive.ObjectID, ip string, lastUsedAt time.Time) error
+	// DeleteSession xóa phiên, trả về false nếu phiên không tồn tại
+	DeleteSession(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// DeleteIdleSessions xóa các phiên không được dùng từ trước before và trả về số phiên đã xóa
+	DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error)
+}
+
+// OutboxStore định nghĩa các thao tác đọc và xác nhận sự kiện trong outbox
+type OutboxStore interface {
+	// PendingOutboxEvents trả về tối đa limit sự kiện chưa gửi, cũ nhất trước
+	PendingOutboxEvents(ctx context.Context, limit int) ([]*models.OutboxEvent, error)
+	// DeleteOutboxEvents xóa các sự kiện đã được gửi đi
+	DeleteOutboxEvents(ctx context.Context, ids []primitive.ObjectID) error
+}
+
+// AttachmentStore định nghĩa các thao tác lưu trữ thông tin tệp đính kèm.
+// Nội dung tệp nằm trong blob store, ở đây chỉ lưu bản ghi trỏ tới nó.
+type AttachmentStore interface {
+	CreateAttachment(ctx context.Context, attachment *models.Attachment) error
+	GetAttachment(ctx context.Context, id primitive.ObjectID) (*models.Attachment, error)
+	// DeleteAttachments xóa bản ghi của các tệp, bỏ qua các ID không tồn tại
+	DeleteAttachments(ctx context.Context, ids []primitive.ObjectID) error
+}
+
+// FriendStore định nghĩa các thao tác lưu trữ lời mời kết bạn và quan hệ bạn bè.
+// Mỗi cặp người dùng có nhiều nhất một bản ghi: lời mời đang chờ hoặc lời mời đã chấp nhận.
+type FriendStore interface {
+	// CreateFriendRequest lưu lời mời mới và ghi các sự kiện outbox trong cùng một transaction.
+	// Trả về ErrDuplicateFriendRequest nếu đã có bản ghi cùng PairKey.
+	CreateFriendRequest(ctx context.Context, req *models.FriendRequest, events []*models.OutboxEvent) error
+	GetFriendRequest(ctx context.Context, id primitive.ObjectID) (*models.FriendRequest, error)
+	// FindFriendRequest tìm bản ghi giữa hai người dùng, không phân biệt ai là người gửi
+	FindFriendRequest(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.FriendRequest, error)
+	// ListFriendRequests trả về các bản ghi có trạng thái status mà userID là người gửi hoặc người nhận, mới nhất trước
+	ListFriendRequests(ctx context.Context, userID primitive.ObjectID, status models.FriendRequestStatus) ([]*models.FriendRequest, error)
+	// AcceptFriendRequest chuyển lời mời đang chờ id sang đã chấp nhận và ghi các sự kiện outbox trong cùng
+	// một transaction. Nếu lời mời không còn chờ, không có gì thay đổi, không sự kiện nào được ghi và kết quả
+	// trả về là false. Trả về ErrNotFound nếu lời mời không tồn tại.
+	AcceptFriendRequest(ctx context.Context, id primitive.ObjectID, acceptedAt time.Time, events []*models.OutboxEvent) (bool, error)
+	// DeleteFriendRequest xóa bản ghi id nếu nó đang có trạng thái status (từ chối lời mời hoặc hủy kết bạn)
+	// và ghi các sự kiện outbox trong cùng một transaction. Nếu trạng thái khác, không có gì thay đổi,
+	// không sự kiện nào được ghi và kết quả trả về là false. Trả về ErrNotFound nếu bản ghi không tồn tại.
+	DeleteFriendRequest(ctx context.Context, id primitive.ObjectID, status models.FriendRequestStatus, events []*models.OutboxEvent) (bool, error)
+}
+
+// ChatStore định nghĩa các thao tác lưu trữ cuộc hội thoại và tin nhắn
+type ChatStore interface {
+	OutboxStore
+	AttachmentStore
+	FriendStore
+
+	CreateConversation(ctx context.Context, conv *models.Conversation) error
+	GetConversation(ctx context.Context, id primitive.ObjectID) (*models.Conversation, error)
+	// FindPersonalConversation tìm cuộc hội thoại 1-1 giữa hai người dùng
+	FindPersonalConversation(ctx context.Context, userID1, userID2 primitive.ObjectID) (*models.Conversation, error)
+	// ListConversations trả về các cuộc hội thoại của người dùng khớp với query,
+	// sắp xếp theo UpdatedAt rồi ID giảm dần
+	ListConversations(ctx context.Context, userID primitive.ObjectID, query ConversationQuery) ([]*models.Conversation, error)
+
+	// SaveMessage lưu tin nhắn, cập nhật tin nhắn cuối và số tin chưa đọc của cuộc hội thoại và ghi các
+	// sự kiện outbox trong cùng một transaction: hoặc tất cả cùng thành công, hoặc không gì cả.
+	// Với tin trả lời trong thread, cuộc hội thoại được giữ nguyên; thay vào đó tin nhắn gốc được cập nhật
+	// số tin trả lời, thời điểm trả lời cuối, người theo dõi (người gửi, và người gửi tin nhắn gốc ở tin
+	// trả lời đầu tiên) và số tin chưa đọc của những người theo dõi khác.
+	// Các tệp trong msg.Attachments được gắn vào tin nhắn trong cùng transaction; trả về
+	// ErrAttachmentUnavailable nếu có tệp không tồn tại, không do người gửi tải lên hoặc đã được gắn trước đó.
+	// Trả về ErrNotFound nếu cuộc hội thoại hoặc tin nhắn gốc không tồn tại.
+	SaveMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error
+	// EditMessage ghi nội dung, thời điểm sửa và lịch sử sửa mới của msg, cập nhật bản sao tin nhắn
+	// cuối của cuộc hội thoại nếu cần và ghi các sự kiện outbox trong cùng một transaction.
+	// Trả về ErrNotFound nếu tin nhắn không tồn tại hoặc đã bị thu hồi.
+	EditMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error
+	// DeleteMessage thu hồi tin nhắn với mọi người: thay tin nhắn bằng tombstone msg (IsDeleted, không còn nội dung, reaction hay tệp đính kèm),
+	// trừ số tin chưa đọc của các thành viên chưa đọc nó và ghi các sự kiện outbox trong cùng một transaction.
+	// Trả về ErrNotFound nếu tin nhắn không tồn tại hoặc đã bị thu hồi trước đó.
+	DeleteMessage(ctx context.Context, msg *models.Message, events []*models.OutboxEvent) error
+	// HideMessage thêm userID vào danh sách đã xóa tin nhắn ở phía mình, đánh dấu userID đã đọc tin nhắn
+	// như MarkMessagesRead và ghi các sự kiện outbox trong cùng một transaction.
+	// Trả về ErrNotFound nếu tin nhắn không tồn tại.
+	HideMessage(ctx context.Context, id, userID primitive.ObjectID, events []*models.OutboxEvent) error
+	GetMessage(ctx context.Context, id primitive.ObjectID) (*models.Message, error)
+	GetMessagesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*models.Message, error)
+	// ListMessages trả về các tin nhắn trong khoảng ID của query, kể cả tombstone của tin nhắn đã thu hồi
+	ListMessages(ctx context.Context, conversationID primitive.ObjectID, query MessageQuery) ([]*models.Message, error)
+	// SearchMessages trả về các tin nhắn chưa thu hồi chứa mọi từ khóa của query, kể cả tin trả lời trong thread,
+	// trong các cuộc hội thoại query.Viewer đang tham gia, mới nhất trước
+	SearchMessages(ctx context.Context, query MessageSearchQuery) ([]*models.Message, error)
+	// MarkMessagesRead thêm userID vào danh sách đã đọc của các tin nhắn, giảm số tin nhắn
+	// chưa đọc của userID tương ứng với các tin nhắn trên dòng thời gian chính lần đầu được đọc
+	// và ghi các sự kiện outbox trong cùng một transaction
+	MarkMessagesRead(ctx context.Context, ids []primitive.ObjectID, userID primitive.ObjectID, events []*models.OutboxEvent) error
+	// MarkMessagePlayed thêm userID vào danh sách đã nghe tin nhắn thoại messageID và ghi các sự kiện outbox
+	// trong cùng một transaction. Nếu userID đã nghe trước đó, không có gì thay đổi, không sự kiện nào được ghi
+	// và kết quả trả về là false. Trả về ErrNotFound nếu tin nhắn không tồn tại hoặc đã bị thu hồi.
+	MarkMessagePlayed(ctx context.Context, messageID, userID primitive.ObjectID, events []*models.OutboxEvent) (bool, error)
+
+	// AddReaction thêm reaction vào tin nhắn messageID và ghi các sự kiện outbox trong cùng một transaction.
+	// Mỗi người dùng chỉ thả mỗi emoji một lần: nếu reaction đã có, không có gì thay đổi, không sự kiện nào
+	// được ghi và kết quả trả về là false. Trả về ErrNotFound nếu tin nhắn không tồn tại hoặc đã bị thu hồi.
+	AddReaction(ctx context.Context, messageID primitive.ObjectID, reaction models.Reaction, events []*models.OutboxEvent) (bool, error)
+	// RemoveReaction gỡ emoji của userID khỏi tin nhắn messageID và ghi các sự kiện outbox trong cùng một
+	// transaction. Trả về false và không ghi sự kiện nếu userID chưa thả emoji đó.
+	// Trả về ErrNotFound nếu tin nhắn không tồn tại.
+	RemoveReaction(ctx context.Context, messageID, userID primitive.ObjectID, emoji string, events []*models.OutboxEvent) (bool, error)
+
+	// FollowThread thêm (follow = true) hoặc xóa userID khỏi người theo dõi thread của tin nhắn gốc rootID.
+	// Bỏ theo dõi cũng xóa số tin chưa đọc của userID trong thread. Trả về ErrNotFound nếu tin nhắn không tồn tại.
+	FollowThread(ctx context.Context, rootID, userID primitive.ObjectID, follow bool) error
+	// MarkThreadRead đặt lại số tin chưa đọc của userID trong thread của rootID về 0
+	MarkThreadRead(ctx context.Context, rootID, userID primitive.ObjectID) error
+	// SetThreadOptIn bật hoặc tắt việc nhận mọi tin trả lời trong thread của cuộc hội thoại cho userID.
+	// Trả về ErrNotFound nếu cuộc hội thoại không tồn tại.
+	SetThreadOptIn(ctx context.Context, conversationID, userID primitive.ObjectID, enabled bool) error
+}
+
+// MessageQuery chọn một đoạn tin nhắn liên tiếp của cuộc hội thoại theo thứ tự ID.
+// ObjectID tăng dần theo thời điểm tạo và không trùng nhau nên phân trang theo ID
+// không bỏ sót hay lặp lại các tin nhắn được gửi trong cùng một thời điểm.
+type MessageQuery struct {
+	Before primitive.ObjectID // chỉ lấy tin nhắn có ID nhỏ hơn, bỏ trống nếu không giới hạn
+	After  primitive.ObjectID // chỉ lấy tin nhắn có ID lớn hơn, bỏ trống nếu không giới hạn
+	// Ascending trả về tin cũ nhất trước, mặc định tin mới nhất trước.
+	// Limit được áp dụng theo thứ tự đã chọn, <= 0 nghĩa là không giới hạn.
+	Ascending bool
+	Limit     int64
+	Viewer    primitive.ObjectID // bỏ qua các tin nhắn người này đã xóa ở phía mình, bỏ trống nếu không lọc
+	// ThreadRootID chỉ lấy các tin trả lời trong thread của tin nhắn này.
+	// Bỏ trống để lấy dòng thời gian chính, không gồm tin trả lời trong thread.
+	ThreadRootID primitive.ObjectID
+	// ExcludeSenders bỏ qua tin nhắn của những người này, dùng để ẩn tin của người bị chặn với người chặn
+	ExcludeSenders []primitive.ObjectID
+}
+
+// MessageSearchQuery chọn một trang kết quả tìm kiếm tin nhắn, sắp xếp theo ID giảm dần
+type MessageSearchQuery struct {
+	// Terms là các từ khóa đã chuẩn hóa bằng search.Terms, tin nhắn phải chứa tất cả
+	Terms []string
+	// Viewer là người tìm kiếm: chỉ tìm trong các cuộc hội thoại người này đang tham gia
+	// và bỏ qua các tin nhắn người này đã xóa ở phía mình
+	Viewer         primitive.ObjectID
+	ConversationID primitive.ObjectID // chỉ tìm trong cuộc hội thoại này, bỏ trống để tìm trong mọi cuộc hội thoại
+	SenderID       primitive.ObjectID // chỉ lấy tin nhắn của người này, bỏ trống nếu không lọc
+	Since          time.Time          // chỉ lấy tin nhắn tạo từ thời điểm này trở đi, bỏ trống nếu không giới hạn
+	Until          time.Time          // chỉ lấy tin nhắn tạo trước thời điểm này, bỏ trống nếu không giới hạn
+	HasAttachment  bool               // chỉ lấy tin nhắn có tệp đính kèm
+	Before         primitive.ObjectID // chỉ lấy tin nhắn có ID nhỏ hơn, bỏ trống để lấy từ mới nhất
+	Limit          int64              // <= 0 nghĩa là không giới hạn
+
+	// ExcludeSenders bỏ qua tin nhắn của những người này, dùng để ẩn tin của người bị chặn với người chặn
+	ExcludeSenders []primitive.ObjectID
+}
+
+// matches kiểm tra msg có khớp với các bộ lọc của query hay không, không xét từ khóa, người xem, Before và Limit
+func (q MessageSearchQuery) matches(msg *models.Message) bool {
+	if msg.IsDeleted {
+		return false
+	}
+	if !q.ConversationID.IsZero() && msg.ConversationID != q.ConversationID {
+		return false
+	}
+	if !q.SenderID.IsZero() && msg.SenderID != q.SenderID {
+		return false
+	}
+	if containsID(q.ExcludeSenders, msg.SenderID) {
+		return false
+	}
+	if !q.Since.IsZero() && msg.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !msg.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return !q.HasAttachment || len(msg.Attachments) > 0
+}
+
+// Mức độ khớp của người dùng với từ khóa tìm kiếm, số nhỏ hơn đứng trước
+const (
+	UserMatchExact     = iota // tên hoặc email trùng với từ khóa
+	UserMatchPrefix           // tên, một từ trong tên hoặc email bắt đầu bằng từ khóa
+	UserMatchSubstring        // tên hoặc email chứa từ khóa
+)
+
+// MinUserSubstringLength là độ dài tối thiểu (tính theo ký tự) của từ khóa để khớp chuỗi con,
+// từ khóa ngắn hơn chỉ khớp hoàn toàn hoặc khớp tiền tố
+const MinUserSubstringLength = 3
+
+// UserSearchCursor là vị trí của một người dùng trong kết quả tìm kiếm
+type UserSearchCursor struct {
+	Rank int
+	Name string // tên đã chuyển sang chữ thường
+	ID   primitive.ObjectID
+}
+
+// UserSearchQuery chọn một trang kết quả tìm kiếm người dùng
+type UserSearchQuery struct {
+	Text    string               // từ khóa đã bỏ khoảng trắng hai đầu và chuyển sang chữ thường
+	Exclude []primitive.ObjectID // các người dùng không được trả về
+	After   *UserSearchCursor    // chỉ lấy các người dùng đứng sau vị trí này, nil để lấy từ đầu
+	Limit   int64                // <= 0 nghĩa là không giới hạn
+}
+
+// UserSearchRank trả về mức độ khớp của user với từ khóa text (đã chuyển sang chữ thường)
+// và false nếu user không khớp
+func UserSearchRank(user *models.User, text string) (int, bool) {
+	if text == "" {
+		return 0, false
+	}
+	name := strings.ToLower(user.Name)
+	email := strings.ToLower(user.Email)
+	switch {
+	case name == text || email == text:
+		return UserMatchExact, true
+	case strings.HasPrefix(name, text) || strings.HasPrefix(email, text) || strings.Contains(name, " "+text):
+		return UserMatchPrefix, true
+	case utf8.RuneCountInString(text) >= MinUserSubstringLength &&
+		(strings.Contains(name, text) || strings.Contains(email, text)):
+		return UserMatchSubstring, true
+	}
+	return 0, false
+}
+
+// follows kiểm tra người dùng có mức khớp rank, tên name (chữ thường) và ID id
+// có đứng sau vị trí cursor hay không
+func (c *UserSearchCursor) follows(rank int, name string, id primitive.ObjectID) bool {
+	if rank != c.Rank {
+		return rank > c.Rank
+	}
+	if name != c.Name {
+		return name > c.Name
+	}
+	return bytes.Compare(id[:], c.ID[:]) > 0
+}
+
+// ConversationCursor là vị trí của một cuộc hội thoại trong danh sách sắp xếp theo UpdatedAt rồi ID
+type ConversationCursor struct {
+	UpdatedAt time.Time
+	ID        primitive.ObjectID
+}
+
+// ConversationQuery chọn một trang cuộc hội thoại của người dùng
+type ConversationQuery struct {
+	After      *ConversationCursor     // chỉ lấy các cuộc hội thoại đứng sau vị trí này, nil để lấy từ đầu
+	Type       models.ConversationType // lọc theo loại, bỏ trống để lấy tất cả
+	UnreadOnly bool                    // chỉ lấy cuộc hội thoại người dùng còn tin nhắn chưa đọc
+	NamePrefix string                  // lọc theo tiền tố tên, không phân biệt hoa thường
+	Limit      int64                   // <= 0 nghĩa là không giới hạn
+}
+
+// matches kiểm tra conv có khớp với các bộ lọc của query hay không, không xét After và Limit
+func (q ConversationQuery) matches(conv *models.Conversation, userID primitive.ObjectID) bool {
+	if q.Type != "" && conv.Type != q.Type {
+		return false
+	}
+	if q.UnreadOnly && conv.UnreadCountFor(userID) == 0 {
+		return false
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(conv.Name), strings.ToLower(q.NamePrefix)) {
+		return false
+	}
+	return true
+}
+
+// follows kiểm tra conv có đứng sau vị trí cursor theo thứ tự UpdatedAt rồi ID giảm dần hay không
+func (c *ConversationCursor) follows(conv *models.Conversation) bool {
+	if !conv.UpdatedAt.Equal(c.UpdatedAt) {
+		return conv.UpdatedAt.Before(c.UpdatedAt)
+	}
+	return bytes.Compare(conv.ID[:], c.ID[:]) < 0
+}
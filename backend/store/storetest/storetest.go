@@ -0,0 +1,2085 @@
+// Package storetest cung cấp bộ kiểm thử dùng chung cho mọi backend của package store.
+//
+// Mỗi backend gọi RunUserStoreTests và RunChatStoreTests với hàm khởi tạo một
+// store rỗng, nhờ đó bộ nhớ, SQLite và MongoDB được kiểm tra theo cùng một hành vi.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"webchat/models"
+	"webchat/search"
+	"webchat/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ctx dùng cho mọi thao tác trong bộ kiểm thử
+var ctx = context.Background()
+
+// baseTime được làm tròn tới mili giây vì MongoDB chỉ lưu thời gian với độ chính xác đó
+var baseTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// RunUserStoreTests chạy các kiểm thử hành vi của UserStore
+func RunUserStoreTests(t *testing.T, newStore func(t *testing.T) store.UserStore) {
+	t.Run("CreateAndGet", func(t *testing.T) {
+		s := newStore(t)
+		user := newUser("alice@example.com")
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+
+		byID, err := s.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if byID.Email != user.Email || byID.Name != user.Name {
+			t.Errorf("GetUserByID = %+v, want %+v", byID, user)
+		}
+
+		byEmail, err := s.GetUserByEmail(ctx, user.Email)
+		if err != nil {
+			t.Fatalf("GetUserByEmail: %v", err)
+		}
+		if byEmail.ID != user.ID {
+			t.Errorf("GetUserByEmail ID = %s, want %s", byEmail.ID.Hex(), user.ID.Hex())
+		}
+	})
+
+	t.Run("GetUsersByIDs", func(t *testing.T) {
+		s := newStore(t)
+		alice, bob := newUser("alice@example.com"), newUser("bob@example.com")
+		for _, user := range []*models.User{alice, bob} {
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+		}
+
+		got, err := s.GetUsersByIDs(ctx, []primitive.ObjectID{bob.ID, primitive.NewObjectID(), alice.ID})
+		if err != nil {
+			t.Fatalf("GetUsersByIDs: %v", err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("GetUsersByIDs returned %d users, want 2", len(got))
+		}
+		for _, user := range got {
+			if user.ID != alice.ID && user.ID != bob.ID {
+				t.Errorf("GetUsersByIDs returned unexpected user %s", user.ID.Hex())
+			}
+		}
+
+		empty, err := s.GetUsersByIDs(ctx, nil)
+		if err != nil {
+			t.Fatalf("GetUsersByIDs empty: %v", err)
+		}
+		if len(empty) != 0 {
+			t.Errorf("GetUsersByIDs(nil) = %d users, want 0", len(empty))
+		}
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateUser(ctx, newUser("bob@example.com")); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		err := s.CreateUser(ctx, newUser("bob@example.com"))
+		if !errors.Is(err, store.ErrDuplicateEmail) {
+			t.Errorf("CreateUser duplicate = %v, want ErrDuplicateEmail", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.GetUserByID(ctx, primitive.NewObjectID()); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetUserByID = %v, want ErrNotFound", err)
+		}
+		if _, err := s.GetUserByEmail(ctx, "missing@example.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetUserByEmail = %v, want ErrNotFound", err)
+		}
+		if err := s.UpdateUserProfile(ctx, primitive.NewObjectID(), "x", "", baseTime); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("UpdateUserProfile = %v, want ErrNotFound", err)
+		}
+		if err := s.UpdateUserStatus(ctx, primitive.NewObjectID(), models.UserStatusOnline, baseTime); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("UpdateUserStatus = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		s := newStore(t)
+		user := newUser("carol@example.com")
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+
+		updatedAt := baseTime.Add(time.Hour)
+		if err := s.UpdateUserProfile(ctx, user.ID, "Carol", "avatar.png", updatedAt); err != nil {
+			t.Fatalf("UpdateUserProfile: %v", err)
+		}
+		if err := s.UpdateUserStatus(ctx, user.ID, models.UserStatusOnline, updatedAt); err != nil {
+			t.Fatalf("UpdateUserStatus: %v", err)
+		}
+
+		got, err := s.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if got.Name != "Carol" || got.Avatar != "avatar.png" || got.Status != models.UserStatusOnline {
+			t.Errorf("GetUserByID after update = %+v", got)
+		}
+		if !got.UpdatedAt.Equal(updatedAt) {
+			t.Errorf("UpdatedAt = %v, want %v", got.UpdatedAt, updatedAt)
+		}
+	})
+
+	t.Run("SearchUsers", func(t *testing.T) {
+		s := newStore(t)
+		newNamedUser := func(name, email string) *models.User {
+			user := newUser(email)
+			user.Name = name
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			return user
+		}
+		an := newNamedUser("An", "an@example.com")
+		anh := newNamedUser("Anh Nguyen", "anh.nguyen@example.com")
+		binh := newNamedUser("Nguyễn Văn An", "binh@example.com")
+		dan := newNamedUser("Dan", "dan@example.com")
+		hanh := newNamedUser("Hạnh", "hanh@example.com")
+
+		search := func(name string, query store.UserSearchQuery, want ...*models.User) {
+			t.Helper()
+			got, err := s.SearchUsers(ctx, query)
+			if err != nil {
+				t.Fatalf("SearchUsers %s: %v", name, err)
+			}
+			wantIDs := []primitive.ObjectID{}
+			for _, user := range want {
+				wantIDs = append(wantIDs, user.ID)
+			}
+			gotIDs := []primitive.ObjectID{}
+			for _, user := range got {
+				gotIDs = append(gotIDs, user.ID)
+			}
+			if !equalIDs(gotIDs, wantIDs) {
+				t.Errorf("SearchUsers %s = %v, want %v", name, gotIDs, wantIDs)
+			}
+		}
+
+		// Khớp hoàn toàn trước, rồi khớp tiền tố của tên, của một từ trong tên; từ khóa 2 ký tự không khớp chuỗi con
+		search("exact and prefix", store.UserSearchQuery{Text: "an"}, an, anh, binh)
+		// Khớp chuỗi con đứng sau khớp tiền tố, kể cả khi chỉ email chứa từ khóa
+		search("substring", store.UserSearchQuery{Text: "anh"}, anh, hanh)
+		search("diacritics", store.UserSearchQuery{Text: "nguyễn"}, binh)
+		search("email prefix", store.UserSearchQuery{Text: "dan@"}, dan)
+		search("exclude", store.UserSearchQuery{Text: "an", Exclude: []primitive.ObjectID{an.ID, binh.ID}}, anh)
+		search("no match", store.UserSearchQuery{Text: "zzz"})
+
+		search("first page", store.UserSearchQuery{Text: "an", Limit: 2}, an, anh)
+		after := &store.UserSearchCursor{Rank: store.UserMatchPrefix, Name: "anh nguyen", ID: anh.ID}
+		search("second page", store.UserSearchQuery{Text: "an", After: after, Limit: 2}, binh)
+
+		// Đổi tên cập nhật chỉ mục: tên cũ không còn khớp, tên mới khớp
+		if err := s.UpdateUserProfile(ctx, binh.ID, "Bình", "", baseTime); err != nil {
+			t.Fatalf("UpdateUserProfile: %v", err)
+		}
+		if err := s.UpdateUserProfile(ctx, dan.ID, "Andrea", "", baseTime); err != nil {
+			t.Fatalf("UpdateUserProfile: %v", err)
+		}
+		search("after rename", store.UserSearchQuery{Text: "an"}, an, dan, anh)
+		search("old name", store.UserSearchQuery{Text: "nguyễn"})
+	})
+
+	t.Run("SearchUsersAccentedNames", func(t *testing.T) {
+		s := newStore(t)
+		// Cùng mức khớp (chuỗi con của email), tên chữ thường được so sánh theo byte ở mọi backend
+		// nên chữ có dấu đứng sau mọi chữ ASCII: "bảo" < "zoe" < "ánh" < "ấn"
+		var want []*models.User
+		for _, name := range []string{"An", "Bảo", "bảo", "Zoe", "Ánh", "Ấn"} {
+			user := newUser(primitive.NewObjectID().Hex() + "@viet.example")
+			user.Name = name
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			want = append(want, user)
+		}
+		// "Bảo" và "bảo" có cùng tên chữ thường nên được xếp theo ID
+		if bytes.Compare(want[1].ID[:], want[2].ID[:]) > 0 {
+			want[1], want[2] = want[2], want[1]
+		}
+
+		// Đi qua từng trang bằng cursor tạo giống UserService: thứ tự trong store phải khớp với
+		// UserSearchCursor, nếu không cursor sẽ bỏ sót hoặc lặp người dùng
+		var got []primitive.ObjectID
+		query := store.UserSearchQuery{Text: "viet", Limit: 2}
+		for page := 0; page < len(want); page++ {
+			users, err := s.SearchUsers(ctx, query)
+			if err != nil {
+				t.Fatalf("SearchUsers: %v", err)
+			}
+			if len(users) == 0 {
+				break
+			}
+			for _, user := range users {
+				got = append(got, user.ID)
+			}
+			last := users[len(users)-1]
+			query.After = &store.UserSearchCursor{Rank: store.UserMatchSubstring, Name: strings.ToLower(last.Name), ID: last.ID}
+		}
+
+		wantIDs := make([]primitive.ObjectID, len(want))
+		for i, user := range want {
+			wantIDs[i] = user.ID
+		}
+		if !equalIDs(got, wantIDs) {
+			t.Errorf("SearchUsers pages = %v, want %v", got, wantIDs)
+		}
+	})
+
+	t.Run("Blocks", func(t *testing.T) {
+		s := newStore(t)
+		alice, bob, carol := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+		block := func(blocker, blocked primitive.ObjectID, minute int, want bool) {
+			t.Helper()
+			created, err := s.BlockUser(ctx, &models.UserBlock{
+				BlockerID: blocker,
+				BlockedID: blocked,
+				CreatedAt: baseTime.Add(time.Duration(minute) * time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("BlockUser: %v", err)
+			}
+			if created != want {
+				t.Errorf("BlockUser = %v, want %v", created, want)
+			}
+		}
+		block(alice, bob, 0, true)
+		block(alice, carol, 1, true)
+		block(carol, bob, 2, true)
+		// Chặn lại không thay đổi thời điểm chặn ban đầu
+		block(alice, bob, 3, false)
+
+		blocks, err := s.ListBlocks(ctx, alice)
+		if err != nil {
+			t.Fatalf("ListBlocks: %v", err)
+		}
+		if len(blocks) != 2 || blocks[0].BlockedID != carol || blocks[1].BlockedID != bob ||
+			blocks[1].BlockerID != alice || !blocks[1].CreatedAt.Equal(baseTime) {
+			t.Errorf("ListBlocks = %+v, want carol then bob blocked by alice", blocks)
+		}
+
+		blockers, err := s.ListBlockerIDs(ctx, bob)
+		if err != nil {
+			t.Fatalf("ListBlockerIDs: %v", err)
+		}
+		if len(blockers) != 2 || !((blockers[0] == alice && blockers[1] == carol) || (blockers[0] == carol && blockers[1] == alice)) {
+			t.Errorf("ListBlockerIDs = %v, want alice and carol", blockers)
+		}
+
+		for _, tc := range []struct {
+			blocker, blocked primitive.ObjectID
+			want             bool
+		}{{alice, bob, true}, {alice, bob, false}, {bob, alice, false}} {
+			removed, err := s.UnblockUser(ctx, tc.blocker, tc.blocked)
+			if err != nil {
+				t.Fatalf("UnblockUser: %v", err)
+			}
+			if removed != tc.want {
+				t.Errorf("UnblockUser = %v, want %v", removed, tc.want)
+			}
+		}
+		if blockers, err = s.ListBlockerIDs(ctx, bob); err != nil {
+			t.Fatalf("ListBlockerIDs: %v", err)
+		}
+		if len(blockers) != 1 || blockers[0] != carol {
+			t.Errorf("ListBlockerIDs after unblock = %v, want [%s]", blockers, carol.Hex())
+		}
+	})
+
+	t.Run("RevokedTokens", func(t *testing.T) {
+		s := newStore(t)
+		expired := &models.RevokedToken{ID: primitive.NewObjectID().Hex(), ExpiresAt: baseTime}
+		active := &models.RevokedToken{ID: primitive.NewObjectID().Hex(), ExpiresAt: baseTime.Add(time.Hour)}
+		for _, token := range []*models.RevokedToken{expired, active, active} {
+			if err := s.RevokeToken(ctx, token); err != nil {
+				t.Fatalf("RevokeToken: %v", err)
+			}
+		}
+
+		revoked := func(id string, want bool) {
+			t.Helper()
+			got, err := s.IsTokenRevoked(ctx, id)
+			if err != nil {
+				t.Fatalf("IsTokenRevoked: %v", err)
+			}
+			if got != want {
+				t.Errorf("IsTokenRevoked(%s) = %v, want %v", id, got, want)
+			}
+		}
+		revoked(expired.ID, true)
+		revoked(active.ID, true)
+		revoked(primitive.NewObjectID().Hex(), false)
+
+		deleted, err := s.DeleteExpiredTokens(ctx, baseTime.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("DeleteExpiredTokens: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("DeleteExpiredTokens = %d, want 1", deleted)
+		}
+		revoked(expired.ID, false)
+		revoked(active.ID, true)
+	})
+
+	t.Run("TokenFamilies", func(t *testing.T) {
+		s := newStore(t)
+		family := &models.TokenFamily{
+			ID:             primitive.NewObjectID(),
+			UserID:         primitive.NewObjectID(),
+			CurrentTokenID: "first",
+			CreatedAt:      baseTime,
+			UpdatedAt:      baseTime,
+			ExpiresAt:      baseTime.Add(time.Hour),
+		}
+		if err := s.CreateTokenFamily(ctx, family); err != nil {
+			t.Fatalf("CreateTokenFamily: %v", err)
+		}
+		if _, err := s.GetTokenFamily(ctx, primitive.NewObjectID()); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetTokenFamily unknown = %v, want ErrNotFound", err)
+		}
+
+		rotate := func(oldID, newID string, want bool) {
+			t.Helper()
+			got, err := s.RotateTokenFamily(ctx, family.ID, oldID, newID, baseTime.Add(2*time.Hour), baseTime.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("RotateTokenFamily: %v", err)
+			}
+			if got != want {
+				t.Errorf("RotateTokenFamily(%s -> %s) = %v, want %v", oldID, newID, got, want)
+			}
+		}
+		rotate("first", "second", true)
+		// Token đã được thay thế không thể dùng để làm mới lần nữa
+		rotate("first", "third", false)
+
+		got, err := s.GetTokenFamily(ctx, family.ID)
+		if err != nil {
+			t.Fatalf("GetTokenFamily: %v", err)
+		}
+		if got.UserID != family.UserID || got.CurrentTokenID != "second" || got.IsRevoked() {
+			t.Errorf("GetTokenFamily = %+v, want current token second and not revoked", got)
+		}
+		if !got.ExpiresAt.Equal(baseTime.Add(2*time.Hour)) || !got.UpdatedAt.Equal(baseTime.Add(time.Minute)) {
+			t.Errorf("GetTokenFamily times = %v/%v, want extended expiry", got.UpdatedAt, got.ExpiresAt)
+		}
+
+		for i, want := range []bool{true, false} {
+			revoked, err := s.RevokeTokenFamily(ctx, family.ID, baseTime.Add(3*time.Minute))
+			if err != nil {
+				t.Fatalf("RevokeTokenFamily: %v", err)
+			}
+			if revoked != want {
+				t.Errorf("RevokeTokenFamily #%d = %v, want %v", i+1, revoked, want)
+			}
+		}
+		rotate("second", "third", false)
+
+		got, err = s.GetTokenFamily(ctx, family.ID)
+		if err != nil {
+			t.Fatalf("GetTokenFamily after revoke: %v", err)
+		}
+		if got.RevokedAt == nil || !got.RevokedAt.Equal(baseTime.Add(3*time.Minute)) {
+			t.Errorf("RevokedAt = %v, want %v", got.RevokedAt, baseTime.Add(3*time.Minute))
+		}
+
+		deleted, err := s.DeleteExpiredTokens(ctx, baseTime.Add(3*time.Hour))
+		if err != nil {
+			t.Fatalf("DeleteExpiredTokens: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("DeleteExpiredTokens = %d, want 1", deleted)
+		}
+		if _, err := s.GetTokenFamily(ctx, family.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetTokenFamily after cleanup = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		s := newStore(t)
+		user, other := primitive.NewObjectID(), primitive.NewObjectID()
+		newSession := func(userID primitive.ObjectID, lastUsedAt time.Time) *models.Session {
+			session := &models.Session{
+				ID:         primitive.NewObjectID(),
+				UserID:     userID,
+				Device:     "Chrome trên Windows",
+				UserAgent:  "Mozilla/5.0",
+				IP:         "10.0.0.1",
+				CreatedAt:  baseTime,
+				LastUsedAt: lastUsedAt,
+			}
+			if err := s.CreateSession(ctx, session); err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+			return session
+		}
+		older := newSession(user, baseTime)
+		newer := newSession(user, baseTime.Add(time.Minute))
+		newSession(other, baseTime)
+
+		expectSessions := func(name string, want ...primitive.ObjectID) {
+			t.Helper()
+			sessions, err := s.ListSessions(ctx, user)
+			if err != nil {
+				t.Fatalf("ListSessions: %v", err)
+			}
+			got := make([]primitive.ObjectID, len(sessions))
+			for i, session := range sessions {
+				got[i] = session.ID
+			}
+			if !equalIDs(got, want) {
+				t.Errorf("%s = %v, want %v", name, got, want)
+			}
+		}
+		expectSessions("ListSessions", newer.ID, older.ID)
+
+		if err := s.TouchSession(ctx, older.ID, "10.0.0.2", baseTime.Add(2*time.Minute)); err != nil {
+			t.Fatalf("TouchSession: %v", err)
+		}
+		if err := s.TouchSession(ctx, primitive.NewObjectID(), "10.0.0.2", baseTime); err != nil {
+			t.Errorf("TouchSession unknown = %v, want nil", err)
+		}
+		expectSessions("ListSessions after touch", older.ID, newer.ID)
+
+		got, err := s.GetSession(ctx, older.ID)
+		if err != nil {
+			t.Fatalf("GetSession: %v", err)
+		}
+		if got.UserID != user || got.IP != "10.0.0.2" || got.Device != older.Device || got.UserAgent != older.UserAgent ||
+			!got.CreatedAt.Equal(baseTime) || !got.LastUsedAt.Equal(baseTime.Add(2*time.Minute)) {
+			t.Errorf("GetSession = %+v, want touched copy of %+v", got, older)
+		}
+
+		for i, want := range []bool{true, false} {
+			deleted, err := s.DeleteSession(ctx, newer.ID)
+			if err != nil {
+				t.Fatalf("DeleteSession: %v", err)
+			}
+			if deleted != want {
+				t.Errorf("DeleteSession #%d = %v, want %v", i+1, deleted, want)
+			}
+		}
+		if _, err := s.GetSession(ctx, newer.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetSession after delete = %v, want ErrNotFound", err)
+		}
+
+		// Phiên của other không được dùng từ baseTime nên bị xóa, phiên vừa được dùng thì còn lại
+		deleted, err := s.DeleteIdleSessions(ctx, baseTime.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("DeleteIdleSessions: %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("DeleteIdleSessions = %d, want 1", deleted)
+		}
+		expectSessions("ListSessions after cleanup", older.ID)
+	})
+}
+
+// RunChatStoreTests chạy các kiểm thử hành vi của ChatStore
+func RunChatStoreTests(t *testing.T, newStore func(t *testing.T) store.ChatStore) {
+	t.Run("PersonalConversation", func(t *testing.T) {
+		s := newStore(t)
+		a, b, c := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+		if _, err := s.FindPersonalConversation(ctx, a, b); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("FindPersonalConversation before create = %v, want ErrNotFound", err)
+		}
+
+		conv := newConversation(models.ConversationTypePersonal, baseTime, a, b)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		got, err := s.FindPersonalConversation(ctx, b, a)
+		if err != nil {
+			t.Fatalf("FindPersonalConversation: %v", err)
+		}
+		if got.ID != conv.ID {
+			t.Errorf("FindPersonalConversation ID = %s, want %s", got.ID.Hex(), conv.ID.Hex())
+		}
+
+		// Một nhóm chứa cả hai người không được coi là cuộc hội thoại 1-1
+		group := newConversation(models.ConversationTypeGroup, baseTime, a, c)
+		if err := s.CreateConversation(ctx, group); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		if _, err := s.FindPersonalConversation(ctx, a, c); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("FindPersonalConversation for group members = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("GetConversationNotFound", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.GetConversation(ctx, primitive.NewObjectID()); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetConversation = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ListConversationsSortsBeforeLimit", func(t *testing.T) {
+		s := newStore(t)
+		user := primitive.NewObjectID()
+
+		// Tạo theo thứ tự cũ -> mới nhưng cuộc hội thoại đầu tiên được cập nhật gần nhất
+		var convs []*models.Conversation
+		for i := 0; i < 4; i++ {
+			conv := newConversation(models.ConversationTypeGroup, baseTime.Add(time.Duration(i)*time.Minute), user, primitive.NewObjectID())
+			if err := s.CreateConversation(ctx, conv); err != nil {
+				t.Fatalf("CreateConversation: %v", err)
+			}
+			convs = append(convs, conv)
+		}
+		other := newConversation(models.ConversationTypeGroup, baseTime.Add(time.Hour), primitive.NewObjectID())
+		if err := s.CreateConversation(ctx, other); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		msg := newMessage(convs[0].ID, user, baseTime.Add(10*time.Minute))
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		got, err := s.ListConversations(ctx, user, store.ConversationQuery{Limit: 2})
+		if err != nil {
+			t.Fatalf("ListConversations: %v", err)
+		}
+		want := []primitive.ObjectID{convs[0].ID, convs[3].ID}
+		if ids := conversationIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListConversations = %v, want %v", ids, want)
+		}
+		if got[0].LastMessage == nil || got[0].LastMessage.ID != msg.ID {
+			t.Errorf("LastMessage = %+v, want message %s", got[0].LastMessage, msg.ID.Hex())
+		}
+	})
+
+	// Các cuộc hội thoại cùng thời điểm cập nhật vẫn được phân trang đầy đủ theo ID
+	t.Run("ListConversationsCursor", func(t *testing.T) {
+		s := newStore(t)
+		user := primitive.NewObjectID()
+
+		var want []primitive.ObjectID
+		for i := 0; i < 5; i++ {
+			conv := newConversation(models.ConversationTypeGroup, baseTime, user)
+			if err := s.CreateConversation(ctx, conv); err != nil {
+				t.Fatalf("CreateConversation: %v", err)
+			}
+			want = append([]primitive.ObjectID{conv.ID}, want...)
+		}
+
+		var got []primitive.ObjectID
+		query := store.ConversationQuery{Limit: 2}
+		for {
+			page, err := s.ListConversations(ctx, user, query)
+			if err != nil {
+				t.Fatalf("ListConversations: %v", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			got = append(got, conversationIDs(page)...)
+			last := page[len(page)-1]
+			query.After = &store.ConversationCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}
+		}
+		if !equalIDs(got, want) {
+			t.Errorf("paged conversations = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("ListConversationsFilters", func(t *testing.T) {
+		s := newStore(t)
+		user := primitive.NewObjectID()
+
+		personal := newConversation(models.ConversationTypePersonal, baseTime, user, primitive.NewObjectID())
+		design := newConversation(models.ConversationTypeGroup, baseTime.Add(time.Minute), user)
+		design.Name = "Đội Thiết kế"
+		sales := newConversation(models.ConversationTypeGroup, baseTime.Add(2*time.Minute), user)
+		sales.Name = "Sales_team"
+		for _, conv := range []*models.Conversation{personal, design, sales} {
+			if err := s.CreateConversation(ctx, conv); err != nil {
+				t.Fatalf("CreateConversation: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name  string
+			query store.ConversationQuery
+			want  []primitive.ObjectID
+		}{
+			{"type", store.ConversationQuery{Type: models.ConversationTypeGroup}, []primitive.ObjectID{sales.ID, design.ID}},
+			{"name prefix ignores case", store.ConversationQuery{NamePrefix: "đội"}, []primitive.ObjectID{design.ID}},
+			{"name prefix is literal", store.ConversationQuery{NamePrefix: "Sales_"}, []primitive.ObjectID{sales.ID}},
+			{"name prefix wildcard", store.ConversationQuery{NamePrefix: "S%"}, nil},
+		}
+		for _, tt := range tests {
+			got, err := s.ListConversations(ctx, user, tt.query)
+			if err != nil {
+				t.Fatalf("ListConversations %s: %v", tt.name, err)
+			}
+			if ids := conversationIDs(got); !equalIDs(ids, tt.want) {
+				t.Errorf("ListConversations %s = %v, want %v", tt.name, ids, tt.want)
+			}
+		}
+	})
+
+	t.Run("UnreadCounts", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		quiet := newConversation(models.ConversationTypeGroup, baseTime, sender, reader)
+		for _, c := range []*models.Conversation{conv, quiet} {
+			if err := s.CreateConversation(ctx, c); err != nil {
+				t.Fatalf("CreateConversation: %v", err)
+			}
+		}
+
+		var msgs []*models.Message
+		for i := 0; i < 3; i++ {
+			msg := newMessage(conv.ID, sender, baseTime.Add(time.Duration(i)*time.Second))
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		unreadCount := func(userID primitive.ObjectID) int64 {
+			t.Helper()
+			got, err := s.GetConversation(ctx, conv.ID)
+			if err != nil {
+				t.Fatalf("GetConversation: %v", err)
+			}
+			return got.UnreadCountFor(userID)
+		}
+		if n := unreadCount(reader); n != 3 {
+			t.Errorf("reader unread = %d, want 3", n)
+		}
+		if n := unreadCount(sender); n != 0 {
+			t.Errorf("sender unread = %d, want 0", n)
+		}
+
+		got, err := s.ListConversations(ctx, reader, store.ConversationQuery{UnreadOnly: true})
+		if err != nil {
+			t.Fatalf("ListConversations: %v", err)
+		}
+		if ids := conversationIDs(got); !equalIDs(ids, []primitive.ObjectID{conv.ID}) {
+			t.Errorf("ListConversations unread = %v, want %s", ids, conv.ID.Hex())
+		}
+
+		// Đọc lại tin nhắn đã đọc hoặc tin nhắn của chính mình không làm giảm thêm
+		for i := 0; i < 2; i++ {
+			if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{msgs[0].ID, msgs[1].ID}, reader, nil); err != nil {
+				t.Fatalf("MarkMessagesRead: %v", err)
+			}
+		}
+		if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{msgs[2].ID}, sender, nil); err != nil {
+			t.Fatalf("MarkMessagesRead: %v", err)
+		}
+		if n := unreadCount(reader); n != 1 {
+			t.Errorf("reader unread after reading two = %d, want 1", n)
+		}
+
+		event := newOutboxEvent(baseTime, sender)
+		if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{msgs[2].ID}, reader, []*models.OutboxEvent{event}); err != nil {
+			t.Fatalf("MarkMessagesRead: %v", err)
+		}
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID}) {
+			t.Errorf("PendingOutboxEvents after MarkMessagesRead = %v, want %s", ids, event.ID.Hex())
+		}
+		got, err = s.ListConversations(ctx, reader, store.ConversationQuery{UnreadOnly: true})
+		if err != nil {
+			t.Fatalf("ListConversations: %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("ListConversations unread after reading all = %v, want none", conversationIDs(got))
+		}
+	})
+
+	t.Run("UnreadExempt", func(t *testing.T) {
+		s := newStore(t)
+		sender, member, blocker := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypeGroup, baseTime, sender, member, blocker)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		save := func(msg *models.Message) {
+			t.Helper()
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+		expectUnread := func(step string, wantMember, wantBlocker int64) {
+			t.Helper()
+			got, err := s.GetConversation(ctx, conv.ID)
+			if err != nil {
+				t.Fatalf("GetConversation: %v", err)
+			}
+			if m, b := got.UnreadCountFor(member), got.UnreadCountFor(blocker); m != wantMember || b != wantBlocker {
+				t.Errorf("%s: unread = member %d, blocker %d; want %d, %d", step, m, b, wantMember, wantBlocker)
+			}
+		}
+
+		root := newMessage(conv.ID, sender, baseTime)
+		save(root)
+		// Tin nhắn gửi khi blocker đã chặn người gửi không được tính là chưa đọc với blocker
+		hidden := newMessage(conv.ID, sender, baseTime.Add(time.Second))
+		hidden.UnreadExempt = []primitive.ObjectID{blocker}
+		save(hidden)
+		expectUnread("after save", 2, 1)
+
+		got, err := s.GetMessage(ctx, hidden.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !equalIDs(got.UnreadExempt, hidden.UnreadExempt) {
+			t.Errorf("UnreadExempt = %v, want %v", got.UnreadExempt, hidden.UnreadExempt)
+		}
+		if !equalIDs(got.ReadBy, []primitive.ObjectID{sender}) {
+			t.Errorf("ReadBy = %v, want only the sender", got.ReadBy)
+		}
+
+		// Đọc (sau khi bỏ chặn) hoặc thu hồi tin nhắn đó cũng không trừ vào số tin chưa đọc của blocker
+		if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{hidden.ID}, blocker, nil); err != nil {
+			t.Fatalf("MarkMessagesRead: %v", err)
+		}
+		expectUnread("after blocker reads", 2, 1)
+		second := newMessage(conv.ID, sender, baseTime.Add(2*time.Second))
+		second.UnreadExempt = []primitive.ObjectID{blocker}
+		save(second)
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *second
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		tombstone.DeletedAt = &deletedAt
+		tombstone.DeletedBy = sender
+		tombstone.UpdatedAt = deletedAt
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+		expectUnread("after delete", 2, 1)
+
+		// Tin trả lời trong thread không làm tăng số tin chưa đọc trong thread của blocker
+		for i, reply := range []*models.Message{
+			newMessage(conv.ID, blocker, baseTime.Add(3*time.Second)),
+			newMessage(conv.ID, sender, baseTime.Add(4*time.Second)),
+			newMessage(conv.ID, member, baseTime.Add(5*time.Second)),
+		} {
+			reply.ThreadRootID = root.ID
+			if i == 1 {
+				reply.UnreadExempt = []primitive.ObjectID{blocker}
+			}
+			save(reply)
+		}
+		gotRoot, err := s.GetMessage(ctx, root.ID)
+		if err != nil {
+			t.Fatalf("GetMessage root: %v", err)
+		}
+		if n := gotRoot.ThreadUnreadCountFor(blocker); n != 1 {
+			t.Errorf("blocker thread unread = %d, want 1", n)
+		}
+		if n := gotRoot.ThreadUnreadCountFor(sender); n != 2 {
+			t.Errorf("sender thread unread = %d, want 2", n)
+		}
+	})
+
+	t.Run("ListMessages", func(t *testing.T) {
+		s := newStore(t)
+		sender, viewer := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, viewer)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		var msgs []*models.Message
+		for i := 0; i < 5; i++ {
+			msg := newMessage(conv.ID, sender, baseTime.Add(time.Duration(i)*time.Second))
+			if i == 2 {
+				msg.HiddenFor = []primitive.ObjectID{viewer}
+			}
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		got, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{Before: msgs[4].ID, Limit: 10})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if len(got) != 4 {
+			t.Errorf("ListMessages without viewer = %v, want all 4 messages", messageIDs(got))
+		}
+
+		got, err = s.ListMessages(ctx, conv.ID, store.MessageQuery{Before: msgs[4].ID, Limit: 10, Viewer: viewer})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		want := []primitive.ObjectID{msgs[3].ID, msgs[1].ID, msgs[0].ID}
+		if ids := messageIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListMessages before = %v, want %v", ids, want)
+		}
+
+		got, err = s.ListMessages(ctx, conv.ID, store.MessageQuery{Limit: 2, Viewer: viewer})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		want = []primitive.ObjectID{msgs[4].ID, msgs[3].ID}
+		if ids := messageIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListMessages with limit = %v, want %v", ids, want)
+		}
+
+		got, err = s.ListMessages(ctx, conv.ID, store.MessageQuery{After: msgs[0].ID, Ascending: true, Limit: 2, Viewer: viewer})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		want = []primitive.ObjectID{msgs[1].ID, msgs[3].ID}
+		if ids := messageIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListMessages after = %v, want %v", ids, want)
+		}
+
+		got, err = s.ListMessages(ctx, conv.ID, store.MessageQuery{After: msgs[0].ID, Before: msgs[4].ID, Viewer: viewer})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		want = []primitive.ObjectID{msgs[3].ID, msgs[1].ID}
+		if ids := messageIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListMessages between = %v, want %v", ids, want)
+		}
+
+		other := newMessage(conv.ID, viewer, baseTime.Add(10*time.Second))
+		if err := s.SaveMessage(ctx, other, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		got, err = s.ListMessages(ctx, conv.ID, store.MessageQuery{Limit: 2, ExcludeSenders: []primitive.ObjectID{sender}})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		want = []primitive.ObjectID{other.ID}
+		if ids := messageIDs(got); !equalIDs(ids, want) {
+			t.Errorf("ListMessages excluding sender = %v, want %v", ids, want)
+		}
+	})
+
+	// Tin nhắn gửi cùng một thời điểm vẫn được phân trang đầy đủ, không trùng lặp
+	t.Run("ListMessagesSameTimestamp", func(t *testing.T) {
+		s := newStore(t)
+		sender := primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, primitive.NewObjectID())
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		var want []primitive.ObjectID
+		for i := 0; i < 5; i++ {
+			msg := newMessage(conv.ID, sender, baseTime)
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			want = append([]primitive.ObjectID{msg.ID}, want...)
+		}
+
+		var got []primitive.ObjectID
+		query := store.MessageQuery{Limit: 2}
+		for {
+			page, err := s.ListMessages(ctx, conv.ID, query)
+			if err != nil {
+				t.Fatalf("ListMessages: %v", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			got = append(got, messageIDs(page)...)
+			query.Before = page[len(page)-1].ID
+		}
+		if !equalIDs(got, want) {
+			t.Errorf("paged messages = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("MarkMessagesRead", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		msg := newMessage(conv.ID, sender, baseTime)
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		// Đánh dấu hai lần để kiểm tra không bị trùng người đọc
+		ids := []primitive.ObjectID{msg.ID, primitive.NewObjectID()}
+		for i := 0; i < 2; i++ {
+			if err := s.MarkMessagesRead(ctx, ids, reader, nil); err != nil {
+				t.Fatalf("MarkMessagesRead: %v", err)
+			}
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if got.Status != models.MessageStatusRead {
+			t.Errorf("Status = %s, want %s", got.Status, models.MessageStatusRead)
+		}
+		if len(got.ReadBy) != 2 {
+			t.Errorf("ReadBy = %v, want sender and reader", got.ReadBy)
+		}
+
+		byIDs, err := s.GetMessagesByIDs(ctx, ids)
+		if err != nil {
+			t.Fatalf("GetMessagesByIDs: %v", err)
+		}
+		if len(byIDs) != 1 || byIDs[0].ID != msg.ID {
+			t.Errorf("GetMessagesByIDs = %v, want only %s", messageIDs(byIDs), msg.ID.Hex())
+		}
+
+		if _, err := s.GetMessage(ctx, primitive.NewObjectID()); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetMessage = %v, want ErrNotFound", err)
+		}
+	})
+
+	// Chạy với -race để phát hiện truy cập dữ liệu không được đồng bộ
+	t.Run("ConcurrentAccess", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				msg := newMessage(conv.ID, sender, baseTime.Add(time.Duration(i)*time.Second))
+				event := newOutboxEvent(msg.CreatedAt, reader)
+				if err := s.SaveMessage(ctx, msg, []*models.OutboxEvent{event}); err != nil {
+					t.Errorf("SaveMessage: %v", err)
+					return
+				}
+				if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{msg.ID}, reader, nil); err != nil {
+					t.Errorf("MarkMessagesRead: %v", err)
+				}
+				if _, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{Limit: 100}); err != nil {
+					t.Errorf("ListMessages: %v", err)
+				}
+				if _, err := s.ListConversations(ctx, reader, store.ConversationQuery{Limit: 10}); err != nil {
+					t.Errorf("ListConversations: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		got, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{Limit: 100})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if len(got) != 8 {
+			t.Errorf("ListMessages returned %d messages, want 8", len(got))
+		}
+
+		updated, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if n := updated.UnreadCountFor(reader); n != 0 {
+			t.Errorf("reader unread = %d, want 0", n)
+		}
+
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if len(events) != 8 {
+			t.Errorf("PendingOutboxEvents returned %d events, want 8", len(events))
+		}
+	})
+
+	// Tin nhắn, tin nhắn cuối cùng và sự kiện outbox phải được ghi cùng nhau hoặc không ghi gì
+	t.Run("SaveMessageNotFound", func(t *testing.T) {
+		s := newStore(t)
+		msg := newMessage(primitive.NewObjectID(), primitive.NewObjectID(), baseTime)
+		event := newOutboxEvent(baseTime, primitive.NewObjectID())
+		if err := s.SaveMessage(ctx, msg, []*models.OutboxEvent{event}); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("SaveMessage = %v, want ErrNotFound", err)
+		}
+
+		if _, err := s.GetMessage(ctx, msg.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetMessage after failed save = %v, want ErrNotFound", err)
+		}
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if len(events) != 0 {
+			t.Errorf("PendingOutboxEvents after failed save = %d events, want 0", len(events))
+		}
+	})
+
+	t.Run("MessageReplyTo", func(t *testing.T) {
+		s := newStore(t)
+		sender := primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, primitive.NewObjectID())
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		original := newMessage(conv.ID, sender, baseTime)
+		reply := newMessage(conv.ID, sender, baseTime.Add(time.Second))
+		reply.ReplyToID = original.ID
+		for _, msg := range []*models.Message{original, reply} {
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+
+		got, err := s.GetMessagesByIDs(ctx, []primitive.ObjectID{original.ID, reply.ID})
+		if err != nil {
+			t.Fatalf("GetMessagesByIDs: %v", err)
+		}
+		replyTo := make(map[primitive.ObjectID]primitive.ObjectID)
+		for _, msg := range got {
+			replyTo[msg.ID] = msg.ReplyToID
+		}
+		if len(got) != 2 || !replyTo[original.ID].IsZero() || replyTo[reply.ID] != original.ID {
+			t.Errorf("ReplyToID = %v, want only the reply to reference %s", replyTo, original.ID.Hex())
+		}
+	})
+
+	t.Run("Threads", func(t *testing.T) {
+		s := newStore(t)
+		author, replier, member := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypeGroup, baseTime, author, replier, member)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		root := newMessage(conv.ID, author, baseTime)
+		if err := s.SaveMessage(ctx, root, nil); err != nil {
+			t.Fatalf("SaveMessage root: %v", err)
+		}
+
+		var replies []*models.Message
+		for i, sender := range []primitive.ObjectID{replier, author, replier} {
+			reply := newMessage(conv.ID, sender, baseTime.Add(time.Duration(i+1)*time.Second))
+			reply.ThreadRootID = root.ID
+			if err := s.SaveMessage(ctx, reply, nil); err != nil {
+				t.Fatalf("SaveMessage reply: %v", err)
+			}
+			replies = append(replies, reply)
+		}
+
+		got, err := s.GetMessage(ctx, root.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if got.ThreadReplyCount != 3 || got.ThreadLastReplyAt == nil || !got.ThreadLastReplyAt.Equal(replies[2].CreatedAt) {
+			t.Errorf("thread stats = %d replies, last at %v; want 3 replies, last at %v",
+				got.ThreadReplyCount, got.ThreadLastReplyAt, replies[2].CreatedAt)
+		}
+		if !got.IsFollowingThread(author) || !got.IsFollowingThread(replier) || got.IsFollowingThread(member) {
+			t.Errorf("ThreadFollowers = %v, want author and replier", got.ThreadFollowers)
+		}
+		if a, r := got.ThreadUnreadCountFor(author), got.ThreadUnreadCountFor(replier); a != 2 || r != 1 {
+			t.Errorf("thread unread = author %d, replier %d; want 2, 1", a, r)
+		}
+
+		// Tin trả lời không nằm trên dòng thời gian chính và không thay đổi cuộc hội thoại
+		timeline, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if ids := messageIDs(timeline); !equalIDs(ids, []primitive.ObjectID{root.ID}) {
+			t.Errorf("ListMessages timeline = %v, want only the root", ids)
+		}
+		thread, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{ThreadRootID: root.ID, Before: replies[2].ID})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if ids := messageIDs(thread); !equalIDs(ids, []primitive.ObjectID{replies[1].ID, replies[0].ID}) {
+			t.Errorf("ListMessages thread = %v, want the two older replies", ids)
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || gotConv.LastMessage.ID != root.ID || gotConv.UnreadCountFor(member) != 1 {
+			t.Errorf("conversation after replies: last %v, member unread %d; want root, 1",
+				gotConv.LastMessage, gotConv.UnreadCountFor(member))
+		}
+		if err := s.MarkMessagesRead(ctx, messageIDs(replies), member, nil); err != nil {
+			t.Fatalf("MarkMessagesRead: %v", err)
+		}
+		if gotConv, err = s.GetConversation(ctx, conv.ID); err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if n := gotConv.UnreadCountFor(member); n != 1 {
+			t.Errorf("member unread after reading replies = %d, want 1", n)
+		}
+
+		if err := s.MarkThreadRead(ctx, root.ID, author); err != nil {
+			t.Fatalf("MarkThreadRead: %v", err)
+		}
+		if err := s.FollowThread(ctx, root.ID, member, true); err != nil {
+			t.Fatalf("FollowThread: %v", err)
+		}
+		if err := s.FollowThread(ctx, root.ID, replier, false); err != nil {
+			t.Fatalf("FollowThread: %v", err)
+		}
+		if got, err = s.GetMessage(ctx, root.ID); err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if got.ThreadUnreadCountFor(author) != 0 || got.ThreadUnreadCountFor(replier) != 0 {
+			t.Errorf("thread unread after read/unfollow = %v, want none", got.ThreadUnreadCounts)
+		}
+		if !got.IsFollowingThread(member) || got.IsFollowingThread(replier) {
+			t.Errorf("ThreadFollowers after follow/unfollow = %v, want member but not replier", got.ThreadFollowers)
+		}
+
+		if err := s.SetThreadOptIn(ctx, conv.ID, member, true); err != nil {
+			t.Fatalf("SetThreadOptIn: %v", err)
+		}
+		if gotConv, err = s.GetConversation(ctx, conv.ID); err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if !equalIDs(gotConv.ThreadOptIns, []primitive.ObjectID{member}) {
+			t.Errorf("ThreadOptIns = %v, want [%s]", gotConv.ThreadOptIns, member.Hex())
+		}
+		if err := s.SetThreadOptIn(ctx, conv.ID, member, false); err != nil {
+			t.Fatalf("SetThreadOptIn: %v", err)
+		}
+		if gotConv, err = s.GetConversation(ctx, conv.ID); err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if len(gotConv.ThreadOptIns) != 0 {
+			t.Errorf("ThreadOptIns after opting out = %v, want none", gotConv.ThreadOptIns)
+		}
+
+		orphan := newMessage(conv.ID, replier, baseTime)
+		orphan.ThreadRootID = primitive.NewObjectID()
+		if err := s.SaveMessage(ctx, orphan, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("SaveMessage with missing thread root = %v, want ErrNotFound", err)
+		}
+		if err := s.FollowThread(ctx, primitive.NewObjectID(), member, true); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("FollowThread of missing message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("EditMessage", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		msg := newMessage(conv.ID, sender, baseTime)
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		editedAt := baseTime.Add(time.Minute)
+		msg.EditHistory = []models.MessageEdit{{Content: msg.Content, ReplacedAt: editedAt}}
+		msg.Content = "đã sửa"
+		msg.EditedAt = &editedAt
+		msg.UpdatedAt = editedAt
+		event := newOutboxEvent(editedAt, sender, reader)
+		if err := s.EditMessage(ctx, msg, []*models.OutboxEvent{event}); err != nil {
+			t.Fatalf("EditMessage: %v", err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if got.Content != "đã sửa" || got.EditedAt == nil || !got.EditedAt.Equal(editedAt) {
+			t.Errorf("GetMessage after edit = %q edited at %v, want %q edited at %v", got.Content, got.EditedAt, "đã sửa", editedAt)
+		}
+		if len(got.EditHistory) != 1 || got.EditHistory[0].Content != msg.EditHistory[0].Content ||
+			!got.EditHistory[0].ReplacedAt.Equal(editedAt) {
+			t.Errorf("EditHistory = %+v, want %+v", got.EditHistory, msg.EditHistory)
+		}
+
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || gotConv.LastMessage.Content != "đã sửa" {
+			t.Errorf("LastMessage after edit = %+v, want edited content", gotConv.LastMessage)
+		}
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID}) {
+			t.Errorf("PendingOutboxEvents after edit = %v, want %s", ids, event.ID.Hex())
+		}
+
+		missing := newMessage(conv.ID, sender, baseTime)
+		if err := s.EditMessage(ctx, missing, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("EditMessage of missing message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("DeleteMessage", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader, other := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypeGroup, baseTime, sender, reader, other)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		earlier := newMessage(conv.ID, sender, baseTime)
+		msg := newMessage(conv.ID, sender, baseTime.Add(time.Second))
+		for _, m := range []*models.Message{earlier, msg} {
+			if err := s.SaveMessage(ctx, m, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+		if err := s.MarkMessagesRead(ctx, []primitive.ObjectID{msg.ID}, reader, nil); err != nil {
+			t.Fatalf("MarkMessagesRead: %v", err)
+		}
+
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *msg
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		tombstone.DeletedAt = &deletedAt
+		tombstone.DeletedBy = sender
+		tombstone.UpdatedAt = deletedAt
+		event := newOutboxEvent(deletedAt, sender, reader, other)
+		if err := s.DeleteMessage(ctx, &tombstone, []*models.OutboxEvent{event}); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !got.IsDeleted || got.Content != "" || got.DeletedAt == nil || !got.DeletedAt.Equal(deletedAt) || got.DeletedBy != sender {
+			t.Errorf("GetMessage after delete = %+v, want tombstone deleted by sender", got)
+		}
+
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || !gotConv.LastMessage.IsDeleted || gotConv.LastMessage.Content != "" {
+			t.Errorf("LastMessage after delete = %+v, want tombstone", gotConv.LastMessage)
+		}
+		// Chỉ thành viên chưa đọc tin nhắn bị thu hồi mới được trừ số tin chưa đọc
+		for userID, want := range map[primitive.ObjectID]int64{sender: 0, reader: 1, other: 1} {
+			if n := gotConv.UnreadCountFor(userID); n != want {
+				t.Errorf("UnreadCountFor(%s) after delete = %d, want %d", userID.Hex(), n, want)
+			}
+		}
+
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID}) {
+			t.Errorf("PendingOutboxEvents after delete = %v, want %s", ids, event.ID.Hex())
+		}
+
+		if err := s.DeleteMessage(ctx, &tombstone, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("DeleteMessage of deleted message = %v, want ErrNotFound", err)
+		}
+		missing := newMessage(conv.ID, sender, baseTime)
+		if err := s.DeleteMessage(ctx, missing, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("DeleteMessage of missing message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("EditDeletedMessage", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		msg := newMessage(conv.ID, sender, baseTime)
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		// Lần sửa đọc tin nhắn trước khi nó bị thu hồi và ghi sau đó
+		editedAt := baseTime.Add(2 * time.Minute)
+		edited := *msg
+		edited.EditHistory = []models.MessageEdit{{Content: msg.Content, ReplacedAt: editedAt}}
+		edited.Content = "sửa muộn"
+		edited.EditedAt = &editedAt
+		edited.UpdatedAt = editedAt
+
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *msg
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		tombstone.DeletedAt = &deletedAt
+		tombstone.DeletedBy = sender
+		tombstone.UpdatedAt = deletedAt
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+
+		event := newOutboxEvent(editedAt, sender, reader)
+		if err := s.EditMessage(ctx, &edited, []*models.OutboxEvent{event}); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("EditMessage of deleted message = %v, want ErrNotFound", err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !got.IsDeleted || got.Content != "" || got.EditedAt != nil || len(got.EditHistory) != 0 {
+			t.Errorf("GetMessage after edit of deleted message = %+v, want unchanged tombstone", got)
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || !gotConv.LastMessage.IsDeleted || gotConv.LastMessage.Content != "" {
+			t.Errorf("LastMessage after edit of deleted message = %+v, want tombstone", gotConv.LastMessage)
+		}
+		found, err := s.SearchMessages(ctx, store.MessageSearchQuery{Terms: search.Terms("muộn"), Viewer: reader})
+		if err != nil {
+			t.Fatalf("SearchMessages: %v", err)
+		}
+		if len(found) != 0 {
+			t.Errorf("SearchMessages found %d messages for the rejected edit, want 0", len(found))
+		}
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if len(events) != 0 {
+			t.Errorf("PendingOutboxEvents after rejected edit = %d events, want 0", len(events))
+		}
+	})
+
+	t.Run("HideMessage", func(t *testing.T) {
+		s := newStore(t)
+		sender, viewer := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, viewer)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		earlier := newMessage(conv.ID, sender, baseTime.Add(-time.Second))
+		msg := newMessage(conv.ID, sender, baseTime)
+		for _, m := range []*models.Message{earlier, msg} {
+			if err := s.SaveMessage(ctx, m, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+
+		event := newOutboxEvent(baseTime, viewer)
+		for i := 0; i < 2; i++ {
+			if err := s.HideMessage(ctx, msg.ID, viewer, nil); err != nil {
+				t.Fatalf("HideMessage: %v", err)
+			}
+		}
+		if err := s.HideMessage(ctx, msg.ID, viewer, []*models.OutboxEvent{event}); err != nil {
+			t.Fatalf("HideMessage: %v", err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !equalIDs(got.HiddenFor, []primitive.ObjectID{viewer}) {
+			t.Errorf("HiddenFor = %v, want [%s]", got.HiddenFor, viewer.Hex())
+		}
+		// Tin nhắn đã ẩn được tính là đã đọc, chỉ một lần dù bị ẩn nhiều lần
+		if !equalIDs(got.ReadBy, []primitive.ObjectID{sender, viewer}) {
+			t.Errorf("ReadBy after hide = %v, want [%s %s]", got.ReadBy, sender.Hex(), viewer.Hex())
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || !gotConv.LastMessage.IsHiddenFor(viewer) || gotConv.LastMessage.IsHiddenFor(sender) {
+			t.Errorf("LastMessage.HiddenFor = %v, want hidden for viewer only", gotConv.LastMessage)
+		}
+		if n := gotConv.UnreadCountFor(viewer); n != 1 {
+			t.Errorf("UnreadCountFor(viewer) after hide = %d, want 1", n)
+		}
+
+		listed, err := s.ListMessages(ctx, conv.ID, store.MessageQuery{Viewer: viewer})
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if ids := messageIDs(listed); !equalIDs(ids, []primitive.ObjectID{earlier.ID}) {
+			t.Errorf("ListMessages for viewer = %v, want [%s]", ids, earlier.ID.Hex())
+		}
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID}) {
+			t.Errorf("PendingOutboxEvents after hide = %v, want %s", ids, event.ID.Hex())
+		}
+
+		if err := s.HideMessage(ctx, primitive.NewObjectID(), viewer, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("HideMessage of missing message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Reactions", func(t *testing.T) {
+		s := newStore(t)
+		sender, reactor := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reactor)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		msg := newMessage(conv.ID, sender, baseTime)
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		thumbsUp := models.Reaction{Emoji: "👍", UserID: reactor, CreatedAt: baseTime.Add(time.Second)}
+		heart := models.Reaction{Emoji: "❤️", UserID: reactor, CreatedAt: baseTime.Add(2 * time.Second)}
+		senderThumbsUp := models.Reaction{Emoji: "👍", UserID: sender, CreatedAt: baseTime.Add(3 * time.Second)}
+		event := newOutboxEvent(baseTime, sender)
+		for _, reaction := range []models.Reaction{thumbsUp, heart, senderThumbsUp} {
+			var events []*models.OutboxEvent
+			if reaction == thumbsUp {
+				events = []*models.OutboxEvent{event}
+			}
+			if added, err := s.AddReaction(ctx, msg.ID, reaction, events); err != nil || !added {
+				t.Fatalf("AddReaction(%s) = %v, %v, want true", reaction.Emoji, added, err)
+			}
+		}
+		// Thả lại cùng emoji không tạo reaction mới hay ghi sự kiện
+		duplicate := newOutboxEvent(baseTime, sender)
+		if added, err := s.AddReaction(ctx, msg.ID, thumbsUp, []*models.OutboxEvent{duplicate}); err != nil || added {
+			t.Errorf("AddReaction of duplicate = %v, %v, want false", added, err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		want := []models.ReactionSummary{{Emoji: "👍", Count: 2, ReactedByMe: true}, {Emoji: "❤️", Count: 1, ReactedByMe: true}}
+		if summaries := got.ReactionSummaries(reactor); !reflect.DeepEqual(summaries, want) {
+			t.Errorf("ReactionSummaries = %+v, want %+v", summaries, want)
+		}
+		if len(got.Reactions) != 3 || got.Reactions[0].UserID != reactor || !got.Reactions[0].CreatedAt.Equal(thumbsUp.CreatedAt) {
+			t.Errorf("Reactions = %+v, want reactions in order added", got.Reactions)
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || len(gotConv.LastMessage.Reactions) != 3 {
+			t.Errorf("LastMessage.Reactions = %+v, want 3 reactions", gotConv.LastMessage)
+		}
+
+		removeEvent := newOutboxEvent(baseTime, sender)
+		if removed, err := s.RemoveReaction(ctx, msg.ID, reactor, "👍", []*models.OutboxEvent{removeEvent}); err != nil || !removed {
+			t.Fatalf("RemoveReaction = %v, %v, want true", removed, err)
+		}
+		if removed, err := s.RemoveReaction(ctx, msg.ID, reactor, "👍", []*models.OutboxEvent{duplicate}); err != nil || removed {
+			t.Errorf("RemoveReaction of missing reaction = %v, %v, want false", removed, err)
+		}
+		got, err = s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		want = []models.ReactionSummary{{Emoji: "❤️", Count: 1}, {Emoji: "👍", Count: 1}}
+		if summaries := got.ReactionSummaries(primitive.NilObjectID); !reflect.DeepEqual(summaries, want) {
+			t.Errorf("ReactionSummaries after remove = %+v, want %+v", summaries, want)
+		}
+
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID, removeEvent.ID}) {
+			t.Errorf("PendingOutboxEvents = %v, want add and remove events only", ids)
+		}
+
+		// Tombstone không giữ lại reaction và không nhận reaction mới
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *got
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		tombstone.Reactions = nil
+		tombstone.DeletedAt = &deletedAt
+		tombstone.UpdatedAt = deletedAt
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+		if got, err = s.GetMessage(ctx, msg.ID); err != nil || len(got.Reactions) != 0 {
+			t.Errorf("Reactions after delete = %+v, %v, want none", got, err)
+		}
+		if _, err := s.AddReaction(ctx, msg.ID, thumbsUp, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("AddReaction on deleted message = %v, want ErrNotFound", err)
+		}
+		if _, err := s.AddReaction(ctx, primitive.NewObjectID(), thumbsUp, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("AddReaction on missing message = %v, want ErrNotFound", err)
+		}
+		if _, err := s.RemoveReaction(ctx, primitive.NewObjectID(), reactor, "👍", nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("RemoveReaction on missing message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("SearchMessages", func(t *testing.T) {
+		s := newStore(t)
+		alice, bob, carol := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+		withBob := newConversation(models.ConversationTypePersonal, baseTime, alice, bob)
+		withCarol := newConversation(models.ConversationTypePersonal, baseTime, alice, carol)
+		withoutAlice := newConversation(models.ConversationTypePersonal, baseTime, bob, carol)
+		for _, conv := range []*models.Conversation{withBob, withCarol, withoutAlice} {
+			if err := s.CreateConversation(ctx, conv); err != nil {
+				t.Fatalf("CreateConversation: %v", err)
+			}
+		}
+		file := &models.Attachment{
+			ID:          primitive.NewObjectID(),
+			UploaderID:  carol,
+			Key:         "attachments/" + primitive.NewObjectID().Hex(),
+			Filename:    "menu.pdf",
+			ContentType: "application/pdf",
+			Size:        2048,
+			CreatedAt:   baseTime,
+		}
+		if err := s.CreateAttachment(ctx, file); err != nil {
+			t.Fatalf("CreateAttachment: %v", err)
+		}
+
+		send := func(conv *models.Conversation, sender primitive.ObjectID, minute int, content string) *models.Message {
+			msg := newMessage(conv.ID, sender, baseTime.Add(time.Duration(minute)*time.Minute))
+			msg.Content = content
+			return msg
+		}
+		greeting := send(withBob, alice, 0, "Xin chào các bạn")
+		morning := send(withBob, bob, 1, "chao buoi sang, hẹn gặp lại")
+		withFile := send(withCarol, carol, 2, "CHÀO Alice! Thực đơn đây")
+		withFile.Attachments = []models.AttachmentRef{file.Ref()}
+		private := send(withoutAlice, bob, 3, "chào Carol")
+		reply := send(withBob, alice, 4, "chào lại")
+		reply.ThreadRootID = greeting.ID
+		deleted := send(withBob, bob, 5, "chào, tin này sẽ bị thu hồi")
+		hidden := send(withBob, bob, 6, "chào, alice đã xóa tin này")
+		edited := send(withBob, alice, 7, "hello world")
+		for _, msg := range []*models.Message{greeting, morning, withFile, private, reply, deleted, hidden, edited} {
+			if err := s.SaveMessage(ctx, msg, nil); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+		}
+
+		tombstone := *deleted
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		deletedAt := baseTime.Add(time.Hour)
+		tombstone.DeletedAt = &deletedAt
+		tombstone.DeletedBy = bob
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+		if err := s.HideMessage(ctx, hidden.ID, alice, nil); err != nil {
+			t.Fatalf("HideMessage: %v", err)
+		}
+		editedAt := baseTime.Add(time.Hour)
+		edited.EditHistory = []models.MessageEdit{{Content: edited.Content, ReplacedAt: editedAt}}
+		edited.Content = "chào thế giới"
+		edited.EditedAt = &editedAt
+		edited.UpdatedAt = editedAt
+		if err := s.EditMessage(ctx, edited, nil); err != nil {
+			t.Fatalf("EditMessage: %v", err)
+		}
+
+		cases := []struct {
+			name  string
+			query store.MessageSearchQuery
+			want  []*models.Message
+		}{
+			{"case and diacritics", store.MessageSearchQuery{Terms: search.Terms("Chào")},
+				[]*models.Message{edited, reply, withFile, morning, greeting}},
+			{"all terms", store.MessageSearchQuery{Terms: search.Terms("chào sáng")}, []*models.Message{morning}},
+			{"old content after edit", store.MessageSearchQuery{Terms: search.Terms("hello")}, nil},
+			{"new content after edit", store.MessageSearchQuery{Terms: search.Terms("giới")}, []*models.Message{edited}},
+			{"conversation", store.MessageSearchQuery{Terms: search.Terms("chao"), ConversationID: withCarol.ID},
+				[]*models.Message{withFile}},
+			{"conversation without viewer", store.MessageSearchQuery{Terms: search.Terms("chao"), ConversationID: withoutAlice.ID}, nil},
+			{"sender", store.MessageSearchQuery{Terms: search.Terms("chao"), SenderID: bob}, []*models.Message{morning}},
+			{"exclude senders", store.MessageSearchQuery{Terms: search.Terms("chao"), ExcludeSenders: []primitive.ObjectID{alice, carol}},
+				[]*models.Message{morning}},
+			{"sender and exclude senders", store.MessageSearchQuery{Terms: search.Terms("chao"), SenderID: bob,
+				ExcludeSenders: []primitive.ObjectID{bob}}, nil},
+			{"date range", store.MessageSearchQuery{Terms: search.Terms("chao"),
+				Since: morning.CreatedAt, Until: reply.CreatedAt}, []*models.Message{withFile, morning}},
+			{"has attachment", store.MessageSearchQuery{Terms: search.Terms("chao"), HasAttachment: true},
+				[]*models.Message{withFile}},
+			{"page", store.MessageSearchQuery{Terms: search.Terms("chao"), Before: withFile.ID, Limit: 1},
+				[]*models.Message{morning}},
+			{"no terms", store.MessageSearchQuery{}, nil},
+		}
+		for _, tc := range cases {
+			tc.query.Viewer = alice
+			got, err := s.SearchMessages(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("SearchMessages %s: %v", tc.name, err)
+			}
+			if ids, want := messageIDs(got), messageIDs(tc.want); !equalIDs(ids, want) {
+				t.Errorf("SearchMessages %s = %v, want %v", tc.name, ids, want)
+			}
+		}
+
+		got, err := s.SearchMessages(ctx, store.MessageSearchQuery{Terms: search.Terms("carol"), Viewer: bob})
+		if err != nil {
+			t.Fatalf("SearchMessages: %v", err)
+		}
+		if len(got) != 1 || got[0].ID != private.ID || got[0].Content != private.Content || got[0].SenderID != bob {
+			t.Errorf("SearchMessages for bob = %+v, want %s", got, private.ID.Hex())
+		}
+	})
+
+	t.Run("VoiceMessages", func(t *testing.T) {
+		s := newStore(t)
+		sender, listener := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, listener)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		voice := &models.Attachment{
+			ID:          primitive.NewObjectID(),
+			UploaderID:  sender,
+			Key:         "attachments/" + primitive.NewObjectID().Hex(),
+			Filename:    "voice.ogg",
+			ContentType: "audio/ogg",
+			Size:        4096,
+			Audio:       &models.AudioInfo{DurationMs: 3250, Waveform: []int{0, 40, 100, 75, 10}},
+			CreatedAt:   baseTime,
+		}
+		if err := s.CreateAttachment(ctx, voice); err != nil {
+			t.Fatalf("CreateAttachment: %v", err)
+		}
+		if got, err := s.GetAttachment(ctx, voice.ID); err != nil || !reflect.DeepEqual(got.Audio, voice.Audio) {
+			t.Errorf("GetAttachment audio = %+v, %v, want %+v", got, err, voice.Audio)
+		}
+
+		msg := newMessage(conv.ID, sender, baseTime)
+		msg.Kind = models.MessageKindVoice
+		msg.Content = ""
+		msg.Attachments = []models.AttachmentRef{voice.Ref()}
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		event := newOutboxEvent(baseTime, sender)
+		if played, err := s.MarkMessagePlayed(ctx, msg.ID, listener, []*models.OutboxEvent{event}); err != nil || !played {
+			t.Fatalf("MarkMessagePlayed = %v, %v, want true", played, err)
+		}
+		// Nghe lại không ghi thêm sự kiện
+		duplicate := newOutboxEvent(baseTime, sender)
+		if played, err := s.MarkMessagePlayed(ctx, msg.ID, listener, []*models.OutboxEvent{duplicate}); err != nil || played {
+			t.Errorf("MarkMessagePlayed again = %v, %v, want false", played, err)
+		}
+
+		got, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !got.IsVoice() || !equalIDs(got.PlayedBy, []primitive.ObjectID{listener}) || !reflect.DeepEqual(got.Attachments, msg.Attachments) {
+			t.Errorf("GetMessage = kind %q, played by %v, attachments %+v, want voice played by listener", got.Kind, got.PlayedBy, got.Attachments)
+		}
+		// Nghe không phải là đọc
+		if !equalIDs(got.ReadBy, msg.ReadBy) {
+			t.Errorf("ReadBy = %v, want listener not marked as read", got.ReadBy)
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || !equalIDs(gotConv.LastMessage.PlayedBy, []primitive.ObjectID{listener}) {
+			t.Errorf("LastMessage = %+v, want played by listener", gotConv.LastMessage)
+		}
+
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(events); !equalIDs(ids, []primitive.ObjectID{event.ID}) {
+			t.Errorf("PendingOutboxEvents = %v, want first played event only", ids)
+		}
+
+		if _, err := s.MarkMessagePlayed(ctx, primitive.NewObjectID(), listener, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("MarkMessagePlayed on missing message = %v, want ErrNotFound", err)
+		}
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *got
+		tombstone.IsDeleted = true
+		tombstone.Attachments = nil
+		tombstone.DeletedAt = &deletedAt
+		tombstone.UpdatedAt = deletedAt
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+		if _, err := s.MarkMessagePlayed(ctx, msg.ID, sender, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("MarkMessagePlayed on deleted message = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("FriendRequests", func(t *testing.T) {
+		s := newStore(t)
+		alice, bob, carol := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+		req := newFriendRequest(alice, bob)
+		if err := s.CreateFriendRequest(ctx, req, []*models.OutboxEvent{newOutboxEvent(baseTime, bob)}); err != nil {
+			t.Fatalf("CreateFriendRequest: %v", err)
+		}
+		// Mỗi cặp chỉ có một lời mời, theo cả hai chiều
+		for _, dup := range []*models.FriendRequest{newFriendRequest(alice, bob), newFriendRequest(bob, alice)} {
+			if err := s.CreateFriendRequest(ctx, dup, nil); !errors.Is(err, store.ErrDuplicateFriendRequest) {
+				t.Errorf("CreateFriendRequest duplicate = %v, want ErrDuplicateFriendRequest", err)
+			}
+		}
+		other := newFriendRequest(carol, alice)
+		if err := s.CreateFriendRequest(ctx, other, nil); err != nil {
+			t.Fatalf("CreateFriendRequest: %v", err)
+		}
+
+		got, err := s.FindFriendRequest(ctx, bob, alice)
+		if err != nil {
+			t.Fatalf("FindFriendRequest: %v", err)
+		}
+		if got.ID != req.ID || got.SenderID != alice || got.RecipientID != bob || got.Status != models.FriendRequestPending {
+			t.Errorf("FindFriendRequest = %+v, want %+v", got, req)
+		}
+		if _, err := s.FindFriendRequest(ctx, bob, carol); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("FindFriendRequest missing = %v, want ErrNotFound", err)
+		}
+
+		list := func(userID primitive.ObjectID, status models.FriendRequestStatus, want ...primitive.ObjectID) {
+			t.Helper()
+			got, err := s.ListFriendRequests(ctx, userID, status)
+			if err != nil {
+				t.Fatalf("ListFriendRequests: %v", err)
+			}
+			ids := []primitive.ObjectID{}
+			for _, req := range got {
+				ids = append(ids, req.ID)
+			}
+			if !equalIDs(ids, want) {
+				t.Errorf("ListFriendRequests(%s) = %v, want %v", status, ids, want)
+			}
+		}
+		list(alice, models.FriendRequestPending, other.ID, req.ID)
+		list(bob, models.FriendRequestPending, req.ID)
+		list(alice, models.FriendRequestAccepted)
+
+		// Thao tác với trạng thái không khớp không thay đổi gì
+		if deleted, err := s.DeleteFriendRequest(ctx, req.ID, models.FriendRequestAccepted, []*models.OutboxEvent{newOutboxEvent(baseTime, bob)}); err != nil || deleted {
+			t.Errorf("DeleteFriendRequest wrong status = %v, %v; want false, nil", deleted, err)
+		}
+		acceptedAt := baseTime.Add(time.Hour)
+		if accepted, err := s.AcceptFriendRequest(ctx, req.ID, acceptedAt, []*models.OutboxEvent{newOutboxEvent(acceptedAt, alice)}); err != nil || !accepted {
+			t.Fatalf("AcceptFriendRequest = %v, %v; want true, nil", accepted, err)
+		}
+		if accepted, err := s.AcceptFriendRequest(ctx, req.ID, acceptedAt, []*models.OutboxEvent{newOutboxEvent(acceptedAt, alice)}); err != nil || accepted {
+			t.Errorf("AcceptFriendRequest again = %v, %v; want false, nil", accepted, err)
+		}
+		if _, err := s.AcceptFriendRequest(ctx, primitive.NewObjectID(), acceptedAt, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("AcceptFriendRequest missing = %v, want ErrNotFound", err)
+		}
+		got, err = s.GetFriendRequest(ctx, req.ID)
+		if err != nil {
+			t.Fatalf("GetFriendRequest: %v", err)
+		}
+		if got.Status != models.FriendRequestAccepted || !got.UpdatedAt.Equal(acceptedAt) {
+			t.Errorf("GetFriendRequest after accept = %+v", got)
+		}
+		list(alice, models.FriendRequestPending, other.ID)
+		list(bob, models.FriendRequestAccepted, req.ID)
+
+		if deleted, err := s.DeleteFriendRequest(ctx, req.ID, models.FriendRequestAccepted, []*models.OutboxEvent{newOutboxEvent(acceptedAt, bob)}); err != nil || !deleted {
+			t.Fatalf("DeleteFriendRequest = %v, %v; want true, nil", deleted, err)
+		}
+		if _, err := s.DeleteFriendRequest(ctx, req.ID, models.FriendRequestAccepted, nil); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("DeleteFriendRequest again = %v, want ErrNotFound", err)
+		}
+		// Sau khi xóa, hai người có thể gửi lời mời mới
+		if err := s.CreateFriendRequest(ctx, newFriendRequest(bob, alice), nil); err != nil {
+			t.Errorf("CreateFriendRequest after delete: %v", err)
+		}
+
+		// Chỉ các thao tác đã thay đổi dữ liệu ghi sự kiện: tạo, chấp nhận và xóa lời mời req
+		events, err := s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if len(events) != 3 {
+			t.Errorf("PendingOutboxEvents = %d events, want 3", len(events))
+		}
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		s := newStore(t)
+		sender, other := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, other)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		newAttachment := func(uploaderID primitive.ObjectID) *models.Attachment {
+			attachment := &models.Attachment{
+				ID:          primitive.NewObjectID(),
+				UploaderID:  uploaderID,
+				Key:         "attachments/" + primitive.NewObjectID().Hex(),
+				Filename:    "photo.png",
+				ContentType: "image/png",
+				Size:        1024,
+				Image: &models.ImageInfo{
+					Width: 1280, Height: 960, ThumbnailWidth: 320, ThumbnailHeight: 240, Blurhash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+				},
+				ThumbnailKey:  "thumbnails/" + primitive.NewObjectID().Hex(),
+				ThumbnailType: "image/jpeg",
+				CreatedAt:     baseTime,
+			}
+			if err := s.CreateAttachment(ctx, attachment); err != nil {
+				t.Fatalf("CreateAttachment: %v", err)
+			}
+			return attachment
+		}
+		first, second := newAttachment(sender), newAttachment(sender)
+		othersAttachment := newAttachment(other)
+
+		got, err := s.GetAttachment(ctx, first.ID)
+		if err != nil {
+			t.Fatalf("GetAttachment: %v", err)
+		}
+		if got.IsAttached() || got.Key != first.Key || got.UploaderID != sender || got.Size != first.Size || !got.CreatedAt.Equal(baseTime) {
+			t.Errorf("GetAttachment = %+v, want unbound %+v", got, first)
+		}
+		if !reflect.DeepEqual(got.Image, first.Image) || got.ThumbnailKey != first.ThumbnailKey || got.ThumbnailType != first.ThumbnailType {
+			t.Errorf("GetAttachment image = %+v, %q, %q, want %+v, %q, %q",
+				got.Image, got.ThumbnailKey, got.ThumbnailType, first.Image, first.ThumbnailKey, first.ThumbnailType)
+		}
+
+		// Không gắn được tệp của người khác, và khi thất bại không tệp nào bị gắn
+		rejected := newMessage(conv.ID, sender, baseTime)
+		rejected.Attachments = []models.AttachmentRef{second.Ref(), othersAttachment.Ref()}
+		if err := s.SaveMessage(ctx, rejected, nil); !errors.Is(err, store.ErrAttachmentUnavailable) {
+			t.Fatalf("SaveMessage with another user's attachment = %v, want ErrAttachmentUnavailable", err)
+		}
+		if got, err := s.GetAttachment(ctx, second.ID); err != nil || got.IsAttached() {
+			t.Errorf("attachment after failed SaveMessage = %+v, %v, want unbound", got, err)
+		}
+		if _, err := s.GetMessage(ctx, rejected.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetMessage of rejected message = %v, want ErrNotFound", err)
+		}
+
+		msg := newMessage(conv.ID, sender, baseTime.Add(time.Second))
+		msg.Attachments = []models.AttachmentRef{first.Ref(), second.Ref()}
+		if err := s.SaveMessage(ctx, msg, nil); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		gotMsg, err := s.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if !reflect.DeepEqual(gotMsg.Attachments, msg.Attachments) {
+			t.Errorf("Attachments = %+v, want %+v", gotMsg.Attachments, msg.Attachments)
+		}
+		if got, err := s.GetAttachment(ctx, first.ID); err != nil || got.MessageID != msg.ID || got.ConversationID != conv.ID {
+			t.Errorf("attachment after SaveMessage = %+v, %v, want bound to message", got, err)
+		}
+
+		// Mỗi tệp chỉ được gắn vào một tin nhắn
+		reused := newMessage(conv.ID, sender, baseTime.Add(2*time.Second))
+		reused.Attachments = []models.AttachmentRef{first.Ref()}
+		if err := s.SaveMessage(ctx, reused, nil); !errors.Is(err, store.ErrAttachmentUnavailable) {
+			t.Errorf("SaveMessage with bound attachment = %v, want ErrAttachmentUnavailable", err)
+		}
+		missing := newMessage(conv.ID, sender, baseTime.Add(2*time.Second))
+		missing.Attachments = []models.AttachmentRef{{ID: primitive.NewObjectID(), Filename: "x", ContentType: "image/png"}}
+		if err := s.SaveMessage(ctx, missing, nil); !errors.Is(err, store.ErrAttachmentUnavailable) {
+			t.Errorf("SaveMessage with missing attachment = %v, want ErrAttachmentUnavailable", err)
+		}
+
+		// Tombstone không giữ lại tệp đính kèm
+		deletedAt := baseTime.Add(time.Minute)
+		tombstone := *gotMsg
+		tombstone.IsDeleted = true
+		tombstone.Content = ""
+		tombstone.Attachments = nil
+		tombstone.DeletedAt = &deletedAt
+		tombstone.UpdatedAt = deletedAt
+		if err := s.DeleteMessage(ctx, &tombstone, nil); err != nil {
+			t.Fatalf("DeleteMessage: %v", err)
+		}
+		if gotMsg, err = s.GetMessage(ctx, msg.ID); err != nil || len(gotMsg.Attachments) != 0 {
+			t.Errorf("Attachments after delete = %+v, %v, want none", gotMsg, err)
+		}
+		gotConv, err := s.GetConversation(ctx, conv.ID)
+		if err != nil {
+			t.Fatalf("GetConversation: %v", err)
+		}
+		if gotConv.LastMessage == nil || len(gotConv.LastMessage.Attachments) != 0 {
+			t.Errorf("LastMessage.Attachments = %+v, want none", gotConv.LastMessage)
+		}
+
+		if err := s.DeleteAttachments(ctx, []primitive.ObjectID{first.ID, second.ID, primitive.NewObjectID()}); err != nil {
+			t.Fatalf("DeleteAttachments: %v", err)
+		}
+		if _, err := s.GetAttachment(ctx, first.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("GetAttachment after delete = %v, want ErrNotFound", err)
+		}
+		if _, err := s.GetAttachment(ctx, othersAttachment.ID); err != nil {
+			t.Errorf("GetAttachment of remaining attachment = %v", err)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStore(t)
+		sender, reader := primitive.NewObjectID(), primitive.NewObjectID()
+		conv := newConversation(models.ConversationTypePersonal, baseTime, sender, reader)
+		if err := s.CreateConversation(ctx, conv); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+
+		var events []*models.OutboxEvent
+		for i := 0; i < 3; i++ {
+			msg := newMessage(conv.ID, sender, baseTime.Add(time.Duration(i)*time.Second))
+			event := newOutboxEvent(msg.CreatedAt, reader)
+			if err := s.SaveMessage(ctx, msg, []*models.OutboxEvent{event}); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			events = append(events, event)
+		}
+
+		got, err := s.PendingOutboxEvents(ctx, 2)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(got); !equalIDs(ids, []primitive.ObjectID{events[0].ID, events[1].ID}) {
+			t.Errorf("PendingOutboxEvents = %v, want the two oldest events", ids)
+		}
+		first := got[0]
+		if first.Type != events[0].Type || string(first.Payload) != string(events[0].Payload) ||
+			!equalIDs(first.Recipients, events[0].Recipients) || !first.CreatedAt.Equal(events[0].CreatedAt) {
+			t.Errorf("PendingOutboxEvents[0] = %+v, want %+v", first, events[0])
+		}
+
+		if err := s.DeleteOutboxEvents(ctx, outboxEventIDs(got)); err != nil {
+			t.Fatalf("DeleteOutboxEvents: %v", err)
+		}
+		got, err = s.PendingOutboxEvents(ctx, 0)
+		if err != nil {
+			t.Fatalf("PendingOutboxEvents: %v", err)
+		}
+		if ids := outboxEventIDs(got); !equalIDs(ids, []primitive.ObjectID{events[2].ID}) {
+			t.Errorf("PendingOutboxEvents after delete = %v, want %s", ids, events[2].ID.Hex())
+		}
+	})
+}
+
+func newUser(email string) *models.User {
+	return &models.User{
+		ID:        primitive.NewObjectID(),
+		Email:     email,
+		Password:  "hashed",
+		Name:      "Test User",
+		Status:    models.UserStatusOffline,
+		CreatedAt: baseTime,
+		UpdatedAt: baseTime,
+	}
+}
+
+func newConversation(convType models.ConversationType, updatedAt time.Time, participants ...primitive.ObjectID) *models.Conversation {
+	return &models.Conversation{
+		ID:           primitive.NewObjectID(),
+		Type:         convType,
+		Participants: participants,
+		CreatedAt:    baseTime,
+		UpdatedAt:    updatedAt,
+	}
+}
+
+func newMessage(conversationID, senderID primitive.ObjectID, createdAt time.Time) *models.Message {
+	return &models.Message{
+		ID:             primitive.NewObjectID(),
+		Type:           models.MessageTypePersonal,
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Content:        "hello",
+		Status:         models.MessageStatusSent,
+		ReadBy:         []primitive.ObjectID{senderID},
+		CreatedAt:      createdAt,
+		UpdatedAt:      createdAt,
+	}
+}
+
+func newOutboxEvent(createdAt time.Time, recipients ...primitive.ObjectID) *models.OutboxEvent {
+	return &models.OutboxEvent{
+		ID:         primitive.NewObjectID(),
+		Type:       "message",
+		Recipients: recipients,
+		Payload:    []byte(`{"content":"hello"}`),
+		CreatedAt:  createdAt,
+	}
+}
+
+func newFriendRequest(senderID, recipientID primitive.ObjectID) *models.FriendRequest {
+	return &models.FriendRequest{
+		ID:          primitive.NewObjectID(),
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		PairKey:     models.FriendPairKey(senderID, recipientID),
+		Status:      models.FriendRequestPending,
+		CreatedAt:   baseTime,
+		UpdatedAt:   baseTime,
+	}
+}
+
+func conversationIDs(convs []*models.Conversation) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(convs))
+	for i, conv := range convs {
+		ids[i] = conv.ID
+	}
+	return ids
+}
+
+func messageIDs(msgs []*models.Message) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func outboxEventIDs(events []*models.OutboxEvent) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
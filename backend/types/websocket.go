@@ -2,8 +2,10 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -11,11 +13,20 @@ import (
 
 // WebSocket event types
 const (
-	EventTypeMessage     = "message"
-	EventTypeTyping      = "typing"
-	EventTypeOnline      = "online"
-	EventTypeRead        = "read"
-	EventTypeGroupUpdate = "group_update"
+	EventTypeMessage         = "message"
+	EventTypeMessageEdited   = "message_edited"
+	EventTypeMessageDeleted  = "message_deleted"
+	EventTypeThreadMessage   = "thread_message"
+	EventTypeMessageReaction = "message_reaction"
+	EventTypeMessagePlayed   = "message_played"
+	EventTypeTyping          = "typing"
+	EventTypeOnline          = "online"
+	EventTypeRead            = "read"
+	EventTypeGroupUpdate     = "group_update"
+	EventTypeFriendRequest   = "friend_request"
+	EventTypeFriendUpdate    = "friend_request_update"
+	EventTypeFriendStatus    = "friend_status"
+	EventTypeError           = "error"
 )
 
 // WebSocketMessage represents a message sent over WebSocket
@@ -24,9 +35,41 @@ type WebSocketMessage struct {
 	Payload interface{} `json:"payload"`
 }
 
+// Client is one open WebSocket connection. A user has one client per open tab or device.
+type Client struct {
+	UserID    primitive.ObjectID
+	SessionID primitive.ObjectID // session (token family) of the token the connection was opened with
+	Conn      *websocket.Conn
+
+	// gorilla/websocket supports only one concurrent writer per connection
+	writeMu sync.Mutex
+}
+
+// NewClient wraps a connection opened by userID with a token from sessionID
+func NewClient(userID, sessionID primitive.ObjectID, conn *websocket.Conn) *Client {
+	return &Client{UserID: userID, SessionID: sessionID, Conn: conn}
+}
+
+// WriteMessage writes a message to the connection, serialized with other writes
+func (c *Client) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// Send writes a WebSocket message to this connection only
+func (c *Client) Send(message WebSocketMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, payload)
+}
+
 // WebSocketHandler handles WebSocket connections and messaging
 type WebSocketHandler struct {
-	Clients  map[primitive.ObjectID]*websocket.Conn
+	Clients  map[primitive.ObjectID]map[*Client]bool            // userID -> open connections of the user
 	Typing   map[primitive.ObjectID]map[primitive.ObjectID]bool // userID -> conversationID -> isTyping
 	Mutex    sync.RWMutex
 	Upgrader websocket.Upgrader
@@ -35,7 +78,7 @@ type WebSocketHandler struct {
 // New WebSocketHandler creates a new WebSocket handler
 func NewWebSocketHandler() *WebSocketHandler {
 	return &WebSocketHandler{
-		Clients: make(map[primitive.ObjectID]*websocket.Conn),
+		Clients: make(map[primitive.ObjectID]map[*Client]bool),
 		Typing:  make(map[primitive.ObjectID]map[primitive.ObjectID]bool),
 		Upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
@@ -45,13 +88,60 @@ func NewWebSocketHandler() *WebSocketHandler {
 	}
 }
 
-// SendToUser sends a WebSocket message to a specific user
-func (h *WebSocketHandler) SendToUser(userID primitive.ObjectID, message WebSocketMessage) error {
-	h.Mutex.RLock()
-	conn, ok := h.Clients[userID]
-	h.Mutex.RUnlock()
+// AddClient registers an open connection. It reports whether this is the user's first
+// connection, i.e. whether the user has just come online.
+func (h *WebSocketHandler) AddClient(client *Client) bool {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
 
+	clients, ok := h.Clients[client.UserID]
 	if !ok {
+		clients = make(map[*Client]bool)
+		h.Clients[client.UserID] = clients
+	}
+	clients[client] = true
+	return len(clients) == 1
+}
+
+// RemoveClient closes and unregisters a connection. It reports whether this was the user's
+// last connection, i.e. whether the user has just gone offline. Removing a connection that
+// is already removed reports false, so the heartbeat and the read loop can both call it.
+func (h *WebSocketHandler) RemoveClient(client *Client) bool {
+	client.Conn.Close()
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	clients := h.Clients[client.UserID]
+	if !clients[client] {
+		return false
+	}
+	delete(clients, client)
+	if len(clients) > 0 {
+		return false
+	}
+	delete(h.Clients, client.UserID)
+	delete(h.Typing, client.UserID)
+	return true
+}
+
+// userClients returns a snapshot of the user's open connections
+func (h *WebSocketHandler) userClients(userID primitive.ObjectID) []*Client {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(h.Clients[userID]))
+	for client := range h.Clients[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// SendToUser sends a WebSocket message to every open connection of a specific user.
+// It returns the errors of the connections the message could not be written to.
+func (h *WebSocketHandler) SendToUser(userID primitive.ObjectID, message WebSocketMessage) error {
+	clients := h.userClients(userID)
+	if len(clients) == 0 {
 		return nil // User not online
 	}
 
@@ -60,5 +150,33 @@ func (h *WebSocketHandler) SendToUser(userID primitive.ObjectID, message WebSock
 		return err
 	}
 
-	return conn.WriteMessage(websocket.TextMessage, payload)
+	var errs []error
+	for _, client := range clients {
+		if err := client.WriteMessage(websocket.TextMessage, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CloseSession closes the user's WebSocket connections opened with a token from the given
+// session. Each connection's read loop then unregisters it, and the user is broadcast as
+// offline if no other connection is left.
+func (h *WebSocketHandler) CloseSession(userID, sessionID primitive.ObjectID) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "logged out")
+	for _, client := range h.userClients(userID) {
+		if client.SessionID != sessionID {
+			continue
+		}
+		client.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		client.Conn.Close()
+	}
+}
+
+// IsOnline reports whether the user currently has at least one open WebSocket connection
+func (h *WebSocketHandler) IsOnline(userID primitive.ObjectID) bool {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	return len(h.Clients[userID]) > 0
 }
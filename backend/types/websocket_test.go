@@ -0,0 +1,183 @@
+package types
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// connPair mở một kết nối WebSocket thật và trả về hai đầu của nó: server là đầu được đăng ký
+// trong WebSocketHandler, peer là đầu trình duyệt mà test dùng để đọc
+func connPair(t *testing.T) (server, peer *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(httpServer.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+	return server, peer
+}
+
+func newTestClient(t *testing.T, userID, sessionID primitive.ObjectID) (*Client, *websocket.Conn) {
+	t.Helper()
+	server, peer := connPair(t)
+	return NewClient(userID, sessionID, server), peer
+}
+
+// readType đọc một sự kiện từ peer và trả về loại của nó, hoặc lỗi đọc nếu không có sự kiện nào
+func readType(peer *websocket.Conn, wait time.Duration) (string, error) {
+	peer.SetReadDeadline(time.Now().Add(wait))
+	var message WebSocketMessage
+	if err := peer.ReadJSON(&message); err != nil {
+		return "", err
+	}
+	return message.Type, nil
+}
+
+func TestAddClient(t *testing.T) {
+	h := NewWebSocketHandler()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	session := primitive.NewObjectID()
+
+	for _, tc := range []struct {
+		name  string
+		user  primitive.ObjectID
+		first bool
+	}{
+		{name: "first connection", user: alice, first: true},
+		{name: "second connection", user: alice, first: false},
+		{name: "third connection", user: alice, first: false},
+		{name: "first connection of another user", user: bob, first: true},
+	} {
+		client, _ := newTestClient(t, tc.user, session)
+		if got := h.AddClient(client); got != tc.first {
+			t.Errorf("%s: AddClient = %v, want %v", tc.name, got, tc.first)
+		}
+		if !h.IsOnline(tc.user) {
+			t.Errorf("%s: user is not online", tc.name)
+		}
+	}
+}
+
+func TestRemoveClient(t *testing.T) {
+	h := NewWebSocketHandler()
+	alice := primitive.NewObjectID()
+	session := primitive.NewObjectID()
+	first, _ := newTestClient(t, alice, session)
+	second, _ := newTestClient(t, alice, session)
+	h.AddClient(first)
+	h.AddClient(second)
+
+	for _, tc := range []struct {
+		name   string
+		client *Client
+		last   bool
+		online bool
+	}{
+		{name: "one of two connections", client: first, last: false, online: true},
+		{name: "same connection again", client: first, last: false, online: true},
+		{name: "last connection", client: second, last: true, online: false},
+		{name: "last connection again", client: second, last: false, online: false},
+	} {
+		if got := h.RemoveClient(tc.client); got != tc.last {
+			t.Errorf("%s: RemoveClient = %v, want %v", tc.name, got, tc.last)
+		}
+		if got := h.IsOnline(alice); got != tc.online {
+			t.Errorf("%s: IsOnline = %v, want %v", tc.name, got, tc.online)
+		}
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	h := NewWebSocketHandler()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	session := primitive.NewObjectID()
+
+	var alicePeers []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		client, peer := newTestClient(t, alice, session)
+		h.AddClient(client)
+		alicePeers = append(alicePeers, peer)
+	}
+	bobClient, bobPeer := newTestClient(t, bob, session)
+	h.AddClient(bobClient)
+
+	if err := h.SendToUser(alice, WebSocketMessage{Type: EventTypeMessage}); err != nil {
+		t.Fatalf("SendToUser: %v", err)
+	}
+	for i, peer := range alicePeers {
+		if got, err := readType(peer, time.Second); err != nil || got != EventTypeMessage {
+			t.Errorf("connection %d: got %q, %v; want %q", i, got, err, EventTypeMessage)
+		}
+	}
+	if got, err := readType(bobPeer, 100*time.Millisecond); err == nil {
+		t.Errorf("other user got %q", got)
+	}
+
+	if err := h.SendToUser(primitive.NewObjectID(), WebSocketMessage{Type: EventTypeMessage}); err != nil {
+		t.Errorf("SendToUser to an offline user: %v", err)
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	h := NewWebSocketHandler()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	revoked, kept := primitive.NewObjectID(), primitive.NewObjectID()
+
+	type conn struct {
+		name    string
+		user    primitive.ObjectID
+		session primitive.ObjectID
+		closed  bool
+	}
+	conns := []conn{
+		{name: "revoked session", user: alice, session: revoked, closed: true},
+		{name: "second connection of revoked session", user: alice, session: revoked, closed: true},
+		{name: "other session", user: alice, session: kept, closed: false},
+		{name: "other user with the same session ID", user: bob, session: revoked, closed: false},
+	}
+	peers := make([]*websocket.Conn, len(conns))
+	for i, c := range conns {
+		client, peer := newTestClient(t, c.user, c.session)
+		h.AddClient(client)
+		peers[i] = peer
+	}
+
+	h.CloseSession(alice, revoked)
+	h.SendToUser(alice, WebSocketMessage{Type: EventTypeMessage})
+	h.SendToUser(bob, WebSocketMessage{Type: EventTypeMessage})
+
+	for i, c := range conns {
+		got, err := readType(peers[i], time.Second)
+		if c.closed {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("%s: got %q, %v; want a normal close", c.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != EventTypeMessage {
+			t.Errorf("%s: got %q, %v; want %q", c.name, got, err, EventTypeMessage)
+		}
+	}
+}